@@ -0,0 +1,69 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: auditverify.go
+
+// auditverify checks a simpleserver audit log: the hash chain and the
+// checkpoint signatures.  Build it with "go build auditverify.go".
+package main
+
+import (
+        "crypto/x509"
+        "flag"
+        "fmt"
+        "os"
+
+        certservice "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
+)
+
+var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "cert file name")
+var auditLogFile = flag.String("auditLogFile", "audit.log", "audit log to check")
+var requireClosed = flag.Bool("requireClosed", false, "fail if records after the last checkpoint are unsigned")
+
+func main() {
+        flag.Parse()
+
+        serializedPolicyCert, err := os.ReadFile(*policyCertFile)
+        if err != nil {
+                fmt.Printf("auditverify: can't read policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+        policyCert, err := x509.ParseCertificate(serializedPolicyCert)
+        if err != nil {
+                fmt.Printf("auditverify: can't parse policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+        f, err := os.Open(*auditLogFile)
+        if err != nil {
+                fmt.Printf("auditverify: %s\n", err.Error())
+                os.Exit(2)
+        }
+        defer f.Close()
+
+        summary, err := certservice.VerifyAuditLog(f, policyCert)
+        if err != nil {
+                fmt.Printf("auditverify: %s: FAILED after %d good records: %s\n", *auditLogFile,
+                        summary.Records, err.Error())
+                os.Exit(1)
+        }
+        fmt.Printf("auditverify: %s: %d records, %d checkpoints\n", *auditLogFile,
+                summary.Records, summary.Checkpoints)
+        if summary.Unsigned > 0 {
+                fmt.Printf("auditverify: the last %d records are after the last checkpoint, the log may have been cut off there\n",
+                        summary.Unsigned)
+                if *requireClosed {
+                        os.Exit(1)
+                }
+        }
+}
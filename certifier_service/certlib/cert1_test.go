@@ -16,6 +16,7 @@ package certlib
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/elliptic"
 	"crypto/ecdsa"
@@ -23,14 +24,19 @@ import (
 	"crypto/sha512"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/big"
         "net"
 	"os"
-        "syscall"
+	"strings"
 	"time"
 	"testing"
 
@@ -110,6 +116,268 @@ func TestDominance(t *testing.T) {
 	}
 }
 
+func TestBuildDominance(t *testing.T) {
+	fmt.Print("\nTestBuildDominance\n")
+
+	declared := []byte(`
+is-trusted dominates is-trusted-for-key-provisioning
+is-trusted-for-key-provisioning dominates is-trusted-for-secret-release
+
+is-trusted-for-attestation dominates is-trusted-for-secret-release
+`)
+	edges, err := ParseDominance(declared)
+	if err != nil {
+		t.Fatalf("Can't parse declarations: %s", err.Error())
+	}
+	again, err := ParseDominance(SerializeDominance(edges))
+	if err != nil || len(again) != 3 || again[2] != edges[2] {
+		t.Error("Serialized declarations don't parse back")
+	}
+	tree, err := BuildDominance(edges)
+	if err != nil {
+		t.Fatalf("BuildDominance fails: %s", err.Error())
+	}
+	PrintDominanceTree(0, tree)
+	dominates := [][2]string{
+		{"is-trusted", "is-trusted-for-authentication"},
+		{"is-trusted", "is-trusted-for-secret-release"},
+		{"is-trusted-for-key-provisioning", "is-trusted-for-secret-release"},
+		{"is-trusted-for-attestation", "is-trusted-for-secret-release"},
+	}
+	for _, d := range dominates {
+		if !Dominates(tree, d[0], d[1]) {
+			t.Errorf("%s doesn't dominate %s", d[0], d[1])
+		}
+	}
+	if Dominates(tree, "is-trusted-for-key-provisioning", "is-trusted-for-attestation") ||
+			Dominates(tree, "is-trusted-for-secret-release", "is-trusted-for-attestation") {
+		t.Error("Dominates more than declared")
+	}
+
+	bad := []string{
+		"is-trusted dominates",
+		"is-trusted dominates says",
+		"is-trusted-for-a dominates is-trusted-for-b",
+		"is-trusted dominates is-trusted-for-a\nis-trusted-for-a dominates is-trusted-for-b\n" +
+			"is-trusted-for-b dominates is-trusted-for-a",
+		"is-trusted-for-attestation dominates is-trusted",
+		"is-trusted-for-a dominates is-trusted-for-a",
+	}
+	for _, b := range bad {
+		edges, err := ParseDominance([]byte(b))
+		if err == nil {
+			_, err = BuildDominance(edges)
+		}
+		if err == nil {
+			t.Errorf("Accepted %q", b)
+		} else {
+			fmt.Printf("%q: %s\n", b, err.Error())
+		}
+	}
+
+	// R5 and R6 use the lattice.
+	keyEntity := func(name string) *certprotos.EntityMessage {
+		k := MakeVseRsaKey(2048)
+		k.KeyName = &name
+		return MakeKeyEntity(InternalPublicFromPrivateKey(k))
+	}
+	key1 := keyEntity("key1")
+	key2 := keyEntity("key2")
+	m := MakeMeasurementEntity(make([]byte, 32))
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	verbProvisioning := "is-trusted-for-key-provisioning"
+	verbRelease := "is-trusted-for-secret-release"
+	builtin := &PredicateDominance{}
+	if !InitDominance(builtin) {
+		t.Fatal("Can't init dominance tree")
+	}
+	provisioner := MakeUnaryVseClause(key1, &verbProvisioning)
+	release := MakeUnaryVseClause(key2, &verbRelease)
+	if !VerifyRule5(tree, provisioner, MakeIndirectVseClause(key1, &verbSays, release), release) {
+		t.Error("R5 rejects a declared predicate")
+	}
+	if VerifyRule5(builtin, provisioner, MakeIndirectVseClause(key1, &verbSays, release), release) {
+		t.Error("R5 accepts an undeclared predicate")
+	}
+	speaksFor := MakeSimpleVseClause(key2, &verbSpeaksFor, m)
+	if VerifyRule6(tree, provisioner, MakeIndirectVseClause(key1, &verbSays, speaksFor), speaksFor) {
+		t.Error("R6 accepts a predicate that doesn't dominate is-trusted-for-attestation")
+	}
+}
+
+func TestDeclaredRules(t *testing.T) {
+	fmt.Print("\nTestDeclaredRules\n")
+
+	rules, err := InitCerifierRules(&certprotos.CertifierRules{
+		Rule: []string{
+			"if A is-trusted-for-attestation and A says K speaks-for M then K is-trusted-for-authentication",
+			"if K says K is-trusted then K is-trusted",
+		},
+	})
+	if err != nil {
+		t.Fatalf("InitCerifierRules fails: %s", err.Error())
+	}
+	for _, bad := range []string{
+		"A is-trusted then A is-trusted",
+		"if A is-trusted",
+		"if A is-trusted then B is-trusted",
+		"if A is-trusted and B is-trusted and C is-trusted then D speaks-for B",
+		"if Measurement[xyz] is-trusted then A is-trusted",
+		"if key1 is-trusted then key1 is-trusted",
+		"if A partial-rule-0-2 B then A is-trusted",
+		"if a is-trusted then a is-trusted",
+		"if A is-trusted B C then A is-trusted",
+		"if A says then A is-trusted",
+	} {
+		if _, err := ParseRule(bad); err == nil {
+			t.Errorf("Parsed %q", bad)
+		}
+	}
+	_, err = ParseRule("if M is-trusted and K speaks-for M on P then K is-trusted-for-authentication")
+	if !errors.Is(err, ErrRuleQualifier) {
+		t.Errorf("Qualifier not refused: %v", err)
+	}
+
+	keyEntity := func(name string) *certprotos.EntityMessage {
+		k := MakeVseRsaKey(2048)
+		k.KeyName = &name
+		return MakeKeyEntity(InternalPublicFromPrivateKey(k))
+	}
+	policySubj := keyEntity("policyKey")
+	attestSubj := keyEntity("attestKey")
+	enclaveSubj := keyEntity("enclaveKey")
+	m := MakeMeasurementEntity(make([]byte, 32))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	verbSpeaksFor := "speaks-for"
+	verbAtt := "is-trusted-for-attestation"
+	verbAuth := "is-trusted-for-authentication"
+	attestIsTrusted := MakeUnaryVseClause(attestSubj, &verbAtt)
+	attestSays := MakeIndirectVseClause(attestSubj, &verbSays, MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor, m))
+	goal := MakeUnaryVseClause(enclaveSubj, &verbAuth)
+
+	if !VerifyDeclaredRule(rules, attestIsTrusted, attestSays, goal, FirstDeclaredRule) {
+		t.Error("Rule 8 rejects its conclusion")
+	}
+	if VerifyDeclaredRule(rules, attestIsTrusted, attestSays, MakeUnaryVseClause(attestSubj, &verbAuth),
+			FirstDeclaredRule) {
+		t.Error("Rule 8 accepts the wrong conclusion")
+	}
+	if VerifyDeclaredRule(rules, MakeUnaryVseClause(policySubj, &verbAtt), attestSays, goal, FirstDeclaredRule) {
+		t.Error("Rule 8 binds A to two keys")
+	}
+	if VerifyDeclaredRule(rules, attestIsTrusted, attestSays, goal, FirstDeclaredRule + 2) {
+		t.Error("Undeclared rule accepted")
+	}
+	selfTrust := MakeIndirectVseClause(attestSubj, &verbSays, MakeUnaryVseClause(attestSubj, &verbIs))
+	if !VerifyDeclaredRule(rules, selfTrust, selfTrust, MakeUnaryVseClause(attestSubj, &verbIs),
+			FirstDeclaredRule + 1) {
+		t.Error("Rule 9 rejects its conclusion")
+	}
+
+	// The prover uses declared rules, and only CheckProofWithRules
+	// accepts its proof.
+	tree := &PredicateDominance{}
+	if !InitDominance(tree) {
+		t.Fatal("Can't init dominance tree")
+	}
+	ps := &certprotos.ProvedStatements{}
+	ps.Proved = append(ps.Proved,
+		MakeUnaryVseClause(policySubj, &verbIs),
+		MakeIndirectVseClause(policySubj, &verbSays, attestIsTrusted),
+		attestSays)
+	if toProve, _, _ := NewProver(tree, ps).Prove(context.Background(), []*certprotos.VseClause{goal}); toProve != nil {
+		t.Fatal("Proved without the declared rule")
+	}
+	toProve, proof, _ := NewProverWithRules(tree, rules, ps).Prove(context.Background(), []*certprotos.VseClause{goal})
+	if toProve == nil {
+		t.Fatal("Can't prove with the declared rule")
+	}
+	last := proof.Steps[len(proof.Steps) - 1]
+	if last.GetRuleApplied() != FirstDeclaredRule {
+		t.Errorf("Last step by rule %d, want %d", last.GetRuleApplied(), FirstDeclaredRule)
+	}
+	check := &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, ps.Proved...)}
+	if err := CheckProofWithRules(context.Background(), tree, rules, policySubj.Key, goal, proof, check); err != nil {
+		t.Errorf("Proof doesn't verify: %s", err.Error())
+	}
+	check = &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, ps.Proved...)}
+	if CheckProof(policySubj.Key, goal, proof, check) == nil {
+		t.Error("Proof verifies without the declared rule")
+	}
+
+	// A rule with three premises, one a constant, takes two steps.  R6
+	// can't make an authentication key's word about M count.
+	mHex := hex.EncodeToString(m.GetMeasurement())
+	rules, err = InitCerifierRules(&certprotos.CertifierRules{
+		Rule: []string{
+			"if M is-trusted and A is-trusted-for-authentication and A says K speaks-for M then K is-trusted-for-authentication",
+			"if A is-trusted-for-authentication and A says K speaks-for Measurement[" + mHex +
+				"] and Measurement[" + mHex + "] is-trusted then K is-trusted-for-authentication",
+		},
+	})
+	if err != nil {
+		t.Fatalf("InitCerifierRules fails: %s", err.Error())
+	}
+	mIsTrusted := MakeUnaryVseClause(m, &verbIs)
+	attestIsAuth := MakeUnaryVseClause(attestSubj, &verbAuth)
+	partial := rules[0].Conclude(mIsTrusted, attestIsAuth)
+	if partial == nil {
+		t.Fatal("Rule 8 doesn't match its first two premises")
+	}
+	if rules[0].Conclude(mIsTrusted, attestSays) != nil {
+		t.Error("Rule 8 matches premises out of order")
+	}
+	if !VerifyDeclaredRule(rules, partial, attestSays, goal, FirstDeclaredRule) {
+		t.Error("Rule 8 rejects its conclusion")
+	}
+	if VerifyDeclaredRule(rules, partial, attestSays, goal, FirstDeclaredRule + 1) {
+		t.Error("Rule 9 accepts rule 8's partial clause")
+	}
+	otherAttestSays := MakeIndirectVseClause(policySubj, &verbSays, MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor, m))
+	if VerifyDeclaredRule(rules, partial, otherAttestSays, goal, FirstDeclaredRule) {
+		t.Error("Rule 8 forgets A")
+	}
+	m2 := MakeMeasurementEntity([]byte{1, 2, 3})
+	if rules[1].Conclude(attestIsAuth, MakeIndirectVseClause(attestSubj, &verbSays,
+			MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor, m2))) != nil {
+		t.Error("Rule 9 matches another measurement")
+	}
+	ps = &certprotos.ProvedStatements{}
+	ps.Proved = append(ps.Proved,
+		MakeUnaryVseClause(policySubj, &verbIs),
+		MakeIndirectVseClause(policySubj, &verbSays, attestIsAuth),
+		MakeIndirectVseClause(policySubj, &verbSays, mIsTrusted),
+		attestSays)
+	if toProve, _, _ := NewProver(tree, ps).Prove(context.Background(), []*certprotos.VseClause{goal}); toProve != nil {
+		t.Fatal("Proved without the declared rules")
+	}
+	for _, r := range rules {
+		// Alone, each is rule 8.
+		only := []*DeclaredRule{r}
+		toProve, proof, _ = NewProverWithRules(tree, only, ps).Prove(context.Background(),
+			[]*certprotos.VseClause{goal})
+		if toProve == nil {
+			t.Fatalf("Can't prove with %q", r.Text)
+		}
+		n := 0
+		for _, step := range proof.Steps {
+			if step.GetRuleApplied() == FirstDeclaredRule {
+				n++
+			}
+		}
+		if n != 2 {
+			t.Errorf("%d steps by the declared rule, want 2", n)
+		}
+		check = &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, ps.Proved...)}
+		err = CheckProofWithRules(context.Background(), tree, only, policySubj.Key, goal, proof, check)
+		if err != nil {
+			t.Errorf("Proof doesn't verify: %s", err.Error())
+		}
+	}
+}
+
 func TestKeys(t *testing.T) {
 	fmt.Print("\nTestKeys\n")
 
@@ -820,6 +1088,94 @@ func TestArtifacts(t *testing.T) {
 	}
 }
 
+func TestServiceTls(t *testing.T) {
+	fmt.Print("\nTestServiceTls\n")
+
+	privatePolicyKey := MakeVseRsaKey(2048)
+	var tpk  string = "policyKey"
+	privatePolicyKey.KeyName = &tpk
+	ipK := rsa.PrivateKey{}
+	iPK := rsa.PublicKey{}
+	if !GetRsaKeysFromInternal(privatePolicyKey, &ipK, &iPK) {
+		t.Fatal("Can't get policy key")
+	}
+	sn := big.Int{}
+	sn.SetInt64(int64(1))
+	policyCertTemplate := x509.Certificate{
+		SerialNumber: &sn,
+		Subject: pkix.Name{
+			CommonName:   "policyKey",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365*86400*1000000000),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	policyDerCert, err := x509.CreateCertificate(rand.Reader, &policyCertTemplate, &policyCertTemplate,
+		&ipK.PublicKey, crypto.Signer(&ipK))
+	if err != nil {
+		t.Fatal("Can't Create policy Certificate")
+	}
+	policyCert, err := x509.ParseCertificate(policyDerCert)
+	if err != nil {
+		t.Fatal("Can't parse policy Certificate")
+	}
+
+	serviceCert, err := ProduceServiceCert(privatePolicyKey, policyCert, "127.0.0.1", 86400.0)
+	if err != nil {
+		t.Fatalf("ProduceServiceCert fails: %s", err.Error())
+	}
+	if !VerifyAdmissionCert(policyCert, serviceCert.Leaf) {
+		t.Error("Service cert does not chain to policy cert")
+	}
+
+	sock, err := tls.Listen("tcp", "127.0.0.1:0", MakeServiceTlsConfig(serviceCert))
+	if err != nil {
+		t.Fatalf("Can't listen: %s", err.Error())
+	}
+	defer sock.Close()
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			b := SizedSocketRead(conn)
+			if b != nil {
+				SizedSocketWrite(conn, b)
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", sock.Addr().String(), MakeServiceClientTlsConfig(policyCert, "127.0.0.1"))
+	if err != nil {
+		t.Fatalf("Can't dial service: %s", err.Error())
+	}
+	b := make([]byte, 70000)
+	for i := 0; i < len(b); i++ {
+		b[i] = byte(i)
+	}
+	if !SizedSocketWrite(conn, b) {
+		t.Error("SizedSocketWrite fails")
+	}
+	nb := SizedSocketRead(conn)
+	if !bytes.Equal(b, nb) {
+		t.Error("Sized read over TLS fails")
+	}
+	conn.Close()
+
+	// A client that doesn't have the policy cert as root must not connect
+	otherPool := x509.NewCertPool()
+	var netConn net.Conn
+	netConn, err = tls.Dial("tcp", sock.Addr().String(), &tls.Config{RootCAs: otherPool, ServerName: "127.0.0.1"})
+	if err == nil {
+		netConn.Close()
+		t.Error("Client accepted service cert without the policy root")
+	}
+}
+
 type MyInterface interface {
 	Func1(i int) int
 	Func2(i int) string
@@ -1074,3 +1430,341 @@ func TestSevSignatures(t *testing.T) {
 	return
 }
 */
+
+// referenceMerkleRoot is MTH from RFC 6962, computed directly.
+func referenceMerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := largestPowerOfTwoBelow(int64(len(leaves)))
+	return merkleNodeHash(referenceMerkleRoot(leaves[:k]), referenceMerkleRoot(leaves[k:]))
+}
+
+func TestMerkle(t *testing.T) {
+	fmt.Print("\nTestMerkle\n")
+
+	const n = 37
+	var tree MerkleTree
+	var leaves [][]byte
+	roots := [][]byte{referenceMerkleRoot(nil)}
+	for i := 0; i < n; i++ {
+		h := MerkleLeafHash([]byte(fmt.Sprintf("artifact %d", i)))
+		leaves = append(leaves, h)
+		if tree.AppendLeaf(h) != int64(i) {
+			t.Fatal("Wrong leaf index")
+		}
+		roots = append(roots, referenceMerkleRoot(leaves))
+	}
+	for size := int64(0); size <= n; size++ {
+		root, err := tree.Root(size)
+		if err != nil || !bytes.Equal(root, roots[size]) {
+			t.Fatalf("Wrong root for size %d", size)
+		}
+	}
+
+	for size := int64(1); size <= n; size++ {
+		for i := int64(0); i < size; i++ {
+			path, err := tree.InclusionProof(i, size)
+			if err != nil || !VerifyInclusionProof(leaves[i], i, size, path, roots[size]) {
+				t.Fatalf("Inclusion proof for %d in %d doesn't verify", i, size)
+			}
+			if VerifyInclusionProof(leaves[(i + 1) % size], i, size, path, roots[size]) && size > 1 {
+				t.Fatalf("Inclusion proof for %d in %d verifies another leaf", i, size)
+			}
+			if len(path) > 0 {
+				path[0] = leaves[i]
+				if VerifyInclusionProof(leaves[i], i, size, path, roots[size]) {
+					t.Fatalf("Bad inclusion proof for %d in %d verifies", i, size)
+				}
+			}
+		}
+	}
+
+	for second := int64(0); second <= n; second++ {
+		for first := int64(0); first <= second; first++ {
+			path, err := tree.ConsistencyProof(first, second)
+			if err != nil || !VerifyConsistencyProof(first, second, path, roots[first], roots[second]) {
+				t.Fatalf("Consistency proof for %d, %d doesn't verify", first, second)
+			}
+			if first > 0 && first < second {
+				if VerifyConsistencyProof(first, second, path, roots[first - 1], roots[second]) {
+					t.Fatalf("Consistency proof for %d, %d verifies the wrong root", first, second)
+				}
+			}
+		}
+	}
+	if _, err := tree.InclusionProof(n, n); err == nil {
+		t.Error("Inclusion proof for a leaf past the end")
+	}
+	if _, err := tree.ConsistencyProof(2, n + 1); err == nil {
+		t.Error("Consistency proof with a tree larger than the log")
+	}
+}
+
+func TestLogging(t *testing.T) {
+	fmt.Print("\nTestLogging\n")
+
+	if Logger().Enabled(context.Background(), slog.LevelError) {
+		t.Error("The default logger isn't quiet")
+	}
+	if l, err := ParseLogLevel("warn"); err != nil || l != slog.LevelWarn {
+		t.Error("Can't parse warn")
+	}
+	if _, err := ParseLogLevel("chatty"); err == nil {
+		t.Error("Parsed a bad level")
+	}
+
+	var buf bytes.Buffer
+	SetLogger(NewLogger(&buf, slog.LevelInfo, true))
+	defer SetLogger(nil)
+	Logger().Debug("dropped")
+	if buf.Len() != 0 {
+		t.Error("Debug record written at info level")
+	}
+
+	k := MakeVseRsaKey(2048)
+	secret := k.RsaKey.PrivateExponent
+	Logger().Info("key", Key("key", k), "report", Sensitive(secret))
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("Log record isn't JSON: %s", err.Error())
+	}
+	if strings.Contains(buf.String(), hex.EncodeToString(secret)) {
+		t.Error("Private key logged")
+	}
+	report, ok := rec["report"].(map[string]interface{})
+	if !ok || report["len"] != float64(len(secret)) || report["sha256"] == nil {
+		t.Errorf("Sensitive value not redacted: %v", rec["report"])
+	}
+
+	buf.Reset()
+	SetLogSensitive(true)
+	defer SetLogSensitive(false)
+	Logger().Info("key", "report", Sensitive(secret))
+	if !strings.Contains(buf.String(), hex.EncodeToString(secret)) {
+		t.Error("Sensitive value not logged with SetLogSensitive")
+	}
+}
+
+func TestProver(t *testing.T) {
+	fmt.Print("\nTestProver\n")
+
+	keyEntity := func(name string) *certprotos.EntityMessage {
+		k := MakeVseRsaKey(2048)
+		k.KeyName = &name
+		return MakeKeyEntity(InternalPublicFromPrivateKey(k))
+	}
+	policySubj := keyEntity("policyKey")
+	platformSubj := keyEntity("platformKey")
+	attest1Subj := keyEntity("attestKey1")
+	attest2Subj := keyEntity("attestKey2")
+	enclaveSubj := keyEntity("enclaveKey")
+	otherSubj := keyEntity("otherKey")
+	m := make([]byte, 32)
+	measurementSubj := MakeMeasurementEntity(m)
+
+	verbIs := "is-trusted"
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	verbAuth := "is-trusted-for-authentication"
+	verbAtt := "is-trusted-for-attestation"
+	says := func(k *certprotos.EntityMessage, c *certprotos.VseClause) *certprotos.VseClause {
+		return MakeIndirectVseClause(k, &verbSays, c)
+	}
+	attestedBy := func(k1 *certprotos.EntityMessage, k2 *certprotos.EntityMessage) *certprotos.VseClause {
+		return says(k1, MakeUnaryVseClause(k2, &verbAtt))
+	}
+
+	// A longer chain than any evidence type has, out of order, and a
+	// statement that plays no part.
+	ps := &certprotos.ProvedStatements{}
+	ps.Proved = append(ps.Proved,
+		says(attest2Subj, MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor, measurementSubj)),
+		attestedBy(attest1Subj, attest2Subj),
+		says(otherSubj, MakeUnaryVseClause(otherSubj, &verbAuth)),
+		says(policySubj, MakeUnaryVseClause(measurementSubj, &verbIs)),
+		attestedBy(platformSubj, attest1Subj),
+		MakeUnaryVseClause(policySubj, &verbIs),
+		attestedBy(policySubj, platformSubj))
+	proved := len(ps.Proved)
+
+	tree := &PredicateDominance{}
+	if !InitDominance(tree) {
+		t.Fatal("Can't init dominance tree")
+	}
+	for _, verb := range []string{verbAuth, verbAtt} {
+		goal := MakeUnaryVseClause(enclaveSubj, &verb)
+		toProve, proof, _ := NewProver(tree, ps).Prove(context.Background(), []*certprotos.VseClause{goal})
+		if toProve == nil || !SameVseClause(toProve, goal) {
+			t.Fatalf("Can't prove %s", VseClauseToString(goal))
+		}
+		if len(ps.Proved) != proved {
+			t.Error("Prover changed the proved statements")
+		}
+		if len(proof.Steps) != 6 {
+			t.Errorf("%d steps, want 6", len(proof.Steps))
+		}
+		for _, step := range proof.Steps {
+			if SameEntity(step.S2.Subject, otherSubj) {
+				t.Error("Proof uses a statement it doesn't need")
+			}
+		}
+		check := &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, ps.Proved...)}
+		if err := CheckProof(policySubj.Key, goal, proof, check); err != nil {
+			t.Errorf("Proof of %s doesn't verify: %s", verb, err.Error())
+		}
+	}
+
+	// Without the middle of the chain there is no proof.
+	broken := &certprotos.ProvedStatements{}
+	for i, c := range ps.Proved {
+		if i != 4 {
+			broken.Proved = append(broken.Proved, c)
+		}
+	}
+	pr := NewProver(tree, broken)
+	toProve, _, _ := pr.Prove(context.Background(), []*certprotos.VseClause{MakeUnaryVseClause(enclaveSubj, &verbAuth)})
+	if toProve != nil {
+		t.Error("Proved without the platform key's statement")
+	}
+	if !pr.Proved(MakeUnaryVseClause(measurementSubj, &verbIs)) ||
+			pr.Proved(MakeUnaryVseClause(attest1Subj, &verbAtt)) {
+		t.Error("Prover derived the wrong statements")
+	}
+
+	// A key the policy names by another name is the same key.
+	renamed := proto.Clone(enclaveSubj).(*certprotos.EntityMessage)
+	other := "renamed"
+	renamed.Key.KeyName = &other
+	if !pr.Proved(says(attest2Subj, MakeSimpleVseClause(renamed, &verbSpeaksFor, measurementSubj))) {
+		t.Error("Statement about a renamed key not found")
+	}
+
+	// The search stops when its context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := NewProver(tree, ps).Prove(ctx, []*certprotos.VseClause{MakeUnaryVseClause(enclaveSubj, &verbAuth)})
+	if err != context.Canceled {
+		t.Errorf("Prove with a canceled context: %v", err)
+	}
+
+	// and when it derives too many statements.
+	big := &certprotos.ProvedStatements{}
+	big.Proved = append(big.Proved, MakeUnaryVseClause(policySubj, &verbIs))
+	for i := 0; i < MaxProverStatements / 2 + 1; i++ {
+		mi := make([]byte, 32)
+		mi[0], mi[1] = byte(i), byte(i >> 8)
+		big.Proved = append(big.Proved, says(policySubj, MakeUnaryVseClause(MakeMeasurementEntity(mi), &verbIs)))
+	}
+	_, _, err = NewProver(tree, big).Prove(context.Background(),
+		[]*certprotos.VseClause{MakeUnaryVseClause(enclaveSubj, &verbAuth)})
+	if err != ErrTooManyStatements {
+		t.Errorf("Prove derives more than MaxProverStatements: %v", err)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	fmt.Print("\nTestDelegation\n")
+
+	keyEntity := func(name string) *certprotos.EntityMessage {
+		k := MakeVseRsaKey(2048)
+		k.KeyName = &name
+		return MakeKeyEntity(InternalPublicFromPrivateKey(k))
+	}
+	key1 := keyEntity("key1")
+	key2 := keyEntity("key2")
+	key3 := keyEntity("key3")
+	m := MakeMeasurementEntity(make([]byte, 32))
+
+	verbIs := "is-trusted"
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	verbAuth := "is-trusted-for-authentication"
+	speaksFor := func(a *certprotos.EntityMessage, b *certprotos.EntityMessage) *certprotos.VseClause {
+		return MakeSimpleVseClause(a, &verbSpeaksFor, b)
+	}
+	tree := &PredicateDominance{}
+	if !InitDominance(tree) {
+		t.Fatal("Can't init dominance tree")
+	}
+
+	// R2
+	if !VerifyRule2(tree, speaksFor(key2, key1), speaksFor(key3, key2), speaksFor(key3, key1)) {
+		t.Error("R2 rejects key3 speaks-for key1")
+	}
+	if !VerifyRule2(tree, speaksFor(key2, m), speaksFor(key3, key2), speaksFor(key3, m)) {
+		t.Error("R2 rejects key3 speaks-for measurement")
+	}
+	if VerifyRule2(tree, speaksFor(key2, key1), speaksFor(key3, key1), speaksFor(key3, key1)) {
+		t.Error("R2 accepts a broken chain")
+	}
+	if VerifyRule2(tree, speaksFor(key2, key1), speaksFor(key3, key2), speaksFor(key1, key3)) {
+		t.Error("R2 accepts the wrong conclusion")
+	}
+
+	// R4
+	verbAtt := "is-trusted-for-attestation"
+	if !VerifyRule4(tree, speaksFor(key2, key1), MakeUnaryVseClause(key1, &verbIs), MakeUnaryVseClause(key2, &verbIs)) {
+		t.Error("R4 rejects key2 is-trusted")
+	}
+	if !VerifyRule4(tree, speaksFor(key2, key1), MakeUnaryVseClause(key1, &verbIs), MakeUnaryVseClause(key2, &verbAuth)) {
+		t.Error("R4 rejects a predicate is-trusted dominates")
+	}
+	if VerifyRule4(tree, speaksFor(key2, key1), MakeUnaryVseClause(key1, &verbAuth),
+			MakeUnaryVseClause(key2, &verbAtt)) {
+		t.Error("R4 accepts a predicate the speaker's doesn't dominate")
+	}
+	if !VerifyRule4(tree, speaksFor(key2, key1), MakeUnaryVseClause(key1, &verbAuth),
+			MakeUnaryVseClause(key2, &verbAuth)) {
+		t.Error("R4 rejects key2 is-trusted-for-authentication")
+	}
+	if VerifyRule4(tree, speaksFor(key2, key1), MakeUnaryVseClause(key1, &verbAuth),
+			MakeUnaryVseClause(key2, &verbIs)) {
+		t.Error("R4 widens the predicate")
+	}
+	if VerifyRule4(tree, speaksFor(key2, m), MakeUnaryVseClause(m, &verbIs), MakeUnaryVseClause(key2, &verbIs)) {
+		t.Error("R4 makes a key that speaks for a measurement is-trusted")
+	}
+
+	// R6 hand-off
+	key1SaysKey2SpeaksForKey1 := MakeIndirectVseClause(key1, &verbSays, speaksFor(key2, key1))
+	if !VerifyRule6(tree, MakeUnaryVseClause(key1, &verbAuth), key1SaysKey2SpeaksForKey1, speaksFor(key2, key1)) {
+		t.Error("R6 rejects a hand-off")
+	}
+	if VerifyRule6(tree, MakeUnaryVseClause(key1, &verbAuth), MakeIndirectVseClause(key1, &verbSays,
+			speaksFor(key2, key3)), speaksFor(key2, key3)) {
+		t.Error("R6 hands off another key's trust")
+	}
+	if !VerifyRule6(tree, MakeUnaryVseClause(key1, &verbIs), key1SaysKey2SpeaksForKey1, speaksFor(key2, key1)) {
+		t.Error("R6 rejects a hand-off by an is-trusted key")
+	}
+
+	// The prover uses them: key1, trusted by the policy key, hands off to
+	// key2, which hands off to key3.
+	policyKey := keyEntity("policyKey")
+	ps := &certprotos.ProvedStatements{}
+	ps.Proved = append(ps.Proved,
+		MakeUnaryVseClause(policyKey, &verbIs),
+		MakeIndirectVseClause(policyKey, &verbSays, MakeUnaryVseClause(key1, &verbAuth)),
+		MakeIndirectVseClause(key2, &verbSays, speaksFor(key3, key2)),
+		key1SaysKey2SpeaksForKey1)
+	goal := MakeUnaryVseClause(key3, &verbAuth)
+	toProve, proof, _ := NewProver(tree, ps).Prove(context.Background(), []*certprotos.VseClause{goal})
+	if toProve == nil {
+		t.Fatal("Can't prove key3 is-trusted-for-authentication")
+	}
+	rules := map[int32]bool{}
+	for _, step := range proof.Steps {
+		rules[step.GetRuleApplied()] = true
+	}
+	if !rules[4] {
+		t.Errorf("Proof doesn't use R4: %v", rules)
+	}
+	if err := CheckProof(policyKey.Key, goal, proof, ps); err != nil {
+		t.Errorf("Proof doesn't verify: %s", err.Error())
+	}
+}
@@ -16,9 +16,9 @@ package certlib
 
 import (
 	"bytes"
+	"context"
 	"encoding/asn1"
 	"fmt"
-	// "io"
 	"math/big"
 	"crypto"
 	"crypto/aes"
@@ -30,14 +30,18 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"errors"
+	"io"
 	"net"
-	"os"
 	"strings"
 	"time"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/proto"
 	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
 	oeverify "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/oeverify"
@@ -80,7 +84,6 @@ func FindNode(node *PredicateDominance, pred string) *PredicateDominance {
 		if ret !=  nil {
 			return ret
 		}
-		n = n.Next
 	}
 	return nil
 }
@@ -164,8 +167,12 @@ func TimePointToString(tp *certprotos.TimePoint) string {
 }
 
 func TimePointNow() *certprotos.TimePoint {
+	return TimePointFromTime(time.Now())
+}
+
+// TimePointFromTime converts t, in the same zone as TimePointNow.
+func TimePointFromTime(t time.Time) *certprotos.TimePoint {
 	// func Date(year int, month Month, day, hour, min, sec, nsec int, loc *Location) Time
-	t := time.Now()
 	y := int32(t.Year())
 	mo := int32(t.Month())
 	d := int32(t.Day())
@@ -325,19 +332,19 @@ func SamePoint(p1 *certprotos.PointMessage, p2 *certprotos.PointMessage) bool {
 
 func GetEccKeysFromInternal(k *certprotos.KeyMessage) (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
 	if  k == nil || k.EccKey == nil {
-		fmt.Printf("GetEccKeysFromInternal: no ecc key\n")
+		Logger().Debug("GetEccKeysFromInternal: no ecc key")
 		return nil, nil, errors.New("EccKey")
 	}
 	if k.EccKey.PublicPoint == nil {
-		fmt.Printf("GetEccKeysFromInternal: no public point\n")
+		Logger().Debug("GetEccKeysFromInternal: no public point")
 		return nil, nil, errors.New("EccKey")
 	}
 	if k.EccKey.BasePoint == nil  {
-		fmt.Printf("GetEccKeysFromInternal: no base\n")
+		Logger().Debug("GetEccKeysFromInternal: no base")
 		return nil, nil, errors.New("no base point")
 	}
 	if k.GetKeyType() != "ecc-384-public" && k.GetKeyType() != "ecc-384-private" {
-		fmt.Printf("GetEccKeysFromInternal: Wrong key type %s\n", k.GetKeyType())
+		Logger().Debug("GetEccKeysFromInternal: wrong key type", "key_type", k.GetKeyType())
 		return nil, nil, errors.New("no public point")
 	}
 
@@ -368,7 +375,7 @@ func GetInternalKeyFromEccPublicKey(name string, PK *ecdsa.PublicKey, km *certpr
 	format := "vse-key"
 	km.KeyFormat = &format
 	if PK.Curve == nil {
-		fmt.Printf("No curve\n")
+		Logger().Debug("GetInternalKeyFromEccPublicKey: no curve")
 		return false
 	}
 	p := PK.Curve.Params()
@@ -538,7 +545,6 @@ func RsaSha256Verify(r *rsa.PublicKey, in []byte, sig []byte) bool {
 func RsaSha256Sign(r *rsa.PrivateKey, in []byte) []byte {
 	rng := rand.Reader
 	hashed := sha256.Sum256(in)
-	PrintBytes(hashed[0:32])
 	signature, err := rsa.SignPKCS1v15(rng, r, crypto.SHA256, hashed[0:32])
 	if err != nil {
 		return nil
@@ -641,7 +647,6 @@ func AuthenticatedDecrypt(in []byte, key []byte) []byte {
 	// check hmac and decrypt
 	mac := hmac.New(sha256.New, key[32:])
 	n:= len(in) - 32
-	fmt.Printf("n= %d\n", n)
 	_, _ = mac.Write(in[0:n])
 	computedMac := mac.Sum(nil)
 	if !bytes.Equal(in[n:], computedMac) {
@@ -946,6 +951,93 @@ func PrintVseClause(c *certprotos.VseClause) {
 	return
 }
 
+// The ...ToString functions give the same descriptions as the Print
+// functions, for reports and logs.
+
+func KeyDescriptorToString(k *certprotos.KeyMessage) string {
+	s := ""
+	if k.GetKeyType() == "rsa-2048-private" || k.GetKeyType() == "rsa-2048-public" ||
+		k.GetKeyType() == "rsa-4096-private" || k.GetKeyType() == "rsa-4096-public" ||
+		k.GetKeyType() == "rsa-1024-private" || k.GetKeyType() == "rsa-1024-public" {
+		s += "Key[rsa, "
+		if k.GetKeyName() != "" {
+			s += k.GetKeyName() + ", "
+		}
+		m := k.GetRsaKey().GetPublicModulus()
+		if len(m) > 20 {
+			m = m[0:20]
+		}
+		s += hex.EncodeToString(m) + "]"
+	}
+	if k.GetKeyType() == "ecc-384-private" || k.GetKeyType() == "ecc-384-public" {
+		if k.GetEccKey() == nil {
+			return "Key[ecc] Bad key"
+		}
+		s += "Key[ecc-" + k.GetEccKey().GetCurveName() + ", "
+		if k.GetKeyName() != "" {
+			s += k.GetKeyName() + ", "
+		}
+		s += hex.EncodeToString(k.GetEccKey().GetPublicPoint().GetX()) + "]"
+	}
+	return s
+}
+
+// KeyFingerprint is the hex SHA-256 of the PKIX (DER) public key, the
+// same as the fingerprint of the key in an issued cert, or "" if k
+// isn't a usable key.
+func KeyFingerprint(k *certprotos.KeyMessage) string {
+	var pub interface{}
+	if k.GetRsaKey() != nil {
+		PK := rsa.PublicKey{}
+		pK := rsa.PrivateKey{}
+		if !GetRsaKeysFromInternal(k, &pK, &PK) {
+			return ""
+		}
+		pub = &PK
+	} else if k.GetEccKey() != nil {
+		_, PK, err := GetEccKeysFromInternal(k)
+		if err != nil {
+			return ""
+		}
+		pub = PK
+	} else {
+		return ""
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	fp := sha256.Sum256(der)
+	return hex.EncodeToString(fp[:])
+}
+
+func EntityToString(e *certprotos.EntityMessage) string {
+	if e.GetEntityType() == "measurement" {
+		return "Measurement[" + hex.EncodeToString(e.GetMeasurement()) + "]"
+	}
+	if e.GetEntityType() == "key" {
+		return KeyDescriptorToString(e.GetKey())
+	}
+	return ""
+}
+
+func VseClauseToString(c *certprotos.VseClause) string {
+	s := ""
+	if c.GetSubject() != nil {
+		s += EntityToString(c.GetSubject())
+	}
+	if c.GetVerb() != "" {
+		s += " " + c.GetVerb()
+	}
+	if c.GetObject() != nil {
+		s += " " + EntityToString(c.GetObject())
+	}
+	if c.GetClause() != nil {
+		s += " " + VseClauseToString(c.GetClause())
+	}
+	return s
+}
+
 func PrintClaim(c *certprotos.ClaimMessage) {
 	if c.GetClaimFormat() != "" {
 		fmt.Printf("Claim format    : %s\n", c.GetClaimFormat())
@@ -1060,23 +1152,29 @@ func MakeClaim(serialized []byte, format string, desc string, nb string, na stri
 	return &c
 }
 
+// RsaSigningAlgorithm names the signing algorithm for a private key of
+// keyType, "" if it isn't an rsa key.
+func RsaSigningAlgorithm(keyType string) string {
+	if keyType == "rsa-1024-private" {
+		return "rsa-1024-sha256-pkcs-sign"
+	} else if keyType == "rsa-2048-private" {
+		return "rsa-2048-sha256-pkcs-sign"
+	} else if keyType == "rsa-4096-private" {
+		return "rsa-4096-sha384-pkcs-sign"
+	}
+	return ""
+}
+
 func MakeSignedClaim(s *certprotos.ClaimMessage, k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
 	if k.GetKeyType() == "" {
 		return nil
 	}
 	sm := certprotos.SignedClaimMessage {}
-	if k.GetKeyType() == "rsa-1024-private" {
-		var ss string = "rsa-1024-sha256-pkcs-sign"
-		sm.SigningAlgorithm =  &ss
-	} else if k.GetKeyType() == "rsa-2048-private" {
-		var ss string = "rsa-2048-sha256-pkcs-sign"
-		sm.SigningAlgorithm =  &ss
-	} else if k.GetKeyType() == "rsa-4096-private" {
-		var ss string = "rsa-4096-sha384-pkcs-sign"
-		sm.SigningAlgorithm =  &ss
-	} else {
+	ss := RsaSigningAlgorithm(k.GetKeyType())
+	if ss == "" {
 		return nil
 	}
+	sm.SigningAlgorithm =  &ss
 
 	psk :=  InternalPublicFromPrivateKey(k)
 	sm.SigningKey = psk
@@ -1100,64 +1198,132 @@ func MakeSignedClaim(s *certprotos.ClaimMessage, k *certprotos.KeyMessage) *cert
 	return &sm
 }
 
-func VerifySignedClaim(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessage) bool {
+// TrustError says why evidence or a proof was rejected.  Detail is
+// meant for the enclave operator, Code for programs.
+type TrustError struct {
+	Code certprotos.TrustErrorCode
+	Detail string
+}
+
+func (e *TrustError) Error() string {
+	return e.Detail
+}
+
+func NewTrustError(code certprotos.TrustErrorCode, format string, a ...interface{}) *TrustError {
+	return &TrustError{
+		Code: code,
+		Detail: fmt.Sprintf(format, a...),
+	}
+}
+
+// TrustErrorCode is the code of err if it is a TrustError,
+// TRUST_ERROR_INTERNAL otherwise.
+func TrustErrorCode(err error) certprotos.TrustErrorCode {
+	var te *TrustError
+	if errors.As(err, &te) {
+		return te.Code
+	}
+	return certprotos.TrustErrorCode_TRUST_ERROR_INTERNAL
+}
+
+// CheckSignedClaim is VerifySignedClaim saying why the claim was rejected.
+func CheckSignedClaim(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessage) error {
+	return CheckSignedClaimAt(c, k, time.Now())
+}
+
+// CheckSignedClaimAt is CheckSignedClaim for a claim that must be valid
+// at time at rather than now.
+func CheckSignedClaimAt(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessage, at time.Time) error {
 	PK := rsa.PublicKey{}
 	pK := rsa.PrivateKey{}
 	if GetRsaKeysFromInternal(k, &pK, &PK) == false {
-		fmt.Printf("VerifySignedClaim: error 1\n")
-		return false
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"claim signing key is not a usable rsa key")
 	}
 
 	cm := certprotos.ClaimMessage{}
 	err := proto.Unmarshal(c.SerializedClaimMessage, &cm)
 	if err != nil {
-		fmt.Printf("VerifySignedClaim: error 2\n")
-		return false
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"can't parse claim: %v", err)
 	}
 
-	if cm.GetClaimFormat() != "vse-clause" && cm.GetClaimFormat() != "vse-attestation" {
-		fmt.Printf("VerifySignedClaim: error 3\n")
-		return false
+	if cm.GetClaimFormat() != "vse-clause" && cm.GetClaimFormat() != "vse-attestation" &&
+			cm.GetClaimFormat() != DominanceClaimFormat && cm.GetClaimFormat() != RulesClaimFormat {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"unknown claim format %s", cm.GetClaimFormat())
 	}
 
-	tn := TimePointNow()
+	tn := TimePointFromTime(at.Local())
 	tb := StringToTimePoint(cm.GetNotBefore())
 	ta := StringToTimePoint(cm.GetNotAfter())
 	if ta != nil && tb != nil {
 		if CompareTimePoints(tb, tn) > 0 || CompareTimePoints(ta, tn) < 0 {
-			fmt.Printf("VerifySignedClaim: error 4\n")
-			return false
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_EXPIRED,
+				"claim \"%s\" is valid from %s to %s", cm.GetClaimDescriptor(),
+				cm.GetNotBefore(), cm.GetNotAfter())
 		}
 	}
 
 	// I remover the following hack:
 	// || FakeRsaSha256Verify(&PK, c.GetSerializedClaimMessage(), c.GetSignature()) {
-	if RsaSha256Verify(&PK, c.GetSerializedClaimMessage(), c.GetSignature()) {
-		return true
+	if !RsaSha256Verify(&PK, c.GetSerializedClaimMessage(), c.GetSignature()) {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_SIGNATURE,
+			"claim \"%s\" signature doesn't verify with %s", cm.GetClaimDescriptor(),
+			KeyDescriptorToString(k))
 	}
-	return false
+	return nil
 }
 
-func VerifySignedAssertion(scm certprotos.SignedClaimMessage, k *certprotos.KeyMessage, vseClause *certprotos.VseClause) bool {
+func VerifySignedClaim(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessage) bool {
+	err := CheckSignedClaim(c, k)
+	if err != nil {
+		Logger().Debug("VerifySignedClaim failed", "err", err)
+		return false
+	}
+	return true
+}
+
+// CheckSignedAssertion is VerifySignedAssertion saying why the claim
+// was rejected.
+func CheckSignedAssertion(scm *certprotos.SignedClaimMessage, k *certprotos.KeyMessage, vseClause *certprotos.VseClause) error {
+	return CheckSignedAssertionAt(scm, k, vseClause, time.Now())
+}
+
+// CheckSignedAssertionAt is CheckSignedAssertion for a claim that must
+// be valid at time at rather than now.
+func CheckSignedAssertionAt(scm *certprotos.SignedClaimMessage, k *certprotos.KeyMessage, vseClause *certprotos.VseClause,
+		at time.Time) error {
 	// verify signed claim and extract vse clause
-	if !VerifySignedClaim(&scm, k) {
-		return false;
+	err := CheckSignedClaimAt(scm, k, at)
+	if err != nil {
+		return err
 	}
 	// extract clause
 	cl_str := "vse-clause"
 
 	cm := certprotos.ClaimMessage{}
-	err := proto.Unmarshal(scm.GetSerializedClaimMessage(), &cm)
+	err = proto.Unmarshal(scm.GetSerializedClaimMessage(), &cm)
 	if err != nil {
-		return false
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"can't parse claim: %v", err)
 	}
-	if cm.GetClaimFormat() == cl_str {
-		err = proto.Unmarshal(cm.GetSerializedClaim(), vseClause)
-		if err != nil {
-			fmt.Printf("VerifySignedAssertion, Error 2\n")
-			return false
-		}
-	} else {
+	if cm.GetClaimFormat() != cl_str {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"claim \"%s\" is not a vse-clause", cm.GetClaimDescriptor())
+	}
+	err = proto.Unmarshal(cm.GetSerializedClaim(), vseClause)
+	if err != nil {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			"can't parse clause in claim \"%s\": %v", cm.GetClaimDescriptor(), err)
+	}
+	return nil
+}
+
+func VerifySignedAssertion(scm certprotos.SignedClaimMessage, k *certprotos.KeyMessage, vseClause *certprotos.VseClause) bool {
+	err := CheckSignedAssertion(&scm, k, vseClause)
+	if err != nil {
+		Logger().Debug("VerifySignedAssertion failed", "err", err)
 		return false
 	}
 	return true
@@ -1311,7 +1477,7 @@ func ProducePlatformRule(issuerKey *certprotos.KeyMessage, issuerCert *x509.Cert
 	}
 	issuerPublic := InternalPublicFromPrivateKey(issuerKey)
 	if issuerPublic == nil {
-		fmt.Printf("Can't make isser public from private\n")
+		Logger().Debug("ProducePlatformRule: can't make issuer public from private")
 		return nil
 	}
 	s2 := MakeKeyEntity(issuerPublic)
@@ -1381,8 +1547,7 @@ func ProduceAdmissionCert(issuerKey *certprotos.KeyMessage, issuerCert *x509.Cer
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &cert, issuerCert, &sPK, crypto.Signer(&ipK))
 	if err != nil {
-		fmt.Printf("error 3\n")
-		fmt.Println(err)
+		Logger().Error("ProduceAdmissionCert: can't create cert", "err", err)
 		return nil
 	}
 	newCert, err := x509.ParseCertificate(derBytes)
@@ -1392,6 +1557,85 @@ func ProduceAdmissionCert(issuerKey *certprotos.KeyMessage, issuerCert *x509.Cer
 	return newCert
 }
 
+// ProduceServiceCert generates a fresh key for the certifier service's TLS
+// endpoint and certifies it with the policy key, so that clients which embed
+// the policy cert can authenticate the service before sending evidence.
+func ProduceServiceCert(issuerKey *certprotos.KeyMessage, issuerCert *x509.Certificate,
+		hostName string, durationSeconds float64) (*tls.Certificate, error) {
+
+	if issuerKey == nil || issuerCert == nil {
+		return nil, errors.New("ProduceServiceCert: no policy key or cert")
+	}
+	servicePK, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ipK := rsa.PrivateKey{}
+	iPK := rsa.PublicKey{}
+	if !GetRsaKeysFromInternal(issuerKey, &ipK, &iPK) {
+		return nil, errors.New("ProduceServiceCert: can't get policy key")
+	}
+
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	dur := int64(durationSeconds * 1000 * 1000 * 1000)
+	cert := x509.Certificate{
+		SerialNumber: sn,
+		Subject: pkix.Name {
+			CommonName: hostName,
+			Organization: []string{"CertifierService"},
+		},
+		NotBefore:	     time.Now(),
+		NotAfter:	      time.Now().Add(time.Duration(dur)),
+		IsCA:		  false,
+		ExtKeyUsage:	   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:	      x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(hostName); ip != nil {
+		cert.IPAddresses = []net.IP{ip}
+	} else {
+		cert.DNSNames = []string{hostName}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &cert, issuerCert, &servicePK.PublicKey, crypto.Signer(&ipK))
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{derBytes, issuerCert.Raw},
+		PrivateKey: servicePK,
+		Leaf: leaf,
+	}, nil
+}
+
+// Server side TLS config for the certifier service.  Client certs are not
+// requested, the enclave proves itself with the evidence it sends.
+func MakeServiceTlsConfig(serviceCert *tls.Certificate) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{*serviceCert},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// Client side TLS config that only accepts a service cert chaining to policyCert.
+func MakeServiceClientTlsConfig(policyCert *x509.Certificate, serverName string) *tls.Config {
+	certPool := x509.NewCertPool()
+	certPool.AddCert(policyCert)
+	return &tls.Config{
+		RootCAs: certPool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
 func GetIssuerNameFromCert(cert *x509.Certificate) string {
 	return cert.Issuer.CommonName
 }
@@ -1430,10 +1674,17 @@ func GetIssuerKey(cert *x509.Certificate) *certprotos.KeyMessage{
 }
 
 func VerifyAdmissionCert(policyCert *x509.Certificate, cert *x509.Certificate) bool {
+	return VerifyAdmissionCertAt(policyCert, cert, time.Now())
+}
+
+// VerifyAdmissionCertAt is VerifyAdmissionCert for a cert that must be
+// valid at time at rather than now.
+func VerifyAdmissionCertAt(policyCert *x509.Certificate, cert *x509.Certificate, at time.Time) bool {
 	certPool := x509.NewCertPool()
 	certPool.AddCert(policyCert)
 	opts := x509.VerifyOptions{
 		Roots:   certPool,
+		CurrentTime: at,
 	}
 
 	if _, err := cert.Verify(opts); err != nil {
@@ -1480,17 +1731,17 @@ func ConstructVseAttestClaim(attestKey *certprotos.KeyMessage, enclaveKey *certp
 		measurement []byte) *certprotos.VseClause {
 	am := MakeKeyEntity(attestKey)
 	if am == nil {
-		fmt.Printf("Can't make attest entity\n")
+		Logger().Debug("ConstructVseAttestClaim: can't make attest entity")
 		return nil
 	}
 	em := MakeKeyEntity(enclaveKey)
 	if em == nil {
-		fmt.Printf("Can't make enclave entity\n")
+		Logger().Debug("ConstructVseAttestClaim: can't make enclave entity")
 		return nil
 	}
 	mm := MakeMeasurementEntity(measurement)
 	if mm == nil {
-		fmt.Printf("Can't make measurement entity\n")
+		Logger().Debug("ConstructVseAttestClaim: can't make measurement entity")
 		return nil
 	}
 	says := "says"
@@ -1506,7 +1757,7 @@ func VerifyReport(etype string, pk *certprotos.KeyMessage, serialized []byte) bo
 	sr := certprotos.SignedReport{}
 	err := proto.Unmarshal(serialized, &sr)
 	if err != nil {
-		fmt.Printf("Can't unmarshal signed report\n")
+		Logger().Debug("VerifyReport: can't unmarshal signed report", "err", err)
 		return false
 	}
 	k := sr.SigningKey
@@ -1520,7 +1771,7 @@ func VerifyReport(etype string, pk *certprotos.KeyMessage, serialized []byte) bo
 	rPK := rsa.PublicKey{}
 	rpK := rsa.PrivateKey{}
 	if GetRsaKeysFromInternal(k, &rpK, &rPK) == false {
-		fmt.Printf("VerifyReport: error 1\n")
+		Logger().Debug("VerifyReport: can't get rsa key")
 		return false
 	}
 
@@ -1531,17 +1782,22 @@ func VerifyReport(etype string, pk *certprotos.KeyMessage, serialized []byte) bo
 }
 
 func CheckTimeRange(nb *string, na *string) bool {
+	return CheckTimeRangeAt(nb, na, time.Now())
+}
+
+// CheckTimeRangeAt is CheckTimeRange for time at rather than now.
+func CheckTimeRangeAt(nb *string, na *string, at time.Time) bool {
 	if nb == nil || na == nil {
 		return false
 	}
-	tn := TimePointNow()
+	tn := TimePointFromTime(at.Local())
 	tb := StringToTimePoint(*nb)
 	ta := StringToTimePoint(*na)
 	if tn == nil || ta == nil && tb == nil {
 		return false
 	}
 	if CompareTimePoints(tb, tn) > 0 || CompareTimePoints(ta, tn) < 0 {
-		fmt.Printf("CheckTimeRange out of range\n")
+		Logger().Debug("CheckTimeRange: out of range", "not_before", *nb, "not_after", *na)
 		return false
 	}
 	return true
@@ -1578,6 +1834,24 @@ func FindKeySeen(list *CertSeenList, name string) *certprotos.KeyMessage {
 	return nil
 }
 
+// certSigner is the cert, among the "cert" evidence in earlier or cert
+// itself, whose public key cert's signature verifies with, or nil.
+func certSigner(cert *x509.Certificate, earlier []*certprotos.Evidence) *x509.Certificate {
+	for _, ev := range earlier {
+		if ev.GetEvidenceType() != "cert" {
+			continue
+		}
+		parent := Asn1ToX509(ev.SerializedEvidence)
+		if parent != nil && cert.CheckSignatureFrom(parent) == nil {
+			return parent
+		}
+	}
+	if cert.CheckSignatureFrom(cert) == nil {
+		return cert
+	}
+	return nil
+}
+
 func ConstructVseAttestationFromCert(subjKey *certprotos.KeyMessage, signerKey *certprotos.KeyMessage) *certprotos.VseClause {
 	subjectKeyEntity := MakeKeyEntity(subjKey)
 	if subjectKeyEntity == nil {
@@ -1632,20 +1906,20 @@ func VerifySevAttestation(serialized []byte, k *certprotos.KeyMessage) []byte {
 	var am certprotos.SevAttestationMessage
 	err := proto.Unmarshal(serialized, &am)
 	if err != nil {
-		fmt.Printf("VerifySevAttestation: Can't unmarshal SevAttestationMessage\n")
+		Logger().Debug("VerifySevAttestation: can't unmarshal SevAttestationMessage", "err", err)
 		return nil
 	}
 
 	ptr := am.ReportedAttestation
 	if ptr == nil {
-		fmt.Printf("VerifySevAttestation: am.ReportedAttestation is wrong\n")
+		Logger().Debug("VerifySevAttestation: no reported attestation")
 		return nil
 	}
 
 	// Get public key so we can check the attestation
 	_, PK, err := GetEccKeysFromInternal(k)
 	if err!= nil || PK == nil {
-		fmt.Printf("VerifySevAttestation: Can't extract key.\n")
+		Logger().Debug("VerifySevAttestation: can't extract key", Key("vcek_key", k))
 		return nil
 	}
 
@@ -1653,69 +1927,35 @@ func VerifySevAttestation(serialized []byte, k *certprotos.KeyMessage) []byte {
 	hd := ptr[0x50:0x80]
 
 	if am.WhatWasSaid == nil {
-		fmt.Printf("VerifySevAttestation: WhatWasSaid is nil.\n")
+		Logger().Debug("VerifySevAttestation: WhatWasSaid is nil")
 		return nil
 	}
 	hashed := sha512.Sum384(am.WhatWasSaid)
 
-	// Debug
-	fmt.Printf("Hashed user data in report: ")
-	PrintBytes(hd)
-	fmt.Printf(", and,\n")
-	PrintBytes(hashed[0:48])
-	fmt.Printf("\n")
-
 	if !bytes.Equal(hashed[0:48], hd[0:48]) {
-		fmt.Printf("VerifySevAttestation: Hash of user data is not the same as in the report\n")
+		Logger().Debug("VerifySevAttestation: hash of user data is not the same as in the report",
+			"report_hash", hex.EncodeToString(hd), "user_data_hash", hex.EncodeToString(hashed[0:48]))
 		return nil
 	}
 
 	hashOfHeader := sha512.Sum384(ptr[0:0x2a0])
 
-	// Debug
-	fmt.Printf("VerifySevAttestation, vcekKey: ")
-	PrintKey(k)
-	fmt.Printf("\n")
-	fmt.Printf("VerifySevAttestation, report (%x): ", len(am.ReportedAttestation))
-	PrintBytes(ptr[0:len(am.ReportedAttestation)])
-	fmt.Printf("\n")
-	outFile := "test_attestation.bin"
-	err = os.WriteFile(outFile, ptr[0:len(am.ReportedAttestation)], 0666)
-	if err != nil {
-		fmt.Printf("Write failed\n")
-	}
-	fmt.Printf("VerifySevAttestation, Header of report: ")
-	PrintBytes(ptr[0:0x2a0])
-	fmt.Printf("\n")
-	fmt.Printf("VerifySevAttestation, Hashed header of report: ")
-	PrintBytes(hashOfHeader[0:48])
-	fmt.Printf("\n")
-	fmt.Printf("VerifySevAttestation, measurement: ")
-	PrintBytes(ptr[0x90: 0xc0])
-	fmt.Printf("\n")
-	fmt.Printf("VerifySevAttestation, signature:\n    ")
-	PrintBytes(ptr[0x2a0:0x2d0])
-	fmt.Printf("\n    ")
-	PrintBytes(ptr[0x2e8:0x318])
-	fmt.Printf("\n")
+	Logger().Debug("VerifySevAttestation", Key("vcek_key", k),
+		"report", Sensitive(ptr),
+		"header_hash", hex.EncodeToString(hashOfHeader[0:48]),
+		"measurement", hex.EncodeToString(ptr[0x90:0xc0]))
 
 	reversedR := LittleToBigEndian(ptr[0x2a0:0x2d0])
 	reversedS := LittleToBigEndian(ptr[0x2e8:0x318])
 	if reversedR == nil || reversedS == nil {
-		fmt.Printf("VerifySevAttestation: reversed bytes failed\n")
+		Logger().Debug("VerifySevAttestation: reversed bytes failed")
 		return nil
 	}
 
-	fmt.Printf("VerifySevAttestation, signature reversed:\n    ")
-	PrintBytes(reversedR)
-	fmt.Printf("\n    ")
-	PrintBytes(reversedS)
-	fmt.Printf("\n")
-
 	r :=  new(big.Int).SetBytes(reversedR)
 	s :=  new(big.Int).SetBytes(reversedS)
 	if !ecdsa.Verify(PK, hashOfHeader[0:48], r, s) {
-		fmt.Printf("VerifySevAttestation: ecdsa.Verify failed\n")
+		Logger().Debug("VerifySevAttestation: ecdsa.Verify failed")
 		return nil
 	}
 
@@ -1749,265 +1989,372 @@ func KeyFromPemFormat(pem string) *certprotos.KeyMessage {
 	// base64 decode pem
 	der, err := b64.StdEncoding.DecodeString(pem)
 	if err != nil || der == nil {
-		fmt.Printf("KeyFromPemFormat: base64 decode error\n")
+		Logger().Debug("KeyFromPemFormat: base64 decode error")
 		return nil
 	}
 	cert := Asn1ToX509(der)
 	if cert == nil {
-		fmt.Printf("KeyFromPemFormat: Can't convert cert\n")
+		Logger().Debug("KeyFromPemFormat: can't convert cert")
 		return nil
 	}
 
 	return GetSubjectKey(cert)
 }
 
-func InitProvedStatements(pk certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
-		ps *certprotos.ProvedStatements) bool {
-	if !InitAxiom(pk, ps) {
-		return false
+// VerifyEvidence verifies each piece of evidence and adds the statements
+// it proves to ps, after the axiom "pk is-trusted".  It returns a
+// TrustError saying why evidence was rejected.
+// NonceChecker is called with the nonce in each attestation_user_data in
+// the evidence, and with nil if there is none.  It returns an error if the
+// nonce isn't acceptable.
+type NonceChecker func(nonce []byte) error
+
+func checkEvidenceNonce(checkNonce NonceChecker, i int, ud *certprotos.AttestationUserData) error {
+	if checkNonce == nil {
+		return nil
+	}
+	err := checkNonce(ud.GetNonce())
+	if err != nil {
+		return fmt.Errorf("evidence %d: %w", i, err)
 	}
+	return nil
+}
+
+// VerifyEvidence checks evidenceList and adds what it proves to ps.  If
+// checkNonce isn't nil, the nonce in any attested user data is checked
+// with it.
+func VerifyEvidence(pk *certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+		ps *certprotos.ProvedStatements, checkNonce NonceChecker) error {
+	return VerifyEvidenceContext(context.Background(), pk, evidenceList, ps, checkNonce)
+}
+
+// VerifyEvidenceAt is VerifyEvidence for evidence that must have been
+// valid at time at rather than now: claims, certs and reports are
+// checked against at.
+func VerifyEvidenceAt(pk *certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+		ps *certprotos.ProvedStatements, checkNonce NonceChecker, at time.Time) error {
+	return verifyEvidence(context.Background(), pk, evidenceList, ps, checkNonce, at)
+}
+
+// VerifyEvidenceContext is VerifyEvidence, tracing each evidence item in
+// a span under the one in ctx.
+func VerifyEvidenceContext(ctx context.Context, pk *certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+		ps *certprotos.ProvedStatements, checkNonce NonceChecker) error {
+	return verifyEvidence(ctx, pk, evidenceList, ps, checkNonce, time.Now())
+}
+
+func verifyEvidence(ctx context.Context, pk *certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+		ps *certprotos.ProvedStatements, checkNonce NonceChecker, at time.Time) error {
+	n := len(ps.Proved)
+	if !InitAxiom(*pk, ps) {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_INTERNAL, "can't add policy key axiom")
+	}
+	noteEvidenceSources(ctx, sourcePolicyKey, len(ps.Proved) - n)
 
 	seenList := new (CertSeenList)
 	seenList.maxSize = 30
 	seenList.size = 0
 
-	// Debug
-	fmt.Printf("\nInitProvedStatements %d assertions\n", len(evidenceList))
+	Logger().Debug("VerifyEvidence", "assertions", len(evidenceList))
+
+	sawUserData := false
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
 
 	for i := 0; i < len(evidenceList); i++ {
-		ev := evidenceList[i]
-		if  ev.GetEvidenceType() == "signed-claim" {
-			signedClaim := certprotos.SignedClaimMessage{}
-			err := proto.Unmarshal(ev.SerializedEvidence, &signedClaim)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal serialized claim\n")
-				return false
-			}
-			k := signedClaim.SigningKey
-			tcl := certprotos.VseClause{}
-			if VerifySignedAssertion(signedClaim, k, &tcl) {
-				// make sure the saying key in tcl is the same key that signed it
-				if tcl.GetVerb() == "says" && tcl.GetSubject().GetEntityType() == "key" {
-					if SameKey(k, tcl.GetSubject().GetKey()) {
-						ps.Proved = append(ps.Proved, &tcl)
-					}
-				}
-			}
-		} else if ev.GetEvidenceType() == "pem-cert-chain" {
-			// nothing to do
-		} else if ev.GetEvidenceType() == "oe-attestation-report" {
-			// call oeVerify here and construct the statement:
-			//      enclave-key speaks-for measurement
-			// from the return values.  Then add it to proved statements
-			if i < 1  || evidenceList[i-1].GetEvidenceType() != "pem-cert-chain" {
-				fmt.Printf("InitProvedStatements: missing cert chain in oe evidence\n")
-				return false
-			}
-			serializedUD, m, err  := oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
-				evidenceList[i-1].SerializedEvidence)
-			if err != nil || serializedUD == nil || m == nil {
-				return false
-			}
-			ud := certprotos.AttestationUserData{}
-			err = proto.Unmarshal(serializedUD, &ud)
-			if err != nil {
-				return false
-			}
-			// Get platform key from pem file
-			stripped := StripPemHeaderAndTrailer(string(evidenceList[i-1].SerializedEvidence))
-			if stripped == nil {
-				fmt.Printf("InitProvedStatements: Bad PEM\n")
-				return false
-			}
-			k := KeyFromPemFormat(*stripped)
-			cl := ConstructSevSpeaksForStatement(k, ud.EnclaveKey, m)
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: ConstructEnclaveKeySpeaksForMeasurement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "sev-attestation" {
-			// get the key from ps
-			n := len(ps.Proved) - 1
-			if n < 0 {
-				fmt.Printf("InitProvedStatements: sev evidence is at wrong position\n")
-				return false
-			}
-			if ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
-					ps.Proved[n].Clause.Subject == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (1)\n")
-				return false
-			}
-			vcekVerifyKeyEnt := ps.Proved[n].Clause.Subject
-			if vcekVerifyKeyEnt == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (2)\n")
-				return false
-			}
-			if vcekVerifyKeyEnt.GetEntityType() != "key" {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (3)\n")
-				return false
-			}
-			vcekKey := vcekVerifyKeyEnt.Key
-			if vcekKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (4)\n")
-				return false
-			}
-			m := VerifySevAttestation(ev.SerializedEvidence, vcekKey)
-			if m == nil {
-				fmt.Printf("InitProvedStatements: VerifySevAttestation failed\n")
-				return false
-			}
-			var am certprotos.SevAttestationMessage
-			err := proto.Unmarshal(ev.SerializedEvidence, &am)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal SevAttestationMessage\n")
-				return false
-			}
-			var ud certprotos.AttestationUserData
-			err = proto.Unmarshal(am.WhatWasSaid, &ud)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal UserData\n")
-				return false
-			}
-			if ud.EnclaveKey == nil {
-				fmt.Printf("InitProvedStatements: No enclaveKey\n")
-				return false
-			}
-			cl := ConstructSevSpeaksForStatement(vcekKey, ud.EnclaveKey, m)
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: ConstructSevSpeaksForStatement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "cert" {
-			// A cert always means "the signing-key says the subject-key is-trusted-for-attestation"
-			// construct vse statement.
-
-			// This whole thing is more complicated because we have to keep track of
-			// previously seen subject keys which, as issuer keys, will sign other
-			// keys.  The only time we can get the issuer_key directly is when the cert
-			// is self signed.
-
-			// turn into X509
-			cert := Asn1ToX509(ev.SerializedEvidence)
-			if cert == nil {
-				fmt.Printf("InitProvedStatements: Can't convert cert\n")
-				return false
+		_, span := tracer.Start(ctx, "VerifyEvidenceItem", trace.WithAttributes(
+			attribute.Int("certifier.evidence_index", i),
+			attribute.String("certifier.evidence_type", evidenceList[i].GetEvidenceType())))
+		n = len(ps.Proved)
+		err := verifyEvidenceItem(i, evidenceList, ps, seenList, checkNonce, &sawUserData, at)
+		noteEvidenceSources(ctx, i, len(ps.Proved) - n)
+		if err == nil && len(ps.Proved) > n {
+			if m := attestedMeasurement(ps.Proved[len(ps.Proved) - 1]); m != nil {
+				span.SetAttributes(attribute.String("certifier.measurement", hex.EncodeToString(m)))
 			}
+		}
+		EndSpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+	if !sawUserData && checkNonce != nil {
+		return checkNonce(nil)
+	}
+	return nil
+}
 
-			subjKey := GetSubjectKey(cert)
-			if subjKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get subject key\n")
-				return false
-			}
-			if FindKeySeen(seenList, subjKey.GetKeyName()) == nil {
-				if !AddKeySeen(seenList, subjKey) {
-					fmt.Printf("InitProvedStatements: Can't add subject key\n")
-					return false
-				}
-			}
-			issuerName := GetIssuerNameFromCert(cert)
-			signerKey := FindKeySeen(seenList, issuerName)
-			if signerKey == nil {
-				fmt.Printf("InitProvedStatements: signerKey is nil\n")
-				return false
-			}
+// attestedMeasurement is the measurement in "k speaks-for m" or
+// "k1 says k speaks-for m".
+func attestedMeasurement(cl *certprotos.VseClause) []byte {
+	if cl.GetVerb() == "says" && cl.GetClause() != nil {
+		cl = cl.GetClause()
+	}
+	if cl.GetVerb() == "speaks-for" && cl.GetObject().GetEntityType() == "measurement" {
+		return cl.GetObject().GetMeasurement()
+	}
+	return nil
+}
 
-			// verify x509 signature
-			certPool := x509.NewCertPool()
-			certPool.AddCert(cert)
-			opts := x509.VerifyOptions{
-				Roots:   certPool,
-			}
-			if _, err := cert.Verify(opts); err != nil {
-				fmt.Printf("InitProvedStatements: Cert.Vertify fails\n")
-				return false
-			}
+// verifyEvidenceItem checks evidenceList[i], as of time at, and adds what
+// it proves to ps, setting *sawUserData if it has attested user data.
+func verifyEvidenceItem(i int, evidenceList []*certprotos.Evidence, ps *certprotos.ProvedStatements,
+		seenList *CertSeenList, checkNonce NonceChecker, sawUserData *bool, at time.Time) error {
+	ev := evidenceList[i]
+	if  ev.GetEvidenceType() == "signed-claim" {
+		signedClaim := certprotos.SignedClaimMessage{}
+		err := proto.Unmarshal(ev.SerializedEvidence, &signedClaim)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse signed claim: %v", i, err)
+		}
+		k := signedClaim.SigningKey
+		if k == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: signed claim has no signing key", i)
+		}
+		tcl := certprotos.VseClause{}
+		err = CheckSignedAssertionAt(&signedClaim, k, &tcl, at)
+		if err != nil {
+			return fmt.Errorf("evidence %d: %w", i, err)
+		}
+		// make sure the saying key in tcl is the same key that signed it
+		if tcl.GetVerb() != "says" || tcl.GetSubject().GetEntityType() != "key" {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: signed claim is not a says statement", i)
+		}
+		if !SameKey(k, tcl.GetSubject().GetKey()) {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: %s says it but %s signed it", i,
+				KeyDescriptorToString(tcl.GetSubject().GetKey()), KeyDescriptorToString(k))
+		}
+		ps.Proved = append(ps.Proved, &tcl)
+	} else if ev.GetEvidenceType() == "pem-cert-chain" {
+		// nothing to do
+	} else if ev.GetEvidenceType() == "oe-attestation-report" {
+		// call oeVerify here and construct the statement:
+		//      enclave-key speaks-for measurement
+		// from the return values.  Then add it to proved statements
+		if i < 1  || evidenceList[i-1].GetEvidenceType() != "pem-cert-chain" {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: oe evidence without a cert chain before it", i)
+		}
+		serializedUD, m, err  := oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
+			evidenceList[i-1].SerializedEvidence)
+		if err != nil || serializedUD == nil || m == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ATTESTATION_FAILED,
+				"evidence %d: oe evidence doesn't verify: %v", i, err)
+		}
+		ud := certprotos.AttestationUserData{}
+		err = proto.Unmarshal(serializedUD, &ud)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse oe user data: %v", i, err)
+		}
+		err = checkEvidenceNonce(checkNonce, i, &ud)
+		if err != nil {
+			return err
+		}
+		*sawUserData = true
+		// Get platform key from pem file
+		stripped := StripPemHeaderAndTrailer(string(evidenceList[i-1].SerializedEvidence))
+		if stripped == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: bad PEM cert chain", i)
+		}
+		k := KeyFromPemFormat(*stripped)
+		cl := ConstructSevSpeaksForStatement(k, ud.EnclaveKey, m)
+		if cl == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get the key and measurement from oe evidence", i)
+		}
+		ps.Proved = append(ps.Proved, cl)
+	} else if ev.GetEvidenceType() == "sev-attestation" {
+		// get the key from ps
+		n := len(ps.Proved) - 1
+		if n < 0 {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: sev evidence must follow the VCEK cert", i)
+		}
+		if ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
+				ps.Proved[n].Clause.Subject == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get VCEK key", i)
+		}
+		vcekVerifyKeyEnt := ps.Proved[n].Clause.Subject
+		if vcekVerifyKeyEnt == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get VCEK key", i)
+		}
+		if vcekVerifyKeyEnt.GetEntityType() != "key" {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: VCEK is not a key", i)
+		}
+		vcekKey := vcekVerifyKeyEnt.Key
+		if vcekKey == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get VCEK key", i)
+		}
+		m := VerifySevAttestation(ev.SerializedEvidence, vcekKey)
+		if m == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ATTESTATION_FAILED,
+				"evidence %d: sev attestation doesn't verify with the VCEK key", i)
+		}
+		var am certprotos.SevAttestationMessage
+		err := proto.Unmarshal(ev.SerializedEvidence, &am)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse sev attestation", i)
+		}
+		var ud certprotos.AttestationUserData
+		err = proto.Unmarshal(am.WhatWasSaid, &ud)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse sev user data", i)
+		}
+		if ud.EnclaveKey == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: sev user data has no enclave key", i)
+		}
+		err = checkEvidenceNonce(checkNonce, i, &ud)
+		if err != nil {
+			return err
+		}
+		*sawUserData = true
+		cl := ConstructSevSpeaksForStatement(vcekKey, ud.EnclaveKey, m)
+		if cl == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get the key and measurement from sev attestation", i)
+		}
+		ps.Proved = append(ps.Proved, cl)
+	} else if ev.GetEvidenceType() == "cert" {
+		// A cert always means "the signing-key says the subject-key is-trusted-for-attestation"
+		// construct vse statement.
+
+		// turn into X509
+		cert := Asn1ToX509(ev.SerializedEvidence)
+		if cert == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse cert", i)
+		}
 
-			/*
-			// This code will replace the above eventually
-			if signerKey.GetName() == subjKey.GetKeyName {
-				err := cert.CheckSignatureFrom(cert)
-				if err != nil {
-					fmt.Printf("InitProvedStatements: parent signature check fails\n")
-					return false
-				}
-			} else {
-				if i <= 0 {
-					fmt.Printf("InitProvedStatements: No parent cert\n")
-					return false
-				}
-				parentCert := Asn1ToX509(evidenceList[i - 1].SerializedEvidence)
-				if parentCert == nil {
-					fmt.Printf("InitProvedStatements: Can't convert parent cert\n")
-					return false
-				}
-				err := cert.CheckSignatureFrom(parentCert)
-				if err != nil {
-					fmt.Printf("InitProvedStatements: parent signature check fails\n")
-					return false
-				}
-			}
-			 */
+		subjKey := GetSubjectKey(cert)
+		if subjKey == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get cert subject key", i)
+		}
+		if !AddKeySeen(seenList, subjKey) {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: too many certs", i)
+		}
+		if at.Before(cert.NotBefore) || at.After(cert.NotAfter) {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_EXPIRED,
+				"evidence %d: cert %s is valid from %s to %s", i, cert.Subject.CommonName,
+				cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		}
 
-			cl := ConstructVseAttestationFromCert(subjKey, signerKey)
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: Can't construct Attestation from cert\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "signed-vse-attestation-report" {
-			sr := certprotos.SignedReport{}
-			err := proto.Unmarshal(ev.SerializedEvidence, &sr)
-			if err != nil {
-				fmt.Printf("Can't unmarshal signed report\n")
-				return false
-			}
-			k := sr.SigningKey
-			info := certprotos.VseAttestationReportInfo{}
-			err = proto.Unmarshal(sr.GetReport(), &info)
-			if err != nil {
-				fmt.Printf("Can't unmarshal info\n")
-				return false
-			}
-			ud := certprotos.AttestationUserData{}
-			err = proto.Unmarshal(info.GetUserData(), &ud)
-			if err != nil {
-				fmt.Printf("Can't unmarshal user data\n")
-				return false
-			}
-			if VerifyReport("vse-attestation-report", k, ev.GetSerializedEvidence()) {
-				if CheckTimeRange(info.NotBefore, info.NotAfter) {
-					cl := ConstructVseAttestClaim(k, ud.EnclaveKey, info.VerifiedMeasurement)
-					ps.Proved = append(ps.Proved, cl)
-				}
-			}
-		} else {
-			fmt.Printf("Unknown evidence type\n")
-			return false
+		// The signer is the key in an earlier cert, or in this one, that
+		// the signature verifies with, whatever the issuer name says.
+		signer := certSigner(cert, evidenceList[:i])
+		if signer == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_SIGNATURE,
+				"evidence %d: cert %s isn't signed by an earlier cert or itself", i, cert.Subject.CommonName)
+		}
+		signerKey := GetSubjectKey(signer)
+		if signerKey == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't get cert signer key", i)
+		}
+
+		cl := ConstructVseAttestationFromCert(subjKey, signerKey)
+		if cl == nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't make statement from cert", i)
+		}
+		ps.Proved = append(ps.Proved, cl)
+	} else if ev.GetEvidenceType() == "signed-vse-attestation-report" {
+		sr := certprotos.SignedReport{}
+		err := proto.Unmarshal(ev.SerializedEvidence, &sr)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse signed report: %v", i, err)
+		}
+		k := sr.SigningKey
+		info := certprotos.VseAttestationReportInfo{}
+		err = proto.Unmarshal(sr.GetReport(), &info)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse report info: %v", i, err)
+		}
+		ud := certprotos.AttestationUserData{}
+		err = proto.Unmarshal(info.GetUserData(), &ud)
+		if err != nil {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+				"evidence %d: can't parse report user data: %v", i, err)
+		}
+		if !VerifyReport("vse-attestation-report", k, ev.GetSerializedEvidence()) {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ATTESTATION_FAILED,
+				"evidence %d: attestation report doesn't verify", i)
+		}
+		if !CheckTimeRangeAt(info.NotBefore, info.NotAfter, at) {
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_EXPIRED,
+				"evidence %d: attestation report is valid from %s to %s", i,
+				info.GetNotBefore(), info.GetNotAfter())
 		}
+		err = checkEvidenceNonce(checkNonce, i, &ud)
+		if err != nil {
+			return err
+		}
+		*sawUserData = true
+		cl := ConstructVseAttestClaim(k, ud.EnclaveKey, info.VerifiedMeasurement)
+		ps.Proved = append(ps.Proved, cl)
+	} else {
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST,
+			"evidence %d: unknown evidence type %s", i, ev.GetEvidenceType())
+	}
+	return nil
+}
+
+func InitProvedStatements(pk certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+		ps *certprotos.ProvedStatements) bool {
+	err := VerifyEvidence(&pk, evidenceList, ps, nil)
+	if err != nil {
+		Logger().Debug("InitProvedStatements failed", "err", err)
+		return false
 	}
 	return true
 }
 
-func InitCerifierRules(cr *certprotos.CertifierRules) bool {
+// InitCerifierRules parses the rules a policy declares, which are
+// numbered from FirstDeclaredRule (see rules.go).
+func InitCerifierRules(cr *certprotos.CertifierRules) ([]*DeclaredRule, error) {
 /*
 	Certifier proofs
 
 	rule 1 (R1): If measurement is-trusted and key1 speaks-for measurement then
 		key1 is-trusted-for-authentication.
 	rule 2 (R2): If key2 speaks-for key1 and key3 speaks-for key2 then key3 speaks-for key1
+		(key1 may also be a measurement)
 	rule 3 (R3): If key1 is-trusted and key1 says X, then X is true
-	rule 4 (R4): If key2 speaks-for key1 and key1 is-trusted then key2 is-trusted
+	rule 4 (R4): If key2 speaks-for key1 and key1 is-trustedXXX then key2 is-trustedYYY
+		provided is-trustedXXX dominates is-trustedYYY (key1 and key2 are keys)
 	rule 5 (R5): If key1 is-trustedXXX and key1 says key2 is-trustedYYY then key2 is-trustedYYY
 		provided is-trustedXXX dominates is-trustedYYY
 	rule 6 (R6): if key1 is-trustedXXX and key1 says key2 speaks-for measurement then
 		key2 speaks-for measurement provided is-trustedXXX dominates is-trusted-for-attestation 
+		and if key1 is-trustedXXX and key1 says key2 speaks-for key1 then key2 speaks-for key1
 	rule 7 (R7): If measurement is-trusted and key1 speaks-for measurement then
 		key1 is-trusted-for-attestation.
  */
 
-	return true;
+	var rules []*DeclaredRule
+	for i, text := range cr.GetRule() {
+		r, err := ParseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", FirstDeclaredRule + i, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
 }
 
 func PrintProofStep(prefix string, step *certprotos.ProofStep) {
@@ -2057,8 +2404,32 @@ func VerifyRule1(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certpro
 }
 
 // R2: If key2 speaks-for key1 and key3 speaks-for key2 then key3 speaks-for key1
+//	key1 may be a measurement.
 func VerifyRule2(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certprotos.VseClause, c *certprotos.VseClause) bool {
-	return false
+	if c1.Subject == nil || c1.Verb == nil || c1.Object == nil || c1.Clause != nil {
+		return false
+	}
+	if c1.GetVerb() != "speaks-for" || c1.Subject.GetEntityType() != "key" {
+		return false
+	}
+
+	if c2.Subject == nil || c2.Verb == nil || c2.Object == nil || c2.Clause != nil {
+		return false
+	}
+	if c2.GetVerb() != "speaks-for" || c2.Subject.GetEntityType() != "key" {
+		return false
+	}
+	if !SameEntity(c2.Object, c1.Subject) {
+		return false
+	}
+
+	if c.Subject == nil || c.Verb == nil || c.Object == nil || c.Clause != nil {
+		return false
+	}
+	if c.GetVerb() != "speaks-for" {
+		return false
+	}
+	return SameEntity(c.Subject, c2.Subject) && SameEntity(c.Object, c1.Object)
 }
 
 // R3: If key1 is-trusted and key1 says X, then X is true
@@ -2092,9 +2463,38 @@ func VerifyRule3(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certpro
 	return SameVseClause(c2.Clause, c)
 }
 
-// R4: If key2 speaks-for key1 and key1 is-trusted then key2 is-trusted
+// R4: If key2 speaks-for key1 and key1 is-trustedXXX then key2 is-trustedYYY
+//	provided is-trustedXXX dominates is-trustedYYY.  A key that speaks for
+//	an is-trusted key, such as the policy key, is itself is-trusted.
 func VerifyRule4(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certprotos.VseClause, c *certprotos.VseClause) bool {
-	return false
+	if c1.Subject == nil || c1.Verb == nil || c1.Object == nil || c1.Clause != nil {
+		return false
+	}
+	if c1.GetVerb() != "speaks-for" {
+		return false
+	}
+	// Only keys: a key that speaks for a trusted measurement gets R1 or R7.
+	if c1.Subject.GetEntityType() != "key" || c1.Object.GetEntityType() != "key" {
+		return false
+	}
+
+	if c2.Subject == nil || c2.Verb == nil || c2.Object != nil || c2.Clause != nil {
+		return false
+	}
+	if !Dominates(tree, "is-trusted", *c2.Verb) {
+		return false
+	}
+	if !SameEntity(c2.Subject, c1.Object) {
+		return false
+	}
+
+	if c.Subject == nil || c.Verb == nil || c.Object != nil  || c.Clause != nil {
+		return false
+	}
+	if !Dominates(tree, c2.GetVerb(), c.GetVerb()) {
+		return false
+	}
+	return SameEntity(c.Subject, c1.Subject)
 }
 
 // R5: If key1 is-trustedXXX and key1 says key2 is-trustedYYY then key2 is-trustedYYY provided is-trustedXXX dominates is-trustedYYY
@@ -2139,6 +2539,8 @@ func VerifyRule5(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certpro
 
 // R6: if key1 is-trustedXXX and key1 says key2 speaks-for measurement then
 //	key2 speaks-for measurement provided is-trustedXXX dominates is-trusted-for-attestation 
+//	Also, if key1 is-trustedXXX and key1 says key2 speaks-for key1 then key2 speaks-for key1:
+//	a key can hand off its own trust.  What key2 gets from it is bounded by R4.
 func VerifyRule6(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certprotos.VseClause, c *certprotos.VseClause) bool {
 	if c1.Subject == nil || c1.Verb == nil || c1.Object != nil || c1.Clause != nil {
 		return false
@@ -2174,6 +2576,9 @@ func VerifyRule6(tree *PredicateDominance, c1 *certprotos.VseClause, c2 *certpro
 	if *c3.Verb != "speaks-for" {
 		return false
 	}
+	if c3.Object.GetEntityType() == "key" && SameEntity(c3.Object, c2.Subject) {
+		return SameVseClause(c3, c)
+	}
 	if c3.Object.GetEntityType() != "measurement" {
 		return false
 	}
@@ -2259,8 +2664,9 @@ func VerifyExternalProofStep(tree *PredicateDominance, step *certprotos.ProofSte
 	return VerifyInternalProofStep(tree, s1, s2, c, int(*rule))
 }
 
-func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause,
-		p *certprotos.Proof, ps *certprotos.ProvedStatements) bool {
+// CheckProof is VerifyProof saying why the proof was rejected.
+func CheckProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause,
+		p *certprotos.Proof, ps *certprotos.ProvedStatements) error {
 
 	tree := PredicateDominance {
 		Predicate: "is-trusted",
@@ -2269,16 +2675,35 @@ func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause
 	}
 
 	if !InitDominance(&tree) {
-		fmt.Printf("Can't init Dominance tree\n");
-		return false;
+		return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_INTERNAL,
+			"can't init dominance tree")
 	}
+	return CheckProofWithDominance(&tree, policyKey, toProve, p, ps)
+}
+
+// CheckProofWithDominance is CheckProof with the policy's dominance
+// lattice, from BuildDominance, instead of the built-in one.
+func CheckProofWithDominance(tree *PredicateDominance, policyKey *certprotos.KeyMessage,
+		toProve *certprotos.VseClause, p *certprotos.Proof, ps *certprotos.ProvedStatements) error {
+	return CheckProofWithRules(context.Background(), tree, nil, policyKey, toProve, p, ps)
+}
+
+// CheckProofWithRules is CheckProofWithDominance that also accepts steps
+// by the rules the policy declares.  It gives up with ctx.Err() if ctx
+// is done.
+func CheckProofWithRules(ctx context.Context, tree *PredicateDominance, rules []*DeclaredRule,
+		policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause, p *certprotos.Proof,
+		ps *certprotos.ProvedStatements) error {
 	for i := 0; i < len(p.Steps); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var s1  *certprotos.VseClause = p.Steps[i].S1
 		var s2  *certprotos.VseClause = p.Steps[i].S2
 		var c  *certprotos.VseClause = p.Steps[i].Conclusion
 		if s1 == nil || s2 == nil || c == nil {
-			fmt.Printf("Bad proof step\n")
-			return false;
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_PROOF_REJECTED,
+				"proof step %d is incomplete", i)
 		}
 		if !StatementAlreadyProved(s1, ps)  {
 			continue
@@ -2286,17 +2711,32 @@ func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause
 		if !StatementAlreadyProved(s2, ps)  {
 			continue
 		}
-		if VerifyExternalProofStep(&tree, p.Steps[i]) {
+		if p.Steps[i].RuleApplied != nil &&
+				VerifyProofStep(tree, rules, s1, s2, c, int(p.Steps[i].GetRuleApplied())) {
 			ps.Proved = append(ps.Proved, c)
 			if SameVseClause(toProve, c) {
-				return true
+				return nil
 			}
 		} else {
-			return false
+			return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_PROOF_REJECTED,
+				"proof step %d: %s doesn't follow from %s and %s by rule %d", i,
+				VseClauseToString(c), VseClauseToString(s1), VseClauseToString(s2),
+				p.Steps[i].GetRuleApplied())
 		}
 
 	}
-	return false
+	return NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_PROOF_REJECTED,
+		"proof doesn't reach %s", VseClauseToString(toProve))
+}
+
+func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause,
+		p *certprotos.Proof, ps *certprotos.ProvedStatements) bool {
+	err := CheckProof(policyKey, toProve, p, ps)
+	if err != nil {
+		Logger().Debug("VerifyProof failed", "err", err)
+		return false
+	}
+	return true
 }
 
 func PrintTrustRequest(req *certprotos.TrustRequestMessage) {
@@ -2369,23 +2809,21 @@ func GetVseFromSignedClaim(sc *certprotos.SignedClaimMessage) *certprotos.VseCla
 	return &vseClause
 }
 
+// A TLS conn can return a record at a time, so both the size and the
+// body are read with io.ReadFull.
 func SizedSocketRead(conn net.Conn) []byte {
 	bsize := make([]byte, 4)
-	n, err := conn.Read(bsize)
+	n, err := io.ReadFull(conn, bsize)
 	if err != nil {
-		fmt.Printf("SizedSocketRead, error: %d\n", n)
+		Logger().Debug("SizedSocketRead: short size", "n", n)
 		return nil
 	}
 	size := int(bsize[0]) +  256 * int(bsize[1]) + 256 * 256 * int(bsize[2])
 	b := make([]byte, size)
-	total := 0
-	for ; total < size; {
-		n, err = conn.Read(b[total:])
-		if err != nil {
-			fmt.Printf("SizedSocketRead, error: %d\n", n)
-			return nil
-		}
-		total = total + n
+	n, err = io.ReadFull(conn, b)
+	if err != nil {
+		Logger().Debug("SizedSocketRead: short read", "n", n)
+		return nil
 	}
 	return b
 }
@@ -2399,13 +2837,12 @@ func SizedSocketWrite(conn net.Conn, b []byte) bool {
 	bs[3] = 0
 	_, err := conn.Write(bs)
 	if err != nil {
-		fmt.Printf("SizedSocketWrite error(1)\n")
+		Logger().Debug("SizedSocketWrite: short size write", "err", err)
 		return false
 	}
 	_, err = conn.Write(b)
 	if err != nil {
-		fmt.Print(err)
-		fmt.Printf("SizedSocketWrite error(2)\n")
+		Logger().Debug("SizedSocketWrite: short write", "err", err)
 		return false
 	}
 	return true
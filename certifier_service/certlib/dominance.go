@@ -0,0 +1,175 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: dominance.go
+
+package certlib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The predicate dominance lattice is a DAG rooted at is-trusted.  It
+// always has
+//	is-trusted dominates is-trusted-for-attestation
+//	is-trusted dominates is-trusted-for-authentication
+// and a policy may declare more, in a signed claim of format
+// DominanceClaimFormat whose serialized claim has one declaration per
+// line, for example
+//	is-trusted-for-attestation dominates is-trusted-for-secret-release
+//	is-trusted-for-key-provisioning dominates is-trusted-for-secret-release
+//	is-trusted dominates is-trusted-for-key-provisioning
+// BuildDominance turns it into a PredicateDominance tree: a predicate
+// with several parents appears under each of them.
+
+const DominanceClaimFormat = "predicate-dominance"
+
+// DominanceEdge says Parent dominates Descendant.
+type DominanceEdge struct {
+	Parent string
+	Descendant string
+}
+
+var builtinDominance = []DominanceEdge{
+	{"is-trusted", "is-trusted-for-attestation"},
+	{"is-trusted", "is-trusted-for-authentication"},
+}
+
+// ParseDominance parses the serialized claim of a DominanceClaimFormat
+// claim.  Blank lines are ignored.
+func ParseDominance(serialized []byte) ([]DominanceEdge, error) {
+	var edges []DominanceEdge
+	for i, line := range strings.Split(string(serialized), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 || f[1] != "dominates" {
+			return nil, fmt.Errorf("line %d: not \"predicate dominates predicate\"", i + 1)
+		}
+		for _, pred := range []string{f[0], f[2]} {
+			if pred == "says" || pred == "speaks-for" {
+				return nil, fmt.Errorf("line %d: %s is not a predicate", i + 1, pred)
+			}
+		}
+		edges = append(edges, DominanceEdge{f[0], f[2]})
+	}
+	if len(edges) == 0 {
+		return nil, fmt.Errorf("no predicates declared")
+	}
+	return edges, nil
+}
+
+// SerializeDominance is the serialized claim ParseDominance parses.
+func SerializeDominance(edges []DominanceEdge) []byte {
+	var b strings.Builder
+	for _, e := range edges {
+		fmt.Fprintf(&b, "%s dominates %s\n", e.Parent, e.Descendant)
+	}
+	return []byte(b.String())
+}
+
+// BuildDominance builds the lattice from the built-in declarations and
+// edges.  It fails if a predicate dominates itself, through a cycle, or
+// isn't dominated by is-trusted.
+func BuildDominance(edges []DominanceEdge) (*PredicateDominance, error) {
+	children := make(map[string][]string)
+	preds := map[string]bool{"is-trusted": true}
+	for _, e := range append(append([]DominanceEdge{}, builtinDominance...), edges...) {
+		if e.Parent == e.Descendant {
+			return nil, fmt.Errorf("%s dominates itself", e.Parent)
+		}
+		dup := false
+		for _, c := range children[e.Parent] {
+			dup = dup || c == e.Descendant
+		}
+		if !dup {
+			children[e.Parent] = append(children[e.Parent], e.Descendant)
+		}
+		preds[e.Parent] = true
+		preds[e.Descendant] = true
+	}
+	var sorted []string
+	for pred := range preds {
+		sorted = append(sorted, pred)
+	}
+	sort.Strings(sorted)
+
+	// Look for a cycle from each predicate, so one is found even if
+	// is-trusted doesn't reach it.
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(pred string) error
+	visit = func(pred string) error {
+		switch state[pred] {
+		case onPath:
+			i := 0
+			for path[i] != pred {
+				i++
+			}
+			return fmt.Errorf("cycle: %s dominates %s", strings.Join(path[i:], " dominates "), pred)
+		case done:
+			return nil
+		}
+		state[pred] = onPath
+		path = append(path, pred)
+		for _, c := range children[pred] {
+			if err := visit(c); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path) - 1]
+		state[pred] = done
+		return nil
+	}
+	for _, pred := range sorted {
+		if err := visit(pred); err != nil {
+			return nil, err
+		}
+	}
+
+	var build func(pred string) *PredicateDominance
+	build = func(pred string) *PredicateDominance {
+		n := &PredicateDominance{
+			Predicate: pred,
+		}
+		// Insert puts children first, so go backwards to keep their order.
+		l := children[pred]
+		for i := len(l) - 1; i >= 0; i-- {
+			c := build(l[i])
+			c.Next = n.FirstChild
+			n.FirstChild = c
+		}
+		return n
+	}
+	root := build("is-trusted")
+
+	var orphans []string
+	for _, pred := range sorted {
+		if FindNode(root, pred) == nil {
+			orphans = append(orphans, pred)
+		}
+	}
+	if len(orphans) > 0 {
+		return nil, fmt.Errorf("is-trusted doesn't dominate %s", strings.Join(orphans, ", "))
+	}
+	return root, nil
+}
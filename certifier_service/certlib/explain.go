@@ -0,0 +1,251 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: explain.go
+
+package certlib
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// Proof explanations.  ExplainProof turns a proof into a graph whose
+// nodes are the clauses and whose edges are the rules applied, with the
+// statements it starts from traced back to the evidence item or policy
+// statement they came from.  It is written as JSON or as a Graphviz DOT
+// graph, so reviewers can see why an artifact was issued.
+
+// Where a proved statement came from.
+const (
+	SourcePolicyKey = "policy-key"
+	SourceEvidence = "evidence"
+	SourcePolicy = "policy"
+)
+
+// sourcePolicyKey, in the indices VerifyEvidenceContext notes, is the
+// policy key axiom.
+const sourcePolicyKey = -1
+
+type evidenceSourcesKey struct{}
+
+// WithEvidenceSources has VerifyEvidenceContext append to *sources, for
+// each statement it proves, the index of the evidence item it came from
+// (-1 for the policy key axiom).  Statements added to the proved
+// statements after that are policy statements.
+func WithEvidenceSources(ctx context.Context, sources *[]int) context.Context {
+	return context.WithValue(ctx, evidenceSourcesKey{}, sources)
+}
+
+func noteEvidenceSources(ctx context.Context, source int, n int) {
+	if sources, ok := ctx.Value(evidenceSourcesKey{}).(*[]int); ok {
+		for i := 0; i < n; i++ {
+			*sources = append(*sources, source)
+		}
+	}
+}
+
+// ExplainedEntity is a key, named by its fingerprint, or a measurement.
+type ExplainedEntity struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Measurement string `json:"measurement,omitempty"`
+}
+
+// ExplainedClause is a node of the proof graph.  Statements the proof
+// starts from have a Source; the others were derived in a step.
+type ExplainedClause struct {
+	Id string `json:"id,omitempty"`
+	Text string `json:"text"`
+	Subject *ExplainedEntity `json:"subject,omitempty"`
+	Verb string `json:"verb"`
+	Object *ExplainedEntity `json:"object,omitempty"`
+	Clause *ExplainedClause `json:"clause,omitempty"`
+	Source string `json:"source,omitempty"`
+	EvidenceIndex *int `json:"evidence_index,omitempty"`
+	EvidenceType string `json:"evidence_type,omitempty"`
+}
+
+// ExplainedStep is "premises imply conclusion" by rule Rule.  Premises
+// and Conclusion are node ids.
+type ExplainedStep struct {
+	Rule int32 `json:"rule"`
+	Premises []string `json:"premises"`
+	Conclusion string `json:"conclusion"`
+}
+
+// ProofExplanation is a proof as a graph.  Conclusion is the id of the
+// node proved.
+type ProofExplanation struct {
+	Conclusion string `json:"conclusion"`
+	Nodes []*ExplainedClause `json:"nodes"`
+	Steps []*ExplainedStep `json:"steps"`
+}
+
+func explainEntity(e *certprotos.EntityMessage) (*ExplainedEntity, string) {
+	if e == nil {
+		return nil, ""
+	}
+	if e.GetEntityType() == "measurement" {
+		m := hex.EncodeToString(e.GetMeasurement())
+		return &ExplainedEntity{Type: "measurement", Measurement: m}, "Measurement[" + m + "]"
+	}
+	if e.GetEntityType() == "key" {
+		fp := KeyFingerprint(e.GetKey())
+		short := fp
+		if len(short) > 16 {
+			short = short[:16]
+		}
+		text := "Key[" + short + "]"
+		if e.GetKey().GetKeyName() != "" {
+			text = "Key[" + e.GetKey().GetKeyName() + ", " + short + "]"
+		}
+		return &ExplainedEntity{Type: "key", Name: e.GetKey().GetKeyName(), Fingerprint: fp}, text
+	}
+	return &ExplainedEntity{Type: e.GetEntityType()}, e.GetEntityType()
+}
+
+// explainClause describes c and returns a string identifying it, which
+// names keys by their whole fingerprint rather than the short one in the
+// text.
+func explainClause(c *certprotos.VseClause) (*ExplainedClause, string) {
+	ec := &ExplainedClause{Verb: c.GetVerb()}
+	var s []string
+	var id []string
+	var text string
+	if c.GetSubject() != nil {
+		ec.Subject, text = explainEntity(c.GetSubject())
+		s = append(s, text)
+		id = append(id, ec.Subject.Fingerprint + ec.Subject.Measurement)
+	}
+	s = append(s, c.GetVerb())
+	id = append(id, c.GetVerb())
+	if c.GetObject() != nil {
+		ec.Object, text = explainEntity(c.GetObject())
+		s = append(s, text)
+		id = append(id, ec.Object.Fingerprint + ec.Object.Measurement)
+	}
+	if c.GetClause() != nil {
+		var key string
+		ec.Clause, key = explainClause(c.GetClause())
+		s = append(s, ec.Clause.Text)
+		id = append(id, "(" + key + ")")
+	}
+	ec.Text = strings.Join(s, " ")
+	return ec, strings.Join(id, " ")
+}
+
+// ExplainProof explains proof of toProve.  proved are the statements it
+// starts from, evidence the evidence they came from and sources what
+// WithEvidenceSources noted.
+func ExplainProof(toProve *certprotos.VseClause, proof *certprotos.Proof, proved *certprotos.ProvedStatements,
+		evidence []*certprotos.Evidence, sources []int) *ProofExplanation {
+	pe := &ProofExplanation{}
+	nodes := make(map[string]*ExplainedClause)
+	node := func(c *certprotos.VseClause) string {
+		ec, key := explainClause(c)
+		if n, ok := nodes[key]; ok {
+			return n.Id
+		}
+		ec.Id = fmt.Sprintf("n%d", len(pe.Nodes))
+		nodes[key] = ec
+		pe.Nodes = append(pe.Nodes, ec)
+		return ec.Id
+	}
+
+	for _, step := range proof.GetSteps() {
+		pe.Steps = append(pe.Steps, &ExplainedStep{
+			Rule: step.GetRuleApplied(),
+			Premises: []string{node(step.S1), node(step.S2)},
+			Conclusion: node(step.Conclusion),
+		})
+	}
+	pe.Conclusion = node(toProve)
+
+	for i, c := range proved.GetProved() {
+		_, key := explainClause(c)
+		ec, ok := nodes[key]
+		if !ok || ec.Source != "" {
+			continue
+		}
+		if i >= len(sources) {
+			ec.Source = SourcePolicy
+		} else if sources[i] == sourcePolicyKey {
+			ec.Source = SourcePolicyKey
+		} else {
+			ec.Source = SourceEvidence
+			index := sources[i]
+			ec.EvidenceIndex = &index
+			if index < len(evidence) {
+				ec.EvidenceType = evidence[index].GetEvidenceType()
+			}
+		}
+	}
+	return pe
+}
+
+// JSON is the explanation as indented JSON.
+func (pe *ProofExplanation) JSON() ([]byte, error) {
+	return json.MarshalIndent(pe, "", "  ")
+}
+
+// dotQuote quotes lines as a DOT label.
+func dotQuote(lines ...string) string {
+	for i := range lines {
+		lines[i] = strings.ReplaceAll(strings.ReplaceAll(lines[i], "\\", "\\\\"), "\"", "\\\"")
+	}
+	return "\"" + strings.Join(lines, "\\n") + "\""
+}
+
+// DOT is the explanation as a Graphviz graph: statements from evidence
+// are blue, from the policy green, and the conclusion is outlined twice.
+// Edges go from premises to conclusions and carry the rule.
+func (pe *ProofExplanation) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph proof {\n")
+	b.WriteString("  rankdir=BT;\n")
+	b.WriteString("  node [shape=box, fontname=\"Helvetica\"];\n")
+	for _, n := range pe.Nodes {
+		label := []string{n.Text}
+		attrs := ""
+		switch n.Source {
+		case SourceEvidence:
+			label = append(label, fmt.Sprintf("evidence %d (%s)", *n.EvidenceIndex, n.EvidenceType))
+			attrs = ", style=filled, fillcolor=lightblue"
+		case SourcePolicy:
+			label = append(label, "policy")
+			attrs = ", style=filled, fillcolor=palegreen"
+		case SourcePolicyKey:
+			label = append(label, "policy key axiom")
+			attrs = ", style=filled, fillcolor=lightgrey"
+		}
+		if n.Id == pe.Conclusion {
+			attrs += ", peripheries=2"
+		}
+		fmt.Fprintf(&b, "  %s [label=%s%s];\n", n.Id, dotQuote(label...), attrs)
+	}
+	for _, s := range pe.Steps {
+		for _, p := range s.Premises {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", p, s.Conclusion, dotQuote(fmt.Sprintf("rule %d", s.Rule)))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
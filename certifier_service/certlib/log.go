@@ -0,0 +1,127 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: log.go
+
+package certlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// Logging.  certlib, and certservice above it, log through a log/slog
+// Logger that discards everything until SetLogger is called, so the
+// library is quiet unless the program asks.  Keys, reports and other
+// byte strings are logged as Sensitive: only their length and a hash
+// prefix, unless SetLogSensitive(true).  The Print functions still
+// write to stdout, for the utilities.
+
+var logger atomic.Pointer[slog.Logger]
+var logSensitive atomic.Bool
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h discardHandler) WithGroup(string) slog.Handler { return h }
+
+func init() {
+	logger.Store(slog.New(discardHandler{}))
+}
+
+// SetLogger sets the logger; nil discards everything.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	logger.Store(l)
+}
+
+// Logger is the logger set by SetLogger.
+func Logger() *slog.Logger {
+	return logger.Load()
+}
+
+// SetLogSensitive logs Sensitive values in full, in hex.  Only for
+// debugging test deployments.
+func SetLogSensitive(on bool) {
+	logSensitive.Store(on)
+}
+
+// NewLogger makes a logger that writes records of at least level to w,
+// as JSON if json is set and otherwise as key=value text.
+func NewLogger(w io.Writer, level slog.Leveler, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// ParseLogLevel parses debug, info, warn or error.
+func ParseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+// Sensitive is a byte string that is redacted in logs.
+type Sensitive []byte
+
+func (b Sensitive) LogValue() slog.Value {
+	if logSensitive.Load() {
+		return slog.StringValue(hex.EncodeToString(b))
+	}
+	h := sha256.Sum256(b)
+	return slog.GroupValue(slog.Int("len", len(b)), slog.String("sha256", hex.EncodeToString(h[:8])))
+}
+
+// Clause logs c in the usual text form.  Clauses name keys by their
+// public parts only.
+func Clause(key string, c *certprotos.VseClause) slog.Attr {
+	return slog.String(key, VseClauseToString(c))
+}
+
+// Key logs the public descriptor of k, never its private parts.
+func Key(key string, k *certprotos.KeyMessage) slog.Attr {
+	return slog.String(key, KeyDescriptorToString(k))
+}
+
+// Clauses logs a list of clauses, like the proved statements.
+func Clauses(key string, l []*certprotos.VseClause) slog.Attr {
+	s := make([]string, len(l))
+	for i := 0; i < len(l); i++ {
+		s[i] = VseClauseToString(l[i])
+	}
+	return slog.Any(key, s)
+}
+
+// Proof logs each step of p as "s1 and s2 imply conclusion (rule n)".
+func Proof(key string, p *certprotos.Proof) slog.Attr {
+	var s []string
+	for _, step := range p.GetSteps() {
+		s = append(s, fmt.Sprintf("%s and %s imply %s (rule %d)", VseClauseToString(step.S1),
+			VseClauseToString(step.S2), VseClauseToString(step.Conclusion), step.GetRuleApplied()))
+	}
+	return slog.Any(key, s)
+}
@@ -0,0 +1,303 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: merkle.go
+
+package certlib
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// Merkle trees for the transparency log of issued artifacts, as in
+// RFC 6962 (and RFC 9162): leaves are hashed as SHA-256(0 || artifact)
+// and interior nodes as SHA-256(1 || left || right).
+
+func MerkleLeafHash(data []byte) []byte {
+	h := sha256.Sum256(append([]byte{0}, data...))
+	return h[:]
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	b := make([]byte, 0, 1 + len(left) + len(right))
+	b = append(b, 1)
+	b = append(b, left...)
+	b = append(b, right...)
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// largestPowerOfTwoBelow is the largest power of 2 less than n, n > 1.
+func largestPowerOfTwoBelow(n int64) int64 {
+	k := int64(1)
+	for k << 1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// MerkleTree keeps the hash of every complete subtree, so roots and
+// proofs for any size take O(log^2 n) hashes.
+type MerkleTree struct {
+	// levels[k][i] is the hash of leaves [i*2^k, (i+1)*2^k).
+	levels [][][]byte
+}
+
+func (t *MerkleTree) Size() int64 {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return int64(len(t.levels[0]))
+}
+
+// AppendLeaf adds the leaf with hash h and returns its index.
+func (t *MerkleTree) AppendLeaf(h []byte) int64 {
+	if len(t.levels) == 0 {
+		t.levels = append(t.levels, nil)
+	}
+	t.levels[0] = append(t.levels[0], h)
+	for k := 0; len(t.levels[k]) % 2 == 0; k++ {
+		if k + 1 == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		l := t.levels[k]
+		t.levels[k + 1] = append(t.levels[k + 1], merkleNodeHash(l[len(l) - 2], l[len(l) - 1]))
+	}
+	return t.Size() - 1
+}
+
+// subtreeHash is the root of leaves [lo, hi), hi > lo.
+func (t *MerkleTree) subtreeHash(lo int64, hi int64) []byte {
+	n := hi - lo
+	if n & (n - 1) == 0 && lo % n == 0 {
+		k := 0
+		for int64(1) << k < n {
+			k++
+		}
+		return t.levels[k][lo / n]
+	}
+	k := largestPowerOfTwoBelow(n)
+	return merkleNodeHash(t.subtreeHash(lo, lo + k), t.subtreeHash(lo + k, hi))
+}
+
+// Root is the root of the first size leaves.
+func (t *MerkleTree) Root(size int64) ([]byte, error) {
+	if size < 0 || size > t.Size() {
+		return nil, errors.New("no such tree size")
+	}
+	if size == 0 {
+		h := sha256.Sum256(nil)
+		return h[:], nil
+	}
+	return t.subtreeHash(0, size), nil
+}
+
+func (t *MerkleTree) path(m int64, lo int64, hi int64) [][]byte {
+	n := hi - lo
+	if n == 1 {
+		return nil
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m < k {
+		return append(t.path(m, lo, lo + k), t.subtreeHash(lo + k, hi))
+	}
+	return append(t.path(m - k, lo + k, hi), t.subtreeHash(lo, lo + k))
+}
+
+// InclusionProof is the audit path for leaf index in the tree of the
+// first size leaves.
+func (t *MerkleTree) InclusionProof(index int64, size int64) ([][]byte, error) {
+	if size > t.Size() || index < 0 || index >= size {
+		return nil, errors.New("no such leaf in a tree of that size")
+	}
+	return t.path(index, 0, size), nil
+}
+
+func (t *MerkleTree) subproof(m int64, lo int64, hi int64, complete bool) [][]byte {
+	n := hi - lo
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{t.subtreeHash(lo, hi)}
+	}
+	k := largestPowerOfTwoBelow(n)
+	if m <= k {
+		return append(t.subproof(m, lo, lo + k, complete), t.subtreeHash(lo + k, hi))
+	}
+	return append(t.subproof(m - k, lo + k, hi, false), t.subtreeHash(lo, lo + k))
+}
+
+// ConsistencyProof shows the tree of the first first leaves is a
+// prefix of the tree of the first second leaves.
+func (t *MerkleTree) ConsistencyProof(first int64, second int64) ([][]byte, error) {
+	if first < 0 || first > second || second > t.Size() {
+		return nil, errors.New("no consistency proof for those sizes")
+	}
+	if first == 0 || first == second {
+		return nil, nil
+	}
+	return t.subproof(first, 0, second, true), nil
+}
+
+// VerifyInclusionProof checks that leafHash is leaf index of the tree
+// of size leaves with root.
+func VerifyInclusionProof(leafHash []byte, index int64, size int64, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn := index
+	sn := size - 1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn & 1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn & 1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistencyProof checks that the tree of first leaves with
+// firstRoot is a prefix of the tree of second leaves with secondRoot.
+func VerifyConsistencyProof(first int64, second int64, path [][]byte, firstRoot []byte, secondRoot []byte) bool {
+	if first < 0 || first > second {
+		return false
+	}
+	if first == second {
+		return len(path) == 0 && bytes.Equal(firstRoot, secondRoot)
+	}
+	if first == 0 {
+		return len(path) == 0
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if first & (first - 1) == 0 {
+		path = append([][]byte{firstRoot}, path...)
+	}
+	fn := first - 1
+	sn := second - 1
+	for fn & 1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr := path[0]
+	sr := path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn & 1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn & 1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
+
+// TreeHeadContext starts the bytes a tree head signature covers.  The
+// policy key also signs claims, and the prefix keeps a signed tree head
+// from passing for anything else it signs.
+const TreeHeadContext = "certifier-transparency-log-tree-head-v1\x00"
+
+func treeHeadSignedBytes(ser []byte) []byte {
+	return append([]byte(TreeHeadContext), ser...)
+}
+
+// SignTreeHead signs th with the private key k.
+func SignTreeHead(th *certprotos.TreeHead, k *certprotos.KeyMessage) *certprotos.SignedTreeHead {
+	alg := RsaSigningAlgorithm(k.GetKeyType())
+	if alg == "" {
+		return nil
+	}
+	PK := rsa.PublicKey{}
+	pK := rsa.PrivateKey{}
+	if k.GetRsaKey() == nil || !GetRsaKeysFromInternal(k, &pK, &PK) || pK.D == nil {
+		return nil
+	}
+	ser, err := proto.Marshal(th)
+	if err != nil {
+		return nil
+	}
+	sig := RsaSha256Sign(&pK, treeHeadSignedBytes(ser))
+	if sig == nil {
+		return nil
+	}
+	return &certprotos.SignedTreeHead{
+		SerializedTreeHead: ser,
+		SigningAlgorithm: &alg,
+		Signature: sig,
+	}
+}
+
+// VerifyTreeHead checks the signature on sth with the key in the
+// policy cert and returns the tree head.
+func VerifyTreeHead(sth *certprotos.SignedTreeHead, policyCert *x509.Certificate) (*certprotos.TreeHead, error) {
+	PK, ok := policyCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("policy cert key is not rsa")
+	}
+	if !RsaSha256Verify(PK, treeHeadSignedBytes(sth.GetSerializedTreeHead()), sth.GetSignature()) {
+		return nil, errors.New("tree head signature doesn't verify")
+	}
+	th := &certprotos.TreeHead{}
+	if err := proto.Unmarshal(sth.GetSerializedTreeHead(), th); err != nil {
+		return nil, err
+	}
+	return th, nil
+}
+
+// VerifyLogInclusion checks that artifact is in the log whose signed
+// tree head is sth, as the inclusion proof says.
+func VerifyLogInclusion(artifact []byte, sth *certprotos.SignedTreeHead, ip *certprotos.InclusionProof,
+		policyCert *x509.Certificate) error {
+	th, err := VerifyTreeHead(sth, policyCert)
+	if err != nil {
+		return err
+	}
+	if ip.GetTreeSize() != th.GetTreeSize() {
+		return errors.New("inclusion proof is for another tree size")
+	}
+	if !VerifyInclusionProof(MerkleLeafHash(artifact), ip.GetLeafIndex(), ip.GetTreeSize(),
+			ip.GetAuditPath(), th.GetRootHash()) {
+		return errors.New("inclusion proof doesn't verify")
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: prover.go
+
+package certlib
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// A forward-chaining prover.  Starting from the proved statements, it
+// applies the certifier rules (see InitCerifierRules) to pairs of
+// statements, a round at a time, until it proves a goal or nothing new
+// follows.  Each round only tries the pairs with a statement derived in
+// the round before.  The proof is the steps the goal needs, in the order
+// they were derived.  Each step is checked with VerifyProofStep, so
+// CheckProofWithRules accepts any proof it finds.  Rules the policy
+// declares are tried after R1-R7.
+//
+// The statements come from the evidence, so the prover gives up once it
+// holds MaxProverStatements of them, and between rounds if its context
+// is done.
+
+// MaxProverStatements bounds the given and derived statements of one
+// proof search.
+const MaxProverStatements = 1024
+
+// proverRule proposes what rule concludes from s1 and s2, or nil.  The
+// proposal is only used if the rule verifies.
+type proverRule struct {
+	rule int32
+	conclude func(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause
+}
+
+// saidClause proposes X from "key says X".
+func saidClause(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+	if s2.GetVerb() != "says" {
+		return nil
+	}
+	return s2.Clause
+}
+
+// speakerIs proposes "key verb" from "key speaks-for ...".
+func speakerIs(verb string) func(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+	return func(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+		if s2.GetVerb() != "speaks-for" || s2.Subject == nil {
+			return nil
+		}
+		v := verb
+		return MakeUnaryVseClause(s2.Subject, &v)
+	}
+}
+
+// delegated proposes "key3 speaks-for X" from "key2 speaks-for X" and
+// "key3 speaks-for key2".
+func delegated(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+	if s1.GetVerb() != "speaks-for" || s2.GetVerb() != "speaks-for" || s1.Object == nil || s2.Subject == nil {
+		return nil
+	}
+	verb := "speaks-for"
+	return MakeSimpleVseClause(s2.Subject, &verb, s1.Object)
+}
+
+// inherited proposes "key2 P" from "key2 speaks-for key1" and "key1 P".
+func inherited(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+	if s1.GetVerb() != "speaks-for" || s1.Subject == nil || s2.Verb == nil || s2.Object != nil ||
+			s2.Clause != nil {
+		return nil
+	}
+	verb := s2.GetVerb()
+	return MakeUnaryVseClause(s1.Subject, &verb)
+}
+
+var proverRules = []proverRule{
+	{3, saidClause},
+	{5, saidClause},
+	{6, saidClause},
+	{1, speakerIs("is-trusted-for-authentication")},
+	{7, speakerIs("is-trusted-for-attestation")},
+	{2, delegated},
+	{4, inherited},
+}
+
+// Prover holds what has been proved so far and how.
+type Prover struct {
+	tree *PredicateDominance
+	rules []*DeclaredRule
+	// proverRules are the built-in proverRules, then the declared rules.
+	proverRules []proverRule
+	// statements are the given statements, then the derived ones.
+	// steps[i] derived statements[i] from statements premises[i]; it is
+	// nil for given statements.
+	statements []*certprotos.VseClause
+	steps []*certprotos.ProofStep
+	premises [][2]int
+	// index maps clauseKey(statements[i]) to i.
+	index map[string]int
+	// tried is how many statements every rule has been tried on, in
+	// pairs with each other.
+	tried int
+}
+
+// ErrTooManyStatements is the error Prove returns when the search holds
+// MaxProverStatements statements.
+var ErrTooManyStatements = NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST,
+	"proof search exceeds %d statements", MaxProverStatements)
+
+func entityKey(b *strings.Builder, e *certprotos.EntityMessage) {
+	switch e.GetEntityType() {
+	case "measurement":
+		b.WriteString("m:" + hex.EncodeToString(e.GetMeasurement()))
+	case "key":
+		k := e.GetKey()
+		b.WriteString("k:" + k.GetKeyType() + ":")
+		switch {
+		case k.GetRsaKey() != nil && strings.HasPrefix(k.GetKeyType(), "rsa-"):
+			b.WriteString(hex.EncodeToString(k.GetRsaKey().GetPublicModulus()) + ":" +
+				hex.EncodeToString(k.GetRsaKey().GetPublicExponent()))
+		case k.GetEccKey() != nil && strings.HasPrefix(k.GetKeyType(), "ecc-"):
+			ek := k.GetEccKey()
+			b.WriteString(ek.GetCurveName())
+			for _, p := range []*certprotos.PointMessage{ek.GetBasePoint(), ek.GetPublicPoint()} {
+				b.WriteString(":" + hex.EncodeToString(p.GetX()) + "," + hex.EncodeToString(p.GetY()))
+			}
+		default:
+			// SameKey never matches these.
+			fmt.Fprintf(b, "%p", k)
+		}
+	default:
+		fmt.Fprintf(b, "%p", e)
+	}
+}
+
+// clauseKey serializes c so that clauses are SameVseClause when their
+// keys are equal.
+func clauseKey(c *certprotos.VseClause) string {
+	var b strings.Builder
+	for ; c != nil; c = c.Clause {
+		entityKey(&b, c.Subject)
+		b.WriteString(" " + c.GetVerb() + " ")
+		if c.Object != nil {
+			entityKey(&b, c.Object)
+		}
+		b.WriteString(";")
+	}
+	return b.String()
+}
+
+// NewProver starts a prover from the statements in ps, which it doesn't
+// change.
+func NewProver(tree *PredicateDominance, ps *certprotos.ProvedStatements) *Prover {
+	return NewProverWithRules(tree, nil, ps)
+}
+
+// NewProverWithRules is NewProver that also uses the declared rules.
+func NewProverWithRules(tree *PredicateDominance, rules []*DeclaredRule, ps *certprotos.ProvedStatements) *Prover {
+	pr := &Prover{
+		tree: tree,
+		rules: rules,
+		proverRules: append([]proverRule{}, proverRules...),
+		index: make(map[string]int),
+	}
+	for i, r := range rules {
+		pr.proverRules = append(pr.proverRules, proverRule{int32(FirstDeclaredRule + i), r.Conclude})
+	}
+	for _, c := range ps.GetProved() {
+		if c != nil && pr.find(c) < 0 {
+			pr.add(c, nil, [2]int{-1, -1})
+		}
+	}
+	return pr
+}
+
+func (pr *Prover) add(c *certprotos.VseClause, step *certprotos.ProofStep, premises [2]int) {
+	pr.index[clauseKey(c)] = len(pr.statements)
+	pr.statements = append(pr.statements, c)
+	pr.steps = append(pr.steps, step)
+	pr.premises = append(pr.premises, premises)
+}
+
+func (pr *Prover) find(c *certprotos.VseClause) int {
+	if c == nil || c.Subject == nil {
+		return -1
+	}
+	if i, ok := pr.index[clauseKey(c)]; ok {
+		return i
+	}
+	return -1
+}
+
+// Proved says whether c is given or has been derived.
+func (pr *Prover) Proved(c *certprotos.VseClause) bool {
+	return pr.find(c) >= 0
+}
+
+// round applies every rule to the pairs of statements proved before it
+// started that it hasn't tried, and says whether it derived anything.
+// It fails once there are too many statements.
+func (pr *Prover) round() (bool, error) {
+	n := len(pr.statements)
+	if n > MaxProverStatements {
+		return false, ErrTooManyStatements
+	}
+	derived := false
+	for i := 0; i < n; i++ {
+		j := 0
+		if i < pr.tried {
+			j = pr.tried
+		}
+		for ; j < n; j++ {
+			s1 := pr.statements[i]
+			s2 := pr.statements[j]
+			for _, r := range pr.proverRules {
+				c := r.conclude(s1, s2)
+				if c == nil || pr.find(c) >= 0 {
+					continue
+				}
+				if !VerifyProofStep(pr.tree, pr.rules, s1, s2, c, int(r.rule)) {
+					continue
+				}
+				if len(pr.statements) >= MaxProverStatements {
+					return false, ErrTooManyStatements
+				}
+				rule := r.rule
+				pr.add(c, &certprotos.ProofStep{
+					S1: s1,
+					S2: s2,
+					Conclusion: c,
+					RuleApplied: &rule,
+				}, [2]int{i, j})
+				derived = true
+			}
+		}
+	}
+	pr.tried = n
+	return derived, nil
+}
+
+// provedGoal is the first of goals that has been derived, or -1.
+func (pr *Prover) provedGoal(goals []*certprotos.VseClause) int {
+	for _, g := range goals {
+		i := pr.find(g)
+		if i >= 0 && pr.steps[i] != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// Prove derives statements until one of goals is derived, and returns
+// it and its proof, or until nothing new follows, and returns nil.  It
+// fails with ctx.Err() if ctx is done before a round, or with
+// ErrTooManyStatements.
+func (pr *Prover) Prove(ctx context.Context, goals []*certprotos.VseClause) (*certprotos.VseClause,
+		*certprotos.Proof, error) {
+	for {
+		if g := pr.provedGoal(goals); g >= 0 {
+			return pr.statements[g], pr.proof(g), nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		derived, err := pr.round()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !derived {
+			return nil, nil, nil
+		}
+	}
+}
+
+// proof is the steps statements[goal] needs.
+func (pr *Prover) proof(goal int) *certprotos.Proof {
+	needed := make([]bool, len(pr.statements))
+	var mark func(i int)
+	mark = func(i int) {
+		if needed[i] || pr.steps[i] == nil {
+			return
+		}
+		needed[i] = true
+		mark(pr.premises[i][0])
+		mark(pr.premises[i][1])
+	}
+	mark(goal)
+
+	proof := &certprotos.Proof{}
+	for i, step := range pr.steps {
+		if needed[i] {
+			proof.Steps = append(proof.Steps, step)
+		}
+	}
+	return proof
+}
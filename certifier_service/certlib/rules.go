@@ -0,0 +1,404 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: rules.go
+
+package certlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// Besides R1-R7, a policy may declare rules in a signed claim of format
+// RulesClaimFormat whose serialized claim is a certifier_rules message.
+// Each rule is a template over vse clauses, for example
+//	if M is-trusted and A is-trusted-for-attestation and A says K speaks-for M then K is-trusted-for-authentication
+// It has any number of premises and a conclusion.  A clause is "X verb",
+// "X verb Y" or "X says clause".  Words starting with an upper case letter
+// are variables, which match any key or measurement, the same one wherever
+// they appear; every variable in the conclusion must be in a premise.
+// Measurement[hex], as EntityToString writes it, is a constant that
+// matches only that measurement.  Vse clauses have no qualifiers, so a
+// rule can't say "K speaks-for M on P"; ParseRule refuses one with
+// ErrRuleQualifier.
+//
+// A proof step has two premises.  A rule with one premise is applied with
+// the premise as both s1 and s2.  A rule with n > 2 premises is applied in
+// n-1 steps: the first matches premises 1 and 2 and concludes a partial
+// clause holding what they matched, each later step takes the partial
+// clause as s1 and the next premise as s2, and the last concludes the
+// rule's conclusion.  Partial clauses have a verb starting with
+// PartialVerbPrefix, which rules may not use.
+//
+// Declared rules are numbered, in the order declared, from
+// FirstDeclaredRule; that is the rule_applied of a step that uses one.
+
+const RulesClaimFormat = "certifier-rules"
+
+const FirstDeclaredRule = 8
+
+const PartialVerbPrefix = "partial-rule-"
+
+var ErrRuleQualifier = errors.New("vse clauses have no qualifiers")
+
+// term is a variable or a constant entity.
+type term struct {
+	variable string
+	constant *certprotos.EntityMessage
+}
+
+// clausePattern is a vse clause with terms for its entities.
+type clausePattern struct {
+	subject *term
+	verb string
+	object *term
+	clause *clausePattern
+}
+
+// DeclaredRule is a rule parsed by ParseRule.
+type DeclaredRule struct {
+	Text string
+	premises []*clausePattern
+	conclusion *clausePattern
+	// id names the rule in the verbs of its partial clauses.
+	id string
+}
+
+func isVariable(word string) bool {
+	for i, r := range word {
+		if i == 0 && !unicode.IsUpper(r) {
+			return false
+		}
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return word != ""
+}
+
+func parseTerm(word string) (*term, error) {
+	if isVariable(word) {
+		return &term{variable: word}, nil
+	}
+	if strings.HasPrefix(word, "Measurement[") && strings.HasSuffix(word, "]") {
+		m, err := hex.DecodeString(word[len("Measurement[") : len(word) - 1])
+		if err != nil || len(m) == 0 {
+			return nil, fmt.Errorf("%s is not a measurement", word)
+		}
+		return &term{constant: MakeMeasurementEntity(m)}, nil
+	}
+	return nil, fmt.Errorf("%s is not a variable or a measurement", word)
+}
+
+func parseClausePattern(words []string) (*clausePattern, error) {
+	if len(words) < 2 {
+		return nil, fmt.Errorf("\"%s\" is not a clause", strings.Join(words, " "))
+	}
+	subject, err := parseTerm(words[0])
+	if err != nil {
+		return nil, err
+	}
+	p := &clausePattern{
+		subject: subject,
+		verb: words[1],
+	}
+	if isVariable(p.verb) || strings.HasPrefix(p.verb, "Measurement[") {
+		return nil, fmt.Errorf("%s is not a verb", p.verb)
+	}
+	if strings.HasPrefix(p.verb, PartialVerbPrefix) {
+		return nil, fmt.Errorf("%s is reserved for partial clauses", p.verb)
+	}
+	if p.verb == "says" {
+		c, err := parseClausePattern(words[2:])
+		if err != nil {
+			return nil, err
+		}
+		p.clause = c
+		return p, nil
+	}
+	for i := 2; i < len(words); i++ {
+		if words[i] == "on" {
+			return nil, fmt.Errorf("\"%s\": %w", strings.Join(words[i:], " "), ErrRuleQualifier)
+		}
+	}
+	switch len(words) {
+	case 2:
+	case 3:
+		p.object, err = parseTerm(words[2])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("\"%s\" is not a clause", strings.Join(words, " "))
+	}
+	return p, nil
+}
+
+// terms lists the terms in p, subject first, in order.
+func (p *clausePattern) terms() []*term {
+	var l []*term
+	for ; p != nil; p = p.clause {
+		l = append(l, p.subject)
+		if p.object != nil {
+			l = append(l, p.object)
+		}
+	}
+	return l
+}
+
+func (p *clausePattern) variables(vars map[string]bool) {
+	for _, t := range p.terms() {
+		if t.constant == nil {
+			vars[t.variable] = true
+		}
+	}
+}
+
+// ParseRule parses "if premise [and premise]... then conclusion".
+func ParseRule(text string) (*DeclaredRule, error) {
+	words := strings.Fields(text)
+	if len(words) == 0 || words[0] != "if" {
+		return nil, errors.New("rule doesn't start with if")
+	}
+	then := -1
+	for i, w := range words {
+		if w == "then" {
+			then = i
+		}
+	}
+	if then < 0 {
+		return nil, errors.New("rule has no then")
+	}
+	r := &DeclaredRule{
+		Text: strings.Join(words, " "),
+	}
+	start := 1
+	for i := 1; i <= then; i++ {
+		if i < then && words[i] != "and" {
+			continue
+		}
+		p, err := parseClausePattern(words[start:i])
+		if err != nil {
+			return nil, err
+		}
+		r.premises = append(r.premises, p)
+		start = i + 1
+	}
+	c, err := parseClausePattern(words[then + 1:])
+	if err != nil {
+		return nil, err
+	}
+	r.conclusion = c
+
+	bound := make(map[string]bool)
+	for _, p := range r.premises {
+		p.variables(bound)
+	}
+	used := make(map[string]bool)
+	c.variables(used)
+	for v := range used {
+		if !bound[v] {
+			return nil, fmt.Errorf("%s is not in a premise", v)
+		}
+	}
+	h := sha256.Sum256([]byte(r.Text))
+	r.id = hex.EncodeToString(h[:8])
+	return r, nil
+}
+
+// Verbs lists the verbs in the rule, including says.
+func (r *DeclaredRule) Verbs() []string {
+	var verbs []string
+	for _, p := range append(append([]*clausePattern{}, r.premises...), r.conclusion) {
+		for ; p != nil; p = p.clause {
+			verbs = append(verbs, p.verb)
+		}
+	}
+	return verbs
+}
+
+func (t *term) bind(bindings map[string]*certprotos.EntityMessage, e *certprotos.EntityMessage) bool {
+	if e == nil {
+		return false
+	}
+	if t.constant != nil {
+		return SameEntity(t.constant, e)
+	}
+	if b, ok := bindings[t.variable]; ok {
+		return SameEntity(b, e)
+	}
+	bindings[t.variable] = e
+	return true
+}
+
+func (t *term) entity(bindings map[string]*certprotos.EntityMessage) *certprotos.EntityMessage {
+	if t.constant != nil {
+		return t.constant
+	}
+	return bindings[t.variable]
+}
+
+func (p *clausePattern) match(c *certprotos.VseClause, bindings map[string]*certprotos.EntityMessage) bool {
+	if c == nil || c.Verb == nil || c.GetVerb() != p.verb || !p.subject.bind(bindings, c.Subject) {
+		return false
+	}
+	if p.verb == "says" && c.Subject.GetEntityType() != "key" {
+		return false
+	}
+	if p.object != nil {
+		if !p.object.bind(bindings, c.Object) {
+			return false
+		}
+	} else if c.Object != nil {
+		return false
+	}
+	if p.clause != nil {
+		return p.clause.match(c.Clause, bindings)
+	}
+	return c.Clause == nil
+}
+
+func (p *clausePattern) instantiate(bindings map[string]*certprotos.EntityMessage) *certprotos.VseClause {
+	verb := p.verb
+	if p.clause != nil {
+		return MakeIndirectVseClause(p.subject.entity(bindings), &verb, p.clause.instantiate(bindings))
+	}
+	if p.object != nil {
+		return MakeSimpleVseClause(p.subject.entity(bindings), &verb, p.object.entity(bindings))
+	}
+	return MakeUnaryVseClause(p.subject.entity(bindings), &verb)
+}
+
+// partialVerb is the verb of r's partial clauses once k premises match.
+func (r *DeclaredRule) partialVerb(k int) string {
+	return fmt.Sprintf("%s%d", r.partialPrefix(), k)
+}
+
+func (r *DeclaredRule) partialPrefix() string {
+	return PartialVerbPrefix + r.id + "-"
+}
+
+// partialTerms lists the terms of the first k premises.
+func (r *DeclaredRule) partialTerms(k int) []*term {
+	var l []*term
+	for _, p := range r.premises[:k] {
+		l = append(l, p.terms()...)
+	}
+	return l
+}
+
+// partial is r's partial clause once k premises match: what each of their
+// terms matched, in order, two to a clause.
+func (r *DeclaredRule) partial(k int, bindings map[string]*certprotos.EntityMessage) *certprotos.VseClause {
+	l := r.partialTerms(k)
+	var c *certprotos.VseClause
+	for i := (len(l) - 1) / 2 * 2; i >= 0; i -= 2 {
+		verb := r.partialVerb(k)
+		link := MakeUnaryVseClause(l[i].entity(bindings), &verb)
+		if i + 1 < len(l) {
+			link.Object = l[i + 1].entity(bindings)
+		}
+		link.Clause = c
+		c = link
+	}
+	return c
+}
+
+// matchPartial binds what c, if it is one of r's partial clauses, holds
+// and returns how many premises it covers, or 0.
+func (r *DeclaredRule) matchPartial(c *certprotos.VseClause, bindings map[string]*certprotos.EntityMessage) int {
+	verb := c.GetVerb()
+	if !strings.HasPrefix(verb, r.partialPrefix()) {
+		return 0
+	}
+	k, err := strconv.Atoi(strings.TrimPrefix(verb, r.partialPrefix()))
+	if err != nil || k < 2 || k >= len(r.premises) || verb != r.partialVerb(k) {
+		return 0
+	}
+	l := r.partialTerms(k)
+	for i := 0; i < len(l); i += 2 {
+		if c == nil || c.GetVerb() != verb || !l[i].bind(bindings, c.Subject) {
+			return 0
+		}
+		if i + 1 < len(l) {
+			if !l[i + 1].bind(bindings, c.Object) {
+				return 0
+			}
+		} else if c.Object != nil {
+			return 0
+		}
+		c = c.Clause
+	}
+	if c != nil {
+		return 0
+	}
+	return k
+}
+
+// Conclude is what r concludes from s1 and s2, or nil if they don't
+// match its premises.  For a rule with more than two premises, that may
+// be a partial clause.
+func (r *DeclaredRule) Conclude(s1 *certprotos.VseClause, s2 *certprotos.VseClause) *certprotos.VseClause {
+	bindings := make(map[string]*certprotos.EntityMessage)
+	if len(r.premises) == 1 {
+		if !SameVseClause(s1, s2) || !r.premises[0].match(s1, bindings) {
+			return nil
+		}
+		return r.conclusion.instantiate(bindings)
+	}
+	k := r.matchPartial(s1, bindings)
+	if k == 0 {
+		if !r.premises[0].match(s1, bindings) {
+			return nil
+		}
+		k = 1
+	}
+	if !r.premises[k].match(s2, bindings) {
+		return nil
+	}
+	if k + 1 < len(r.premises) {
+		return r.partial(k + 1, bindings)
+	}
+	return r.conclusion.instantiate(bindings)
+}
+
+// VerifyDeclaredRule checks c follows from c1 and c2 by declared rule
+// number rule.
+func VerifyDeclaredRule(rules []*DeclaredRule, c1 *certprotos.VseClause, c2 *certprotos.VseClause,
+		c *certprotos.VseClause, rule int) bool {
+	i := rule - FirstDeclaredRule
+	if i < 0 || i >= len(rules) {
+		return false
+	}
+	concluded := rules[i].Conclude(c1, c2)
+	return concluded != nil && SameVseClause(concluded, c)
+}
+
+// VerifyProofStep is VerifyInternalProofStep that also knows the
+// declared rules.
+func VerifyProofStep(tree *PredicateDominance, rules []*DeclaredRule, c1 *certprotos.VseClause,
+		c2 *certprotos.VseClause, c *certprotos.VseClause, rule int) bool {
+	if rule >= FirstDeclaredRule {
+		return VerifyDeclaredRule(rules, c1, c2, c, rule)
+	}
+	return VerifyInternalProofStep(tree, c1, c2, c, rule)
+}
@@ -0,0 +1,203 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: admin.go
+
+package certservice
+
+import (
+        "crypto/subtle"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "net"
+        "net/http"
+        "net/url"
+        "strconv"
+        "time"
+)
+
+// The admin endpoints are for operators, serve them on a listener
+// that isn't exposed to clients.  The /admin/ ones change or reveal the
+// policy and the issuances, so they also check who is asking.
+
+// adminAllowed says whether r may use the /admin/ endpoints: it must
+// carry the admin token as "Authorization: Bearer <token>" or, if the
+// service has no token, come from a loopback address.
+func (cs *CertifierService) adminAllowed(r *http.Request) bool {
+        if cs.adminToken != "" {
+                const prefix = "Bearer "
+                auth := r.Header.Get("Authorization")
+                if len(auth) < len(prefix) || auth[:len(prefix)] != prefix {
+                        return false
+                }
+                return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(cs.adminToken)) == 1
+        }
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                return false
+        }
+        ip := net.ParseIP(host)
+        return ip != nil && ip.IsLoopback()
+}
+
+// adminOnly serves h to callers adminAllowed lets in, and 401 to the rest.
+func (cs *CertifierService) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if !cs.adminAllowed(r) {
+                        if cs.adminToken != "" {
+                                w.Header().Set("WWW-Authenticate", "Bearer")
+                        }
+                        http.Error(w, "admin token required", http.StatusUnauthorized)
+                        return
+                }
+                h(w, r)
+        }
+}
+
+type policyReport struct {
+        Reloaded bool `json:"reloaded"`
+        Error string `json:"error,omitempty"`
+        MeasurementPolicies int `json:"measurement_policies"`
+        PlatformPolicies int `json:"platform_policies"`
+        PolicyStatements int `json:"policy_statements"`
+        PolicyHash string `json:"policy_hash"`
+        LoadedAt string `json:"loaded_at"`
+        Rejected int `json:"rejected_statements"`
+        Statements []PolicyEntryReport `json:"statements"`
+}
+
+func (cs *CertifierService) policyReport() policyReport {
+        p := cs.Policy()
+        return policyReport{
+                MeasurementPolicies: p.MeasurementPolicies(),
+                PlatformPolicies: p.PlatformPolicies(),
+                PolicyStatements: p.StatementCount(),
+                PolicyHash: hex.EncodeToString(p.Hash[:]),
+                LoadedAt: p.LoadedAt.UTC().Format(time.RFC3339),
+                Rejected: p.Rejected(),
+                Statements: p.Report(),
+        }
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(code)
+        json.NewEncoder(w).Encode(v)
+}
+
+// issuanceQuery reads an IssuanceQuery from the query parameters serial,
+// measurement, platform_key, subject_key, issued_after, issued_before,
+// live and limit.  Times are RFC 3339; live is a time or "true", for now.
+func issuanceQuery(v url.Values) (IssuanceQuery, error) {
+        q := IssuanceQuery{
+                Serial: v.Get("serial"),
+                Measurement: v.Get("measurement"),
+                PlatformKey: v.Get("platform_key"),
+                SubjectKey: v.Get("subject_key"),
+        }
+        for _, t := range []struct{
+                name string
+                t *time.Time
+        }{
+                {"issued_after", &q.IssuedAfter},
+                {"issued_before", &q.IssuedBefore},
+                {"live", &q.LiveAt},
+        } {
+                s := v.Get(t.name)
+                if s == "" {
+                        continue
+                }
+                if t.name == "live" && s == "true" {
+                        q.LiveAt = time.Now()
+                        continue
+                }
+                var err error
+                if *t.t, err = time.Parse(time.RFC3339, s); err != nil {
+                        return q, fmt.Errorf("bad %s: %v", t.name, err)
+                }
+        }
+        if s := v.Get("limit"); s != "" {
+                n, err := strconv.Atoi(s)
+                if err != nil {
+                        return q, fmt.Errorf("bad limit: %v", err)
+                }
+                q.Limit = n
+        }
+        return q, nil
+}
+
+type issuancesReport struct {
+        Error string `json:"error,omitempty"`
+        Issuances []*Issuance `json:"issuances"`
+}
+
+// AdminHandler serves
+//      POST /admin/reload-policy   reload the policy from policyFile
+//      GET  /admin/policy          describe the policy in force
+//      GET  /admin/issuances       query the issuance database
+//      GET  /metrics               Prometheus metrics
+//      GET  /healthz, /readyz      liveness and readiness, see healthHandler
+// A rejected reload answers 422 with the reason; the old policy stays.
+// For the issuance query parameters, see issuanceQuery.  The /admin/
+// endpoints answer 401 to callers adminAllowed doesn't let in; the rest
+// are open, for scrapers and probes.
+func (cs *CertifierService) AdminHandler(policyFile string) http.Handler {
+        mux := http.NewServeMux()
+        mux.HandleFunc("/admin/reload-policy", cs.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost {
+                        w.Header().Set("Allow", http.MethodPost)
+                        http.Error(w, "use POST", http.StatusMethodNotAllowed)
+                        return
+                }
+                err := cs.ReloadPolicyFile(policyFile)
+                rep := cs.policyReport()
+                if err != nil {
+                        rep.Error = err.Error()
+                        writeJson(w, http.StatusUnprocessableEntity, rep)
+                        return
+                }
+                rep.Reloaded = true
+                writeJson(w, http.StatusOK, rep)
+        }))
+        mux.HandleFunc("/admin/policy", cs.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+                rep := cs.policyReport()
+                rep.Error = cs.lastReloadError()
+                writeJson(w, http.StatusOK, rep)
+        }))
+        mux.HandleFunc("/admin/issuances", cs.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+                q, err := issuanceQuery(r.URL.Query())
+                if err != nil {
+                        writeJson(w, http.StatusBadRequest, issuancesReport{Error: err.Error()})
+                        return
+                }
+                found, err := cs.QueryIssuances(q)
+                if err == ErrNoIssuanceDB {
+                        writeJson(w, http.StatusNotFound, issuancesReport{Error: err.Error()})
+                        return
+                }
+                if err != nil {
+                        writeJson(w, http.StatusInternalServerError, issuancesReport{Error: err.Error()})
+                        return
+                }
+                if found == nil {
+                        found = []*Issuance{}
+                }
+                writeJson(w, http.StatusOK, issuancesReport{Issuances: found})
+        }))
+        mux.Handle("/metrics", cs.MetricsHandler())
+        mux.HandleFunc("/healthz", cs.healthHandler)
+        mux.HandleFunc("/readyz", cs.healthHandler)
+        return mux
+}
@@ -0,0 +1,369 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: audit.go
+
+package certservice
+
+import (
+        "bufio"
+        "bytes"
+        "crypto/rsa"
+        "crypto/sha256"
+        "crypto/x509"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "os"
+        "sync"
+        "time"
+
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The audit log is a file of JSON records, one per line.  Each record
+// has the SHA-256 of the line before it (all zeros for the first), so
+// removing, reordering or editing a record breaks the chain.  Every so
+// often a checkpoint record signs the chain so far with the policy key;
+// records after the last checkpoint can still be cut off unnoticed, so
+// the log is checkpointed when it is closed.  VerifyAuditLog checks a
+// log; auditverify.go is the command line verifier.
+
+// Kinds of audit record.
+const (
+        AuditRequest = "request"
+        AuditEvent = "event"
+        AuditCheckpoint = "checkpoint"
+)
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+        Seq uint64 `json:"seq"`
+        Time string `json:"time"`
+        Kind string `json:"kind"`
+
+        // Requests.
+        Transport string `json:"transport,omitempty"`
+        Peer string `json:"peer,omitempty"`
+        // Proxy, ClientCert and ClientCertHash are as in Peer.
+        Proxy string `json:"proxy,omitempty"`
+        ClientCert string `json:"client_cert,omitempty"`
+        ClientCertHash string `json:"client_cert_hash,omitempty"`
+        EvidenceType string `json:"evidence_type,omitempty"`
+        Purpose string `json:"purpose,omitempty"`
+        // PolicyHash is the SHA-256 of the policy the request was
+        // evaluated against.
+        PolicyHash string `json:"policy_hash,omitempty"`
+        Measurement string `json:"measurement,omitempty"`
+        // EnclaveKey is certlib.KeyFingerprint of the certified key.
+        EnclaveKey string `json:"enclave_key,omitempty"`
+        // ProofHash is the SHA-256 of the serialized proof.
+        ProofHash string `json:"proof_hash,omitempty"`
+        // Decision is "succeeded", "failed" or, for requests that
+        // couldn't be evaluated, "error".
+        Decision string `json:"decision,omitempty"`
+        CertSerial string `json:"cert_serial,omitempty"`
+        // ArtifactHash is the SHA-256 of the admission cert or
+        // platform rule.
+        ArtifactHash string `json:"artifact_hash,omitempty"`
+        // LogIndex is the artifact's index in the transparency log.
+        LogIndex *int64 `json:"log_index,omitempty"`
+        ErrorCode string `json:"error_code,omitempty"`
+        Reason string `json:"reason,omitempty"`
+        // Request is the serialized trust_request_message, with
+        // Options.AuditRequests, for replaying it (replay.go).
+        Request []byte `json:"request,omitempty"`
+        // Proof explains the proof, with Options.AuditProofs.
+        Proof *certlib.ProofExplanation `json:"proof,omitempty"`
+
+        // Events.
+        Event string `json:"event,omitempty"`
+
+        // Prev is the hex SHA-256 of the previous line.
+        Prev string `json:"prev"`
+        // Signature, on checkpoints, is the policy key's RSA SHA-256
+        // signature of checkpointMessage(Seq, Prev).
+        Signature string `json:"signature,omitempty"`
+}
+
+func checkpointMessage(seq uint64, prev string) []byte {
+        return []byte(fmt.Sprintf("certifier-audit-checkpoint %d %s", seq, prev))
+}
+
+const defaultCheckpointEvery = 100
+
+// AuditLog appends records to an audit log file.  Its methods may be
+// called concurrently.
+type AuditLog struct {
+        mu sync.Mutex
+        f *os.File
+        signingKey *rsa.PrivateKey
+        seq uint64
+        prev [32]byte
+        checkpointEvery int
+        unsigned int
+        stop chan struct{}
+        closed bool
+}
+
+// OpenAuditLog opens or creates the audit log name, continuing the chain
+// of the records already in it.  policyKey signs the checkpoints, one
+// every checkpointEvery records (100 if zero) and, if interval isn't
+// zero, one every interval when there are unsigned records.
+func OpenAuditLog(name string, policyKey *certprotos.KeyMessage, checkpointEvery int,
+                interval time.Duration) (*AuditLog, error) {
+        if policyKey == nil || policyKey.GetRsaKey() == nil || policyKey.GetRsaKey().PrivateExponent == nil {
+                return nil, errors.New("audit log needs a private rsa policy key")
+        }
+        PK := rsa.PublicKey{}
+        pK := rsa.PrivateKey{}
+        if !certlib.GetRsaKeysFromInternal(policyKey, &pK, &PK) {
+                return nil, errors.New("can't get rsa policy key")
+        }
+        f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+        if err != nil {
+                return nil, err
+        }
+        l := &AuditLog{
+                f: f,
+                signingKey: &pK,
+                checkpointEvery: checkpointEvery,
+        }
+        if l.checkpointEvery <= 0 {
+                l.checkpointEvery = defaultCheckpointEvery
+        }
+        if err := l.readTail(); err != nil {
+                f.Close()
+                return nil, fmt.Errorf("%s: %v", name, err)
+        }
+        if interval > 0 {
+                l.stop = make(chan struct{})
+                go l.checkpointEveryInterval(interval)
+        }
+        return l, nil
+}
+
+// readTail finds where the chain in the file left off.
+func (l *AuditLog) readTail() error {
+        b, err := io.ReadAll(l.f)
+        if err != nil {
+                return err
+        }
+        if len(b) == 0 {
+                return nil
+        }
+        if b[len(b) - 1] != '\n' {
+                return errors.New("audit log ends in a partial record")
+        }
+        lines := bytes.Split(b[:len(b) - 1], []byte{'\n'})
+        last := lines[len(lines) - 1]
+        var rec AuditRecord
+        if err := json.Unmarshal(last, &rec); err != nil {
+                return fmt.Errorf("can't parse the last audit record: %v", err)
+        }
+        l.seq = rec.Seq + 1
+        l.prev = sha256.Sum256(last)
+        if rec.Kind != AuditCheckpoint {
+                l.unsigned = 1
+        }
+        return nil
+}
+
+func (l *AuditLog) checkpointEveryInterval(interval time.Duration) {
+        t := time.NewTicker(interval)
+        defer t.Stop()
+        for {
+                select {
+                case <-t.C:
+                        l.mu.Lock()
+                        if !l.closed && l.unsigned > 0 {
+                                l.checkpointLocked()
+                        }
+                        l.mu.Unlock()
+                case <-l.stop:
+                        return
+                }
+        }
+}
+
+// appendLocked chains and writes rec.  l.mu must be held.
+func (l *AuditLog) appendLocked(rec *AuditRecord) error {
+        if l.closed {
+                return errors.New("audit log closed")
+        }
+        rec.Seq = l.seq
+        if rec.Time == "" {
+                rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+        }
+        rec.Prev = hex.EncodeToString(l.prev[:])
+        line, err := json.Marshal(rec)
+        if err != nil {
+                return err
+        }
+        // One write per record, so a crash can't interleave them.
+        if _, err := l.f.Write(append(line, '\n')); err != nil {
+                return err
+        }
+        l.seq++
+        l.prev = sha256.Sum256(line)
+        return nil
+}
+
+func (l *AuditLog) checkpointLocked() error {
+        rec := &AuditRecord{
+                Kind: AuditCheckpoint,
+        }
+        rec.Seq = l.seq
+        prev := hex.EncodeToString(l.prev[:])
+        sig := certlib.RsaSha256Sign(l.signingKey, checkpointMessage(l.seq, prev))
+        if sig == nil {
+                return errors.New("can't sign audit checkpoint")
+        }
+        rec.Signature = hex.EncodeToString(sig)
+        if err := l.appendLocked(rec); err != nil {
+                return err
+        }
+        l.unsigned = 0
+        return l.f.Sync()
+}
+
+// Append adds rec to the log, filling in Seq, Prev and, if it is empty,
+// Time.
+func (l *AuditLog) Append(rec *AuditRecord) error {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if err := l.appendLocked(rec); err != nil {
+                return err
+        }
+        l.unsigned++
+        if l.unsigned >= l.checkpointEvery {
+                return l.checkpointLocked()
+        }
+        return nil
+}
+
+// Checkpoint signs the records so far.
+func (l *AuditLog) Checkpoint() error {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return l.checkpointLocked()
+}
+
+// Close checkpoints any unsigned records and closes the file.
+func (l *AuditLog) Close() error {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if l.closed {
+                return nil
+        }
+        var err error
+        if l.unsigned > 0 {
+                err = l.checkpointLocked()
+        }
+        l.closed = true
+        if l.stop != nil {
+                close(l.stop)
+        }
+        if cerr := l.f.Close(); err == nil {
+                err = cerr
+        }
+        return err
+}
+
+// ReadAuditRecords calls f with each record in the audit log read from
+// r, stopping at the first error.  It doesn't check the chain; see
+// VerifyAuditLog.
+func ReadAuditRecords(r io.Reader, f func(rec *AuditRecord) error) error {
+        br := bufio.NewReader(r)
+        for n := 0; ; n++ {
+                line, err := br.ReadBytes('\n')
+                if err == io.EOF && len(line) == 0 {
+                        return nil
+                }
+                if err != nil && err != io.EOF {
+                        return err
+                }
+                var rec AuditRecord
+                if err := json.Unmarshal(line, &rec); err != nil {
+                        return fmt.Errorf("record %d: can't parse: %v", n, err)
+                }
+                if err := f(&rec); err != nil {
+                        return err
+                }
+        }
+}
+
+// AuditSummary is what VerifyAuditLog found.
+type AuditSummary struct {
+        Records uint64
+        Checkpoints int
+        // Unsigned is the number of records after the last checkpoint.
+        // They could have been cut off without trace, so a log that
+        // was closed cleanly has none.
+        Unsigned int
+}
+
+// VerifyAuditLog checks the chain and the checkpoint signatures in the
+// audit log read from r, with the policy key in policyCert.  The error
+// gives the first record that doesn't check.
+func VerifyAuditLog(r io.Reader, policyCert *x509.Certificate) (*AuditSummary, error) {
+        PK, ok := policyCert.PublicKey.(*rsa.PublicKey)
+        if !ok {
+                return nil, errors.New("policy cert key is not rsa")
+        }
+        summary := &AuditSummary{}
+        var prev [32]byte
+        br := bufio.NewReader(r)
+        for {
+                line, err := br.ReadBytes('\n')
+                if err == io.EOF {
+                        if len(line) > 0 {
+                                return summary, fmt.Errorf("record %d: partial record at the end", summary.Records)
+                        }
+                        return summary, nil
+                }
+                if err != nil {
+                        return summary, err
+                }
+                line = line[:len(line) - 1]
+                var rec AuditRecord
+                if err := json.Unmarshal(line, &rec); err != nil {
+                        return summary, fmt.Errorf("record %d: can't parse: %v", summary.Records, err)
+                }
+                if rec.Seq != summary.Records {
+                        return summary, fmt.Errorf("record %d: has sequence number %d, records are missing",
+                                summary.Records, rec.Seq)
+                }
+                if rec.Prev != hex.EncodeToString(prev[:]) {
+                        return summary, fmt.Errorf("record %d: doesn't chain to the record before it",
+                                summary.Records)
+                }
+                if rec.Kind == AuditCheckpoint {
+                        sig, err := hex.DecodeString(rec.Signature)
+                        if err != nil || !certlib.RsaSha256Verify(PK, checkpointMessage(rec.Seq, rec.Prev), sig) {
+                                return summary, fmt.Errorf("record %d: checkpoint signature doesn't verify",
+                                        summary.Records)
+                        }
+                        summary.Checkpoints++
+                        summary.Unsigned = 0
+                } else {
+                        summary.Unsigned++
+                }
+                prev = sha256.Sum256(line)
+                summary.Records++
+        }
+}
@@ -0,0 +1,390 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: bundle.go
+
+package certservice
+
+import (
+        "crypto/sha256"
+        "crypto/x509"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "os"
+        "path/filepath"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// A proof bundle is why an artifact was issued, complete enough to be
+// checked without the service: the evidence, the policy in force, the
+// statements the proof starts from and the proof.  With
+// Options.ProofBundleDir the service writes one for each artifact it
+// issues, named by the artifact's SHA-256; CheckProofBundle (and the
+// proofcheck program) checks one against the policy cert.
+
+const proofBundleVersion = 1
+
+// ProofBundle is a proof bundle.  The byte fields are serialized
+// protobufs.
+type ProofBundle struct {
+        Version int `json:"version"`
+        // ArtifactType is AdmissionCertEntry or PlatformRuleEntry.
+        ArtifactType string `json:"artifact_type"`
+        Artifact []byte `json:"artifact"`
+        // IssuedAt is when the artifact was issued.  No signature covers
+        // it: CheckProofBundle trusts it only as far as it falls in the
+        // artifact's validity period, which is signed.
+        IssuedAt time.Time `json:"issued_at"`
+        EvidenceType string `json:"evidence_type"`
+        Purpose string `json:"purpose"`
+        // Evidence is the request's evidence_package.
+        Evidence []byte `json:"evidence"`
+        // Policy is the serialized policy in force, PolicyHash its SHA-256.
+        Policy []byte `json:"policy"`
+        PolicyHash string `json:"policy_hash"`
+        // ToProve is the vse_clause proved.
+        ToProve []byte `json:"to_prove"`
+        // ProvedStatements are the statements the proof starts from: from
+        // the evidence and the policy.
+        ProvedStatements []byte `json:"proved_statements"`
+        Proof []byte `json:"proof"`
+}
+
+// MakeProofBundle makes the bundle for artifact, issued on the strength
+// of proof under p.  alreadyProved are the statements proof starts from.
+func MakeProofBundle(p *Policy, artifactType string, artifact []byte, request *certprotos.TrustRequestMessage,
+                toProve *certprotos.VseClause, proof *certprotos.Proof,
+                alreadyProved *certprotos.ProvedStatements) (*ProofBundle, error) {
+        b := &ProofBundle{
+                Version: proofBundleVersion,
+                ArtifactType: artifactType,
+                Artifact: artifact,
+                IssuedAt: time.Now().UTC(),
+                EvidenceType: request.GetSubmittedEvidenceType(),
+                Purpose: request.GetPurpose(),
+                Policy: p.serialized,
+                PolicyHash: hex.EncodeToString(p.Hash[:]),
+        }
+        var err error
+        for _, f := range []struct {
+                to *[]byte
+                m proto.Message
+        }{
+                {&b.Evidence, request.GetSupport()},
+                {&b.ToProve, toProve},
+                {&b.ProvedStatements, alreadyProved},
+                {&b.Proof, proof},
+        } {
+                *f.to, err = proto.Marshal(f.m)
+                if err != nil {
+                        return nil, err
+                }
+        }
+        return b, nil
+}
+
+// WriteProofBundle writes b to the file name and syncs it, and the
+// directory, to disk.
+func WriteProofBundle(name string, b *ProofBundle) error {
+        j, err := json.Marshal(b)
+        if err != nil {
+                return err
+        }
+        tmp := name + ".tmp"
+        f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+        if err != nil {
+                return err
+        }
+        _, err = f.Write(j)
+        if err == nil {
+                err = f.Sync()
+        }
+        if cerr := f.Close(); err == nil {
+                err = cerr
+        }
+        if err == nil {
+                err = os.Rename(tmp, name)
+        }
+        if err != nil {
+                os.Remove(tmp)
+                return err
+        }
+        d, err := os.Open(filepath.Dir(name))
+        if err != nil {
+                return err
+        }
+        defer d.Close()
+        return d.Sync()
+}
+
+// ReadProofBundle reads a bundle WriteProofBundle wrote.
+func ReadProofBundle(name string) (*ProofBundle, error) {
+        j, err := os.ReadFile(name)
+        if err != nil {
+                return nil, err
+        }
+        b := &ProofBundle{}
+        if err := json.Unmarshal(j, b); err != nil {
+                return nil, fmt.Errorf("%s: %v", name, err)
+        }
+        if b.Version != proofBundleVersion {
+                return nil, fmt.Errorf("%s: bundle version %d, not %d", name, b.Version, proofBundleVersion)
+        }
+        return b, nil
+}
+
+// ProofBundleName is the file the service writes the bundle for
+// artifact to, in dir.
+func ProofBundleName(dir string, artifact []byte) string {
+        return filepath.Join(dir, hashHex(artifact) + ".bundle")
+}
+
+// writeProofBundle writes the bundle for the artifact in response to
+// the proof bundle directory and returns its name, or "" if there is no
+// directory.  An artifact without one isn't handed out.
+func (cs *CertifierService) writeProofBundle(response *certprotos.TrustResponseMessage, entryType string,
+                p *Policy, request *certprotos.TrustRequestMessage, toProve *certprotos.VseClause,
+                proof *certprotos.Proof, alreadyProved *certprotos.ProvedStatements) string {
+        if cs.proofBundleDir == "" || response.Artifact == nil {
+                return ""
+        }
+        name := ProofBundleName(cs.proofBundleDir, response.Artifact)
+        b, err := MakeProofBundle(p, entryType, response.Artifact, request, toProve, proof, alreadyProved)
+        if err == nil {
+                err = WriteProofBundle(name, b)
+        }
+        if err != nil {
+                cs.log().Error("Can't write proof bundle", "err", err)
+                response.Artifact = nil
+                setFailure(response, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED,
+                        "can't write the proof bundle: %v", err))
+                return ""
+        }
+        return name
+}
+
+// publishIssued writes the proof bundle for the artifact in response,
+// then adds the artifact to the transparency log, so that every logged
+// artifact has its bundle on disk.  If the artifact can't be logged, its
+// bundle is removed.
+func (cs *CertifierService) publishIssued(response *certprotos.TrustResponseMessage, entryType string,
+                rec *AuditRecord, p *Policy, request *certprotos.TrustRequestMessage, toProve *certprotos.VseClause,
+                proof *certprotos.Proof, alreadyProved *certprotos.ProvedStatements) {
+        name := cs.writeProofBundle(response, entryType, p, request, toProve, proof, alreadyProved)
+        if response.Artifact == nil {
+                return
+        }
+        cs.logIssued(response, entryType, rec)
+        if response.Artifact == nil && name != "" {
+                if err := os.Remove(name); err != nil {
+                        cs.log().Error("Can't remove proof bundle", "err", err)
+                }
+        }
+}
+
+// BundleCheck is what CheckProofBundle found.
+type BundleCheck struct {
+        // Conclusion is the statement proved.
+        Conclusion string
+        // EvidenceItems, PolicyStatements and Steps count the evidence,
+        // the policy statements the proof starts from and its steps.
+        EvidenceItems int
+        PolicyStatements int
+        Steps int
+}
+
+// CheckProofBundle checks, as the service would have when it issued the
+// artifact, that b's artifact follows from its evidence and policy.  The
+// policy must be signed by the key in policyCert.  Every evidence item is
+// verified again, every statement the proof starts from must come from
+// the evidence or the policy, every step must follow by a rule, and the
+// artifact must be issued under policyCert for the key proved trusted.
+// Claims, certs and the artifact are checked as of b.IssuedAt, which must
+// be in the artifact's validity period; as IssuedAt isn't signed, a
+// bundle can only claim a time when its artifact was valid.  Nonces
+// aren't checked.
+func CheckProofBundle(b *ProofBundle, policyCert *x509.Certificate) (*BundleCheck, error) {
+        policyKey := certlib.GetSubjectKey(policyCert)
+        if policyKey == nil {
+                return nil, errors.New("can't get the policy key from the policy cert")
+        }
+        h := sha256.Sum256(b.Policy)
+        if b.PolicyHash != hex.EncodeToString(h[:]) {
+                return nil, errors.New("policy doesn't match its hash")
+        }
+        if err := checkIssuedAt(b); err != nil {
+                return nil, err
+        }
+        at := b.IssuedAt
+        p, err := NewPolicyAt(policyKey, b.Policy, at)
+        if err != nil {
+                return nil, fmt.Errorf("policy: %v", err)
+        }
+        if p.StatementCount() == 0 {
+                return nil, errors.New("no policy statement verifies with the key in the policy cert")
+        }
+
+        support := &certprotos.EvidencePackage{}
+        toProve := &certprotos.VseClause{}
+        given := &certprotos.ProvedStatements{}
+        proof := &certprotos.Proof{}
+        for _, f := range []struct {
+                name string
+                from []byte
+                m proto.Message
+        }{
+                {"evidence", b.Evidence, support},
+                {"to_prove", b.ToProve, toProve},
+                {"proved_statements", b.ProvedStatements, given},
+                {"proof", b.Proof, proof},
+        } {
+                if err := proto.Unmarshal(f.from, f.m); err != nil {
+                        return nil, fmt.Errorf("can't parse %s: %v", f.name, err)
+                }
+        }
+        check := &BundleCheck{
+                Conclusion: certlib.VseClauseToString(toProve),
+                EvidenceItems: len(support.FactAssertion),
+                Steps: len(proof.Steps),
+        }
+
+        fromEvidence := &certprotos.ProvedStatements{}
+        err = certlib.VerifyEvidenceAt(policyKey, support.FactAssertion, fromEvidence, nil, at)
+        if err != nil {
+                return nil, fmt.Errorf("evidence: %v", err)
+        }
+        if err := policyKeyStatement(policyKey, fromEvidence); err != nil {
+                return nil, fmt.Errorf("evidence: %v", err)
+        }
+        for i, c := range given.Proved {
+                if certlib.StatementAlreadyProved(c, fromEvidence) {
+                        continue
+                }
+                if c.GetVerb() == "says" && certlib.SameKey(c.GetSubject().GetKey(), policyKey) &&
+                                p.Find(c.Clause) != nil {
+                        check.PolicyStatements++
+                        continue
+                }
+                return nil, fmt.Errorf("statement %d, %s, is in neither the evidence nor the policy", i,
+                        certlib.VseClauseToString(c))
+        }
+
+        verb := "is-trusted-for-authentication"
+        if b.Purpose == "attestation" {
+                verb = "is-trusted-for-attestation"
+        }
+        if toProve.GetVerb() != verb || toProve.GetSubject().GetKey() == nil || toProve.Object != nil ||
+                        toProve.Clause != nil {
+                return nil, fmt.Errorf("%s is not \"key %s\"", check.Conclusion, verb)
+        }
+        proved := &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, given.Proved...)}
+        for i, step := range proof.Steps {
+                if step.S1 == nil || step.S2 == nil || step.Conclusion == nil || step.RuleApplied == nil {
+                        return nil, fmt.Errorf("proof step %d is incomplete", i)
+                }
+                if !certlib.StatementAlreadyProved(step.S1, proved) || !certlib.StatementAlreadyProved(step.S2, proved) {
+                        return nil, fmt.Errorf("proof step %d uses a statement not yet proved", i)
+                }
+                if !certlib.VerifyProofStep(p.Dominance(), p.Rules(), step.S1, step.S2, step.Conclusion,
+                                int(step.GetRuleApplied())) {
+                        return nil, fmt.Errorf("proof step %d: %s doesn't follow from %s and %s by rule %d", i,
+                                certlib.VseClauseToString(step.Conclusion), certlib.VseClauseToString(step.S1),
+                                certlib.VseClauseToString(step.S2), step.GetRuleApplied())
+                }
+                proved.Proved = append(proved.Proved, step.Conclusion)
+        }
+        if !certlib.StatementAlreadyProved(toProve, proved) {
+                return nil, fmt.Errorf("the proof doesn't reach %s", check.Conclusion)
+        }
+
+        if err := checkBundleArtifact(b, policyCert, policyKey, toProve, at); err != nil {
+                return nil, err
+        }
+        return check, nil
+}
+
+// checkIssuedAt checks that b.IssuedAt is in its artifact's validity
+// period.
+func checkIssuedAt(b *ProofBundle) error {
+        switch b.ArtifactType {
+        case AdmissionCertEntry:
+                cert, err := x509.ParseCertificate(b.Artifact)
+                if err != nil {
+                        return fmt.Errorf("can't parse admission cert: %v", err)
+                }
+                if b.IssuedAt.Before(cert.NotBefore) || b.IssuedAt.After(cert.NotAfter) {
+                        return fmt.Errorf("issued at %s, but the admission cert is valid from %s to %s",
+                                b.IssuedAt.Format(time.RFC3339), cert.NotBefore.Format(time.RFC3339),
+                                cert.NotAfter.Format(time.RFC3339))
+                }
+        case PlatformRuleEntry:
+                sc := &certprotos.SignedClaimMessage{}
+                if err := proto.Unmarshal(b.Artifact, sc); err != nil {
+                        return fmt.Errorf("can't parse platform rule: %v", err)
+                }
+                cm := &certprotos.ClaimMessage{}
+                if err := proto.Unmarshal(sc.SerializedClaimMessage, cm); err != nil {
+                        return fmt.Errorf("can't parse platform rule claim: %v", err)
+                }
+                if !certlib.CheckTimeRangeAt(cm.NotBefore, cm.NotAfter, b.IssuedAt) {
+                        return fmt.Errorf("issued at %s, but the platform rule is valid from %s to %s",
+                                b.IssuedAt.Format(time.RFC3339), cm.GetNotBefore(), cm.GetNotAfter())
+                }
+        default:
+                return fmt.Errorf("unknown artifact type %s", b.ArtifactType)
+        }
+        return nil
+}
+
+// checkBundleArtifact checks that the artifact was issued under
+// policyCert, as of at, for the key toProve names.
+func checkBundleArtifact(b *ProofBundle, policyCert *x509.Certificate, policyKey *certprotos.KeyMessage,
+                toProve *certprotos.VseClause, at time.Time) error {
+        switch b.ArtifactType {
+        case AdmissionCertEntry:
+                cert, err := x509.ParseCertificate(b.Artifact)
+                if err != nil {
+                        return fmt.Errorf("can't parse admission cert: %v", err)
+                }
+                if !certlib.VerifyAdmissionCertAt(policyCert, cert, at) {
+                        return errors.New("admission cert isn't issued under the policy cert")
+                }
+                if !certlib.SameKey(certlib.GetSubjectKey(cert), toProve.Subject.Key) {
+                        return errors.New("admission cert isn't for the key proved trusted")
+                }
+        case PlatformRuleEntry:
+                sc := &certprotos.SignedClaimMessage{}
+                if err := proto.Unmarshal(b.Artifact, sc); err != nil {
+                        return fmt.Errorf("can't parse platform rule: %v", err)
+                }
+                rule := &certprotos.VseClause{}
+                if err := certlib.CheckSignedAssertionAt(sc, policyKey, rule, at); err != nil {
+                        return fmt.Errorf("platform rule: %v", err)
+                }
+                verb := "says"
+                if !certlib.SameVseClause(rule, certlib.MakeIndirectVseClause(certlib.MakeKeyEntity(policyKey),
+                                &verb, toProve)) {
+                        return errors.New("platform rule isn't for the key proved trusted")
+                }
+        default:
+                return fmt.Errorf("unknown artifact type %s", b.ArtifactType)
+        }
+        return nil
+}
@@ -0,0 +1,101 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: failure.go
+
+package certservice
+
+import (
+        "context"
+        "crypto/tls"
+        "errors"
+        "fmt"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// A failed response carries an error code and a detail for the enclave
+// operator.  The detail can name measurements and keys in the policy,
+// so how much of it callers see is configurable.  Callers that present
+// a client cert issued under the policy cert always see everything.
+const (
+        // FailureDetailNone sends only the "failed" status.
+        FailureDetailNone = "none"
+        // FailureDetailCode adds the error code.
+        FailureDetailCode = "code"
+        // FailureDetailFull adds the error code and detail.
+        FailureDetailFull = "full"
+)
+
+func checkFailureDetail(level string) error {
+        switch level {
+        case FailureDetailNone, FailureDetailCode, FailureDetailFull:
+                return nil
+        }
+        return fmt.Errorf("failure detail must be %s, %s or %s, not %s", FailureDetailNone,
+                FailureDetailCode, FailureDetailFull, level)
+}
+
+// failureCode is the trust_error_code for err.
+func failureCode(err error) certprotos.TrustErrorCode {
+        switch {
+        case errors.Is(err, ErrBadRequest):
+                return certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST
+        case errors.Is(err, ErrOverloaded):
+                return certprotos.TrustErrorCode_TRUST_ERROR_OVERLOADED
+        case errors.Is(err, ErrRateLimited):
+                return certprotos.TrustErrorCode_TRUST_ERROR_RATE_LIMITED
+        case errors.Is(err, ErrShuttingDown):
+                return certprotos.TrustErrorCode_TRUST_ERROR_SHUTTING_DOWN
+        case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+                return certprotos.TrustErrorCode_TRUST_ERROR_TIMEOUT
+        }
+        return certlib.TrustErrorCode(err)
+}
+
+// setFailure marks response failed because of err.
+func setFailure(response *certprotos.TrustResponseMessage, err error) {
+        failed := "failed"
+        code := failureCode(err)
+        detail := err.Error()
+        response.Status = &failed
+        response.ErrorCode = &code
+        response.ErrorDetail = &detail
+}
+
+// redactResponse returns response with only as much failure detail as
+// the caller may see.
+func (cs *CertifierService) redactResponse(response *certprotos.TrustResponseMessage,
+                authenticated bool) *certprotos.TrustResponseMessage {
+        if response.ErrorCode == nil && response.ErrorDetail == nil {
+                return response
+        }
+        if authenticated || cs.failureDetail == FailureDetailFull {
+                return response
+        }
+        r := proto.Clone(response).(*certprotos.TrustResponseMessage)
+        r.ErrorDetail = nil
+        if cs.failureDetail == FailureDetailNone {
+                r.ErrorCode = nil
+        }
+        return r
+}
+
+// verifiedClient says whether the TLS peer presented a client cert that
+// chains to the policy cert.
+func verifiedClient(state *tls.ConnectionState) bool {
+        return state != nil && len(state.VerifiedChains) > 0
+}
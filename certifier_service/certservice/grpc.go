@@ -0,0 +1,200 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: grpc.go
+
+package certservice
+
+import (
+        "context"
+        "errors"
+        "io"
+
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/credentials"
+        "google.golang.org/grpc/peer"
+        "google.golang.org/grpc/status"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// trustServiceServer serves TrustService (certprotos/trust_service.proto)
+// with the same pipeline as ServeConn.
+type trustServiceServer struct {
+        certprotos.UnimplementedTrustServiceServer
+        cs *CertifierService
+}
+
+// RegisterTrustService registers cs as the TrustService on gs.
+func (cs *CertifierService) RegisterTrustService(gs *grpc.Server) {
+        certprotos.RegisterTrustServiceServer(gs, &trustServiceServer{cs: cs})
+}
+
+func grpcError(err error) error {
+        if errors.Is(err, ErrBadRequest) {
+                return status.Error(codes.InvalidArgument, err.Error())
+        }
+        if errors.Is(err, ErrOverloaded) || errors.Is(err, ErrRateLimited) {
+                return status.Error(codes.ResourceExhausted, err.Error())
+        }
+        if errors.Is(err, ErrShuttingDown) {
+                return status.Error(codes.Unavailable, err.Error())
+        }
+        if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+                return status.FromContextError(err).Err()
+        }
+        return status.Error(codes.Internal, err.Error())
+}
+
+// failedStatus is the PermissionDenied status for a failed request.  The
+// response, with its error code, rides along as a status detail.
+func failedStatus(response *certprotos.TrustResponseMessage) error {
+        msg := "trust request failed"
+        if response.ErrorCode != nil {
+                msg += ": " + response.GetErrorCode().String()
+        }
+        if response.GetErrorDetail() != "" {
+                msg += ": " + response.GetErrorDetail()
+        }
+        st, err := status.New(codes.PermissionDenied, msg).WithDetails(response)
+        if err != nil {
+                return status.Error(codes.PermissionDenied, msg)
+        }
+        return st.Err()
+}
+
+func grpcVerifiedClient(ctx context.Context) bool {
+        p, ok := peer.FromContext(ctx)
+        if !ok {
+                return false
+        }
+        info, ok := p.AuthInfo.(credentials.TLSInfo)
+        return ok && verifiedClient(&info.State)
+}
+
+func (s *trustServiceServer) Certify(ctx context.Context,
+                request *certprotos.TrustRequestMessage) (*certprotos.TrustResponseMessage, error) {
+        ctx, span := s.cs.startGrpcSpan(ctx, "Certify")
+        defer span.End()
+        response, err := s.cs.Certify(ctx, request)
+        if err != nil {
+                return nil, grpcError(err)
+        }
+        if response.GetStatus() != "succeeded" {
+                return nil, failedStatus(s.cs.redactResponse(response, grpcVerifiedClient(ctx)))
+        }
+        return response, nil
+}
+
+func (s *trustServiceServer) CertifyStream(stream certprotos.TrustService_CertifyStreamServer) error {
+        for {
+                request, err := stream.Recv()
+                if err == io.EOF {
+                        return nil
+                }
+                if err != nil {
+                        return err
+                }
+                ctx, span := s.cs.startGrpcSpan(stream.Context(), "CertifyStream")
+                response, err := s.cs.Certify(ctx, request)
+                span.End()
+                if err != nil {
+                        // A request that can't be evaluated fails on its
+                        // own; the stream goes on with the next one.
+                        response = &certprotos.TrustResponseMessage{
+                                RequestingEnclaveTag: request.RequestingEnclaveTag,
+                                ProvidingEnclaveTag: request.ProvidingEnclaveTag,
+                        }
+                        setFailure(response, err)
+                }
+                response = s.cs.redactResponse(response, grpcVerifiedClient(stream.Context()))
+                if err := stream.Send(response); err != nil {
+                        return err
+                }
+        }
+}
+
+func (s *trustServiceServer) Status(ctx context.Context,
+                request *certprotos.TrustServiceStatusRequest) (*certprotos.TrustServiceStatusResponse, error) {
+        return s.cs.Status(), nil
+}
+
+func (s *trustServiceServer) GetNonce(ctx context.Context,
+                request *certprotos.NonceRequest) (*certprotos.NonceResponse, error) {
+        response, err := s.cs.IssueNonce(ctx)
+        if err != nil {
+                return nil, grpcError(err)
+        }
+        return response, nil
+}
+
+func (s *trustServiceServer) transparencyLog() (*TransparencyLog, error) {
+        l := s.cs.TransparencyLog()
+        if l == nil {
+                return nil, status.Error(codes.Unimplemented, ErrNoTransparencyLog.Error())
+        }
+        return l, nil
+}
+
+func (s *trustServiceServer) GetTreeHead(ctx context.Context,
+                request *certprotos.TreeHeadRequest) (*certprotos.SignedTreeHead, error) {
+        l, err := s.transparencyLog()
+        if err != nil {
+                return nil, err
+        }
+        sth, err := l.SignedTreeHead()
+        if err != nil {
+                return nil, status.Error(codes.Internal, err.Error())
+        }
+        return sth, nil
+}
+
+func (s *trustServiceServer) GetInclusionProof(ctx context.Context,
+                request *certprotos.InclusionProofRequest) (*certprotos.InclusionProof, error) {
+        l, err := s.transparencyLog()
+        if err != nil {
+                return nil, err
+        }
+        ip, err := l.InclusionProof(request.GetLeafIndex(), request.GetTreeSize())
+        if err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        return ip, nil
+}
+
+func (s *trustServiceServer) GetConsistencyProof(ctx context.Context,
+                request *certprotos.ConsistencyProofRequest) (*certprotos.ConsistencyProof, error) {
+        l, err := s.transparencyLog()
+        if err != nil {
+                return nil, err
+        }
+        cp, err := l.ConsistencyProof(request.GetFirstSize(), request.GetSecondSize())
+        if err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        return cp, nil
+}
+
+func (s *trustServiceServer) GetLogEntries(ctx context.Context,
+                request *certprotos.LogEntriesRequest) (*certprotos.LogEntriesResponse, error) {
+        l, err := s.transparencyLog()
+        if err != nil {
+                return nil, err
+        }
+        entries, err := l.Entries(request.GetStart(), request.GetEnd())
+        if err != nil {
+                return nil, status.Error(codes.InvalidArgument, err.Error())
+        }
+        return &certprotos.LogEntriesResponse{Entries: entries}, nil
+}
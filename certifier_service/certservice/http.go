@@ -0,0 +1,252 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: http.go
+
+package certservice
+
+import (
+        "context"
+        "errors"
+        "io"
+        "mime"
+        "net/http"
+        "strconv"
+
+        "github.com/golang/protobuf/proto"
+        "google.golang.org/protobuf/encoding/protojson"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The HTTP gateway accepts a trust_request_message as protojson
+// ("application/json") or binary protobuf ("application/x-protobuf")
+// and answers with the trust_response_message in the same encoding.
+const maxHttpRequestSize = 1 << 24  // same bound as the sized socket frames
+
+const (
+        jsonContentType = "application/json"
+        protoContentType = "application/x-protobuf"
+)
+
+func requestEncoding(contentType string) string {
+        mediaType, _, err := mime.ParseMediaType(contentType)
+        if err != nil {
+                return ""
+        }
+        switch mediaType {
+        case "application/json":
+                return jsonContentType
+        case "application/x-protobuf", "application/protobuf", "application/octet-stream":
+                return protoContentType
+        }
+        return ""
+}
+
+func writeHttpResponse(w http.ResponseWriter, encoding string, code int, response proto.Message) {
+        var rb []byte
+        var err error
+        if encoding == jsonContentType {
+                rb, err = protojson.Marshal(proto.MessageV2(response))
+        } else {
+                rb, err = proto.Marshal(response)
+        }
+        if err != nil {
+                http.Error(w, "can't encode response", http.StatusInternalServerError)
+                return
+        }
+        w.Header().Set("Content-Type", encoding)
+        w.WriteHeader(code)
+        w.Write(rb)
+}
+
+// CertifyHandler serves POST /v1/certify.
+func (cs *CertifierService) CertifyHandler() http.Handler {
+        return http.HandlerFunc(cs.certifyHandler)
+}
+
+// HttpHandler routes the HTTP gateway paths.  The health endpoints are
+// here too, for orchestrators that probe the service port.
+func (cs *CertifierService) HttpHandler() http.Handler {
+        mux := http.NewServeMux()
+        mux.Handle("/v1/certify", cs.CertifyHandler())
+        mux.HandleFunc("/v1/nonce", cs.nonceHandler)
+        mux.HandleFunc("/v1/log/", cs.logHandler)
+        mux.HandleFunc("/healthz", cs.healthHandler)
+        mux.HandleFunc("/readyz", cs.healthHandler)
+        return mux
+}
+
+func (cs *CertifierService) certifyHandler(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                w.Header().Set("Allow", http.MethodPost)
+                http.Error(w, "use POST", http.StatusMethodNotAllowed)
+                return
+        }
+        encoding := requestEncoding(r.Header.Get("Content-Type"))
+        if encoding == "" {
+                http.Error(w, "Content-Type must be " + jsonContentType + " or " + protoContentType,
+                        http.StatusUnsupportedMediaType)
+                return
+        }
+        ctx, span := cs.startHttpSpan(r)
+        defer span.End()
+        _, readSpan := startSpan(ctx, "ReadRequest")
+        b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHttpRequestSize))
+        certlib.EndSpan(readSpan, err)
+        if err != nil {
+                cs.logEvent("Can't read http request from " + r.RemoteAddr)
+                http.Error(w, "can't read request", http.StatusBadRequest)
+                return
+        }
+
+        request := &certprotos.TrustRequestMessage{}
+        _, unmarshalSpan := startSpan(ctx, "UnmarshalRequest")
+        if encoding == jsonContentType {
+                err = protojson.Unmarshal(b, request)
+        } else {
+                err = proto.Unmarshal(b, request)
+        }
+        certlib.EndSpan(unmarshalSpan, err)
+        if err != nil {
+                cs.logEvent("Can't unmarshal http request from " + r.RemoteAddr)
+                http.Error(w, "can't decode request: " + err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        p := peerFromHttp(r)
+        response, err := cs.Certify(WithPeer(ctx, p), request)
+        if err != nil {
+                if errors.Is(err, ErrBadRequest) {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                } else if errors.Is(err, ErrRateLimited) {
+                        w.Header().Set("Retry-After", "1")
+                        http.Error(w, err.Error(), http.StatusTooManyRequests)
+                } else if errors.Is(err, context.DeadlineExceeded) {
+                        http.Error(w, err.Error(), http.StatusGatewayTimeout)
+                } else {
+                        // Overloaded, shutting down or the client went away.
+                        w.Header().Set("Retry-After", "1")
+                        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+                }
+                return
+        }
+        response = cs.redactResponse(response, p.ClientCertHash != "")
+        if response.GetStatus() != "succeeded" {
+                writeHttpResponse(w, encoding, http.StatusForbidden, response)
+                return
+        }
+        writeHttpResponse(w, encoding, http.StatusOK, response)
+}
+
+// nonceHandler serves POST /v1/nonce.  The body, if any, is ignored; the
+// nonce_response is protojson unless the request is binary protobuf.
+func (cs *CertifierService) nonceHandler(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+                w.Header().Set("Allow", http.MethodPost)
+                http.Error(w, "use POST", http.StatusMethodNotAllowed)
+                return
+        }
+        encoding := requestEncoding(r.Header.Get("Content-Type"))
+        if encoding == "" {
+                encoding = jsonContentType
+        }
+        response, err := cs.IssueNonce(WithPeer(r.Context(), peerFromHttp(r)))
+        if err != nil {
+                w.Header().Set("Retry-After", "1")
+                if errors.Is(err, ErrRateLimited) {
+                        http.Error(w, err.Error(), http.StatusTooManyRequests)
+                } else {
+                        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+                }
+                return
+        }
+        writeHttpResponse(w, encoding, http.StatusOK, response)
+}
+
+func queryInt(r *http.Request, name string) (int64, error) {
+        v := r.URL.Query().Get(name)
+        if v == "" {
+                return 0, nil
+        }
+        return strconv.ParseInt(v, 10, 64)
+}
+
+// logHandler serves the transparency log, as protojson:
+//      GET /v1/log/sth                                 signed tree head
+//      GET /v1/log/inclusion?index=i&size=n            inclusion proof
+//      GET /v1/log/consistency?first=m&second=n        consistency proof
+//      GET /v1/log/entries?start=i&end=j               entries [i, j)
+// A size of 0 or none is the current size.
+func (cs *CertifierService) logHandler(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+                w.Header().Set("Allow", http.MethodGet)
+                http.Error(w, "use GET", http.StatusMethodNotAllowed)
+                return
+        }
+        l := cs.TransparencyLog()
+        if l == nil {
+                http.Error(w, ErrNoTransparencyLog.Error(), http.StatusNotFound)
+                return
+        }
+        var a, b int64
+        var err error
+        switch r.URL.Path {
+        case "/v1/log/inclusion":
+                a, err = queryInt(r, "index")
+                if err == nil {
+                        b, err = queryInt(r, "size")
+                }
+        case "/v1/log/consistency":
+                a, err = queryInt(r, "first")
+                if err == nil {
+                        b, err = queryInt(r, "second")
+                }
+        case "/v1/log/entries":
+                a, err = queryInt(r, "start")
+                if err == nil {
+                        b, err = queryInt(r, "end")
+                }
+        }
+        if err != nil {
+                http.Error(w, "bad query: " + err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        var response proto.Message
+        switch r.URL.Path {
+        case "/v1/log/sth":
+                response, err = l.SignedTreeHead()
+                if err != nil {
+                        http.Error(w, err.Error(), http.StatusInternalServerError)
+                        return
+                }
+        case "/v1/log/inclusion":
+                response, err = l.InclusionProof(a, b)
+        case "/v1/log/consistency":
+                response, err = l.ConsistencyProof(a, b)
+        case "/v1/log/entries":
+                var entries []*certprotos.LogEntry
+                entries, err = l.Entries(a, b)
+                response = &certprotos.LogEntriesResponse{Entries: entries}
+        default:
+                http.NotFound(w, r)
+                return
+        }
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        writeHttpResponse(w, jsonContentType, http.StatusOK, response)
+}
@@ -0,0 +1,361 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: issuance.go
+
+package certservice
+
+import (
+        "bytes"
+        "encoding/binary"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        bolt "go.etcd.io/bbolt"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The issuance database keeps a record of every admission cert and
+// platform rule issued, in a bbolt file, so operators can find out, for
+// example, which enclaves running a measurement hold live certs.
+//
+// Records are JSON in the issuances bucket, keyed by an 8 byte big endian
+// id.  The index buckets map serial to id and, for measurement, platform
+// key, subject key and issue time, value|0|id to nothing.
+
+var (
+        bucketIssuances = []byte("issuances")
+        bucketBySerial = []byte("by_serial")
+        bucketByMeasurement = []byte("by_measurement")
+        bucketByPlatform = []byte("by_platform_key")
+        bucketBySubject = []byte("by_subject_key")
+        bucketByTime = []byte("by_time")
+)
+
+const maxIssuancesPerQuery = 1000
+
+// Issuance is the record of an issued artifact.
+type Issuance struct {
+        Id uint64 `json:"id"`
+        // Artifact is AdmissionCertEntry or PlatformRuleEntry.
+        Artifact string `json:"artifact"`
+        // Serial is the admission cert serial number; platform rules
+        // have none.
+        Serial string `json:"serial,omitempty"`
+        // SubjectKey and PlatformKey are certlib.KeyFingerprint of the
+        // certified key and of the key the policy trusts to attest it.
+        SubjectKey string `json:"subject_key"`
+        Measurement string `json:"measurement,omitempty"`
+        PlatformKey string `json:"platform_key,omitempty"`
+        EvidenceType string `json:"evidence_type"`
+        Purpose string `json:"purpose"`
+        NotBefore time.Time `json:"not_before"`
+        NotAfter time.Time `json:"not_after"`
+        // RequestDigest and ArtifactDigest are the hex SHA-256 of the
+        // serialized trust request and of the artifact.
+        RequestDigest string `json:"request_digest"`
+        ArtifactDigest string `json:"artifact_digest"`
+        PolicyHash string `json:"policy_hash"`
+        LogIndex *int64 `json:"log_index,omitempty"`
+        // Peer and ClientCertHash are who asked for it, as in the audit
+        // record.
+        Peer string `json:"peer,omitempty"`
+        ClientCertHash string `json:"client_cert_hash,omitempty"`
+}
+
+// IssuanceQuery selects issuances; every field that is set must match.
+type IssuanceQuery struct {
+        Serial string
+        Measurement string
+        PlatformKey string
+        SubjectKey string
+        // IssuedAfter and IssuedBefore bound NotBefore, the first
+        // inclusively.
+        IssuedAfter time.Time
+        IssuedBefore time.Time
+        // LiveAt selects artifacts valid at that time.
+        LiveAt time.Time
+        // Limit is the most records returned, at most 1000 (the
+        // default).
+        Limit int
+}
+
+func (q *IssuanceQuery) matches(is *Issuance) bool {
+        if q.Serial != "" && is.Serial != q.Serial {
+                return false
+        }
+        if q.Measurement != "" && is.Measurement != q.Measurement {
+                return false
+        }
+        if q.PlatformKey != "" && is.PlatformKey != q.PlatformKey {
+                return false
+        }
+        if q.SubjectKey != "" && is.SubjectKey != q.SubjectKey {
+                return false
+        }
+        if !q.IssuedAfter.IsZero() && is.NotBefore.Before(q.IssuedAfter) {
+                return false
+        }
+        if !q.IssuedBefore.IsZero() && !is.NotBefore.Before(q.IssuedBefore) {
+                return false
+        }
+        if !q.LiveAt.IsZero() && (q.LiveAt.Before(is.NotBefore) || q.LiveAt.After(is.NotAfter)) {
+                return false
+        }
+        return true
+}
+
+// IssuanceDB is the issuance database.  Its methods may be called
+// concurrently.
+type IssuanceDB struct {
+        db *bolt.DB
+}
+
+// OpenIssuanceDB opens or creates the database file name.
+func OpenIssuanceDB(name string) (*IssuanceDB, error) {
+        db, err := bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second})
+        if err != nil {
+                return nil, fmt.Errorf("%s: %v", name, err)
+        }
+        err = db.Update(func(tx *bolt.Tx) error {
+                for _, b := range [][]byte{bucketIssuances, bucketBySerial, bucketByMeasurement,
+                                bucketByPlatform, bucketBySubject, bucketByTime} {
+                        if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+        if err != nil {
+                db.Close()
+                return nil, fmt.Errorf("%s: %v", name, err)
+        }
+        return &IssuanceDB{db: db}, nil
+}
+
+// Close closes the database.
+func (d *IssuanceDB) Close() error {
+        return d.db.Close()
+}
+
+func idBytes(id uint64) []byte {
+        b := make([]byte, 8)
+        binary.BigEndian.PutUint64(b, id)
+        return b
+}
+
+func indexKey(value []byte, id []byte) []byte {
+        k := append([]byte{}, value...)
+        k = append(k, 0)
+        return append(k, id...)
+}
+
+func timeKey(t time.Time) []byte {
+        b := make([]byte, 8)
+        binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+        return b
+}
+
+// Record adds is, setting its Id.
+func (d *IssuanceDB) Record(is *Issuance) error {
+        return d.db.Update(func(tx *bolt.Tx) error {
+                b := tx.Bucket(bucketIssuances)
+                seq, err := b.NextSequence()
+                if err != nil {
+                        return err
+                }
+                is.Id = seq
+                v, err := json.Marshal(is)
+                if err != nil {
+                        return err
+                }
+                id := idBytes(seq)
+                if err := b.Put(id, v); err != nil {
+                        return err
+                }
+                if is.Serial != "" {
+                        if err := tx.Bucket(bucketBySerial).Put([]byte(is.Serial), id); err != nil {
+                                return err
+                        }
+                }
+                for _, ix := range []struct{
+                        bucket []byte
+                        value string
+                }{
+                        {bucketByMeasurement, is.Measurement},
+                        {bucketByPlatform, is.PlatformKey},
+                        {bucketBySubject, is.SubjectKey},
+                } {
+                        if ix.value == "" {
+                                continue
+                        }
+                        if err := tx.Bucket(ix.bucket).Put(indexKey([]byte(ix.value), id), nil); err != nil {
+                                return err
+                        }
+                }
+                return tx.Bucket(bucketByTime).Put(append(timeKey(is.NotBefore), id...), nil)
+        })
+}
+
+// errQueryDone stops a scan once the query has its limit.
+var errQueryDone = errors.New("query done")
+
+// Query returns the issuances q selects, in the order they were
+// recorded.  It scans the most selective index q allows.
+func (d *IssuanceDB) Query(q IssuanceQuery) ([]*Issuance, error) {
+        limit := q.Limit
+        if limit <= 0 || limit > maxIssuancesPerQuery {
+                limit = maxIssuancesPerQuery
+        }
+        var found []*Issuance
+        err := d.db.View(func(tx *bolt.Tx) error {
+                issuances := tx.Bucket(bucketIssuances)
+                visit := func(id []byte) error {
+                        v := issuances.Get(id)
+                        if v == nil {
+                                return nil
+                        }
+                        is := &Issuance{}
+                        if err := json.Unmarshal(v, is); err != nil {
+                                return fmt.Errorf("issuance %x: %v", id, err)
+                        }
+                        if q.matches(is) {
+                                found = append(found, is)
+                                if len(found) >= limit {
+                                        return errQueryDone
+                                }
+                        }
+                        return nil
+                }
+                // The index keys end in the id.
+                scan := func(bucket []byte, from []byte, to []byte) error {
+                        c := tx.Bucket(bucket).Cursor()
+                        for k, _ := c.Seek(from); k != nil && (to == nil || bytes.Compare(k, to) < 0); k, _ = c.Next() {
+                                if err := visit(k[len(k) - 8:]); err != nil {
+                                        return err
+                                }
+                        }
+                        return nil
+                }
+                prefix := func(bucket []byte, value string) error {
+                        from := append([]byte(value), 0)
+                        return scan(bucket, from, append([]byte(value), 1))
+                }
+
+                switch {
+                case q.Serial != "":
+                        if id := tx.Bucket(bucketBySerial).Get([]byte(q.Serial)); id != nil {
+                                return visit(id)
+                        }
+                        return nil
+                case q.SubjectKey != "":
+                        return prefix(bucketBySubject, q.SubjectKey)
+                case q.Measurement != "":
+                        return prefix(bucketByMeasurement, q.Measurement)
+                case q.PlatformKey != "":
+                        return prefix(bucketByPlatform, q.PlatformKey)
+                case !q.IssuedAfter.IsZero() || !q.IssuedBefore.IsZero():
+                        var from, to []byte
+                        if !q.IssuedAfter.IsZero() {
+                                from = timeKey(q.IssuedAfter)
+                        }
+                        if !q.IssuedBefore.IsZero() {
+                                to = timeKey(q.IssuedBefore)
+                        }
+                        return scan(bucketByTime, from, to)
+                }
+                c := issuances.Cursor()
+                for k, _ := c.First(); k != nil; k, _ = c.Next() {
+                        if err := visit(k); err != nil {
+                                return err
+                        }
+                }
+                return nil
+        })
+        if err == errQueryDone {
+                err = nil
+        }
+        return found, err
+}
+
+// ErrNoIssuanceDB is returned by QueryIssuances when the service has
+// no issuance database.
+var ErrNoIssuanceDB = errors.New("no issuance database")
+
+// QueryIssuances queries the service's issuance database.
+func (cs *CertifierService) QueryIssuances(q IssuanceQuery) ([]*Issuance, error) {
+        if cs.issuanceDB == nil {
+                return nil, ErrNoIssuanceDB
+        }
+        return cs.issuanceDB.Query(q)
+}
+
+// provedPlatformKey is the fingerprint of the key the policy key trusts
+// for attestation in the statements a proof starts from: the platform
+// key, or for SEV the ARK.
+func provedPlatformKey(publicPolicyKey *certprotos.KeyMessage, alreadyProved *certprotos.ProvedStatements) string {
+        for _, c := range alreadyProved.GetProved() {
+                if c.GetVerb() != "says" || c.GetSubject().GetEntityType() != "key" ||
+                                !certlib.SameKey(c.GetSubject().GetKey(), publicPolicyKey) {
+                        continue
+                }
+                cl := c.GetClause()
+                if cl.GetVerb() == "is-trusted-for-attestation" && cl.GetSubject().GetEntityType() == "key" {
+                        return certlib.KeyFingerprint(cl.GetSubject().GetKey())
+                }
+        }
+        return ""
+}
+
+// recordIssued adds the artifact in response to the issuance database.
+// An artifact that can't be recorded isn't handed out.
+func (cs *CertifierService) recordIssued(response *certprotos.TrustResponseMessage, entryType string,
+                rec *AuditRecord, request *certprotos.TrustRequestMessage, alreadyProved *certprotos.ProvedStatements,
+                notBefore time.Time, notAfter time.Time) {
+        if cs.issuanceDB == nil || response.Artifact == nil {
+                return
+        }
+        is := &Issuance{
+                Artifact: entryType,
+                Serial: rec.CertSerial,
+                SubjectKey: rec.EnclaveKey,
+                Measurement: rec.Measurement,
+                PlatformKey: provedPlatformKey(cs.publicPolicyKey, alreadyProved),
+                EvidenceType: request.GetSubmittedEvidenceType(),
+                Purpose: request.GetPurpose(),
+                NotBefore: notBefore.UTC(),
+                NotAfter: notAfter.UTC(),
+                ArtifactDigest: hashHex(response.Artifact),
+                PolicyHash: rec.PolicyHash,
+                LogIndex: rec.LogIndex,
+                Peer: rec.Peer,
+                ClientCertHash: rec.ClientCertHash,
+        }
+        if b, err := proto.Marshal(request); err == nil {
+                is.RequestDigest = hashHex(b)
+        }
+        if err := cs.issuanceDB.Record(is); err != nil {
+                cs.log().Error("Can't record issued artifact", "err", err)
+                response.Artifact = nil
+                response.TreeHead = nil
+                response.Inclusion = nil
+                rec.LogIndex = nil
+                setFailure(response, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED,
+                        "can't record the artifact in the issuance database: %v", err))
+        }
+}
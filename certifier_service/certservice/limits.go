@@ -0,0 +1,187 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: limits.go
+
+package certservice
+
+import (
+        "context"
+        "errors"
+        "net"
+        "sync/atomic"
+        "time"
+)
+
+// ErrOverloaded is returned when every verification slot is busy and
+// the queue is full.  Clients should retry later.
+var ErrOverloaded = errors.New("certifier service overloaded")
+
+// ErrShuttingDown is returned for requests that arrive after Shutdown.
+var ErrShuttingDown = errors.New("certifier service shutting down")
+
+const (
+        defaultIdleTimeout = 30 * time.Second
+        defaultRequestTimeout = 60 * time.Second
+        defaultMaxConcurrent = 16
+        defaultMaxQueue = 64
+)
+
+// IdleTimeout is how long a connection may take to send its request.
+func (cs *CertifierService) IdleTimeout() time.Duration {
+        return cs.idleTimeout
+}
+
+// RequestTimeout bounds the evaluation of one request and the reply.
+func (cs *CertifierService) RequestTimeout() time.Duration {
+        return cs.requestTimeout
+}
+
+// acquire waits for a verification slot.  At most maxQueue callers
+// wait; the rest are turned away with ErrOverloaded.
+func (cs *CertifierService) acquire(ctx context.Context) error {
+        select {
+        case cs.slots <- struct{}{}:
+                return nil
+        default:
+        }
+        if atomic.AddInt64(&cs.queued, 1) > int64(cs.maxQueue) {
+                atomic.AddInt64(&cs.queued, -1)
+                return ErrOverloaded
+        }
+        defer atomic.AddInt64(&cs.queued, -1)
+        select {
+        case cs.slots <- struct{}{}:
+                return nil
+        case <-ctx.Done():
+                return ctx.Err()
+        }
+}
+
+func (cs *CertifierService) release() {
+        <-cs.slots
+}
+
+// requestContext bounds a request by the request timeout and by
+// Shutdown giving up on it.
+func (cs *CertifierService) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+        ctx, cancel := context.WithTimeout(ctx, cs.requestTimeout)
+        go func() {
+                select {
+                case <-cs.shutdownCtx.Done():
+                        cancel()
+                case <-ctx.Done():
+                }
+        }()
+        return ctx, cancel
+}
+
+// begin registers an in-flight request or connection, Shutdown waits
+// for them.  It fails once Shutdown has started.
+func (cs *CertifierService) begin() bool {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        if cs.shuttingDown {
+                return false
+        }
+        cs.active++
+        return true
+}
+
+func (cs *CertifierService) end() {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        cs.active--
+        if cs.active == 0 && cs.shuttingDown {
+                close(cs.drained)
+        }
+}
+
+func (cs *CertifierService) isShuttingDown() bool {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        return cs.shuttingDown
+}
+
+// trackListener remembers sock so Shutdown can close it.
+func (cs *CertifierService) trackListener(sock net.Listener) bool {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        if cs.shuttingDown {
+                return false
+        }
+        cs.listeners[sock] = true
+        return true
+}
+
+// addIdleConn records conn as waiting for its request, Shutdown closes
+// such connections.  It fails once Shutdown has started.
+func (cs *CertifierService) addIdleConn(conn net.Conn) bool {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        if cs.shuttingDown {
+                return false
+        }
+        cs.conns[conn] = true
+        return true
+}
+
+// connBusy marks conn as having a request in progress, so Shutdown lets
+// it finish.  It fails if Shutdown already closed conn.
+func (cs *CertifierService) connBusy(conn net.Conn) bool {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        if _, ok := cs.conns[conn]; !ok {
+                return false
+        }
+        cs.conns[conn] = false
+        return true
+}
+
+func (cs *CertifierService) forgetConn(conn net.Conn) {
+        cs.drainMu.Lock()
+        defer cs.drainMu.Unlock()
+        delete(cs.conns, conn)
+}
+
+// Shutdown stops accepting connections and requests, closes idle
+// connections and waits until in-flight requests finish or ctx is done.
+// Requests still running when ctx is done are canceled.
+func (cs *CertifierService) Shutdown(ctx context.Context) error {
+        cs.drainMu.Lock()
+        if !cs.shuttingDown {
+                cs.shuttingDown = true
+                for sock := range cs.listeners {
+                        sock.Close()
+                }
+                for conn, idle := range cs.conns {
+                        if idle {
+                                conn.Close()
+                                delete(cs.conns, conn)
+                        }
+                }
+                if cs.active == 0 {
+                        close(cs.drained)
+                }
+        }
+        cs.drainMu.Unlock()
+
+        select {
+        case <-cs.drained:
+                return nil
+        case <-ctx.Done():
+                cs.cancelRequests()
+                return ctx.Err()
+        }
+}
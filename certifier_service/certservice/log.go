@@ -0,0 +1,115 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: log.go
+
+package certservice
+
+import (
+        "context"
+        "crypto/sha256"
+        "encoding/hex"
+        "log/slog"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// Requests are recorded in the audit log (audit.go); the text log gets a
+// line for each request and for events, like policy reloads, that the
+// audit log records too.
+
+// log is Options.Logger, or certlib's logger if there wasn't one.
+func (cs *CertifierService) log() *slog.Logger {
+        if cs.logger != nil {
+                return cs.logger
+        }
+        return certlib.Logger()
+}
+
+func hashHex(b []byte) string {
+        h := sha256.Sum256(b)
+        return hex.EncodeToString(h[:])
+}
+
+func (cs *CertifierService) audit(rec *AuditRecord) {
+        if cs.auditLog == nil {
+                return
+        }
+        if err := cs.auditLog.Append(rec); err != nil {
+                cs.log().Error("Can't write audit record", "err", err)
+        }
+}
+
+// logEvent records something that isn't a request.
+func (cs *CertifierService) logEvent(msg string) {
+        cs.log().Info(msg)
+        cs.audit(&AuditRecord{
+                Kind: AuditEvent,
+                Event: msg,
+        })
+}
+
+// logRequest records the outcome of a request: response, or err if it
+// couldn't be evaluated.  rec has what was learned evaluating it.
+func (cs *CertifierService) logRequest(ctx context.Context, request *certprotos.TrustRequestMessage,
+                rec *AuditRecord, response *certprotos.TrustResponseMessage, err error) {
+        rec.Kind = AuditRequest
+        rec.EvidenceType = request.GetSubmittedEvidenceType()
+        rec.Purpose = request.GetPurpose()
+        if err != nil {
+                // Anything issued wasn't handed out.
+                rec.CertSerial = ""
+                rec.LogIndex = nil
+                rec.Decision = "error"
+                rec.ErrorCode = failureCode(err).String()
+                rec.Reason = err.Error()
+        } else {
+                rec.Decision = response.GetStatus()
+                if response.ErrorCode != nil {
+                        rec.ErrorCode = response.GetErrorCode().String()
+                }
+                rec.Reason = response.GetErrorDetail()
+                if len(response.Artifact) > 0 {
+                        rec.ArtifactHash = hashHex(response.Artifact)
+                }
+        }
+        if cs.auditRequests && cs.auditLog != nil {
+                rec.Request, _ = proto.Marshal(request)
+        }
+        attrs := []any{"transport", rec.Transport, "peer", rec.Peer, "evidence_type", rec.EvidenceType,
+                "decision", rec.Decision}
+        if rec.Proxy != "" {
+                attrs = append(attrs, "proxy", rec.Proxy)
+        }
+        if rec.ClientCertHash != "" {
+                attrs = append(attrs, "client_cert", rec.ClientCert, "client_cert_hash", rec.ClientCertHash)
+        }
+        if rec.Measurement != "" {
+                attrs = append(attrs, "measurement", rec.Measurement)
+        }
+        if rec.CertSerial != "" {
+                attrs = append(attrs, "serial", rec.CertSerial)
+        }
+        if rec.ErrorCode != "" {
+                attrs = append(attrs, "error_code", rec.ErrorCode, "reason", rec.Reason)
+        }
+        if rec.Decision == "succeeded" {
+                cs.log().Info("Trust request", attrs...)
+        } else {
+                cs.log().Warn("Trust request", attrs...)
+        }
+        cs.audit(rec)
+}
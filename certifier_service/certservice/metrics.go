@@ -0,0 +1,276 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: metrics.go
+
+package certservice
+
+import (
+        "context"
+        "net/http"
+        "sync/atomic"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics.  Each CertifierService has its own registry, so
+// several can be embedded in one program; MetricsHandler serves it.
+// Label values come from fixed sets, whatever clients send.
+
+// Stages of evaluating a request, timed in certifier_stage_duration_seconds.
+const (
+        stageInitProvedStatements = "init_proved_statements"
+        stageAddNewFacts = "add_new_facts"
+        stageConstructProof = "construct_proof"
+        stageVerifyProof = "verify_proof"
+        stageSignArtifact = "sign_artifact"
+)
+
+// knownEvidenceTypes are the submitted evidence types Certify accepts.
+var knownEvidenceTypes = map[string]bool{
+        "full-vse-support": true,
+        "platform-attestation-only": true,
+        "sev-evidence": true,
+        "augmented-platform-attestation-only": true,
+        "oe-evidence": true,
+        "sev-platform-attestation-only": true,
+}
+
+func evidenceTypeLabel(evidenceType string) string {
+        if knownEvidenceTypes[evidenceType] {
+                return evidenceType
+        }
+        return "other"
+}
+
+func transportLabel(transport string) string {
+        switch transport {
+        case "socket", "http", "grpc":
+                return transport
+        }
+        return "other"
+}
+
+func yesNoLabel(b bool) string {
+        if b {
+                return "yes"
+        }
+        return "no"
+}
+
+func purposeLabel(purpose string) string {
+        switch purpose {
+        case "", "authentication":
+                return "authentication"
+        case "attestation":
+                return "attestation"
+        }
+        return "other"
+}
+
+type metrics struct {
+        registry *prometheus.Registry
+        requests *prometheus.CounterVec
+        failures *prometheus.CounterVec
+        peers *prometheus.CounterVec
+        nonces *prometheus.CounterVec
+        requestSeconds *prometheus.HistogramVec
+        stageSeconds *prometheus.HistogramVec
+        reloads *prometheus.CounterVec
+        lastReloadOk prometheus.Gauge
+        issuedExpiry *prometheus.GaugeVec
+}
+
+func newMetrics(cs *CertifierService) *metrics {
+        m := &metrics{
+                registry: prometheus.NewRegistry(),
+                requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "certifier_requests_total",
+                        Help: "Trust requests by evidence type, purpose and outcome (succeeded, failed or error).",
+                }, []string{"evidence_type", "purpose", "outcome"}),
+                failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "certifier_request_failures_total",
+                        Help: "Trust requests that failed or couldn't be evaluated, by error code.",
+                }, []string{"error_code"}),
+                peers: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "certifier_requests_by_peer_total",
+                        Help: "Trust requests by transport, whether the client presented a client cert and whether it came through a PROXY protocol proxy.",
+                }, []string{"transport", "client_cert", "proxied"}),
+                nonces: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "certifier_nonce_requests_total",
+                        Help: "Nonce requests by outcome (issued, rate_limited or error).",
+                }, []string{"outcome"}),
+                requestSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                        Name: "certifier_request_duration_seconds",
+                        Help: "Time to evaluate a trust request, including waiting for a slot.",
+                        Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
+                }, []string{"outcome"}),
+                stageSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+                        Name: "certifier_stage_duration_seconds",
+                        Help: "Time spent in each stage of evaluating a trust request.",
+                        Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+                }, []string{"stage"}),
+                reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+                        Name: "certifier_policy_reloads_total",
+                        Help: "Policy reloads by result (ok or rejected).",
+                }, []string{"result"}),
+                lastReloadOk: prometheus.NewGauge(prometheus.GaugeOpts{
+                        Name: "certifier_policy_last_reload_success",
+                        Help: "1 if the last policy reload succeeded or there hasn't been one, 0 if it was rejected.",
+                }),
+                issuedExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+                        Name: "certifier_last_issued_expiry_timestamp_seconds",
+                        Help: "When the most recently issued artifact of each kind expires.",
+                }, []string{"artifact"}),
+        }
+        m.lastReloadOk.Set(1)
+
+        policyGauge := func(name string, help string, f func(p *Policy) float64) prometheus.Collector {
+                return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help},
+                        func() float64 { return f(cs.Policy()) })
+        }
+        m.registry.MustRegister(
+                m.requests, m.failures, m.peers, m.nonces, m.requestSeconds, m.stageSeconds,
+                m.reloads, m.lastReloadOk, m.issuedExpiry,
+                policyGauge("certifier_policy_statements", "Policy statements in force.",
+                        func(p *Policy) float64 { return float64(p.StatementCount()) }),
+                policyGauge("certifier_policy_measurements", "Trusted measurements in the policy.",
+                        func(p *Policy) float64 { return float64(p.MeasurementPolicies()) }),
+                policyGauge("certifier_policy_platforms", "Trusted platform keys in the policy.",
+                        func(p *Policy) float64 { return float64(p.PlatformPolicies()) }),
+                policyGauge("certifier_policy_rejected_statements", "Policy statements left out because they failed verification.",
+                        func(p *Policy) float64 { return float64(p.Rejected()) }),
+                policyGauge("certifier_policy_loaded_timestamp_seconds", "When the policy in force was loaded.",
+                        func(p *Policy) float64 { return float64(p.LoadedAt.Unix()) }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_connections",
+                        Help: "Open sized socket connections.",
+                }, func() float64 {
+                        cs.drainMu.Lock()
+                        defer cs.drainMu.Unlock()
+                        return float64(len(cs.conns))
+                }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_requests_in_flight",
+                        Help: "Requests and socket connections being served.",
+                }, func() float64 {
+                        cs.drainMu.Lock()
+                        defer cs.drainMu.Unlock()
+                        return float64(cs.active)
+                }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_ready",
+                        Help: "1 if the service is ready for requests (see /readyz), else 0.",
+                }, func() float64 {
+                        if cs.Ready() != nil {
+                                return 0
+                        }
+                        return 1
+                }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_rate_limited_clients",
+                        Help: "Clients that have used some of their rate limit recently.",
+                }, func() float64 { return float64(cs.limiter.clients()) }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_requests_queued",
+                        Help: "Requests waiting for a verification slot.",
+                }, func() float64 { return float64(atomic.LoadInt64(&cs.queued)) }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_policy_cert_expiry_timestamp_seconds",
+                        Help: "When the policy cert expires; no artifact is valid after it.",
+                }, func() float64 { return float64(cs.policyCert.NotAfter.Unix()) }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_artifact_lifetime_seconds",
+                        Help: "Lifetime of issued admission certs and platform rules.",
+                }, func() float64 { return cs.duration }),
+                prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+                        Name: "certifier_transparency_log_entries",
+                        Help: "Entries in the transparency log.",
+                }, func() float64 {
+                        if cs.transLog == nil {
+                                return 0
+                        }
+                        return float64(cs.transLog.Size())
+                }),
+        )
+        return m
+}
+
+// MetricsHandler serves the service's metrics in the Prometheus
+// exposition format.
+func (cs *CertifierService) MetricsHandler() http.Handler {
+        return promhttp.HandlerFor(cs.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// MetricsRegistry is the registry with the service's metrics, for
+// programs that gather them with their own.
+func (cs *CertifierService) MetricsRegistry() *prometheus.Registry {
+        return cs.metrics.registry
+}
+
+// observeRequest counts a request once logRequest has filled in rec.
+func (m *metrics) observeRequest(rec *AuditRecord, elapsed time.Duration) {
+        m.requests.WithLabelValues(evidenceTypeLabel(rec.EvidenceType), purposeLabel(rec.Purpose),
+                rec.Decision).Inc()
+        if rec.Decision != "succeeded" && rec.ErrorCode != "" {
+                m.failures.WithLabelValues(rec.ErrorCode).Inc()
+        }
+        m.peers.WithLabelValues(transportLabel(rec.Transport), yesNoLabel(rec.ClientCertHash != ""),
+                yesNoLabel(rec.Proxy != "")).Inc()
+        m.requestSeconds.WithLabelValues(rec.Decision).Observe(elapsed.Seconds())
+}
+
+// observeNonce counts a nonce request that ended with err.
+func (m *metrics) observeNonce(err error) {
+        switch {
+        case err == nil:
+                m.nonces.WithLabelValues("issued").Inc()
+        case err == ErrRateLimited:
+                m.nonces.WithLabelValues("rate_limited").Inc()
+        default:
+                m.nonces.WithLabelValues("error").Inc()
+        }
+}
+
+func (m *metrics) observeReload(err error) {
+        if err != nil {
+                m.reloads.WithLabelValues("rejected").Inc()
+                m.lastReloadOk.Set(0)
+                return
+        }
+        m.reloads.WithLabelValues("ok").Inc()
+        m.lastReloadOk.Set(1)
+}
+
+func (m *metrics) observeIssued(entryType string, notAfter time.Time) {
+        m.issuedExpiry.WithLabelValues(entryType).Set(float64(notAfter.Unix()))
+}
+
+// Stage timings reach ConstructProofFromRequest through its context.
+
+type stageKey struct{}
+
+func withStageTimer(ctx context.Context, m *metrics) context.Context {
+        return context.WithValue(ctx, stageKey{}, m)
+}
+
+// observeStage records the time since start for stage, if ctx came
+// through withStageTimer.
+func observeStage(ctx context.Context, stage string, start time.Time) {
+        if m, ok := ctx.Value(stageKey{}).(*metrics); ok {
+                m.stageSeconds.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+        }
+}
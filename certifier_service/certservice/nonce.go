@@ -0,0 +1,212 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: nonce.go
+
+package certservice
+
+import (
+        "bytes"
+        "context"
+        "crypto/rand"
+        "sync"
+        "time"
+
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// Evidence freshness.  A client asks for a nonce (a trust request with
+// only nonce_request set, or GetNonce), puts it in the
+// attestation_user_data it attests to and sends the evidence before the
+// nonce expires.  Each nonce is accepted once.  Evidence without a nonce
+// is accepted unless RequireNonce is set, so older clients keep working.
+// Nonces are handed out under the same rate limit as trust requests.
+
+const (
+        defaultNonceLifetime = 2 * time.Minute
+        defaultMaxNoncesPerClient = 16
+        nonceSize = 32
+)
+
+// nonceStore holds the outstanding nonces.  Each client (Peer.client)
+// may have maxPerClient of them; asking for another drops its oldest,
+// so one client can't use up the nonces of others.
+type nonceStore struct {
+        mu sync.Mutex
+        // outstanding maps an issued, unused nonce to its client and
+        // expiry.
+        outstanding map[string]issuedNonce
+        // byClient lists each client's nonces, oldest first.  It may
+        // still have nonces that were redeemed or have expired.
+        byClient map[string][]string
+        lifetime time.Duration
+        maxPerClient int
+        lastPrune time.Time
+}
+
+type issuedNonce struct {
+        client string
+        expiry time.Time
+}
+
+func newNonceStore(lifetime time.Duration, maxPerClient int) *nonceStore {
+        if lifetime <= 0 {
+                lifetime = defaultNonceLifetime
+        }
+        if maxPerClient <= 0 {
+                maxPerClient = defaultMaxNoncesPerClient
+        }
+        return &nonceStore{
+                outstanding: make(map[string]issuedNonce),
+                byClient: make(map[string][]string),
+                lifetime: lifetime,
+                maxPerClient: maxPerClient,
+                lastPrune: time.Now(),
+        }
+}
+
+// liveLocked is client's list without the nonces no longer
+// outstanding.  s.mu must be held.
+func (s *nonceStore) liveLocked(client string) []string {
+        var live []string
+        for _, n := range s.byClient[client] {
+                if _, ok := s.outstanding[n]; ok {
+                        live = append(live, n)
+                }
+        }
+        if len(live) == 0 {
+                delete(s.byClient, client)
+        } else {
+                s.byClient[client] = live
+        }
+        return live
+}
+
+// pruneLocked drops expired nonces, at most once a lifetime.  s.mu must
+// be held.
+func (s *nonceStore) pruneLocked(now time.Time) {
+        if now.Sub(s.lastPrune) < s.lifetime {
+                return
+        }
+        s.lastPrune = now
+        for n, in := range s.outstanding {
+                if now.After(in.expiry) {
+                        delete(s.outstanding, n)
+                }
+        }
+        for client := range s.byClient {
+                s.liveLocked(client)
+        }
+}
+
+func (s *nonceStore) issue(client string) ([]byte, time.Time, error) {
+        nonce := make([]byte, nonceSize)
+        if _, err := rand.Read(nonce); err != nil {
+                return nil, time.Time{}, err
+        }
+        now := time.Now()
+        expiry := now.Add(s.lifetime)
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        s.pruneLocked(now)
+        live := s.liveLocked(client)
+        for len(live) >= s.maxPerClient {
+                delete(s.outstanding, live[0])
+                live = live[1:]
+        }
+        s.outstanding[string(nonce)] = issuedNonce{client: client, expiry: expiry}
+        s.byClient[client] = append(live, string(nonce))
+        return nonce, expiry, nil
+}
+
+// redeem uses up nonce.  Any client may redeem it: the evidence that
+// attests to it is what matters.
+func (s *nonceStore) redeem(nonce []byte) error {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        in, ok := s.outstanding[string(nonce)]
+        if !ok {
+                return badNonce("nonce unknown or already used")
+        }
+        delete(s.outstanding, string(nonce))
+        s.liveLocked(in.client)
+        if time.Now().After(in.expiry) {
+                return badNonce("nonce expired")
+        }
+        return nil
+}
+
+func badNonce(detail string) error {
+        return certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE, "%s", detail)
+}
+
+// IssueNonce makes a nonce for the attestation_user_data of a later
+// request.  It is Certify with a trust request asking for a nonce, so
+// the caller's rate limit applies; WithPeer says who the caller is.
+func (cs *CertifierService) IssueNonce(ctx context.Context) (*certprotos.NonceResponse, error) {
+        response, err := cs.Certify(ctx, &certprotos.TrustRequestMessage{
+                NonceRequest: &certprotos.NonceRequest{},
+        })
+        if err != nil {
+                return nil, err
+        }
+        return response.Nonce, nil
+}
+
+// nonceResponse answers a trust request from p asking for a nonce.
+func (cs *CertifierService) nonceResponse(p Peer, request *certprotos.TrustRequestMessage) (
+                *certprotos.TrustResponseMessage, error) {
+        nonce, expiry, err := cs.nonces.issue(p.client())
+        if err != nil {
+                return nil, err
+        }
+        notAfter := certlib.TimePointToString(certlib.TimePointFromTime(expiry))
+        succeeded := "succeeded"
+        return &certprotos.TrustResponseMessage{
+                RequestingEnclaveTag: request.RequestingEnclaveTag,
+                ProvidingEnclaveTag: request.ProvidingEnclaveTag,
+                Status: &succeeded,
+                Nonce: &certprotos.NonceResponse{
+                        Nonce: nonce,
+                        NotAfter: &notAfter,
+                },
+        }, nil
+}
+
+// nonceChecker checks the nonces in the evidence of one request.  A
+// request may attest to the same nonce more than once, in different
+// evidence, but can't reuse a nonce from an earlier request.
+func (cs *CertifierService) nonceChecker() certlib.NonceChecker {
+        var redeemed []byte
+        return func(nonce []byte) error {
+                if len(nonce) == 0 {
+                        if cs.requireNonce {
+                                return badNonce("evidence has no nonce")
+                        }
+                        return nil
+                }
+                if redeemed != nil && bytes.Equal(nonce, redeemed) {
+                        return nil
+                }
+                if redeemed != nil {
+                        return badNonce("evidence attests to different nonces")
+                }
+                if err := cs.nonces.redeem(nonce); err != nil {
+                        return err
+                }
+                redeemed = nonce
+                return nil
+        }
+}
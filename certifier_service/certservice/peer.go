@@ -0,0 +1,149 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: peer.go
+
+package certservice
+
+import (
+        "context"
+        "crypto/tls"
+        "net"
+        "net/http"
+
+        "google.golang.org/grpc/credentials"
+        "google.golang.org/grpc/peer"
+)
+
+// Every request is recorded with who sent it: the client's address, the
+// proxy it came through and the client cert it presented, if any.  The
+// same identity is what rate limits apply to.
+
+// Peer is who a request came from.
+type Peer struct {
+        // Transport is "socket", "http" or "grpc".
+        Transport string
+        // Addr is the client's address: the connection's remote address
+        // or, behind a proxy speaking the PROXY protocol, the source
+        // address the proxy reported.
+        Addr string
+        // Proxy is the address of that proxy.
+        Proxy string
+        // ClientCert is the subject common name of the client cert, if
+        // the client presented one that chains to the policy cert, and
+        // ClientCertHash is the hex SHA-256 of that cert.
+        ClientCert string
+        ClientCertHash string
+}
+
+// client is who rate limits apply to: the client cert or, without one,
+// the client's IP address.
+func (p *Peer) client() string {
+        if p.ClientCertHash != "" {
+                return "cert:" + p.ClientCertHash
+        }
+        if host, _, err := net.SplitHostPort(p.Addr); err == nil {
+                return "ip:" + host
+        }
+        return "ip:" + p.Addr
+}
+
+func (p *Peer) setAddr(a net.Addr) {
+        if a == nil {
+                return
+        }
+        if pa, ok := a.(*ProxiedAddr); ok {
+                p.Addr = pa.Source.String()
+                p.Proxy = pa.Proxy.String()
+                return
+        }
+        p.Addr = a.String()
+}
+
+func (p *Peer) setClientCert(state *tls.ConnectionState) {
+        if !verifiedClient(state) {
+                return
+        }
+        leaf := state.VerifiedChains[0][0]
+        p.ClientCert = leaf.Subject.CommonName
+        p.ClientCertHash = hashHex(leaf.Raw)
+}
+
+// peerFromConn is who is at the other end of conn.  A TLS conn has
+// the client cert once the handshake is done.
+func peerFromConn(transport string, conn net.Conn) Peer {
+        p := Peer{Transport: transport}
+        p.setAddr(conn.RemoteAddr())
+        if tc, ok := conn.(*tls.Conn); ok {
+                state := tc.ConnectionState()
+                p.setClientCert(&state)
+        }
+        return p
+}
+
+func (rec *AuditRecord) setPeer(p Peer) {
+        rec.Transport = p.Transport
+        rec.Peer = p.Addr
+        rec.Proxy = p.Proxy
+        rec.ClientCert = p.ClientCert
+        rec.ClientCertHash = p.ClientCertHash
+}
+
+type connKey struct{}
+
+// ConnContext, as the http.Server ConnContext, lets the HTTP gateway
+// see the proxy a request came through.
+func (cs *CertifierService) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+        return context.WithValue(ctx, connKey{}, conn)
+}
+
+// peerFromHttp is who sent r.
+func peerFromHttp(r *http.Request) Peer {
+        if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+                return peerFromConn("http", conn)
+        }
+        p := Peer{Transport: "http", Addr: r.RemoteAddr}
+        p.setClientCert(r.TLS)
+        return p
+}
+
+type peerKey struct{}
+
+// WithPeer tells Certify who sent the request in ctx.
+func WithPeer(ctx context.Context, p Peer) context.Context {
+        return context.WithValue(ctx, peerKey{}, p)
+}
+
+// WithRequestOrigin tells Certify how the request in ctx came in and from
+// what address.
+func WithRequestOrigin(ctx context.Context, transport string, peerAddr string) context.Context {
+        return WithPeer(ctx, Peer{Transport: transport, Addr: peerAddr})
+}
+
+// peerFromContext is who sent the request in ctx, from WithPeer or, for
+// gRPC calls, the gRPC peer.
+func peerFromContext(ctx context.Context) Peer {
+        if p, ok := ctx.Value(peerKey{}).(Peer); ok {
+                return p
+        }
+        if gp, ok := peer.FromContext(ctx); ok {
+                p := Peer{Transport: "grpc"}
+                p.setAddr(gp.Addr)
+                if info, ok := gp.AuthInfo.(credentials.TLSInfo); ok {
+                        p.setClientCert(&info.State)
+                }
+                return p
+        }
+        return Peer{}
+}
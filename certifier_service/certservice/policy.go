@@ -0,0 +1,533 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: policy.go
+
+package certservice
+
+import (
+        "crypto/sha256"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "log/slog"
+        "sort"
+        "strings"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The policy is a list of statements of the form
+//      policy-key says clause
+// where clause is, for example,
+//      Measurement[] is-trusted
+//      Key[] is-trusted-for-attestation
+//      Key[] is-trusted-for-authentication
+//      Key[] speaks-for Measurement[]
+//      Key[] says clause
+// Statements are indexed by the verb of clause.  The predicates, and which
+// dominates which, are the built-in ones and those declared in the
+// policy's predicate-dominance claims (see certlib/dominance.go).  Besides
+// rules R1-R7, proofs may use the rules in the policy's certifier-rules
+// claims (see certlib/rules.go).
+
+type policyStatement struct {
+        // says is "policy-key says clause".
+        says *certprotos.VseClause
+        sc *certprotos.SignedClaimMessage
+}
+
+// Policy holds the policy statements.  It is not modified once it is
+// built, so requests can share it.
+type Policy struct {
+        PublicPolicyKey *certprotos.KeyMessage
+        // LoadedAt is the time the policy was built for, now for NewPolicy.
+        LoadedAt time.Time
+        // Hash is the SHA-256 of the serialized policy.
+        Hash [32]byte
+        // serialized is the policy as loaded, for proof bundles.
+        serialized []byte
+        statements map[string][]policyStatement
+        report []PolicyEntryReport
+        // tree is the predicate dominance lattice the prover and proof
+        // checker use.
+        tree *certlib.PredicateDominance
+        // rules are the declared rules, numbered from
+        // certlib.FirstDeclaredRule.
+        rules []*certlib.DeclaredRule
+}
+
+// Dominance is the policy's predicate dominance lattice.
+func (p *Policy) Dominance() *certlib.PredicateDominance {
+        return p.tree
+}
+
+// Rules are the rules the policy declares.
+func (p *Policy) Rules() []*certlib.DeclaredRule {
+        return p.rules
+}
+
+// Find returns the signed policy statement "policy-key says c", or nil.
+func (p *Policy) Find(c *certprotos.VseClause) *certprotos.SignedClaimMessage {
+        if c == nil {
+                return nil
+        }
+        l := p.statements[c.GetVerb()]
+        for i := 0; i < len(l); i++ {
+                if certlib.SameVseClause(l[i].says.Clause, c) {
+                        return l[i].sc
+                }
+        }
+        return nil
+}
+
+// Statements returns the policy statements whose clause has verb.
+func (p *Policy) Statements(verb string) []*certprotos.VseClause {
+        var l []*certprotos.VseClause
+        for _, ps := range p.statements[verb] {
+                l = append(l, ps.says)
+        }
+        return l
+}
+
+// StatementCount is the number of statements in force.
+func (p *Policy) StatementCount() int {
+        n := 0
+        for _, l := range p.statements {
+                n += len(l)
+        }
+        return n
+}
+
+func (p *Policy) countStatements(verb string, entityType string) int {
+        n := 0
+        for _, ps := range p.statements[verb] {
+                if ps.says.Clause.Subject.GetEntityType() == entityType {
+                        n++
+                }
+        }
+        return n
+}
+
+func (p *Policy) findPolicyFromMeasurement(m []byte) *certprotos.SignedClaimMessage {
+        verb := "is-trusted"
+        return p.Find(certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &verb))
+}
+
+func (p *Policy) findPolicyFromKey(k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
+        if k == nil {
+                return nil
+        }
+        verb := "is-trusted-for-attestation"
+        return p.Find(certlib.MakeUnaryVseClause(certlib.MakeKeyEntity(k), &verb))
+}
+
+// MeasurementPolicies is the number of trusted measurements.
+func (p *Policy) MeasurementPolicies() int {
+        return p.countStatements("is-trusted", "measurement")
+}
+
+// PlatformPolicies is the number of keys trusted for attestation.
+func (p *Policy) PlatformPolicies() int {
+        return p.countStatements("is-trusted-for-attestation", "key")
+}
+
+// PolicyEntryReport says what happened to one policy statement at load.
+type PolicyEntryReport struct {
+        Index int `json:"index"`
+        Accepted bool `json:"accepted"`
+        // Statement is the clause, if it could be recovered.
+        Statement string `json:"statement,omitempty"`
+        Reason string `json:"reason,omitempty"`
+}
+
+// Report lists, in file order, which statements were accepted and why
+// the others were rejected.
+func (p *Policy) Report() []PolicyEntryReport {
+        return p.report
+}
+
+// Rejected is the number of rejected statements.
+func (p *Policy) Rejected() int {
+        n := 0
+        for _, e := range p.report {
+                if !e.Accepted {
+                        n++
+                }
+        }
+        return n
+}
+
+// verifyPolicyStatement checks that sc is a current vse-clause claim,
+// signed by the policy key and of the form "policy-key says ...".  The
+// clause is returned, when it can be parsed, even if sc is rejected.
+func verifyPolicyStatement(publicPolicyKey *certprotos.KeyMessage, sc *certprotos.SignedClaimMessage,
+                now time.Time, tree *certlib.PredicateDominance) (*certprotos.VseClause, error) {
+        cm := certprotos.ClaimMessage{}
+        err := proto.Unmarshal(sc.SerializedClaimMessage, &cm)
+        if err != nil {
+                return nil, fmt.Errorf("can't parse claim: %v", err)
+        }
+        if cm.GetClaimFormat() != "vse-clause" {
+                return nil, fmt.Errorf("claim format %s, not vse-clause", cm.GetClaimFormat())
+        }
+        vse := &certprotos.VseClause{}
+        err = proto.Unmarshal(cm.SerializedClaim, vse)
+        if err != nil {
+                return nil, fmt.Errorf("can't parse clause: %v", err)
+        }
+
+        err = checkPolicyClaim(publicPolicyKey, sc, &cm, now)
+        if err != nil {
+                return vse, err
+        }
+        if vse.Subject == nil || vse.Verb == nil || vse.Clause == nil || vse.GetVerb() != "says" {
+                return vse, errors.New("not a says statement")
+        }
+        if vse.Subject.GetEntityType() != "key" || !certlib.SameKey(vse.Subject.Key, publicPolicyKey) {
+                return vse, errors.New("the policy key is not the one that says it")
+        }
+        err = wellFormedClause(tree, vse.Clause)
+        if err != nil {
+                return vse, err
+        }
+        return vse, nil
+}
+
+// checkPolicyClaim checks that sc, whose claim is cm, is current and
+// signed by the policy key.
+func checkPolicyClaim(publicPolicyKey *certprotos.KeyMessage, sc *certprotos.SignedClaimMessage,
+                cm *certprotos.ClaimMessage, now time.Time) error {
+        if sc.SigningKey == nil {
+                return errors.New("no signing key")
+        }
+        if !certlib.SameKey(sc.SigningKey, publicPolicyKey) {
+                return fmt.Errorf("signed by %s, not the policy key",
+                        certlib.KeyDescriptorToString(sc.SigningKey))
+        }
+        nb := certlib.StringToTimePoint(cm.GetNotBefore())
+        na := certlib.StringToTimePoint(cm.GetNotAfter())
+        if nb == nil || na == nil {
+                return errors.New("claim has no validity period")
+        }
+        tn := certlib.TimePointFromTime(now.Local())
+        if certlib.CompareTimePoints(nb, tn) > 0 {
+                return fmt.Errorf("not valid before %s", cm.GetNotBefore())
+        }
+        if certlib.CompareTimePoints(na, tn) < 0 {
+                return fmt.Errorf("expired %s", cm.GetNotAfter())
+        }
+        // Verify with the policy key, not the key the claim names.
+        if certlib.CheckSignedClaimAt(sc, publicPolicyKey, now) != nil {
+                return errors.New("bad signature")
+        }
+        return nil
+}
+
+// verifyDominanceStatement checks that sc is a current
+// predicate-dominance claim signed by the policy key, and returns the
+// predicates it declares.  The description is returned, when the claim
+// can be parsed, even if sc is rejected.
+func verifyDominanceStatement(publicPolicyKey *certprotos.KeyMessage, sc *certprotos.SignedClaimMessage,
+                now time.Time) ([]certlib.DominanceEdge, string, error) {
+        cm := certprotos.ClaimMessage{}
+        err := proto.Unmarshal(sc.SerializedClaimMessage, &cm)
+        if err != nil {
+                return nil, "", fmt.Errorf("can't parse claim: %v", err)
+        }
+        var lines []string
+        for _, line := range strings.Split(string(cm.SerializedClaim), "\n") {
+                if f := strings.Fields(line); len(f) > 0 {
+                        lines = append(lines, strings.Join(f, " "))
+                }
+        }
+        desc := "predicate dominance: " + strings.Join(lines, "; ")
+        err = checkPolicyClaim(publicPolicyKey, sc, &cm, now)
+        if err != nil {
+                return nil, desc, err
+        }
+        edges, err := certlib.ParseDominance(cm.SerializedClaim)
+        if err != nil {
+                return nil, desc, err
+        }
+        return edges, desc, nil
+}
+
+// verifyRulesStatement checks that sc is a current certifier-rules claim
+// signed by the policy key, whose rules use only predicates in tree, and
+// returns the rules, numbered from first.  The description is returned,
+// when the claim can be parsed, even if sc is rejected.
+func verifyRulesStatement(publicPolicyKey *certprotos.KeyMessage, sc *certprotos.SignedClaimMessage,
+                now time.Time, tree *certlib.PredicateDominance, first int) ([]*certlib.DeclaredRule,
+                string, error) {
+        cm := certprotos.ClaimMessage{}
+        err := proto.Unmarshal(sc.SerializedClaimMessage, &cm)
+        if err != nil {
+                return nil, "", fmt.Errorf("can't parse claim: %v", err)
+        }
+        cr := &certprotos.CertifierRules{}
+        err = proto.Unmarshal(cm.SerializedClaim, cr)
+        if err != nil {
+                return nil, "", fmt.Errorf("can't parse rules: %v", err)
+        }
+        var texts []string
+        for i, text := range cr.GetRule() {
+                texts = append(texts, fmt.Sprintf("R%d: %s", first + i, strings.Join(strings.Fields(text), " ")))
+        }
+        desc := "certifier rules: " + strings.Join(texts, "; ")
+        err = checkPolicyClaim(publicPolicyKey, sc, &cm, now)
+        if err != nil {
+                return nil, desc, err
+        }
+        if len(cr.GetRule()) == 0 {
+                return nil, desc, errors.New("no rules declared")
+        }
+        rules, err := certlib.InitCerifierRules(cr)
+        if err != nil {
+                return nil, desc, err
+        }
+        for i, r := range rules {
+                for _, verb := range r.Verbs() {
+                        if verb != "says" && verb != "speaks-for" && !certlib.IsChild(tree, verb) {
+                                return nil, desc, fmt.Errorf("rule %d: unknown verb %s", first + i, verb)
+                        }
+                }
+        }
+        return rules, desc, nil
+}
+
+// claimFormat is the format of the claim in sc, or "" if it can't be
+// parsed.
+func claimFormat(sc *certprotos.SignedClaimMessage) string {
+        cm := certprotos.ClaimMessage{}
+        if proto.Unmarshal(sc.SerializedClaimMessage, &cm) != nil {
+                return ""
+        }
+        return cm.GetClaimFormat()
+}
+
+func wellFormedEntity(e *certprotos.EntityMessage) bool {
+        if e == nil {
+                return false
+        }
+        if e.GetEntityType() == "key" {
+                return e.Key != nil && e.Key.KeyType != nil
+        }
+        if e.GetEntityType() == "measurement" {
+                return len(e.Measurement) > 0
+        }
+        return false
+}
+
+// wellFormedClause checks that c is a clause the prover understands:
+// an entity with a predicate from the dominance lattice, a speaks-for or
+// a key that says a well formed clause.
+func wellFormedClause(tree *certlib.PredicateDominance, c *certprotos.VseClause) error {
+        if !wellFormedEntity(c.Subject) || c.Verb == nil {
+                return errors.New("malformed clause")
+        }
+        verb := c.GetVerb()
+        switch {
+        case verb == "speaks-for":
+                if !wellFormedEntity(c.Object) || c.Clause != nil {
+                        return errors.New("malformed speaks-for")
+                }
+                if c.Subject.GetEntityType() != "key" {
+                        return errors.New("only keys speak for")
+                }
+        case verb == "says":
+                if c.Subject.GetEntityType() != "key" || c.Object != nil || c.Clause == nil {
+                        return errors.New("malformed says")
+                }
+                return wellFormedClause(tree, c.Clause)
+        case certlib.IsChild(tree, verb):
+                if c.Object != nil || c.Clause != nil {
+                        return fmt.Errorf("%s takes no object", verb)
+                }
+        default:
+                return fmt.Errorf("unknown verb %s", verb)
+        }
+        return nil
+}
+
+// NewPolicy builds the policy from a serialized buffer_sequence of
+// signed claims, the format written by the policy utilities.  Each
+// statement is verified; the ones that fail are left out and listed,
+// with the reason, in Report.  The predicate dominance lattice is built
+// first, from the built-in predicates and the accepted
+// predicate-dominance claims; NewPolicy fails if it has a cycle or a
+// predicate is-trusted doesn't dominate.  Declared rules are numbered in
+// the order of the accepted certifier-rules claims.
+func NewPolicy(publicPolicyKey *certprotos.KeyMessage, policySeq []byte) (*Policy, error) {
+        return NewPolicyAt(publicPolicyKey, policySeq, time.Now())
+}
+
+// NewPolicyAt is NewPolicy for the policy as it stood at time at: a
+// statement is accepted if it was valid then.
+func NewPolicyAt(publicPolicyKey *certprotos.KeyMessage, policySeq []byte, at time.Time) (*Policy, error) {
+        if publicPolicyKey == nil {
+                return nil, errors.New("no policy key")
+        }
+        p := &Policy{
+                PublicPolicyKey: publicPolicyKey,
+                LoadedAt: at,
+                Hash: sha256.Sum256(policySeq),
+                serialized: policySeq,
+                statements: make(map[string][]policyStatement),
+        }
+
+        var  claimBlocks *certprotos.BufferSequence = &certprotos.BufferSequence{}
+        err := proto.Unmarshal(policySeq, claimBlocks)
+        if err != nil {
+                return nil, fmt.Errorf("can't parse policy: %v", err)
+        }
+
+        certlib.Logger().Debug("NewPolicy", "bytes", len(policySeq), "statements", len(claimBlocks.Block))
+
+        signedClaims := make([]*certprotos.SignedClaimMessage, len(claimBlocks.Block))
+        parseErrs := make([]error, len(claimBlocks.Block))
+        dominance := make(map[int]PolicyEntryReport)
+        var edges []certlib.DominanceEdge
+        for i := 0; i < len(claimBlocks.Block); i++ {
+                sc := &certprotos.SignedClaimMessage{}
+                parseErrs[i] = proto.Unmarshal(claimBlocks.Block[i], sc)
+                if parseErrs[i] != nil {
+                        continue
+                }
+                signedClaims[i] = sc
+                if claimFormat(sc) != certlib.DominanceClaimFormat {
+                        continue
+                }
+                entry := PolicyEntryReport{
+                        Index: i,
+                }
+                e, desc, err := verifyDominanceStatement(publicPolicyKey, sc, at)
+                entry.Statement = desc
+                if err != nil {
+                        entry.Reason = err.Error()
+                } else {
+                        edges = append(edges, e...)
+                        entry.Accepted = true
+                }
+                dominance[i] = entry
+        }
+        tree, err := certlib.BuildDominance(edges)
+        if err != nil {
+                return nil, fmt.Errorf("predicate dominance: %v", err)
+        }
+        p.tree = tree
+
+        for i := 0; i < len(claimBlocks.Block); i++ {
+                if entry, ok := dominance[i]; ok {
+                        p.report = append(p.report, entry)
+                        continue
+                }
+                entry := PolicyEntryReport{
+                        Index: i,
+                }
+                if parseErrs[i] != nil {
+                        entry.Reason = fmt.Sprintf("can't parse signed claim: %v", parseErrs[i])
+                        p.report = append(p.report, entry)
+                        continue
+                }
+                sc := signedClaims[i]
+                if claimFormat(sc) == certlib.RulesClaimFormat {
+                        rules, desc, err := verifyRulesStatement(publicPolicyKey, sc, at, tree,
+                                certlib.FirstDeclaredRule + len(p.rules))
+                        entry.Statement = desc
+                        if err != nil {
+                                entry.Reason = err.Error()
+                        } else {
+                                p.rules = append(p.rules, rules...)
+                                entry.Accepted = true
+                        }
+                        p.report = append(p.report, entry)
+                        continue
+                }
+                vse, err := verifyPolicyStatement(publicPolicyKey, sc, at, tree)
+                if vse != nil {
+                        entry.Statement = certlib.VseClauseToString(vse)
+                }
+                if err != nil {
+                        entry.Reason = err.Error()
+                        p.report = append(p.report, entry)
+                        continue
+                }
+
+                if p.Find(vse.Clause) != nil {
+                        entry.Reason = "duplicate statement"
+                        p.report = append(p.report, entry)
+                        continue
+                }
+                verb := vse.Clause.GetVerb()
+                p.statements[verb] = append(p.statements[verb], policyStatement{
+                        says: vse,
+                        sc: sc,
+                })
+                entry.Accepted = true
+                p.report = append(p.report, entry)
+        }
+        return p, nil
+}
+
+// PrintReport prints the accept/reject report.
+func (p *Policy) PrintReport() {
+        fmt.Printf("\nPolicy statements, %d accepted, %d rejected:\n", len(p.report) - p.Rejected(), p.Rejected())
+        for _, e := range p.report {
+                if e.Accepted {
+                        fmt.Printf("  %3d accepted: %s\n", e.Index, e.Statement)
+                } else {
+                        fmt.Printf("  %3d REJECTED: %s (%s)\n", e.Index, e.Statement, e.Reason)
+                }
+        }
+}
+
+// LogReport logs the accept/reject report: a summary, then each rejected
+// statement as a warning and each accepted one at debug level.
+func (p *Policy) LogReport(l *slog.Logger) {
+        l.Info("Policy loaded", "hash", hex.EncodeToString(p.Hash[:]), "accepted", len(p.report) - p.Rejected(),
+                "rejected", p.Rejected())
+        for _, e := range p.report {
+                if e.Accepted {
+                        l.Debug("Policy statement accepted", "index", e.Index, "statement", e.Statement)
+                } else {
+                        l.Warn("Policy statement rejected", "index", e.Index, "statement", e.Statement,
+                                "reason", e.Reason)
+                }
+        }
+}
+
+// Print prints the policy statements.
+func (p *Policy) Print() {
+        fmt.Printf("\nPolicy, %d statements:\n", p.StatementCount())
+        var verbs []string
+        for verb := range p.statements {
+                verbs = append(verbs, verb)
+        }
+        sort.Strings(verbs)
+        for _, verb := range verbs {
+                l := p.statements[verb]
+                fmt.Printf("\n%s, %d entries:\n", verb, len(l))
+                for i := 0; i < len(l); i++ {
+                        fmt.Printf("\n")
+                        certlib.PrintVseClause(l[i].says)
+                        fmt.Printf("\n")
+                        certlib.PrintSignedClaim(l[i].sc)
+                        fmt.Printf("\n")
+                }
+        }
+}
@@ -0,0 +1,421 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: proofs.go
+
+package certservice
+
+import (
+        "context"
+        "encoding/hex"
+        "fmt"
+        "sort"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+        //oeverify "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/oeverify"
+)
+
+func AddFactFromSignedClaim(signedClaim *certprotos.SignedClaimMessage,
+                alreadyProved *certprotos.ProvedStatements) bool {
+
+        k := signedClaim.SigningKey
+        tcl := certprotos.VseClause{}
+        if certlib.CheckSignedAssertion(signedClaim, k, &tcl) == nil {
+                // make sure the saying key in tcl is the same key that signed it
+                if tcl.GetVerb() == "says" && tcl.GetSubject().GetEntityType() == "key" {
+                        if certlib.SameKey(k, tcl.GetSubject().GetKey()) {
+                                alreadyProved.Proved = append(alreadyProved.Proved, &tcl)
+                        } else {
+                                return false
+                        }
+                }
+        } else {
+                return false
+        }
+        return true
+}
+
+func badEvidence(detail string) error {
+        return certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE, "%s", detail)
+}
+
+func badRequest(detail string) error {
+        return certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST, "%s", detail)
+}
+
+// policyKeyStatement is an error if the evidence in ps has the policy key
+// say anything.  What the policy key says comes only from the loaded
+// policy: a client can't bring back a statement a reload removed.
+func policyKeyStatement(policyKey *certprotos.KeyMessage, ps *certprotos.ProvedStatements) error {
+        for i, c := range ps.Proved {
+                if c.GetVerb() == "says" && certlib.SameKey(c.GetSubject().GetKey(), policyKey) {
+                        return badEvidence(fmt.Sprintf("statement %d, %s, is the policy key's; only the policy can make it",
+                                i, certlib.VseClauseToString(c)))
+                }
+        }
+        return nil
+}
+
+func unknownMeasurement(m []byte) error {
+        return certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT,
+                "policy doesn't trust measurement %s", hex.EncodeToString(m))
+}
+
+func unknownPlatform(k *certprotos.KeyMessage) error {
+        if k == nil {
+                return badEvidence("no platform key")
+        }
+        return certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_PLATFORM,
+                "policy doesn't trust platform key %s for attestation", certlib.KeyDescriptorToString(k))
+}
+
+// addPolicyFact adds the statement in a signed policy claim to
+// alreadyProved.  Policy statements are checked when the policy is
+// loaded, but may expire since.
+func addPolicyFact(signedClaim *certprotos.SignedClaimMessage,
+                alreadyProved *certprotos.ProvedStatements) error {
+        k := signedClaim.SigningKey
+        tcl := certprotos.VseClause{}
+        err := certlib.CheckSignedAssertion(signedClaim, k, &tcl)
+        if err != nil {
+                return fmt.Errorf("policy statement: %w", err)
+        }
+        alreadyProved.Proved = append(alreadyProved.Proved, &tcl)
+        return nil
+}
+
+// maxEvidenceItems bounds the evidence in one request.  The prover's
+// work grows with the square of the statements it holds.
+const maxEvidenceItems = 64
+
+// Proofs are found by the prover in certlib/prover.go.  The evidence is
+// verified into proved statements, the policy statements about the keys
+// and measurements they name are added, and the prover derives
+// "key is-trusted-for-authentication" (or -attestation) for a key the
+// evidence attests.  Nothing depends on the order of the evidence or the
+// length of its chains, so new evidence only needs a verifier in certlib.
+
+// attested returns the keys and measurements the evidence attests: key2
+// and the measurement in "key1 says key2 speaks-for measurement", where
+// key1 isn't the policy key.  When key1 hands off to key2, in
+// "key1 says key2 speaks-for key1", key2 is attested instead of key1.
+func attested(policyKey *certprotos.KeyMessage, alreadyProved *certprotos.ProvedStatements) (
+                []*certprotos.EntityMessage, [][]byte) {
+        var keys []*certprotos.EntityMessage
+        var handedOff []*certprotos.EntityMessage
+        var measurements [][]byte
+        for _, c := range alreadyProved.Proved {
+                if c.GetVerb() != "says" || c.GetClause().GetVerb() != "speaks-for" {
+                        continue
+                }
+                if certlib.SameKey(c.GetSubject().GetKey(), policyKey) {
+                        continue
+                }
+                if c.GetClause().GetSubject().GetEntityType() == "key" {
+                        keys = append(keys, c.GetClause().GetSubject())
+                }
+                object := c.GetClause().GetObject()
+                if object.GetEntityType() == "measurement" {
+                        measurements = append(measurements, object.GetMeasurement())
+                }
+                if object.GetEntityType() == "key" && certlib.SameEntity(object, c.GetSubject()) {
+                        handedOff = append(handedOff, object)
+                }
+        }
+        var current []*certprotos.EntityMessage
+        for _, k := range keys {
+                if !mentions(&certprotos.VseClause{Subject: k}, handedOff) {
+                        current = append(current, k)
+                }
+        }
+        if len(current) == 0 {
+                current = keys
+        }
+        return current, measurements
+}
+
+// mentions says whether c, or a clause in it, names one of entities.
+func mentions(c *certprotos.VseClause, entities []*certprotos.EntityMessage) bool {
+        if c == nil {
+                return false
+        }
+        for _, e := range entities {
+                if certlib.SameEntity(c.GetSubject(), e) || certlib.SameEntity(c.GetObject(), e) {
+                        return true
+                }
+        }
+        return mentions(c.GetClause(), entities)
+}
+
+// AddPolicyFacts adds to alreadyProved the policy statements that name a
+// key or measurement named in alreadyProved.
+func (p *Policy) AddPolicyFacts(alreadyProved *certprotos.ProvedStatements) error {
+        var entities []*certprotos.EntityMessage
+        var collect func(c *certprotos.VseClause)
+        collect = func(c *certprotos.VseClause) {
+                if c == nil {
+                        return
+                }
+                for _, e := range []*certprotos.EntityMessage{c.GetSubject(), c.GetObject()} {
+                        if e != nil && !mentions(&certprotos.VseClause{Subject: e}, entities) {
+                                entities = append(entities, e)
+                        }
+                }
+                collect(c.GetClause())
+        }
+        for _, c := range alreadyProved.Proved {
+                collect(c)
+        }
+
+        // In a fixed order, so the same request gets the same proof.
+        var verbs []string
+        for verb := range p.statements {
+                verbs = append(verbs, verb)
+        }
+        sort.Strings(verbs)
+        for _, verb := range verbs {
+                l := p.statements[verb]
+                for i := 0; i < len(l); i++ {
+                        if !mentions(l[i].says.Clause, entities) ||
+                                        certlib.StatementAlreadyProved(l[i].says, alreadyProved) {
+                                continue
+                        }
+                        if err := addPolicyFact(l[i].sc, alreadyProved); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+// ProveRequest proves that a key the evidence attests is trusted for
+// purpose.  It returns the goal proved and its proof, or an error
+// saying what is missing.  It gives up if ctx is done.
+func (p *Policy) ProveRequest(ctx context.Context, purpose string, alreadyProved *certprotos.ProvedStatements) (
+                *certprotos.VseClause, *certprotos.Proof, error) {
+        verb := "is-trusted-for-authentication"
+        if purpose == "attestation" {
+                verb = "is-trusted-for-attestation"
+        }
+        keys, measurements := attested(p.PublicPolicyKey, alreadyProved)
+        if len(keys) == 0 {
+                return nil, nil, badEvidence("the evidence attests no key")
+        }
+        var goals []*certprotos.VseClause
+        for _, k := range keys {
+                goals = append(goals, certlib.MakeUnaryVseClause(k, &verb))
+        }
+
+        pr := certlib.NewProverWithRules(p.tree, p.rules, alreadyProved)
+        toProve, proof, err := pr.Prove(ctx, goals)
+        if err != nil {
+                return nil, nil, err
+        }
+        if toProve != nil {
+                return toProve, proof, nil
+        }
+
+        // Say why: an untrusted measurement, else the first key that
+        // says something and isn't trusted.
+        isTrusted := "is-trusted"
+        for _, m := range measurements {
+                if !pr.Proved(certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &isTrusted)) {
+                        return nil, nil, unknownMeasurement(m)
+                }
+        }
+        for _, c := range alreadyProved.Proved {
+                if c.GetVerb() != "says" || c.GetSubject().GetEntityType() != "key" ||
+                                certlib.SameKey(c.GetSubject().GetKey(), p.PublicPolicyKey) {
+                        continue
+                }
+                if !trustedForAttestation(p.tree, pr, c.GetSubject()) {
+                        return nil, nil, unknownPlatform(c.GetSubject().GetKey())
+                }
+        }
+        return nil, nil, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_NO_PROOF,
+                "the evidence doesn't prove %s", certlib.VseClauseToString(goals[0]))
+}
+
+// trustedForAttestation says whether pr proved e trusted with a predicate
+// that dominates is-trusted-for-attestation.
+func trustedForAttestation(tree *certlib.PredicateDominance, pr *certlib.Prover, e *certprotos.EntityMessage) bool {
+        var walk func(n *certlib.PredicateDominance) bool
+        walk = func(n *certlib.PredicateDominance) bool {
+                for ; n != nil; n = n.Next {
+                        verb := n.Predicate
+                        if certlib.Dominates(tree, verb, "is-trusted-for-attestation") &&
+                                        pr.Proved(certlib.MakeUnaryVseClause(e, &verb)) {
+                                return true
+                        }
+                        if walk(n.FirstChild) {
+                                return true
+                        }
+                }
+                return false
+        }
+        return walk(tree)
+}
+
+//      ConstructProofFromRequest first checks evidence and make sure each evidence
+//            component is verified and it put in alreadyProved Statements
+//      Next, alreadyProved is augmented to include additional true statements
+//            required for the proof
+//      Finally a proof is constructed
+//
+//      Returns the proof goal (toProve), the proof steps (proof), 
+//            and a list of true statements (alreadyProved)
+//      or a certlib.TrustError saying why there is no proof
+// ConstructProofFromRequest gives up between stages if ctx is done.
+// checkNonce, if not nil, checks the nonces in the evidence.
+func (p *Policy) ConstructProofFromRequest(ctx context.Context, evidenceType string, support *certprotos.EvidencePackage,
+                purpose string, checkNonce certlib.NonceChecker) (*certprotos.VseClause, *certprotos.Proof,
+                *certprotos.ProvedStatements, error) {
+
+        publicPolicyKey := p.PublicPolicyKey
+
+        log := certlib.Logger()
+        log.Debug("ConstructProofFromRequest", "evidence_type", evidenceType, "purpose", purpose)
+
+        if support == nil {
+                return nil, nil, nil, badRequest("no evidence")
+        }
+
+        if support.ProverType == nil {
+                return nil, nil, nil, badRequest("no prover type")
+        }
+
+        if support.GetProverType() != "vse-verifier" {
+                return nil, nil, nil, badRequest("prover type " + support.GetProverType() +
+                        " is not supported, only vse-verifier")
+        }
+
+        if len(support.FactAssertion) > maxEvidenceItems {
+                return nil, nil, nil, badRequest(fmt.Sprintf("%d evidence items, at most %d",
+                        len(support.FactAssertion), maxEvidenceItems))
+        }
+
+        alreadyProved := &certprotos.ProvedStatements{}
+        var toProve *certprotos.VseClause = nil
+        var proof *certprotos.Proof = nil
+
+        for i := 0; i < len(support.FactAssertion); i++ {
+                et := support.FactAssertion[i].GetEvidenceType()
+                if et == "signed-claim" {
+                        var sc certprotos.SignedClaimMessage
+                        err := proto.Unmarshal(support.FactAssertion[i].SerializedEvidence, &sc)
+                        if err != nil {
+                                log.Debug("ConstructProofFromRequest: can't unmarshal signed claim", "index", i)
+                        } else {
+                                log.Debug("ConstructProofFromRequest: evidence", "index", i, "type", et,
+                                        certlib.Clause("clause", certlib.GetVseFromSignedClaim(&sc)))
+                        }
+                } else if et == "signed-vse-attestation-report" || et == "cert" ||
+                                et == "oe-attestation-report" || et == "sev-attestation" || et == "pem-cert-chain" {
+                        log.Debug("ConstructProofFromRequest: evidence", "index", i, "type", et,
+                                "evidence", certlib.Sensitive(support.FactAssertion[i].SerializedEvidence))
+                } else {
+                        return nil, nil, nil, badRequest(fmt.Sprintf("evidence %d: unknown evidence type %s",
+                                i, support.FactAssertion[i].GetEvidenceType()))
+                }
+        }
+
+        st := startStage(ctx, stageInitProvedStatements)
+        err := certlib.VerifyEvidenceContext(st.ctx, publicPolicyKey, support.FactAssertion, alreadyProved, checkNonce)
+        st.end(err)
+        if err != nil {
+                log.Debug("ConstructProofFromRequest: VerifyEvidence failed", "err", err)
+                return nil, nil, nil, err
+        }
+
+        if err := policyKeyStatement(publicPolicyKey, alreadyProved); err != nil {
+                log.Debug("ConstructProofFromRequest: policy statement in evidence", "err", err)
+                return nil, nil, nil, err
+        }
+
+        log.Debug("ConstructProofFromRequest: initial proved statements",
+                certlib.Clauses("proved", alreadyProved.Proved))
+
+        if ctx.Err() != nil {
+                log.Debug("ConstructProofFromRequest", "err", ctx.Err())
+                return nil, nil, nil, ctx.Err()
+        }
+
+        if !knownEvidenceTypes[evidenceType] {
+                return nil, nil, nil, badRequest("unknown evidence type " + evidenceType)
+        }
+
+        st = startStage(ctx, stageAddNewFacts)
+        st.span.SetName("AddPolicyFacts")
+        err = p.AddPolicyFacts(alreadyProved)
+        st.end(err)
+        if err != nil {
+                log.Debug("ConstructProofFromRequest: adding policy facts failed", "err", err)
+                return nil, nil, nil, err
+        }
+
+        log.Debug("ConstructProofFromRequest: augmented proved statements",
+                certlib.Clauses("proved", alreadyProved.Proved))
+
+        if ctx.Err() != nil {
+                log.Debug("ConstructProofFromRequest", "err", ctx.Err())
+                return nil, nil, nil, ctx.Err()
+        }
+
+        st = startStage(ctx, stageConstructProof)
+        st.span.SetName("ProveRequest")
+        toProve, proof, err = p.ProveRequest(st.ctx, purpose, alreadyProved)
+        st.end(err)
+        if err != nil {
+                log.Debug("ConstructProofFromRequest: no proof", "err", err)
+                return nil, nil, nil, err
+        }
+
+        log.Debug("ConstructProofFromRequest: proof", certlib.Clause("to_prove", toProve),
+                certlib.Proof("steps", proof))
+
+        return toProve, proof, alreadyProved, nil
+}
+
+func getAppMeasurementFromProvedStatements(appKeyEntity *certprotos.EntityMessage,
+                alreadyProved *certprotos.ProvedStatements) []byte {
+
+        for i := 0; i < len(alreadyProved.Proved); i++ {
+                if certlib.SameEntity(alreadyProved.Proved[i].GetSubject(), appKeyEntity) {
+                        if alreadyProved.Proved[i].GetVerb() == "speaks-for" {
+                                if alreadyProved.Proved[i].Object != nil &&
+                                        alreadyProved.Proved[i].Object.GetEntityType() == "measurement" {
+                                        return alreadyProved.Proved[i].Object.Measurement
+                                }
+                        }
+                }
+        }
+        return nil
+}
+
+// provedMeasurement is the measurement appKeyEntity speaks for, from
+// alreadyProved or the conclusions of proof.
+func provedMeasurement(appKeyEntity *certprotos.EntityMessage, alreadyProved *certprotos.ProvedStatements,
+                proof *certprotos.Proof) []byte {
+        m := getAppMeasurementFromProvedStatements(appKeyEntity, alreadyProved)
+        if m != nil {
+                return m
+        }
+        conclusions := &certprotos.ProvedStatements{}
+        for _, step := range proof.GetSteps() {
+                conclusions.Proved = append(conclusions.Proved, step.Conclusion)
+        }
+        return getAppMeasurementFromProvedStatements(appKeyEntity, conclusions)
+}
@@ -0,0 +1,306 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: proxy.go
+
+package certservice
+
+import (
+        "bufio"
+        "bytes"
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "io"
+        "net"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// The PROXY protocol (haproxy.org/download/2.8/doc/proxy-protocol.txt)
+// lets a TCP load balancer in front of the service pass on the client's
+// address.  Only proxies on trusted networks may use it, or any client
+// could claim any address.
+
+// ProxiedAddr is the remote address of a connection through a proxy.
+// It is the client's address, as far as net.Addr goes.
+type ProxiedAddr struct {
+        // Source is the client's address, as the proxy reported it.
+        Source net.Addr
+        // Proxy is the proxy's address.
+        Proxy net.Addr
+}
+
+func (a *ProxiedAddr) Network() string {
+        return a.Source.Network()
+}
+
+func (a *ProxiedAddr) String() string {
+        return a.Source.String()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const maxProxyV1Header = 107
+
+// proxyConn is a connection whose PROXY header has been read.
+type proxyConn struct {
+        net.Conn
+        r *bufio.Reader
+        addr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+        return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+        return c.addr
+}
+
+// readProxyHeader reads the PROXY header, version 1 or 2, that starts
+// conn.  A header that doesn't give a source, like the ones proxies send
+// on their own health checks, leaves the connection's address alone.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+        r := bufio.NewReader(conn)
+        pc := &proxyConn{Conn: conn, r: r, addr: conn.RemoteAddr()}
+        start, err := r.Peek(len(proxyV2Signature))
+        if err != nil {
+                return nil, err
+        }
+        var source net.Addr
+        if bytes.Equal(start, proxyV2Signature) {
+                source, err = readProxyV2(r)
+        } else if bytes.HasPrefix(start, []byte("PROXY ")) {
+                source, err = readProxyV1(r)
+        } else {
+                return nil, errors.New("no PROXY protocol header")
+        }
+        if err != nil {
+                return nil, err
+        }
+        if source != nil {
+                pc.addr = &ProxiedAddr{Source: source, Proxy: conn.RemoteAddr()}
+        }
+        return pc, nil
+}
+
+// readProxyV1 reads "PROXY TCP4 src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+        var line []byte
+        for len(line) < maxProxyV1Header && !bytes.HasSuffix(line, []byte("\r\n")) {
+                b, err := r.ReadByte()
+                if err != nil {
+                        return nil, err
+                }
+                line = append(line, b)
+        }
+        if !bytes.HasSuffix(line, []byte("\r\n")) {
+                return nil, errors.New("PROXY v1 header too long")
+        }
+        f := strings.Split(string(line[:len(line) - 2]), " ")
+        if len(f) >= 2 && f[1] == "UNKNOWN" {
+                return nil, nil
+        }
+        if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+                return nil, fmt.Errorf("bad PROXY v1 header %q", line)
+        }
+        ip := net.ParseIP(f[2])
+        port, err := strconv.ParseUint(f[4], 10, 16)
+        if ip == nil || err != nil || (f[1] == "TCP4") != (ip.To4() != nil) {
+                return nil, fmt.Errorf("bad PROXY v1 header %q", line)
+        }
+        return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary header: the signature, version and
+// command, family, length and addresses.  TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+        hdr := make([]byte, 16)
+        if _, err := io.ReadFull(r, hdr); err != nil {
+                return nil, err
+        }
+        if hdr[12] >> 4 != 2 {
+                return nil, fmt.Errorf("PROXY v2 header has version %d", hdr[12] >> 4)
+        }
+        body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+        if _, err := io.ReadFull(r, body); err != nil {
+                return nil, err
+        }
+        switch hdr[12] & 0xf {
+        case 0:
+                // LOCAL
+                return nil, nil
+        case 1:
+                // PROXY
+        default:
+                return nil, fmt.Errorf("PROXY v2 header has command %d", hdr[12] & 0xf)
+        }
+        switch hdr[13] >> 4 {
+        case 1:
+                if len(body) < 12 {
+                        return nil, errors.New("PROXY v2 header too short for IPv4")
+                }
+                return &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:4]...)),
+                        Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+        case 2:
+                if len(body) < 36 {
+                        return nil, errors.New("PROXY v2 header too short for IPv6")
+                }
+                return &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:16]...)),
+                        Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+        }
+        // Unix sockets or unspecified.
+        return nil, nil
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks and IP
+// addresses.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+        var nets []*net.IPNet
+        for _, f := range strings.Split(s, ",") {
+                f = strings.TrimSpace(f)
+                if f == "" {
+                        continue
+                }
+                if !strings.Contains(f, "/") {
+                        ip := net.ParseIP(f)
+                        if ip == nil {
+                                return nil, fmt.Errorf("bad address %s", f)
+                        }
+                        bits := 8 * len(ip)
+                        if ip4 := ip.To4(); ip4 != nil {
+                                ip, bits = ip4, 32
+                        }
+                        nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+                        continue
+                }
+                _, n, err := net.ParseCIDR(f)
+                if err != nil {
+                        return nil, err
+                }
+                nets = append(nets, n)
+        }
+        return nets, nil
+}
+
+type proxyListener struct {
+        net.Listener
+        cs *CertifierService
+        trusted []*net.IPNet
+        timeout time.Duration
+
+        start sync.Once
+        conns chan net.Conn
+        errs chan error
+        closeOnce sync.Once
+        done chan struct{}
+}
+
+// ProxyListener accepts connections from l.  Those from the trusted
+// networks, the proxies, must start with a PROXY protocol header, version
+// 1 or 2, and have a *ProxiedAddr as their remote address.  Others are
+// taken to be from the client.  Headers are read as connections come in;
+// a proxy has timeout to send one, and a connection without a good one is
+// closed.
+func (cs *CertifierService) ProxyListener(l net.Listener, trusted []*net.IPNet,
+                timeout time.Duration) net.Listener {
+        return &proxyListener{
+                Listener: l,
+                cs: cs,
+                trusted: trusted,
+                timeout: timeout,
+                conns: make(chan net.Conn),
+                errs: make(chan error),
+                done: make(chan struct{}),
+        }
+}
+
+func (l *proxyListener) fromProxy(a net.Addr) bool {
+        ta, ok := a.(*net.TCPAddr)
+        if !ok {
+                return false
+        }
+        for _, n := range l.trusted {
+                if n.Contains(ta.IP) {
+                        return true
+                }
+        }
+        return false
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+        l.start.Do(func() { go l.acceptLoop() })
+        select {
+        case conn := <-l.conns:
+                return conn, nil
+        case err := <-l.errs:
+                return nil, err
+        case <-l.done:
+                return nil, net.ErrClosed
+        }
+}
+
+func (l *proxyListener) acceptLoop() {
+        for {
+                conn, err := l.Listener.Accept()
+                if err != nil {
+                        if errors.Is(err, net.ErrClosed) {
+                                l.Close()
+                                return
+                        }
+                        select {
+                        case l.errs <- err:
+                        case <-l.done:
+                                return
+                        }
+                        continue
+                }
+                if !l.fromProxy(conn.RemoteAddr()) {
+                        l.deliver(conn)
+                        continue
+                }
+                go func() {
+                        conn.SetReadDeadline(time.Now().Add(l.timeout))
+                        pc, err := readProxyHeader(conn)
+                        if err != nil {
+                                l.cs.log().Warn("Bad PROXY protocol header", "proxy", conn.RemoteAddr().String(),
+                                        "err", err)
+                                conn.Close()
+                                return
+                        }
+                        conn.SetReadDeadline(time.Time{})
+                        l.deliver(pc)
+                }()
+        }
+}
+
+func (l *proxyListener) deliver(conn net.Conn) {
+        select {
+        case l.conns <- conn:
+        case <-l.done:
+                conn.Close()
+        }
+}
+
+func (l *proxyListener) Close() error {
+        err := net.ErrClosed
+        l.closeOnce.Do(func() {
+                close(l.done)
+                err = l.Listener.Close()
+        })
+        return err
+}
@@ -0,0 +1,117 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: ratelimit.go
+
+package certservice
+
+import (
+        "errors"
+        "sync"
+        "time"
+)
+
+// ErrRateLimited is returned for requests from a client that has used up
+// its rate limit.  Clients should retry later.
+var ErrRateLimited = errors.New("client rate limit exceeded")
+
+const defaultRateBurst = 10
+
+// rateLimiter is a token bucket for each client (Peer.client).  Buckets
+// that have filled up again are forgotten.
+type rateLimiter struct {
+        rate float64
+        burst float64
+
+        mu sync.Mutex
+        buckets map[string]*tokenBucket
+        lastSweep time.Time
+}
+
+type tokenBucket struct {
+        tokens float64
+        last time.Time
+}
+
+// newRateLimiter allows each client rate requests a second, burst at
+// once.  It returns nil, which allows everything, if rate isn't positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+        if rate <= 0 {
+                return nil
+        }
+        if burst <= 0 {
+                burst = defaultRateBurst
+        }
+        return &rateLimiter{
+                rate: rate,
+                burst: float64(burst),
+                buckets: make(map[string]*tokenBucket),
+                lastSweep: time.Now(),
+        }
+}
+
+// allow takes a token from client's bucket, if it has one.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+        if l == nil {
+                return true
+        }
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        l.sweep(now)
+        b, ok := l.buckets[client]
+        if !ok {
+                b = &tokenBucket{tokens: l.burst, last: now}
+                l.buckets[client] = b
+        }
+        b.fill(l, now)
+        if b.tokens < 1 {
+                return false
+        }
+        b.tokens--
+        return true
+}
+
+func (b *tokenBucket) fill(l *rateLimiter, now time.Time) {
+        if now.After(b.last) {
+                b.tokens += now.Sub(b.last).Seconds() * l.rate
+                if b.tokens > l.burst {
+                        b.tokens = l.burst
+                }
+                b.last = now
+        }
+}
+
+// sweep forgets full buckets, at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+        if now.Sub(l.lastSweep) < time.Minute {
+                return
+        }
+        l.lastSweep = now
+        for client, b := range l.buckets {
+                b.fill(l, now)
+                if b.tokens >= l.burst {
+                        delete(l.buckets, client)
+                }
+        }
+}
+
+// clients is how many clients have a bucket.
+func (l *rateLimiter) clients() int {
+        if l == nil {
+                return 0
+        }
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return len(l.buckets)
+}
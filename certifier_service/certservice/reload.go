@@ -0,0 +1,152 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: reload.go
+
+package certservice
+
+import (
+        "bytes"
+        "context"
+        "crypto/sha256"
+        "errors"
+        "fmt"
+        "os"
+        "time"
+)
+
+// Policy reload: the new policy is built and checked off to the side
+// and only then swapped in, so requests see either the old policy or
+// the new one.  A rejected policy leaves the old one in force.
+
+func (cs *CertifierService) setPolicy(p *Policy) {
+        cs.policy.Store(p)
+}
+
+func (cs *CertifierService) lastReloadError() string {
+        cs.reloadMu.Lock()
+        defer cs.reloadMu.Unlock()
+        return cs.reloadError
+}
+
+// rejectedStatementsError names the first rejected statement of p.
+func rejectedStatementsError(p *Policy) error {
+        for _, e := range p.Report() {
+                if !e.Accepted {
+                        return fmt.Errorf("%d policy statements rejected, statement %d: %s",
+                                p.Rejected(), e.Index, e.Reason)
+                }
+        }
+        return nil
+}
+
+// validateReload rejects policies that would refuse every request;
+// that is nearly always a truncated or half written file.  In strict
+// mode it also rejects policies with any bad statement.
+func validateReload(p *Policy, strict bool) error {
+        if p.StatementCount() == 0 {
+                return errors.New("policy has no usable statements")
+        }
+        if strict && p.Rejected() > 0 {
+                return rejectedStatementsError(p)
+        }
+        return nil
+}
+
+// ReloadPolicy replaces the policy with policySeq, once it passes the
+// self-test (selftest.go).  If it is rejected, the old policy stays in
+// force and the error says why; if the self-test failed, the service
+// isn't Ready either.
+func (cs *CertifierService) ReloadPolicy(policySeq []byte) error {
+        cs.reloadMu.Lock()
+        defer cs.reloadMu.Unlock()
+
+        p, err := NewPolicy(cs.publicPolicyKey, policySeq)
+        if err == nil {
+                for _, e := range p.Report() {
+                        if !e.Accepted {
+                                cs.logEvent(fmt.Sprintf("Policy statement %d rejected: %s",
+                                        e.Index, e.Reason))
+                        }
+                }
+                err = validateReload(p, cs.strictPolicy)
+        }
+        if err == nil {
+                err = cs.selfTest(p)
+                cs.noteSelfTest(err)
+                if err != nil {
+                        err = fmt.Errorf("self-test: %v", err)
+                }
+        }
+        cs.metrics.observeReload(err)
+        if err != nil {
+                cs.reloadError = err.Error()
+                cs.logEvent("Policy reload rejected: " + err.Error())
+                return err
+        }
+        cs.setPolicy(p)
+        cs.reloadError = ""
+        cs.logEvent(fmt.Sprintf("Policy %x reloaded, %d statements, %d measurements, %d platforms, %d statements rejected",
+                p.Hash, p.StatementCount(), p.MeasurementPolicies(), p.PlatformPolicies(), p.Rejected()))
+        return nil
+}
+
+// ReloadPolicyFile reloads the policy from a file.
+func (cs *CertifierService) ReloadPolicyFile(name string) error {
+        policySeq, err := os.ReadFile(name)
+        if err != nil {
+                err = fmt.Errorf("can't read policy file: %v", err)
+                cs.reloadMu.Lock()
+                cs.reloadError = err.Error()
+                cs.reloadMu.Unlock()
+                cs.metrics.observeReload(err)
+                return err
+        }
+        return cs.ReloadPolicy(policySeq)
+}
+
+// WatchPolicyFile checks name every interval and reloads the policy
+// when its contents change, until ctx is done.  Errors go to report,
+// which may be nil.
+func (cs *CertifierService) WatchPolicyFile(ctx context.Context, name string,
+                interval time.Duration, report func(error)) {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        var lastRejected []byte
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                }
+                policySeq, err := os.ReadFile(name)
+                if err != nil {
+                        // Possibly being replaced, try again next time.
+                        continue
+                }
+                hash := sha256.Sum256(policySeq)
+                if hash == cs.Policy().Hash || bytes.Equal(hash[:], lastRejected) {
+                        continue
+                }
+                err = cs.ReloadPolicy(policySeq)
+                if err != nil {
+                        lastRejected = hash[:]
+                } else {
+                        lastRejected = nil
+                }
+                if report != nil {
+                        report(err)
+                }
+        }
+}
@@ -0,0 +1,188 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: replay.go
+
+package certservice
+
+import (
+        "context"
+        "encoding/hex"
+        "fmt"
+        "io"
+        "os"
+        "strings"
+
+        "github.com/golang/protobuf/proto"
+        "google.golang.org/protobuf/encoding/protojson"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// Replaying requests.  Before a policy that drops a measurement or a
+// platform key is rolled out, the requests seen in production can be
+// evaluated against the policy in force and the candidate, offline, to
+// find the enclaves whose requests would start failing.  Requests come
+// from files or from audit logs kept with Options.AuditRequests.
+
+// Decision is how a policy decides a request.
+type Decision struct {
+        // Status is "succeeded", "failed" or, for requests that can't be
+        // evaluated, "error".
+        Status string
+        ErrorCode string
+        Reason string
+        Measurement string
+        EnclaveKey string
+        // Proof explains the proof, if one was found.
+        Proof *certlib.ProofExplanation
+}
+
+// Decide evaluates request against p as Certify does, up to and
+// including checking the proof, but issues nothing.  Nonces aren't
+// checked: they were used up when the request was first made.
+func (p *Policy) Decide(ctx context.Context, request *certprotos.TrustRequestMessage) Decision {
+        if err := checkTrustRequest(request); err != nil {
+                return Decision{
+                        Status: "error",
+                        ErrorCode: certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST.String(),
+                        Reason: err.Error(),
+                }
+        }
+        purpose := request.GetPurpose()
+        if purpose == "" {
+                purpose = "authentication"
+        }
+        var sources []int
+        toProve, proof, alreadyProved, err := p.ConstructProofFromRequest(certlib.WithEvidenceSources(ctx, &sources),
+                request.GetSubmittedEvidenceType(), request.GetSupport(), purpose, nil)
+        if err != nil {
+                return failedDecision(Decision{}, err)
+        }
+        d := Decision{
+                Proof: certlib.ExplainProof(toProve, proof, alreadyProved, request.GetSupport().GetFactAssertion(),
+                        sources),
+        }
+        appKeyEntity := toProve.GetSubject()
+        if appKeyEntity.GetKey() != nil {
+                d.EnclaveKey = certlib.KeyFingerprint(appKeyEntity.GetKey())
+        }
+        if m := provedMeasurement(appKeyEntity, alreadyProved, proof); m != nil {
+                d.Measurement = hex.EncodeToString(m)
+        }
+        err = certlib.CheckProofWithRules(ctx, p.tree, p.rules, p.PublicPolicyKey, toProve, proof, alreadyProved)
+        if err != nil {
+                return failedDecision(d, err)
+        }
+        if appKeyEntity.GetKey() == nil {
+                return failedDecision(d, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_NO_PROOF,
+                        "the proof is not about a key"))
+        }
+        d.Status = "succeeded"
+        return d
+}
+
+func failedDecision(d Decision, err error) Decision {
+        d.Status = "failed"
+        d.ErrorCode = failureCode(err).String()
+        d.Reason = err.Error()
+        return d
+}
+
+// ReplayRequest is a request to replay.
+type ReplayRequest struct {
+        // Name says where it came from: a file name, or the audit log
+        // name and record number.
+        Name string
+        Request *certprotos.TrustRequestMessage
+        // Recorded is the decision in the audit record, if it came from
+        // one.
+        Recorded string
+}
+
+// ReplayResult is how the policy in force and the candidate decide a
+// request.
+type ReplayResult struct {
+        ReplayRequest
+        Current Decision
+        Candidate Decision
+}
+
+// Changed is whether the candidate decides differently.
+func (r *ReplayResult) Changed() bool {
+        return r.Current.Status != r.Candidate.Status
+}
+
+// Replay decides each request with current and with candidate.
+func Replay(ctx context.Context, requests []ReplayRequest, current *Policy, candidate *Policy) []ReplayResult {
+        results := make([]ReplayResult, 0, len(requests))
+        for _, r := range requests {
+                results = append(results, ReplayResult{
+                        ReplayRequest: r,
+                        Current: current.Decide(ctx, r.Request),
+                        Candidate: candidate.Decide(ctx, r.Request),
+                })
+        }
+        return results
+}
+
+// ReadRequestFile reads a trust_request_message, serialized or, if the
+// file name ends in .json, as protojson.
+func ReadRequestFile(name string) (*certprotos.TrustRequestMessage, error) {
+        b, err := os.ReadFile(name)
+        if err != nil {
+                return nil, err
+        }
+        request := &certprotos.TrustRequestMessage{}
+        if strings.HasSuffix(name, ".json") {
+                err = protojson.Unmarshal(b, request)
+        } else {
+                err = proto.Unmarshal(b, request)
+        }
+        if err != nil {
+                return nil, fmt.Errorf("%s: can't parse trust request: %v", name, err)
+        }
+        return request, nil
+}
+
+// ReadAuditRequests returns the requests saved in the audit log read from
+// r, named name.  Records without a saved request are skipped; the count
+// of those is returned too.
+func ReadAuditRequests(r io.Reader, name string) ([]ReplayRequest, int, error) {
+        var requests []ReplayRequest
+        skipped := 0
+        err := ReadAuditRecords(r, func(rec *AuditRecord) error {
+                if rec.Kind != AuditRequest {
+                        return nil
+                }
+                if len(rec.Request) == 0 {
+                        skipped++
+                        return nil
+                }
+                request := &certprotos.TrustRequestMessage{}
+                if err := proto.Unmarshal(rec.Request, request); err != nil {
+                        return fmt.Errorf("record %d: can't parse trust request: %v", rec.Seq, err)
+                }
+                requests = append(requests, ReplayRequest{
+                        Name: fmt.Sprintf("%s:%d", name, rec.Seq),
+                        Request: request,
+                        Recorded: rec.Decision,
+                })
+                return nil
+        })
+        if err != nil {
+                return requests, skipped, fmt.Errorf("%s: %v", name, err)
+        }
+        return requests, skipped, nil
+}
@@ -0,0 +1,171 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: selftest.go
+
+package certservice
+
+import (
+        "errors"
+        "fmt"
+        "net/http"
+        "sync"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The self-test runs when the service starts and on every policy reload.
+// It checks that the policy key, the policy cert and the policy fit
+// together, and issues and verifies a throwaway admission cert and
+// platform rule, so a service that can't issue anything clients will
+// accept doesn't start, and one that stops being able to isn't ready.
+
+var selfTestKeyOnce sync.Once
+var selfTestKey *certprotos.KeyMessage
+
+// throwawayKey is the key the self-test certifies.  It is made once, it
+// is never handed out.
+func throwawayKey() *certprotos.KeyMessage {
+        selfTestKeyOnce.Do(func() {
+                k := certlib.MakeVseRsaKey(2048)
+                if k != nil {
+                        selfTestKey = certlib.InternalPublicFromPrivateKey(k)
+                }
+        })
+        return selfTestKey
+}
+
+// selfTest checks the policy key and cert and p.
+func (cs *CertifierService) selfTest(p *Policy) error {
+        certKey := certlib.GetSubjectKey(cs.policyCert)
+        if certKey == nil || !certlib.SameKey(certKey, cs.publicPolicyKey) {
+                return errors.New("the policy key doesn't match the policy cert")
+        }
+        if !certlib.SameKey(p.PublicPolicyKey, cs.publicPolicyKey) {
+                return errors.New("the policy is for another policy key")
+        }
+        now := time.Now()
+        if now.Before(cs.policyCert.NotBefore) || now.After(cs.policyCert.NotAfter) {
+                return fmt.Errorf("the policy cert is valid from %s to %s", cs.policyCert.NotBefore,
+                        cs.policyCert.NotAfter)
+        }
+        subject := throwawayKey()
+        if subject == nil {
+                return errors.New("can't make a key to certify")
+        }
+
+        cert := certlib.ProduceAdmissionCert(cs.privatePolicyKey, cs.policyCert, subject,
+                "CertifierSelfTest", "self-test", 0, 60)
+        if cert == nil {
+                return errors.New("can't produce an admission cert")
+        }
+        if !certlib.VerifyAdmissionCert(cs.policyCert, cert) {
+                return errors.New("an admission cert doesn't verify against the policy cert")
+        }
+        if !certlib.SameKey(certlib.GetSubjectKey(cert), subject) {
+                return errors.New("an admission cert certifies the wrong key")
+        }
+
+        sr := certlib.ProducePlatformRule(cs.privatePolicyKey, cs.policyCert, subject, 60)
+        if sr == nil {
+                return errors.New("can't produce a platform rule")
+        }
+        sc := &certprotos.SignedClaimMessage{}
+        if err := proto.Unmarshal(sr, sc); err != nil {
+                return fmt.Errorf("can't parse a platform rule: %v", err)
+        }
+        if err := certlib.CheckSignedClaim(sc, cs.publicPolicyKey); err != nil {
+                return fmt.Errorf("a platform rule doesn't verify: %v", err)
+        }
+        rule := certlib.GetVseFromSignedClaim(sc)
+        if rule.GetVerb() != "says" || !certlib.SameKey(rule.GetSubject().GetKey(), cs.publicPolicyKey) ||
+                        rule.GetClause().GetVerb() != "is-trusted-for-attestation" ||
+                        !certlib.SameKey(rule.GetClause().GetSubject().GetKey(), subject) {
+                return errors.New("a platform rule says the wrong thing")
+        }
+        return nil
+}
+
+// noteSelfTest records the outcome of a self-test; reloadMu is held.
+func (cs *CertifierService) noteSelfTest(err error) {
+        cs.selfTestAt = time.Now()
+        if err != nil {
+                cs.selfTestError = err.Error()
+                cs.logEvent("Self-test failed: " + err.Error())
+        } else {
+                cs.selfTestError = ""
+        }
+}
+
+// Ready says whether the service should be sent requests: it isn't
+// shutting down, its last self-test passed, the policy cert hasn't
+// expired and the policy has usable statements.  If not, the error says
+// why.
+func (cs *CertifierService) Ready() error {
+        if cs.isShuttingDown() {
+                return ErrShuttingDown
+        }
+        cs.reloadMu.Lock()
+        selfTestError := cs.selfTestError
+        cs.reloadMu.Unlock()
+        if selfTestError != "" {
+                return errors.New("self-test failed: " + selfTestError)
+        }
+        if time.Now().After(cs.policyCert.NotAfter) {
+                return errors.New("the policy cert has expired")
+        }
+        if cs.Policy().StatementCount() == 0 {
+                return errors.New("the policy has no usable statements")
+        }
+        return nil
+}
+
+type healthReport struct {
+        Status string `json:"status"`
+        Reason string `json:"reason,omitempty"`
+        PolicyHash string `json:"policy_hash,omitempty"`
+        PolicyLoadedAt string `json:"policy_loaded_at,omitempty"`
+        PolicyReloadError string `json:"policy_reload_error,omitempty"`
+        SelfTestAt string `json:"self_test_at,omitempty"`
+}
+
+// healthHandler serves
+//      GET /healthz    200 while the process answers (liveness)
+//      GET /readyz     200 if Ready, else 503 with the reason (readiness)
+func (cs *CertifierService) healthHandler(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/healthz" {
+                writeJson(w, http.StatusOK, healthReport{Status: "ok"})
+                return
+        }
+        p := cs.Policy()
+        cs.reloadMu.Lock()
+        rep := healthReport{
+                Status: "ready",
+                PolicyHash: fmt.Sprintf("%x", p.Hash),
+                PolicyLoadedAt: p.LoadedAt.UTC().Format(time.RFC3339),
+                PolicyReloadError: cs.reloadError,
+                SelfTestAt: cs.selfTestAt.UTC().Format(time.RFC3339),
+        }
+        cs.reloadMu.Unlock()
+        if err := cs.Ready(); err != nil {
+                rep.Status = "not-ready"
+                rep.Reason = err.Error()
+                writeJson(w, http.StatusServiceUnavailable, rep)
+                return
+        }
+        writeJson(w, http.StatusOK, rep)
+}
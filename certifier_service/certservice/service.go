@@ -0,0 +1,542 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: service.go
+
+// Package certservice is the Certifier Service: it evaluates trust
+// requests against the signed policy and, if they succeed, issues
+// admission certs or platform rules signed by the policy key.
+// simpleserver is a thin wrapper around it; other programs can embed
+// one or more CertifierService instances directly.
+package certservice
+
+import (
+        "context"
+        "crypto/x509"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "log/slog"
+        "net"
+        "sync"
+        "strconv"
+        "sync/atomic"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        "go.opentelemetry.io/otel"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/trace"
+
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// Options configure a CertifierService.
+type Options struct {
+        // PolicyKey is the private policy key, it signs the artifacts.
+        PolicyKey *certprotos.KeyMessage
+        // PolicyCert is the self-signed cert for PolicyKey.
+        PolicyCert *x509.Certificate
+        // Policy is the serialized signed policy, as written by the
+        // policy utilities (policy.bin).
+        Policy []byte
+        // CertDuration is the lifetime of issued artifacts in seconds,
+        // a year if zero.
+        CertDuration float64
+        // Logger receives a line for each request and event, and debug
+        // output.  certlib.Logger() if nil.
+        Logger *slog.Logger
+        // AuditLog, if not nil, gets a record for each request and
+        // event.  The caller closes it after Shutdown.
+        AuditLog *AuditLog
+        // AuditRequests saves each request in its audit record, so it
+        // can be replayed against a candidate policy (see Replay).  The
+        // evidence has no secrets but makes the records much larger.
+        AuditRequests bool
+        // AuditProofs saves the proof behind each decision in its audit
+        // record, as a certlib.ProofExplanation.
+        AuditProofs bool
+        // TransparencyLog, if not nil, gets every issued artifact.  The
+        // caller closes it after Shutdown.
+        TransparencyLog *TransparencyLog
+        // IssuanceDB, if not nil, gets a record of every issued artifact
+        // (see QueryIssuances).  The caller closes it after Shutdown.
+        IssuanceDB *IssuanceDB
+        // ProofBundleDir, if not empty, gets a proof bundle for every
+        // issued artifact (see bundle.go).
+        ProofBundleDir string
+        // IdleTimeout is how long a socket connection may take to send
+        // its request, 30 seconds if zero.
+        IdleTimeout time.Duration
+        // RequestTimeout bounds evaluating a request and sending the
+        // response, 60 seconds if zero.
+        RequestTimeout time.Duration
+        // MaxConcurrent is the number of requests evaluated at once, 16
+        // if zero.
+        MaxConcurrent int
+        // MaxQueue is the number of requests that may wait for one of
+        // those slots, 64 if zero.  Beyond that Certify fails with
+        // ErrOverloaded.
+        MaxQueue int
+        // RateLimit is how many requests a second each client may make,
+        // averaged over RateBurst requests (10 if zero); beyond that
+        // Certify fails with ErrRateLimited.  A client is its client cert
+        // or, without one, its IP address (see Peer).  No limit if zero.
+        RateLimit float64
+        RateBurst int
+        // StrictPolicy refuses a policy with any rejected statement,
+        // at startup and on reload.  Otherwise rejected statements are
+        // left out and reported.
+        StrictPolicy bool
+        // FailureDetail is how much of the reason a request failed is
+        // sent to callers without a client cert from this service,
+        // FailureDetailNone, FailureDetailCode or FailureDetailFull.
+        // FailureDetailCode if empty.
+        FailureDetail string
+        // RequireNonce fails requests whose evidence doesn't attest to a
+        // nonce from IssueNonce.  See nonce.go.
+        RequireNonce bool
+        // NonceLifetime is how long an issued nonce may be used, two
+        // minutes if zero.
+        NonceLifetime time.Duration
+        // TracerProvider gets the request spans, see trace.go.  The
+        // global provider if nil.
+        TracerProvider trace.TracerProvider
+        // AdminToken, if not empty, is the bearer token the /admin/
+        // endpoints require.  Without one they answer only loopback
+        // clients.  See AdminHandler.
+        AdminToken string
+}
+
+// CertifierService holds everything needed to evaluate trust requests.
+// Its methods may be called concurrently.
+type CertifierService struct {
+        // 64 bit atomics first, for 32 bit platforms.
+        sn uint64
+        requestsServed uint64
+        requestsSucceeded uint64
+        queued int64
+
+        privatePolicyKey *certprotos.KeyMessage
+        publicPolicyKey *certprotos.KeyMessage
+        policyCert *x509.Certificate
+        policy atomic.Value  // *Policy, see reload.go
+        duration float64
+        servingSince time.Time
+
+        logger *slog.Logger
+        auditLog *AuditLog
+        auditRequests bool
+        auditProofs bool
+        transLog *TransparencyLog
+        issuanceDB *IssuanceDB
+        proofBundleDir string
+        metrics *metrics
+        tracer trace.Tracer
+
+        idleTimeout time.Duration
+        requestTimeout time.Duration
+        maxQueue int
+        slots chan struct{}
+        limiter *rateLimiter
+
+        reloadMu sync.Mutex
+        reloadError string
+        selfTestError string
+        selfTestAt time.Time
+        strictPolicy bool
+
+        // How much callers are told about failures, see failure.go.
+        failureDetail string
+
+        // Who may use the /admin/ endpoints, see admin.go.
+        adminToken string
+
+        // Evidence freshness, see nonce.go.
+        nonces *nonceStore
+        requireNonce bool
+
+        // Shutdown state, see limits.go.
+        drainMu sync.Mutex
+        shuttingDown bool
+        active int
+        drained chan struct{}
+        listeners map[net.Listener]bool
+        conns map[net.Conn]bool
+        shutdownCtx context.Context
+        cancelRequests context.CancelFunc
+}
+
+// NewCertifierService checks opts and builds the policy.
+func NewCertifierService(opts Options) (*CertifierService, error) {
+        if opts.PolicyKey == nil {
+                return nil, errors.New("no policy key")
+        }
+        if opts.PolicyCert == nil {
+                return nil, errors.New("no policy cert")
+        }
+        publicPolicyKey := certlib.InternalPublicFromPrivateKey(opts.PolicyKey)
+        if publicPolicyKey == nil {
+                return nil, errors.New("can't get public policy key")
+        }
+        policy, err := NewPolicy(publicPolicyKey, opts.Policy)
+        if err != nil {
+                return nil, err
+        }
+        if opts.StrictPolicy && policy.Rejected() > 0 {
+                return nil, rejectedStatementsError(policy)
+        }
+
+        cs := &CertifierService{
+                sn: uint64(time.Now().UnixNano()),
+                privatePolicyKey: opts.PolicyKey,
+                publicPolicyKey: publicPolicyKey,
+                policyCert: opts.PolicyCert,
+                duration: opts.CertDuration,
+                servingSince: time.Now(),
+                logger: opts.Logger,
+                auditLog: opts.AuditLog,
+                auditRequests: opts.AuditRequests,
+                auditProofs: opts.AuditProofs,
+                transLog: opts.TransparencyLog,
+                issuanceDB: opts.IssuanceDB,
+                proofBundleDir: opts.ProofBundleDir,
+                strictPolicy: opts.StrictPolicy,
+                nonces: newNonceStore(opts.NonceLifetime, 0),
+                requireNonce: opts.RequireNonce,
+        }
+        if cs.duration <= 0 {
+                cs.duration = 365.0 * 86400
+        }
+        cs.metrics = newMetrics(cs)
+        tp := opts.TracerProvider
+        if tp == nil {
+                tp = otel.GetTracerProvider()
+        }
+        cs.tracer = tp.Tracer(tracerName)
+        cs.failureDetail = opts.FailureDetail
+        if cs.failureDetail == "" {
+                cs.failureDetail = FailureDetailCode
+        }
+        if err := checkFailureDetail(cs.failureDetail); err != nil {
+                return nil, err
+        }
+        cs.adminToken = opts.AdminToken
+
+        cs.idleTimeout = opts.IdleTimeout
+        if cs.idleTimeout <= 0 {
+                cs.idleTimeout = defaultIdleTimeout
+        }
+        cs.requestTimeout = opts.RequestTimeout
+        if cs.requestTimeout <= 0 {
+                cs.requestTimeout = defaultRequestTimeout
+        }
+        maxConcurrent := opts.MaxConcurrent
+        if maxConcurrent <= 0 {
+                maxConcurrent = defaultMaxConcurrent
+        }
+        cs.slots = make(chan struct{}, maxConcurrent)
+        cs.limiter = newRateLimiter(opts.RateLimit, opts.RateBurst)
+        cs.maxQueue = opts.MaxQueue
+        if cs.maxQueue <= 0 {
+                cs.maxQueue = defaultMaxQueue
+        }
+        if err := cs.selfTest(policy); err != nil {
+                return nil, fmt.Errorf("self-test: %v", err)
+        }
+        cs.selfTestAt = time.Now()
+        cs.setPolicy(policy)
+        cs.drained = make(chan struct{})
+        cs.listeners = make(map[net.Listener]bool)
+        cs.conns = make(map[net.Conn]bool)
+        cs.shutdownCtx, cs.cancelRequests = context.WithCancel(context.Background())
+        return cs, nil
+}
+
+// PolicyCert is the cert clients use to authenticate artifacts and the service.
+func (cs *CertifierService) PolicyCert() *x509.Certificate {
+        return cs.policyCert
+}
+
+// Policy is the policy requests are evaluated against.  A request
+// keeps the policy it started with even if it is reloaded meanwhile.
+func (cs *CertifierService) Policy() *Policy {
+        return cs.policy.Load().(*Policy)
+}
+
+// checkTrustRequest rejects requests that can't be evaluated at all.
+func checkTrustRequest(request *certprotos.TrustRequestMessage) error {
+        if request == nil || request.Support == nil {
+                return errors.New("trust request has no evidence package")
+        }
+        if request.GetSubmittedEvidenceType() == "" {
+                return errors.New("trust request has no evidence type")
+        }
+        if request.Purpose != nil && request.GetPurpose() != "authentication" &&
+                        request.GetPurpose() != "attestation" {
+                return fmt.Errorf("unknown purpose %s", request.GetPurpose())
+        }
+        return nil
+}
+
+// ErrBadRequest wraps the errors for requests that can't be evaluated.
+var ErrBadRequest = errors.New("bad trust request")
+
+// Certify evaluates the trust assertion in request and, if it succeeds,
+// produces the artifact.  A request that is evaluated and fails is not
+// an error: the response has status "failed".  An error is returned if
+// the request can't be evaluated (wrapping ErrBadRequest), the client is
+// over its rate limit, the service is overloaded or shutting down, or ctx
+// is done.  WithPeer says who the request is from.
+func (cs *CertifierService) Certify(ctx context.Context,
+                request *certprotos.TrustRequestMessage) (*certprotos.TrustResponseMessage, error) {
+        if !cs.begin() {
+                return nil, ErrShuttingDown
+        }
+        defer cs.end()
+        return cs.certify(ctx, request)
+}
+
+// certify is Certify for callers that already hold a begin().  Every
+// transport, and IssueNonce, comes through here, so this is where the
+// client's rate limit is applied.
+func (cs *CertifierService) certify(ctx context.Context,
+                request *certprotos.TrustRequestMessage) (*certprotos.TrustResponseMessage, error) {
+        p := peerFromContext(ctx)
+        start := time.Now()
+        allowed := cs.limiter.allow(p.client(), start)
+        if request != nil && request.NonceRequest != nil {
+                var response *certprotos.TrustResponseMessage
+                err := ErrRateLimited
+                if allowed {
+                        response, err = cs.nonceResponse(p, request)
+                }
+                cs.metrics.observeNonce(err)
+                return response, err
+        }
+        ctx, span := cs.tracer.Start(ctx, "Certify", trace.WithAttributes(
+                attribute.String("certifier.evidence_type", request.GetSubmittedEvidenceType()),
+                attribute.String("certifier.purpose", request.GetPurpose())))
+        rec := &AuditRecord{}
+        rec.setPeer(p)
+        var response *certprotos.TrustResponseMessage
+        var err error
+        if allowed {
+                response, err = cs.evaluate(ctx, request, rec)
+        } else {
+                err = ErrRateLimited
+        }
+        cs.logRequest(ctx, request, rec, response, err)
+        cs.metrics.observeRequest(rec, time.Since(start))
+        traceRequest(span, rec)
+        return response, err
+}
+
+// evaluate is certify, noting what it learns about the request in rec.
+func (cs *CertifierService) evaluate(ctx context.Context, request *certprotos.TrustRequestMessage,
+                rec *AuditRecord) (*certprotos.TrustResponseMessage, error) {
+        if err := checkTrustRequest(request); err != nil {
+                return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+        }
+        if err := ctx.Err(); err != nil {
+                return nil, err
+        }
+        ctx, cancel := cs.requestContext(ctx)
+        defer cancel()
+        if err := cs.acquire(ctx); err != nil {
+                return nil, err
+        }
+        defer cs.release()
+
+        response := cs.certifyRequest(ctx, request, rec)
+        if err := ctx.Err(); err != nil {
+                // The caller gave up, don't hand out the artifact.
+                return nil, err
+        }
+        return response, nil
+}
+
+func (cs *CertifierService) certifyRequest(ctx context.Context,
+                request *certprotos.TrustRequestMessage, rec *AuditRecord) *certprotos.TrustResponseMessage {
+
+        // Prepare response
+        succeeded := "succeeded"
+        failed := "failed"
+
+        response := certprotos.TrustResponseMessage{}
+        response.RequestingEnclaveTag = request.RequestingEnclaveTag
+        response.ProvidingEnclaveTag = request.ProvidingEnclaveTag
+        response.Status = &failed
+
+        atomic.AddUint64(&cs.requestsServed, 1)
+        ctx = withStageTimer(ctx, cs.metrics)
+
+        // Construct the proof
+        var purpose string
+        if  request.Purpose == nil {
+                purpose =  "authentication"
+        } else {
+                purpose =  *request.Purpose
+        }
+        policy := cs.Policy()
+        rec.PolicyHash = hex.EncodeToString(policy.Hash[:])
+        var sources []int
+        if cs.auditProofs && cs.auditLog != nil {
+                ctx = certlib.WithEvidenceSources(ctx, &sources)
+        }
+        toProve, proof, alreadyProved, err := policy.ConstructProofFromRequest(ctx,
+                        request.GetSubmittedEvidenceType(), request.GetSupport(),
+                        purpose, cs.nonceChecker())
+        if err != nil {
+                cs.log().Debug("Constructing proof failed", "err", err)
+                setFailure(&response, err)
+                return &response
+        }
+        appKeyEntity := toProve.GetSubject()
+        if appKeyEntity.GetKey() != nil {
+                rec.EnclaveKey = certlib.KeyFingerprint(appKeyEntity.GetKey())
+        }
+        if m := provedMeasurement(appKeyEntity, alreadyProved, proof); m != nil {
+                rec.Measurement = hex.EncodeToString(m)
+        }
+        if serializedProof, err := proto.Marshal(proof); err == nil {
+                rec.ProofHash = hashHex(serializedProof)
+        }
+        if cs.auditProofs && cs.auditLog != nil {
+                rec.Proof = certlib.ExplainProof(toProve, proof, alreadyProved,
+                        request.GetSupport().GetFactAssertion(), sources)
+        }
+
+        // Verify proof and send response
+        var appOrgName string = "anonymous"
+        if  toProve.Subject != nil && toProve.Subject.Key != nil && toProve.Subject.Key.KeyName != nil {
+                appOrgName = *toProve.Subject.Key.KeyName
+        }
+
+        cs.log().Debug("Verifying proof", certlib.Clause("to_prove", toProve), "steps", len(proof.Steps))
+
+        // Check proof
+        if ctx.Err() != nil {
+                return &response
+        }
+        // CheckProofWithRules adds the conclusions to alreadyProved.
+        given := &certprotos.ProvedStatements{Proved: append([]*certprotos.VseClause{}, alreadyProved.Proved...)}
+        st := startStage(ctx, stageVerifyProof)
+        err = certlib.CheckProofWithRules(st.ctx, policy.tree, policy.rules, cs.publicPolicyKey, toProve, proof,
+                alreadyProved)
+        st.end(err)
+        if err == nil {
+                cs.log().Debug("Proof verified")
+                if ctx.Err() != nil {
+                        return &response
+                }
+                // Produce Artifact
+                if toProve.Subject == nil || toProve.Subject.Key == nil {
+                        cs.log().Debug("toProve check failed", certlib.Clause("to_prove", toProve))
+                        setFailure(&response, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_NO_PROOF,
+                                "the proof is not about a key"))
+                } else {
+                        if purpose == "attestation" {
+                                st = startStage(ctx, stageSignArtifact)
+                                st.span.SetName("ProducePlatformRule")
+                                sr := certlib.ProducePlatformRule(cs.privatePolicyKey, cs.policyCert,
+                                        toProve.Subject.Key, cs.duration)
+                                st.end(nil)
+                                if sr == nil {
+                                        response.Status = &succeeded
+                                } else {
+                                        response.Status = &succeeded
+                                        response.Artifact = sr
+                                        notAfter := st.start.Add(time.Duration(cs.duration * float64(time.Second)))
+                                        cs.publishIssued(&response, PlatformRuleEntry, rec, policy, request,
+                                                toProve, proof, given)
+                                        cs.recordIssued(&response, PlatformRuleEntry, rec, request, alreadyProved,
+                                                st.start, notAfter)
+                                        cs.metrics.observeIssued(PlatformRuleEntry, notAfter)
+                                }
+                        } else {
+                                // find statement appKey speaks-for measurement in alreadyProved and reset appOrgName
+                                m := getAppMeasurementFromProvedStatements(appKeyEntity,  alreadyProved)
+                                if m != nil {
+                                        appOrgName = "Measured-" + hex.EncodeToString(m)
+                                }
+                                sn := atomic.AddUint64(&cs.sn, 1)
+                                rec.CertSerial = strconv.FormatUint(sn, 10)
+                                org := "CertifierUsers"
+                                st = startStage(ctx, stageSignArtifact)
+                                st.span.SetName("ProduceAdmissionCert")
+                                cert := certlib.ProduceAdmissionCert(cs.privatePolicyKey, cs.policyCert,
+                                        toProve.Subject.Key, org,
+                                        appOrgName, sn, cs.duration)
+                                st.end(nil)
+                                if cert == nil {
+                                        setFailure(&response, certlib.NewTrustError(
+                                                certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED,
+                                                "can't produce the admission cert"))
+                                } else {
+                                        response.Status = &succeeded
+                                        response.Artifact = cert.Raw
+                                        cs.publishIssued(&response, AdmissionCertEntry, rec, policy, request,
+                                                toProve, proof, given)
+                                        cs.recordIssued(&response, AdmissionCertEntry, rec, request, alreadyProved,
+                                                cert.NotBefore, cert.NotAfter)
+                                        cs.metrics.observeIssued(AdmissionCertEntry, cert.NotAfter)
+                                }
+                        }
+                }
+        } else {
+                cs.log().Debug("Verifying proof failed", "err", err)
+                setFailure(&response, err)
+        }
+
+        if response.GetStatus() == "succeeded" {
+                atomic.AddUint64(&cs.requestsSucceeded, 1)
+        }
+        return &response
+}
+
+// Status reports the policy size and request counts.  The service is
+// "not-serving" if it isn't Ready.
+func (cs *CertifierService) Status() *certprotos.TrustServiceStatusResponse {
+        st := "serving"
+        if cs.Ready() != nil {
+                st = "not-serving"
+        }
+        policy := cs.Policy()
+        nm := int32(policy.MeasurementPolicies())
+        np := int32(policy.PlatformPolicies())
+        ns := int32(policy.StatementCount())
+        var logSize int64
+        if cs.transLog != nil {
+                logSize = cs.transLog.Size()
+        }
+        loadedAt := policy.LoadedAt.UTC().Format(time.RFC3339)
+        reloadError := cs.lastReloadError()
+        since := cs.servingSince.UTC().Format(time.RFC3339)
+        served := atomic.LoadUint64(&cs.requestsServed)
+        succeeded := atomic.LoadUint64(&cs.requestsSucceeded)
+        return &certprotos.TrustServiceStatusResponse{
+                Status: &st,
+                MeasurementPolicies: &nm,
+                PlatformPolicies: &np,
+                ServingSince: &since,
+                RequestsServed: &served,
+                RequestsSucceeded: &succeeded,
+                PolicyLoadedAt: &loadedAt,
+                PolicyReloadError: &reloadError,
+                PolicyStatements: &ns,
+                TransparencyLogSize: &logSize,
+        }
+}
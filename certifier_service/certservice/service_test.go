@@ -0,0 +1,2674 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: service_test.go
+
+package certservice
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// testPolicy is a policy key, its cert and a signed policy trusting one
+// platform key and one measurement.
+type testPolicy struct {
+	privatePolicyKey *certprotos.KeyMessage
+	policyCert *x509.Certificate
+	serializedPolicy []byte
+	privatePlatformKey *certprotos.KeyMessage
+	measurement []byte
+}
+
+func makeKey(t *testing.T, name string) (*certprotos.KeyMessage, *certprotos.EntityMessage) {
+	k := certlib.MakeVseRsaKey(2048)
+	k.KeyName = &name
+	pk := certlib.InternalPublicFromPrivateKey(k)
+	if pk == nil {
+		t.Fatal("Can't make public key")
+	}
+	return k, certlib.MakeKeyEntity(pk)
+}
+
+func signClause(t *testing.T, cl *certprotos.VseClause, desc string,
+		k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
+	tn := certlib.TimePointNow()
+	tf := certlib.TimePointPlus(tn, 365 * 86400)
+	ser, err := proto.Marshal(cl)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	c := certlib.MakeClaim(ser, "vse-clause", desc, certlib.TimePointToString(tn),
+		certlib.TimePointToString(tf))
+	return certlib.MakeSignedClaim(c, k)
+}
+
+func signedClaimEvidence(t *testing.T, sc *certprotos.SignedClaimMessage) *certprotos.Evidence {
+	scStr := "signed-claim"
+	b, err := proto.Marshal(sc)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	return &certprotos.Evidence{
+		EvidenceType: &scStr,
+		SerializedEvidence: b,
+	}
+}
+
+func makeTestPolicy(t *testing.T, name string) *testPolicy {
+	tp := &testPolicy{}
+	tp.privatePolicyKey, _ = makeKey(t, name)
+	tp.privatePlatformKey, _ = makeKey(t, "platformKey")
+
+	ipK := rsa.PrivateKey{}
+	iPK := rsa.PublicKey{}
+	if !certlib.GetRsaKeysFromInternal(tp.privatePolicyKey, &ipK, &iPK) {
+		t.Fatal("Can't get policy key")
+	}
+	sn := big.Int{}
+	sn.SetInt64(int64(1))
+	policyCertTemplate := x509.Certificate{
+		SerialNumber: &sn,
+		Subject: pkix.Name{
+			CommonName:   name,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(365*86400*1000000000),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	policyDerCert, err := x509.CreateCertificate(rand.Reader, &policyCertTemplate, &policyCertTemplate,
+		&ipK.PublicKey, crypto.Signer(&ipK))
+	if err != nil {
+		t.Fatal("Can't Create policy Certificate")
+	}
+	tp.policyCert, err = x509.ParseCertificate(policyDerCert)
+	if err != nil {
+		t.Fatal("Can't parse policy Certificate")
+	}
+
+	tp.measurement = make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		tp.measurement[i] = byte(i)
+	}
+	tp.serializedPolicy = tp.makePolicy(t, tp.measurement)
+	return tp
+}
+
+// makePolicy makes a policy trusting the platform key and measurements.
+func (tp *testPolicy) makePolicy(t *testing.T, measurements ...[]byte) []byte {
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	platformSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	verbIsTrustedForAtt := "is-trusted-for-attestation"
+	platformKeyIsTrusted := certlib.MakeUnaryVseClause(platformSubj, &verbIsTrustedForAtt)
+
+	clauses := []*certprotos.VseClause{
+		certlib.MakeIndirectVseClause(policySubj, &verbSays, platformKeyIsTrusted),
+	}
+	for _, m := range measurements {
+		measurementIsTrusted := certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &verbIs)
+		clauses = append(clauses, certlib.MakeIndirectVseClause(policySubj, &verbSays, measurementIsTrusted))
+	}
+	return tp.signPolicy(t, clauses...)
+}
+
+// signPolicy makes a policy of "policy-key says ..." clauses.
+func (tp *testPolicy) signPolicy(t *testing.T, clauses ...*certprotos.VseClause) []byte {
+	var blocks certprotos.BufferSequence
+	for _, cl := range clauses {
+		b, err := proto.Marshal(signClause(t, cl, "policy", tp.privatePolicyKey))
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		blocks.Block = append(blocks.Block, b)
+	}
+	serializedPolicy, err := proto.Marshal(&blocks)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	return serializedPolicy
+}
+
+// fullVseRequest makes a "full-vse-support" request for a new enclave
+// key with the given measurement, attested through the platform key.
+func (tp *testPolicy) fullVseRequest(t *testing.T, m []byte) *certprotos.TrustRequestMessage {
+	return tp.vseRequest(t, "full-vse-support", m)
+}
+
+// platformOnlyRequest leaves the policy statements to the service.
+func (tp *testPolicy) platformOnlyRequest(t *testing.T, m []byte) *certprotos.TrustRequestMessage {
+	return tp.vseRequest(t, "platform-attestation-only", m)
+}
+
+// reportRequest is platformOnlyRequest with the enclave key attested by
+// a signed vse attestation report whose user data carries nonce.
+func (tp *testPolicy) reportRequest(t *testing.T, m []byte, nonce []byte) *certprotos.TrustRequestMessage {
+	request := tp.platformOnlyRequest(t, m)
+	privateAttestKey, attestSubj := makeKey(t, "attestKey")
+	_, enclaveSubj := makeKey(t, "enclaveKey")
+	platformSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	verbSays := "says"
+	verbIsTrustedForAtt := "is-trusted-for-attestation"
+	request.Support.FactAssertion[0] = signedClaimEvidence(t, signClause(t,
+		certlib.MakeIndirectVseClause(platformSubj, &verbSays,
+			certlib.MakeUnaryVseClause(attestSubj, &verbIsTrustedForAtt)), "d1", tp.privatePlatformKey))
+
+	et := "simulated-enclave"
+	ud, err := proto.Marshal(&certprotos.AttestationUserData{
+		EnclaveType: &et,
+		EnclaveKey: enclaveSubj.Key,
+		Nonce: nonce,
+	})
+	if err != nil {
+		t.Fatal("Can't marshal user data")
+	}
+	tn := certlib.TimePointNow()
+	nb := certlib.TimePointToString(tn)
+	na := certlib.TimePointToString(certlib.TimePointPlus(tn, 3600))
+	info, err := proto.Marshal(&certprotos.VseAttestationReportInfo{
+		EnclaveType: &et,
+		VerifiedMeasurement: m,
+		NotBefore: &nb,
+		NotAfter: &na,
+		UserData: ud,
+	})
+	if err != nil {
+		t.Fatal("Can't marshal report info")
+	}
+	rpK := rsa.PrivateKey{}
+	rPK := rsa.PublicKey{}
+	if !certlib.GetRsaKeysFromInternal(privateAttestKey, &rpK, &rPK) {
+		t.Fatal("Can't get attest key")
+	}
+	format := "vse-attestation-report"
+	sr, err := proto.Marshal(&certprotos.SignedReport{
+		ReportFormat: &format,
+		Report: info,
+		SigningKey: attestSubj.Key,
+		Signature: certlib.RsaSha256Sign(&rpK, info),
+	})
+	if err != nil {
+		t.Fatal("Can't marshal signed report")
+	}
+	evType := "signed-vse-attestation-report"
+	request.Support.FactAssertion[1] = &certprotos.Evidence{
+		EvidenceType: &evType,
+		SerializedEvidence: sr,
+	}
+	return request
+}
+
+func (tp *testPolicy) vseRequest(t *testing.T, et string, m []byte) *certprotos.TrustRequestMessage {
+	platformSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	privateAttestKey, attestSubj := makeKey(t, "attestKey")
+	_, enclaveSubj := makeKey(t, "enclaveKey")
+
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	verbIsTrustedForAtt := "is-trusted-for-attestation"
+	attestKeyIsTrusted := certlib.MakeUnaryVseClause(attestSubj, &verbIsTrustedForAtt)
+	enclaveKeySpeaksForMeasurement := certlib.MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor,
+		certlib.MakeMeasurementEntity(m))
+
+	support := &certprotos.EvidencePackage{}
+	pt := "vse-verifier"
+	support.ProverType = &pt
+	support.FactAssertion = append(support.FactAssertion,
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(platformSubj, &verbSays,
+			attestKeyIsTrusted), "d1", tp.privatePlatformKey)),
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(attestSubj, &verbSays,
+			enclaveKeySpeaksForMeasurement), "d2", privateAttestKey)))
+
+	purpose := "authentication"
+	return &certprotos.TrustRequestMessage{
+		SubmittedEvidenceType: &et,
+		Purpose: &purpose,
+		Support: support,
+	}
+}
+
+func (tp *testPolicy) newService(t *testing.T) *CertifierService {
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	return cs
+}
+
+func TestCertify(t *testing.T) {
+	fmt.Print("\nTestCertify\n")
+
+	tp1 := makeTestPolicy(t, "policyKey1")
+	tp2 := makeTestPolicy(t, "policyKey2")
+	cs1 := tp1.newService(t)
+	cs2 := tp2.newService(t)
+
+	if cs1.Policy().MeasurementPolicies() != 1 || cs1.Policy().PlatformPolicies() != 1 {
+		t.Errorf("Wrong policy size %d %d", cs1.Policy().MeasurementPolicies(),
+			cs1.Policy().PlatformPolicies())
+	}
+
+	// Each instance issues under its own policy cert.
+	for _, c := range []struct{
+		tp *testPolicy
+		cs *CertifierService
+	} {{tp1, cs1}, {tp2, cs2}} {
+		response, err := c.cs.Certify(context.Background(), c.tp.fullVseRequest(t, c.tp.measurement))
+		if err != nil {
+			t.Fatalf("Certify fails: %s", err.Error())
+		}
+		if response.GetStatus() != "succeeded" {
+			t.Fatal("Certify did not succeed")
+		}
+		cert, err := x509.ParseCertificate(response.Artifact)
+		if err != nil {
+			t.Fatal("Can't parse admission cert")
+		}
+		if !certlib.VerifyAdmissionCert(c.tp.policyCert, cert) {
+			t.Error("Admission cert not issued under the policy cert")
+		}
+	}
+
+	// The order of the evidence doesn't matter.
+	request := tp2.platformOnlyRequest(t, tp2.measurement)
+	fa := request.Support.FactAssertion
+	fa[0], fa[1] = fa[1], fa[0]
+	response, err := cs2.Certify(context.Background(), request)
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Errorf("Certify fails with the evidence reordered: %v %s", err, response.GetErrorDetail())
+	}
+
+	// Evidence for another policy key fails.
+	response, err = cs1.Certify(context.Background(), tp2.fullVseRequest(t, tp2.measurement))
+	if err != nil || response.GetStatus() != "failed" {
+		t.Error("Certify succeeded with another policy")
+	}
+
+	// A request that can't be evaluated is an error.
+	_, err = cs1.Certify(context.Background(), &certprotos.TrustRequestMessage{})
+	if err == nil {
+		t.Error("Certify accepted an empty request")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cs1.Certify(ctx, tp1.fullVseRequest(t, tp1.measurement))
+	if err != context.Canceled {
+		t.Error("Certify ignored the canceled context")
+	}
+
+	st := cs1.Status()
+	if st.GetRequestsServed() != 2 || st.GetRequestsSucceeded() != 1 {
+		t.Errorf("Wrong counts %d %d", st.GetRequestsServed(), st.GetRequestsSucceeded())
+	}
+}
+
+func TestForgedPolicyCert(t *testing.T) {
+	fmt.Print("\nTestForgedPolicyCert\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+
+	// A self-signed cert with the policy cert's name doesn't speak for the
+	// policy key.
+	attacker := certlib.MakeVseRsaKey(2048)
+	apK := rsa.PrivateKey{}
+	aPK := rsa.PublicKey{}
+	if !certlib.GetRsaKeysFromInternal(attacker, &apK, &aPK) {
+		t.Fatal("Can't get attacker key")
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject: tp.policyCert.Subject,
+		Issuer: tp.policyCert.Subject,
+		NotBefore: time.Now(),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+	forged, err := x509.CreateCertificate(rand.Reader, &template, &template, &apK.PublicKey, crypto.Signer(&apK))
+	if err != nil {
+		t.Fatal("Can't create forged cert")
+	}
+	attackerSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(attacker))
+	_, enclaveSubj := makeKey(t, "enclaveKey")
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	certType := "cert"
+	et := "platform-attestation-only"
+	purpose := "authentication"
+	pt := "vse-verifier"
+	request := &certprotos.TrustRequestMessage{
+		SubmittedEvidenceType: &et,
+		Purpose: &purpose,
+		Support: &certprotos.EvidencePackage{
+			ProverType: &pt,
+			FactAssertion: []*certprotos.Evidence{
+				{EvidenceType: &certType, SerializedEvidence: tp.policyCert.Raw},
+				{EvidenceType: &certType, SerializedEvidence: forged},
+				signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(attackerSubj, &verbSays,
+					certlib.MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor,
+						certlib.MakeMeasurementEntity(tp.measurement))), "d1", attacker)),
+			},
+		},
+	}
+	response, err := cs.Certify(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Certify fails: %s", err.Error())
+	}
+	if response.GetStatus() != "failed" || response.Artifact != nil {
+		t.Fatal("Forged policy cert accepted")
+	}
+	switch response.GetErrorCode() {
+	case certprotos.TrustErrorCode_TRUST_ERROR_BAD_SIGNATURE, certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE,
+			certprotos.TrustErrorCode_TRUST_ERROR_NO_PROOF:
+	default:
+		t.Errorf("Wrong error for a forged policy cert: %s", response.GetErrorCode())
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	fmt.Print("\nTestDelegation\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	platformSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	verbSpeaksFor := "speaks-for"
+	verbIsTrustedForAtt := "is-trusted-for-attestation"
+
+	// An enclave rotates its key: the old key says the new one speaks
+	// for it, and the new key is certified.
+	privateAttestKey, attestSubj := makeKey(t, "attestKey")
+	privateEnclaveKey, enclaveSubj := makeKey(t, "enclaveKey")
+	_, newSubj := makeKey(t, "newEnclaveKey")
+	request := tp.platformOnlyRequest(t, tp.measurement)
+	request.Support.FactAssertion = []*certprotos.Evidence{
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(platformSubj, &verbSays,
+			certlib.MakeUnaryVseClause(attestSubj, &verbIsTrustedForAtt)), "d1", tp.privatePlatformKey)),
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(attestSubj, &verbSays,
+			certlib.MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor,
+				certlib.MakeMeasurementEntity(tp.measurement))), "d2", privateAttestKey)),
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(enclaveSubj, &verbSays,
+			certlib.MakeSimpleVseClause(newSubj, &verbSpeaksFor, enclaveSubj)), "d3", privateEnclaveKey)),
+	}
+	response, err := cs.Certify(context.Background(), request)
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Fatalf("Rotated key not certified: %v %s", err, response.GetErrorDetail())
+	}
+	cert, err := x509.ParseCertificate(response.Artifact)
+	if err != nil {
+		t.Fatal("Can't parse admission cert")
+	}
+	if !certlib.SameKey(certlib.GetSubjectKey(cert), newSubj.Key) {
+		t.Error("Admission cert isn't for the new key")
+	}
+
+	// The offline policy key delegates to an online key, which says
+	// which measurements are trusted.
+	privateOnlineKey, onlineSubj := makeKey(t, "onlineKey")
+	m := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		m[i] = byte(100 + i)
+	}
+	onlineRequest := func() *certprotos.TrustRequestMessage {
+		request := tp.platformOnlyRequest(t, m)
+		request.Support.FactAssertion = append(request.Support.FactAssertion,
+			signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(onlineSubj, &verbSays,
+				certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &verbIs)), "d4",
+				privateOnlineKey)))
+		return request
+	}
+	response, err = cs.Certify(context.Background(), onlineRequest())
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT {
+		t.Errorf("Online key trusted without delegation: %v %s", err, response.GetErrorCode())
+	}
+	policy := tp.signPolicy(t,
+		certlib.MakeIndirectVseClause(policySubj, &verbSays,
+			certlib.MakeUnaryVseClause(platformSubj, &verbIsTrustedForAtt)),
+		certlib.MakeIndirectVseClause(policySubj, &verbSays,
+			certlib.MakeSimpleVseClause(onlineSubj, &verbSpeaksFor, policySubj)))
+	if err := cs.ReloadPolicy(policy); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	response, err = cs.Certify(context.Background(), onlineRequest())
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Errorf("Measurement trusted by the online key not accepted: %v %s", err, response.GetErrorDetail())
+	}
+
+	// Delegation is bounded by the lattice: the policy key makes the
+	// online key is-trusted-for-attestation and the online key hands that
+	// off to a short-lived key, which can vouch for the platform but not
+	// for a measurement.
+	privateShortKey, shortSubj := makeKey(t, "shortLivedKey")
+	policy = tp.signPolicy(t,
+		certlib.MakeIndirectVseClause(policySubj, &verbSays,
+			certlib.MakeUnaryVseClause(onlineSubj, &verbIsTrustedForAtt)),
+		certlib.MakeIndirectVseClause(policySubj, &verbSays,
+			certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &verbIs)))
+	if err := cs.ReloadPolicy(policy); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	shortRequest := func(m []byte) *certprotos.TrustRequestMessage {
+		request := tp.platformOnlyRequest(t, m)
+		request.Support.FactAssertion = append(request.Support.FactAssertion,
+			signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(onlineSubj, &verbSays,
+				certlib.MakeSimpleVseClause(shortSubj, &verbSpeaksFor, onlineSubj)), "d5", privateOnlineKey)),
+			signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(shortSubj, &verbSays,
+				certlib.MakeUnaryVseClause(platformSubj, &verbIsTrustedForAtt)), "d6", privateShortKey)),
+			signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(shortSubj, &verbSays,
+				certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(tp.measurement), &verbIs)), "d7",
+				privateShortKey)))
+		return request
+	}
+	response, err = cs.Certify(context.Background(), shortRequest(m))
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Errorf("Platform trusted by the short-lived key not accepted: %v %s", err, response.GetErrorDetail())
+	}
+	response, err = cs.Certify(context.Background(), shortRequest(tp.measurement))
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT {
+		t.Errorf("Short-lived key vouches for a measurement: %v %s", err, response.GetErrorCode())
+	}
+}
+
+func TestDominanceLattice(t *testing.T) {
+	fmt.Print("\nTestDominanceLattice\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	platformSubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	verbHardware := "is-trusted-for-hardware"
+
+	// The platform key is trusted for hardware, which the policy
+	// declares dominates is-trusted-for-attestation.
+	withDominance := func(declared string, k *certprotos.KeyMessage) []byte {
+		var blocks certprotos.BufferSequence
+		if err := proto.Unmarshal(tp.signPolicy(t,
+				certlib.MakeIndirectVseClause(policySubj, &verbSays,
+					certlib.MakeUnaryVseClause(platformSubj, &verbHardware)),
+				certlib.MakeIndirectVseClause(policySubj, &verbSays,
+					certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(tp.measurement), &verbIs))),
+				&blocks); err != nil {
+			t.Fatal("Can't unmarshal policy")
+		}
+		tn := certlib.TimePointNow()
+		c := certlib.MakeClaim([]byte(declared), certlib.DominanceClaimFormat, "lattice",
+			certlib.TimePointToString(tn), certlib.TimePointToString(certlib.TimePointPlus(tn, 3600)))
+		b, err := proto.Marshal(certlib.MakeSignedClaim(c, k))
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		blocks.Block = append(blocks.Block, b)
+		policy, err := proto.Marshal(&blocks)
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		return policy
+	}
+	lattice := "is-trusted dominates is-trusted-for-hardware\n" +
+		"is-trusted-for-hardware dominates is-trusted-for-attestation\n"
+	otherKey, _ := makeKey(t, "otherKey")
+	if err := cs.ReloadPolicy(withDominance(lattice, otherKey)); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	if cs.Policy().Rejected() != 2 {
+		t.Errorf("%d statements rejected, want the lattice and the statement using it", cs.Policy().Rejected())
+	}
+	response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_PLATFORM {
+		t.Errorf("Platform trusted without the lattice: %v %s", err, response.GetErrorCode())
+	}
+
+	if err := cs.ReloadPolicy(withDominance(lattice, tp.privatePolicyKey)); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	p := cs.Policy()
+	p.PrintReport()
+	if p.Rejected() != 0 || !certlib.Dominates(p.Dominance(), verbHardware, "is-trusted-for-attestation") {
+		t.Fatal("Lattice not in force")
+	}
+	response, err = cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Errorf("Platform trusted for hardware not accepted: %v %s", err, response.GetErrorDetail())
+	}
+
+	// A lattice with a cycle or an orphan is refused at load, and the
+	// old policy stays.
+	for _, bad := range []string{
+		lattice + "is-trusted-for-attestation dominates is-trusted-for-hardware\n",
+		lattice + "is-trusted-for-nothing dominates is-trusted-for-something\n",
+	} {
+		if err := cs.ReloadPolicy(withDominance(bad, tp.privatePolicyKey)); err == nil {
+			t.Errorf("Lattice accepted: %s", bad)
+		} else {
+			fmt.Printf("%s\n", err.Error())
+		}
+		if cs.Policy() != p {
+			t.Error("Old policy not kept")
+		}
+	}
+}
+
+func TestDeclaredRules(t *testing.T) {
+	fmt.Print("\nTestDeclaredRules\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	m := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		m[i] = byte(100 + i)
+	}
+	request := tp.platformOnlyRequest(t, m)
+	response, err := cs.Certify(context.Background(), request)
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT {
+		t.Fatalf("Untrusted measurement not refused: %v %s", err, response.GetErrorCode())
+	}
+
+	// A rule trusting whatever a trusted platform attests.
+	withRules := func(k *certprotos.KeyMessage, rules ...string) []byte {
+		var blocks certprotos.BufferSequence
+		if err := proto.Unmarshal(tp.makePolicy(t, tp.measurement), &blocks); err != nil {
+			t.Fatal("Can't unmarshal policy")
+		}
+		ser, err := proto.Marshal(&certprotos.CertifierRules{Rule: rules})
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		tn := certlib.TimePointNow()
+		c := certlib.MakeClaim(ser, certlib.RulesClaimFormat, "rules",
+			certlib.TimePointToString(tn), certlib.TimePointToString(certlib.TimePointPlus(tn, 3600)))
+		b, err := proto.Marshal(certlib.MakeSignedClaim(c, k))
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		blocks.Block = append(blocks.Block, b)
+		policy, err := proto.Marshal(&blocks)
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		return policy
+	}
+	rule := "if A is-trusted-for-attestation and A says K speaks-for M then K is-trusted-for-authentication"
+	otherKey, _ := makeKey(t, "otherKey")
+	for _, bad := range [][]byte{
+		withRules(otherKey, rule),
+		withRules(tp.privatePolicyKey, "if A is-trusted-for-attestation then A is-trusted-for-everything"),
+		withRules(tp.privatePolicyKey, "if A is-trusted then B is-trusted"),
+		withRules(tp.privatePolicyKey, "if M is-trusted and K speaks-for M on P then K is-trusted-for-authentication"),
+	} {
+		if err := cs.ReloadPolicy(bad); err != nil {
+			t.Fatalf("ReloadPolicy fails: %s", err.Error())
+		}
+		if cs.Policy().Rejected() != 1 || len(cs.Policy().Rules()) != 0 {
+			t.Error("Bad rules accepted")
+		}
+		response, err = cs.Certify(context.Background(), request)
+		if err != nil || response.GetStatus() != "failed" {
+			t.Error("Certified by a rejected rule")
+		}
+	}
+
+	if err := cs.ReloadPolicy(withRules(tp.privatePolicyKey, rule)); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	cs.Policy().PrintReport()
+	if len(cs.Policy().Rules()) != 1 {
+		t.Fatal("Rule not declared")
+	}
+	response, err = cs.Certify(context.Background(), request)
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Fatalf("Declared rule not used: %v %s", err, response.GetErrorDetail())
+	}
+	d := cs.Policy().Decide(context.Background(), request)
+	if d.Status != "succeeded" || d.Proof == nil {
+		t.Fatalf("Decide: %s %s", d.Status, d.Reason)
+	}
+	last := d.Proof.Steps[len(d.Proof.Steps) - 1]
+	if last.Rule != certlib.FirstDeclaredRule {
+		t.Errorf("Conclusion by rule %d, want %d", last.Rule, certlib.FirstDeclaredRule)
+	}
+}
+
+func TestConcurrentSerialNumbers(t *testing.T) {
+	fmt.Print("\nTestConcurrentSerialNumbers\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+
+	const n = 8
+	requests := make([]*certprotos.TrustRequestMessage, n)
+	for i := 0; i < n; i++ {
+		requests[i] = tp.fullVseRequest(t, tp.measurement)
+	}
+	serials := make([]*big.Int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := cs.Certify(context.Background(), requests[i])
+			if err != nil || response.GetStatus() != "succeeded" {
+				return
+			}
+			cert, err := x509.ParseCertificate(response.Artifact)
+			if err == nil {
+				serials[i] = cert.SerialNumber
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		if serials[i] == nil {
+			t.Fatalf("Request %d failed", i)
+		}
+		if seen[serials[i].String()] {
+			t.Errorf("Serial number %s issued twice", serials[i].String())
+		}
+		seen[serials[i].String()] = true
+	}
+}
+
+func TestOverload(t *testing.T) {
+	fmt.Print("\nTestOverload\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		MaxConcurrent: 1,
+		MaxQueue: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	request := tp.fullVseRequest(t, tp.measurement)
+
+	// Hold the only slot, so one request queues and the next is refused.
+	cs.slots <- struct{}{}
+	queued := make(chan error, 1)
+	go func() {
+		_, err := cs.Certify(context.Background(), request)
+		queued <- err
+	}()
+	for atomic.LoadInt64(&cs.queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = cs.Certify(context.Background(), request)
+	if err != ErrOverloaded {
+		t.Errorf("Expected ErrOverloaded, got %v", err)
+	}
+	<-cs.slots
+	if err := <-queued; err != nil {
+		t.Errorf("Queued request fails: %s", err.Error())
+	}
+
+	// A queued request gives up with its context.
+	cs.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	_, err = cs.Certify(ctx, request)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	<-cs.slots
+}
+
+func TestShutdown(t *testing.T) {
+	fmt.Print("\nTestShutdown\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	sock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Can't listen")
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- cs.Serve(sock)
+	}()
+
+	// A request over the sized socket protocol.
+	b, _ := proto.Marshal(tp.fullVseRequest(t, tp.measurement))
+	conn, err := net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal("Can't dial")
+	}
+	if !certlib.SizedSocketWrite(conn, b) {
+		t.Fatal("Can't write request")
+	}
+	rb := certlib.SizedSocketRead(conn)
+	response := &certprotos.TrustResponseMessage{}
+	if rb == nil || proto.Unmarshal(rb, response) != nil || response.GetStatus() != "succeeded" {
+		t.Error("Socket request fails")
+	}
+	conn.Close()
+
+	// A client that never sends its request is dropped.
+	conn, err = net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal("Can't dial")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || time.Since(start) > 4 * time.Second {
+		t.Error("Idle connection not closed")
+	}
+	conn.Close()
+
+	// An idle connection doesn't hold up Shutdown.
+	conn, err = net.Dial("tcp", sock.Addr().String())
+	if err != nil {
+		t.Fatal("Can't dial")
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := cs.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown fails: %s", err.Error())
+	}
+	if err := <-served; err != ErrShuttingDown {
+		t.Errorf("Serve returned %v", err)
+	}
+	_, err = cs.Certify(context.Background(), &certprotos.TrustRequestMessage{})
+	if err != ErrShuttingDown {
+		t.Errorf("Certify after Shutdown returned %v", err)
+	}
+	if cs.Status().GetStatus() != "not-serving" {
+		t.Error("Status still serving")
+	}
+}
+
+// cancelAtSpan cancels a request when the span name starts, as a
+// client giving up while a slow stage runs would.
+type cancelAtSpan struct {
+	name string
+	cancel context.CancelFunc
+}
+
+func (c *cancelAtSpan) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {
+	if s.Name() == c.name {
+		c.cancel()
+	}
+}
+func (c *cancelAtSpan) OnEnd(s sdktrace.ReadOnlySpan) {}
+func (c *cancelAtSpan) Shutdown(ctx context.Context) error { return nil }
+func (c *cancelAtSpan) ForceFlush(ctx context.Context) error { return nil }
+
+func TestCancelProof(t *testing.T) {
+	fmt.Print("\nTestCancelProof\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	// Cancel the request as proof search, then proof checking, starts:
+	// neither goes on, and nothing is issued.
+	// A stage's span is renamed once it starts, ConstructProof to
+	// ProveRequest.
+	for _, stage := range []struct{ start, name string }{
+		{"ConstructProof", "ProveRequest"},
+		{"VerifyProof", "VerifyProof"},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		recorder := tracetest.NewSpanRecorder()
+		cs, err := NewCertifierService(Options{
+			PolicyKey: tp.privatePolicyKey,
+			PolicyCert: tp.policyCert,
+			Policy: tp.serializedPolicy,
+			TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder),
+				sdktrace.WithSpanProcessor(&cancelAtSpan{name: stage.start, cancel: cancel})),
+		})
+		if err != nil {
+			t.Fatalf("NewCertifierService fails: %s", err.Error())
+		}
+		response, err := cs.Certify(ctx, tp.platformOnlyRequest(t, tp.measurement))
+		if err != context.Canceled || response != nil {
+			t.Errorf("%s: Certify with a canceled request: %v", stage.name, err)
+		}
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, s := range recorder.Ended() {
+			spans[s.Name()] = s
+		}
+		if s := spans[stage.name]; s == nil || s.Status().Description != context.Canceled.Error() {
+			t.Errorf("%s doesn't stop when the request is canceled", stage.name)
+		}
+		if stage.name == "ProveRequest" && spans["VerifyProof"] != nil {
+			t.Error("Canceled proof is checked")
+		}
+		if spans["ProduceAdmissionCert"] != nil {
+			t.Errorf("%s: canceled request issues a cert", stage.name)
+		}
+		cancel()
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	fmt.Print("\nTestReloadPolicy\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	newMeasurement := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		newMeasurement[i] = byte(100 + i)
+	}
+
+	certify := func(m []byte) string {
+		response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, m))
+		if err != nil {
+			t.Fatalf("Certify fails: %s", err.Error())
+		}
+		return response.GetStatus()
+	}
+	if certify(tp.measurement) != "succeeded" || certify(newMeasurement) != "failed" {
+		t.Fatal("Wrong initial policy")
+	}
+
+	if err := cs.ReloadPolicy(tp.makePolicy(t, tp.measurement, newMeasurement)); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	if certify(newMeasurement) != "succeeded" {
+		t.Error("Reloaded policy not in force")
+	}
+	if cs.Status().GetMeasurementPolicies() != 2 {
+		t.Error("Status doesn't report the reloaded policy")
+	}
+
+	// Bad policies are rejected and the old one stays.
+	for _, bad := range [][]byte{[]byte("not a policy"), []byte{}} {
+		if err := cs.ReloadPolicy(bad); err == nil {
+			t.Error("Bad policy accepted")
+		}
+		if certify(newMeasurement) != "succeeded" {
+			t.Error("Old policy not kept")
+		}
+		if cs.Status().GetPolicyReloadError() == "" {
+			t.Error("Status doesn't report the rejected policy")
+		}
+	}
+
+	// Changes to the policy file are picked up.
+	policyFile := t.TempDir() + "/policy.bin"
+	if err := os.WriteFile(policyFile, tp.makePolicy(t, tp.measurement), 0666); err != nil {
+		t.Fatal("Can't write policy file")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 1)
+	go cs.WatchPolicyFile(ctx, policyFile, 10 * time.Millisecond, func(err error) {
+		reloaded <- err
+	})
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Errorf("Watched reload fails: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Policy file change not noticed")
+	}
+	if certify(newMeasurement) != "failed" {
+		t.Error("Watched policy not in force")
+	}
+
+	// The client can't bring back the statement the reload removed by
+	// signing it with the policy key itself.
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	request := tp.platformOnlyRequest(t, newMeasurement)
+	request.Support.FactAssertion = append(request.Support.FactAssertion,
+		signedClaimEvidence(t, signClause(t, certlib.MakeIndirectVseClause(policySubj, &verbSays,
+			certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(newMeasurement), &verbIs)),
+			"d3", tp.privatePolicyKey)))
+	response, err := cs.Certify(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Certify fails: %s", err.Error())
+	}
+	if response.GetStatus() != "failed" || response.Artifact != nil ||
+			response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_BAD_EVIDENCE {
+		t.Errorf("Policy statement from the client accepted: %s %s", response.GetStatus(),
+			response.GetErrorCode())
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	fmt.Print("\nTestSelfTest\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	other := makeTestPolicy(t, "policyKey2")
+	_, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: other.policyCert,
+		Policy: tp.serializedPolicy,
+	})
+	if err == nil || !strings.Contains(err.Error(), "self-test") {
+		t.Errorf("Service starts with another key's policy cert: %v", err)
+	}
+
+	cs := tp.newService(t)
+	probe := func(h http.Handler, path string) (int, healthReport) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var rep healthReport
+		json.Unmarshal(w.Body.Bytes(), &rep)
+		return w.Code, rep
+	}
+	if code, rep := probe(cs.AdminHandler(""), "/readyz"); code != http.StatusOK || rep.Status != "ready" ||
+			rep.SelfTestAt == "" {
+		t.Errorf("GET /readyz answers %d, %+v", code, rep)
+	}
+	if code, _ := probe(cs.HttpHandler(), "/healthz"); code != http.StatusOK {
+		t.Errorf("GET /healthz answers %d", code)
+	}
+
+	// A policy that doesn't load leaves the service ready.
+	if cs.ReloadPolicy([]byte("not a policy")) == nil || cs.Ready() != nil {
+		t.Error("Rejected policy makes the service not ready")
+	}
+
+	// A policy key that no longer signs what the policy cert certifies
+	// fails the self-test on reload.
+	policyKey := cs.privatePolicyKey
+	cs.privatePolicyKey = other.privatePolicyKey
+	err = cs.ReloadPolicy(tp.serializedPolicy)
+	if err == nil || !strings.Contains(err.Error(), "self-test") {
+		t.Errorf("Reload passes the self-test with the wrong key: %v", err)
+	}
+	if cs.Ready() == nil || cs.Status().GetStatus() != "not-serving" {
+		t.Error("Service is ready after a failed self-test")
+	}
+	if code, rep := probe(cs.HttpHandler(), "/readyz"); code != http.StatusServiceUnavailable ||
+			rep.Status != "not-ready" || !strings.Contains(rep.Reason, "admission cert") {
+		t.Errorf("GET /readyz answers %d, %+v", code, rep)
+	}
+	if code, _ := probe(cs.AdminHandler(""), "/healthz"); code != http.StatusOK {
+		t.Errorf("GET /healthz answers %d when not ready", code)
+	}
+	w := httptest.NewRecorder()
+	cs.AdminHandler("").ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "certifier_ready 0") {
+		t.Error("Metrics say the service is ready")
+	}
+
+	cs.privatePolicyKey = policyKey
+	if err := cs.ReloadPolicy(tp.serializedPolicy); err != nil || cs.Ready() != nil {
+		t.Errorf("Service isn't ready after a good reload: %v", err)
+	}
+}
+
+func TestPolicyVerification(t *testing.T) {
+	fmt.Print("\nTestPolicyVerification\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	otherKey, otherSubj := makeKey(t, "otherKey")
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	verbSays := "says"
+	verbIs := "is-trusted"
+	statement := func(subj *certprotos.EntityMessage, b byte) *certprotos.VseClause {
+		m := make([]byte, 32)
+		m[0] = b
+		return certlib.MakeIndirectVseClause(subj, &verbSays,
+			certlib.MakeUnaryVseClause(certlib.MakeMeasurementEntity(m), &verbIs))
+	}
+	// TimePointPlus doesn't go backwards, so format the times directly.
+	timeString := func(d time.Duration) string {
+		return time.Now().Add(d).Format("2006:01:02T15:04:05Z")
+	}
+	sign := func(cl *certprotos.VseClause, k *certprotos.KeyMessage, nb, na time.Duration) *certprotos.SignedClaimMessage {
+		ser, err := proto.Marshal(cl)
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		c := certlib.MakeClaim(ser, "vse-clause", "policy", timeString(nb), timeString(na))
+		return certlib.MakeSignedClaim(c, k)
+	}
+
+	badSignature := sign(statement(policySubj, 4), tp.privatePolicyKey, -time.Minute, time.Hour)
+	badSignature.Signature[0] ^= 0xff
+	entries := []struct {
+		sc *certprotos.SignedClaimMessage
+		accepted bool
+	}{
+		{sign(statement(policySubj, 1), tp.privatePolicyKey, -time.Minute, time.Hour), true},
+		{sign(statement(policySubj, 2), otherKey, -time.Minute, time.Hour), false},
+		{sign(statement(policySubj, 3), tp.privatePolicyKey, -2 * time.Hour, -time.Hour), false},
+		{badSignature, false},
+		{sign(statement(otherSubj, 5), tp.privatePolicyKey, -time.Minute, time.Hour), false},
+		{sign(statement(policySubj, 6), tp.privatePolicyKey, time.Hour, 2 * time.Hour), false},
+	}
+	var blocks certprotos.BufferSequence
+	for _, e := range entries {
+		b, err := proto.Marshal(e.sc)
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		blocks.Block = append(blocks.Block, b)
+	}
+	serializedPolicy, err := proto.Marshal(&blocks)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+
+	p, err := NewPolicy(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey), serializedPolicy)
+	if err != nil {
+		t.Fatalf("NewPolicy fails: %s", err.Error())
+	}
+	p.PrintReport()
+	report := p.Report()
+	if len(report) != len(entries) {
+		t.Fatalf("Report has %d entries, want %d", len(report), len(entries))
+	}
+	for i, e := range entries {
+		if report[i].Accepted != e.accepted {
+			t.Errorf("Statement %d: accepted %v, want %v (%s)", i, report[i].Accepted,
+				e.accepted, report[i].Reason)
+		}
+		if !report[i].Accepted && report[i].Reason == "" {
+			t.Errorf("Statement %d rejected without a reason", i)
+		}
+	}
+	if p.MeasurementPolicies() != 1 || p.Rejected() != len(entries) - 1 {
+		t.Error("Rejected statements in the policy")
+	}
+
+	// A policy built as of another time says so.
+	at := time.Now().Add(-time.Hour)
+	p, err = NewPolicyAt(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey), serializedPolicy, at)
+	if err != nil {
+		t.Fatalf("NewPolicyAt fails: %s", err.Error())
+	}
+	if !p.LoadedAt.Equal(at) {
+		t.Errorf("Policy loaded at %s, want %s", p.LoadedAt, at)
+	}
+
+	// Strict mode refuses the whole policy.
+	_, err = NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: serializedPolicy,
+		StrictPolicy: true,
+	})
+	if err == nil {
+		t.Error("Strict service accepts a policy with bad statements")
+	}
+}
+
+func TestPolicyStatements(t *testing.T) {
+	fmt.Print("\nTestPolicyStatements\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	untrusted := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		untrusted[i] = byte(200 + i)
+	}
+	request := tp.platformOnlyRequest(t, untrusted)
+	response, err := cs.Certify(context.Background(), request)
+	if err != nil || response.GetStatus() != "failed" {
+		t.Fatal("Untrusted measurement not refused")
+	}
+
+	// Pre-authorize the enclave key in the request.
+	var sc certprotos.SignedClaimMessage
+	if proto.Unmarshal(request.Support.FactAssertion[1].SerializedEvidence, &sc) != nil {
+		t.Fatal("Can't unmarshal evidence")
+	}
+	enclaveSubj := certlib.GetVseFromSignedClaim(&sc).Clause.Subject
+	_, serviceSubj := makeKey(t, "serviceKey")
+	policySubj := certlib.MakeKeyEntity(certlib.InternalPublicFromPrivateKey(tp.privatePolicyKey))
+	verbSays := "says"
+	verbAuth := "is-trusted-for-authentication"
+	verbSpeaksFor := "speaks-for"
+	verbUnknown := "is-trusted-for-everything"
+	says := func(c *certprotos.VseClause) *certprotos.VseClause {
+		return certlib.MakeIndirectVseClause(policySubj, &verbSays, c)
+	}
+	policy := tp.signPolicy(t,
+		says(certlib.MakeUnaryVseClause(enclaveSubj, &verbAuth)),
+		says(certlib.MakeSimpleVseClause(serviceSubj, &verbSpeaksFor, enclaveSubj)),
+		says(certlib.MakeUnaryVseClause(serviceSubj, &verbUnknown)),
+		says(certlib.MakeUnaryVseClause(enclaveSubj, &verbAuth)))
+	if err := cs.ReloadPolicy(policy); err != nil {
+		t.Fatalf("ReloadPolicy fails: %s", err.Error())
+	}
+	p := cs.Policy()
+	if p.StatementCount() != 2 || p.Rejected() != 2 {
+		t.Errorf("%d statements, %d rejected, want 2 and 2", p.StatementCount(), p.Rejected())
+	}
+	if len(p.Statements("speaks-for")) != 1 {
+		t.Error("speaks-for statement not indexed")
+	}
+	if p.Find(certlib.MakeUnaryVseClause(enclaveSubj, &verbAuth)) == nil {
+		t.Error("Can't find the enclave key statement")
+	}
+	if p.Find(certlib.MakeUnaryVseClause(serviceSubj, &verbAuth)) != nil {
+		t.Error("Found a statement not in the policy")
+	}
+
+	response, err = cs.Certify(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Certify fails: %s", err.Error())
+	}
+	if response.GetStatus() != "succeeded" {
+		t.Error("Key trusted by policy not certified")
+	}
+}
+
+func TestFailureReasons(t *testing.T) {
+	fmt.Print("\nTestFailureReasons\n")
+
+	tp1 := makeTestPolicy(t, "policyKey1")
+	tp2 := makeTestPolicy(t, "policyKey2")
+	cs := tp1.newService(t)
+	untrusted := make([]byte, 32)
+
+	badSignature := tp1.platformOnlyRequest(t, tp1.measurement)
+	var sc certprotos.SignedClaimMessage
+	if proto.Unmarshal(badSignature.Support.FactAssertion[1].SerializedEvidence, &sc) != nil {
+		t.Fatal("Can't unmarshal evidence")
+	}
+	sc.Signature[0] ^= 0xff
+	b, err := proto.Marshal(&sc)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	badSignature.Support.FactAssertion[1].SerializedEvidence = b
+
+	noProver := tp1.platformOnlyRequest(t, tp1.measurement)
+	noProver.Support.ProverType = nil
+
+	tooMuchEvidence := tp1.platformOnlyRequest(t, tp1.measurement)
+	for len(tooMuchEvidence.Support.FactAssertion) <= maxEvidenceItems {
+		tooMuchEvidence.Support.FactAssertion = append(tooMuchEvidence.Support.FactAssertion,
+			tooMuchEvidence.Support.FactAssertion[0])
+	}
+
+	tests := []struct {
+		name string
+		request *certprotos.TrustRequestMessage
+		code certprotos.TrustErrorCode
+	}{
+		{"unknown measurement", tp1.platformOnlyRequest(t, untrusted),
+			certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT},
+		{"unknown platform", tp2.platformOnlyRequest(t, tp1.measurement),
+			certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_PLATFORM},
+		{"bad signature", badSignature, certprotos.TrustErrorCode_TRUST_ERROR_BAD_SIGNATURE},
+		{"no prover", noProver, certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST},
+		{"too much evidence", tooMuchEvidence, certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST},
+		{"wrong policy key", tp2.fullVseRequest(t, tp1.measurement),
+			certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_PLATFORM},
+	}
+	for _, test := range tests {
+		response, err := cs.Certify(context.Background(), test.request)
+		if err != nil {
+			t.Errorf("%s: Certify fails: %s", test.name, err.Error())
+			continue
+		}
+		if response.GetStatus() != "failed" || response.GetErrorCode() != test.code {
+			t.Errorf("%s: got %s %s, want %s", test.name, response.GetStatus(),
+				response.GetErrorCode(), test.code)
+		}
+		if response.GetErrorDetail() == "" {
+			t.Errorf("%s: no detail", test.name)
+		}
+	}
+
+	// Unauthenticated callers get the code by default, authenticated
+	// ones the detail too.
+	response, err := cs.Certify(context.Background(), tp1.platformOnlyRequest(t, untrusted))
+	if err != nil {
+		t.Fatalf("Certify fails: %s", err.Error())
+	}
+	r := cs.redactResponse(response, false)
+	if r.ErrorCode == nil || r.ErrorDetail != nil {
+		t.Error("Default failure detail is not the code")
+	}
+	if r = cs.redactResponse(response, true); r.GetErrorDetail() == "" {
+		t.Error("Authenticated caller doesn't get the detail")
+	}
+	none, err := NewCertifierService(Options{
+		PolicyKey: tp1.privatePolicyKey,
+		PolicyCert: tp1.policyCert,
+		Policy: tp1.serializedPolicy,
+		FailureDetail: FailureDetailNone,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	if r = none.redactResponse(response, false); r.ErrorCode != nil || r.ErrorDetail != nil {
+		t.Error("Failure detail none sends the reason")
+	}
+	if r.GetStatus() != "failed" || response.GetErrorDetail() == "" {
+		t.Error("Redacting changes the response")
+	}
+}
+
+func TestNonce(t *testing.T) {
+	fmt.Print("\nTestNonce\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+
+	// A trust request asking for a nonce gets one.
+	response, err := cs.Certify(context.Background(), &certprotos.TrustRequestMessage{
+		NonceRequest: &certprotos.NonceRequest{},
+	})
+	if err != nil || response.GetStatus() != "succeeded" || len(response.GetNonce().GetNonce()) != nonceSize {
+		t.Fatal("No nonce for a nonce request")
+	}
+	nonce := response.GetNonce().GetNonce()
+
+	check := func(name string, request *certprotos.TrustRequestMessage, want certprotos.TrustErrorCode) {
+		response, err := cs.Certify(context.Background(), request)
+		if err != nil {
+			t.Errorf("%s: Certify fails: %s", name, err.Error())
+			return
+		}
+		if want == certprotos.TrustErrorCode_TRUST_ERROR_NONE {
+			if response.GetStatus() != "succeeded" {
+				t.Errorf("%s: failed: %s", name, response.GetErrorDetail())
+			}
+			return
+		}
+		if response.GetStatus() != "failed" || response.GetErrorCode() != want {
+			t.Errorf("%s: got %s %s, want %s", name, response.GetStatus(), response.GetErrorCode(), want)
+		}
+	}
+	check("fresh nonce", tp.reportRequest(t, tp.measurement, nonce), certprotos.TrustErrorCode_TRUST_ERROR_NONE)
+	check("reused nonce", tp.reportRequest(t, tp.measurement, nonce), certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+	check("unknown nonce", tp.reportRequest(t, tp.measurement, make([]byte, nonceSize)),
+		certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+	check("no nonce", tp.reportRequest(t, tp.measurement, nil), certprotos.TrustErrorCode_TRUST_ERROR_NONE)
+
+	nr, err := cs.IssueNonce(context.Background())
+	if err != nil {
+		t.Fatalf("IssueNonce fails: %s", err.Error())
+	}
+	// Expire it without waiting out the lifetime.
+	cs.nonces.mu.Lock()
+	in := cs.nonces.outstanding[string(nr.GetNonce())]
+	in.expiry = time.Now().Add(-time.Second)
+	cs.nonces.outstanding[string(nr.GetNonce())] = in
+	cs.nonces.mu.Unlock()
+	check("expired nonce", tp.reportRequest(t, tp.measurement, nr.GetNonce()),
+		certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+
+	// With RequireNonce, evidence must attest to a nonce.
+	cs.requireNonce = true
+	check("required nonce", tp.reportRequest(t, tp.measurement, nil), certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+	check("signed claims only", tp.platformOnlyRequest(t, tp.measurement), certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+	nr, err = cs.IssueNonce(context.Background())
+	if err != nil {
+		t.Fatalf("IssueNonce fails: %s", err.Error())
+	}
+	check("required nonce given", tp.reportRequest(t, tp.measurement, nr.GetNonce()),
+		certprotos.TrustErrorCode_TRUST_ERROR_NONE)
+
+	// Outstanding nonces are bounded per client: a client asking for
+	// more loses its oldest, and other clients aren't affected.
+	cs.nonces = newNonceStore(time.Minute, 2)
+	issue := func(addr string) []byte {
+		nr, err := cs.IssueNonce(WithPeer(context.Background(), Peer{Transport: "grpc", Addr: addr}))
+		if err != nil {
+			t.Fatalf("IssueNonce fails: %s", err.Error())
+		}
+		return nr.GetNonce()
+	}
+	other := issue("10.0.0.2:4000")
+	var greedy [][]byte
+	for i := 0; i < 5; i++ {
+		greedy = append(greedy, issue("10.0.0.1:4000"))
+	}
+	if len(cs.nonces.outstanding) != 3 {
+		t.Errorf("%d nonces outstanding", len(cs.nonces.outstanding))
+	}
+	check("evicted nonce", tp.reportRequest(t, tp.measurement, greedy[0]),
+		certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE)
+	check("newest nonce", tp.reportRequest(t, tp.measurement, greedy[4]),
+		certprotos.TrustErrorCode_TRUST_ERROR_NONE)
+	check("other client's nonce", tp.reportRequest(t, tp.measurement, other),
+		certprotos.TrustErrorCode_TRUST_ERROR_NONE)
+
+	// Nonces count against the rate limit.
+	cs.limiter = newRateLimiter(0.001, 2)
+	ctx := WithPeer(context.Background(), Peer{Transport: "grpc", Addr: "10.0.0.3:4000"})
+	for i := 0; i < 2; i++ {
+		if _, err := cs.IssueNonce(ctx); err != nil {
+			t.Fatalf("IssueNonce fails: %s", err.Error())
+		}
+	}
+	if _, err := cs.IssueNonce(ctx); err != ErrRateLimited {
+		t.Errorf("Nonce issued beyond the rate limit: %v", err)
+	}
+	_, err = cs.Certify(ctx, &certprotos.TrustRequestMessage{NonceRequest: &certprotos.NonceRequest{}})
+	if err != ErrRateLimited {
+		t.Errorf("Nonce request beyond the rate limit: %v", err)
+	}
+}
+
+// grpcClient serves cs's TrustService over an in-memory connection and
+// returns a client for it.
+func grpcClient(t *testing.T, cs *CertifierService) certprotos.TrustServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	cs.RegisterTrustService(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial fails: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return certprotos.NewTrustServiceClient(conn)
+}
+
+// failedResponse is the trust_response_message in a PermissionDenied
+// status, or nil.
+func failedResponse(err error) *certprotos.TrustResponseMessage {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.PermissionDenied {
+		return nil
+	}
+	for _, d := range st.Details() {
+		if response, ok := d.(*certprotos.TrustResponseMessage); ok {
+			return response
+		}
+	}
+	return nil
+}
+
+func TestGrpc(t *testing.T) {
+	fmt.Print("\nTestGrpc\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	client := grpcClient(t, tp.newService(t))
+	ctx := context.Background()
+	untrusted := make([]byte, 32)
+	untrusted[0] = 1
+
+	// Certify
+	response, err := client.Certify(ctx, tp.fullVseRequest(t, tp.measurement))
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Fatalf("Certify fails: %v", err)
+	}
+	if _, err := x509.ParseCertificate(response.Artifact); err != nil {
+		t.Errorf("Can't parse admission cert: %s", err.Error())
+	}
+	_, err = client.Certify(ctx, tp.fullVseRequest(t, untrusted))
+	if failed := failedResponse(err); failed == nil ||
+			failed.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT {
+		t.Errorf("Untrusted measurement: %v", err)
+	}
+	_, err = client.Certify(ctx, &certprotos.TrustRequestMessage{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Request without evidence: %v", err)
+	}
+
+	// A nonce from GetNonce is good once.
+	nr, err := client.GetNonce(ctx, &certprotos.NonceRequest{})
+	if err != nil || len(nr.GetNonce()) != nonceSize {
+		t.Fatalf("GetNonce fails: %v", err)
+	}
+	response, err = client.Certify(ctx, tp.reportRequest(t, tp.measurement, nr.GetNonce()))
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Errorf("Certify with a fresh nonce fails: %v", err)
+	}
+	_, err = client.Certify(ctx, tp.reportRequest(t, tp.measurement, nr.GetNonce()))
+	if failed := failedResponse(err); failed == nil ||
+			failed.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE {
+		t.Errorf("Reused nonce: %v", err)
+	}
+
+	// CertifyStream answers each request in turn, failed ones, and ones
+	// it can't evaluate, with a failed response, and goes on.
+	stream, err := client.CertifyStream(ctx)
+	if err != nil {
+		t.Fatalf("CertifyStream fails: %s", err.Error())
+	}
+	for i, c := range []struct{
+		request *certprotos.TrustRequestMessage
+		status string
+		code certprotos.TrustErrorCode
+	} {
+		{&certprotos.TrustRequestMessage{}, "failed", certprotos.TrustErrorCode_TRUST_ERROR_BAD_REQUEST},
+		{tp.fullVseRequest(t, tp.measurement), "succeeded", certprotos.TrustErrorCode_TRUST_ERROR_NONE},
+		{tp.fullVseRequest(t, untrusted), "failed", certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT},
+		{tp.fullVseRequest(t, tp.measurement), "succeeded", certprotos.TrustErrorCode_TRUST_ERROR_NONE},
+	} {
+		if err := stream.Send(c.request); err != nil {
+			t.Fatalf("Send fails: %s", err.Error())
+		}
+		response, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Stream request %d: %s", i, err.Error())
+		}
+		if response.GetStatus() != c.status || response.GetErrorCode() != c.code {
+			t.Errorf("Stream request %d: %s %s, want %s %s", i, response.GetStatus(),
+				response.GetErrorCode(), c.status, c.code)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend fails: %s", err.Error())
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("Stream doesn't end when the client is done: %v", err)
+	}
+}
+
+func TestHttpGateway(t *testing.T) {
+	fmt.Print("\nTestHttpGateway\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	h := tp.newService(t).HttpHandler()
+	post := func(method string, path string, contentType string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	asJson := func(m proto.Message) []byte {
+		b, err := protojson.Marshal(proto.MessageV2(m))
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		return b
+	}
+	asProto := func(m proto.Message) []byte {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal("Marshal fails")
+		}
+		return b
+	}
+	decode := func(w *httptest.ResponseRecorder) *certprotos.TrustResponseMessage {
+		response := &certprotos.TrustResponseMessage{}
+		var err error
+		if w.Header().Get("Content-Type") == jsonContentType {
+			err = protojson.Unmarshal(w.Body.Bytes(), proto.MessageV2(response))
+		} else {
+			err = proto.Unmarshal(w.Body.Bytes(), response)
+		}
+		if err != nil {
+			t.Fatalf("Can't decode response: %s", err.Error())
+		}
+		return response
+	}
+	untrusted := make([]byte, 32)
+	untrusted[0] = 1
+
+	// A valid request, in either encoding, gets the artifact.
+	for _, ct := range []string{jsonContentType, protoContentType} {
+		var w *httptest.ResponseRecorder
+		if ct == jsonContentType {
+			w = post("POST", "/v1/certify", ct + "; charset=utf-8", asJson(tp.fullVseRequest(t, tp.measurement)))
+		} else {
+			w = post("POST", "/v1/certify", ct, asProto(tp.fullVseRequest(t, tp.measurement)))
+		}
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ct {
+			t.Fatalf("%s: status %d, %s: %s", ct, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		response := decode(w)
+		if response.GetStatus() != "succeeded" {
+			t.Errorf("%s: %s", ct, response.GetErrorDetail())
+		}
+		if _, err := x509.ParseCertificate(response.Artifact); err != nil {
+			t.Errorf("%s: can't parse admission cert: %s", ct, err.Error())
+		}
+	}
+
+	// A request that fails gets its response with 403.
+	w := post("POST", "/v1/certify", jsonContentType, asJson(tp.fullVseRequest(t, untrusted)))
+	if w.Code != http.StatusForbidden ||
+			decode(w).GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT {
+		t.Errorf("Untrusted measurement: status %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, c := range []struct {
+		name string
+		method string
+		contentType string
+		body []byte
+		want int
+	}{
+		{"malformed json", "POST", jsonContentType, []byte(`{"submittedEvidenceType": `), http.StatusBadRequest},
+		{"unknown field", "POST", jsonContentType, []byte(`{"noSuchField": 1}`), http.StatusBadRequest},
+		{"malformed protobuf", "POST", protoContentType, []byte{0xff, 0xff, 0xff}, http.StatusBadRequest},
+		{"no evidence", "POST", jsonContentType, []byte(`{}`), http.StatusBadRequest},
+		{"GET", "GET", "", nil, http.StatusMethodNotAllowed},
+		{"text", "POST", "text/plain", []byte("hello"), http.StatusUnsupportedMediaType},
+		{"no content type", "POST", "", asProto(tp.fullVseRequest(t, tp.measurement)),
+			http.StatusUnsupportedMediaType},
+	} {
+		w := post(c.method, "/v1/certify", c.contentType, c.body)
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d: %s", c.name, w.Code, c.want, w.Body.String())
+		}
+	}
+	if w := post("GET", "/v1/certify", "", nil); w.Header().Get("Allow") != "POST" {
+		t.Error("405 without Allow")
+	}
+
+	// A nonce from /v1/nonce is good for a certify request.
+	w = post("POST", "/v1/nonce", "", nil)
+	nr := &certprotos.NonceResponse{}
+	if w.Code != http.StatusOK || protojson.Unmarshal(w.Body.Bytes(), proto.MessageV2(nr)) != nil ||
+			len(nr.GetNonce()) != nonceSize {
+		t.Fatalf("No nonce: status %d: %s", w.Code, w.Body.String())
+	}
+	if w := post("GET", "/v1/nonce", "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /v1/nonce: status %d", w.Code)
+	}
+	w = post("POST", "/v1/certify", jsonContentType, asJson(tp.reportRequest(t, tp.measurement, nr.GetNonce())))
+	if w.Code != http.StatusOK {
+		t.Errorf("Certify with a fresh nonce: status %d: %s", w.Code, w.Body.String())
+	}
+	w = post("POST", "/v1/certify", jsonContentType, asJson(tp.reportRequest(t, tp.measurement, nr.GetNonce())))
+	if w.Code != http.StatusForbidden || decode(w).GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_BAD_NONCE {
+		t.Errorf("Certify with a reused nonce: status %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	fmt.Print("\nTestAuditLog\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	name := t.TempDir() + "/audit.log"
+	auditLog, err := OpenAuditLog(name, tp.privatePolicyKey, 3, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		AuditLog: auditLog,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	ctx := WithRequestOrigin(context.Background(), "socket", "10.0.0.1:4000")
+	for _, m := range [][]byte{tp.measurement, make([]byte, 32), tp.measurement, tp.measurement} {
+		if _, err := cs.Certify(ctx, tp.platformOnlyRequest(t, m)); err != nil {
+			t.Fatalf("Certify fails: %s", err.Error())
+		}
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close fails: %s", err.Error())
+	}
+
+	verify := func() (*AuditSummary, error) {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal("Can't open audit log")
+		}
+		defer f.Close()
+		return VerifyAuditLog(f, tp.policyCert)
+	}
+	summary, err := verify()
+	if err != nil {
+		t.Fatalf("VerifyAuditLog fails: %s", err.Error())
+	}
+	// Four requests, a checkpoint after the third and one on Close.
+	if summary.Records != 6 || summary.Checkpoints != 2 || summary.Unsigned != 0 {
+		t.Errorf("Summary is %+v", *summary)
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal("Can't read audit log")
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	lines = lines[:len(lines) - 1]
+	var succeeded, failed AuditRecord
+	json.Unmarshal(lines[0], &succeeded)
+	json.Unmarshal(lines[1], &failed)
+	if succeeded.Decision != "succeeded" || succeeded.CertSerial == "" || succeeded.EnclaveKey == "" ||
+			succeeded.Measurement != hex.EncodeToString(tp.measurement) || succeeded.Peer != "10.0.0.1:4000" ||
+			succeeded.EvidenceType != "platform-attestation-only" || succeeded.ProofHash == "" ||
+			succeeded.ArtifactHash == "" || succeeded.PolicyHash == "" {
+		t.Errorf("Bad record for a request that succeeded: %s", string(lines[0]))
+	}
+	if failed.Decision != "failed" || failed.Reason == "" || failed.CertSerial != "" ||
+			failed.ErrorCode != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT.String() {
+		t.Errorf("Bad record for a request that failed: %s", string(lines[1]))
+	}
+
+	// Reopening continues the chain.
+	auditLog, err = OpenAuditLog(name, tp.privatePolicyKey, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fails: %s", err.Error())
+	}
+	cs.auditLog = auditLog
+	cs.logEvent("reopened")
+	auditLog.Close()
+	if summary, err = verify(); err != nil || summary.Records != 8 {
+		t.Errorf("Reopened log doesn't verify: %v", err)
+	}
+
+	tamper := []struct {
+		name string
+		log [][]byte
+	}{
+		{"edited", append(append(append([][]byte{}, lines[0]),
+			bytes.Replace(lines[1], []byte("failed"), []byte("succeeded"), 1)), lines[2:]...)},
+		{"deleted", append(append([][]byte{}, lines[0]), lines[2:]...)},
+		{"cut at the start", lines[1:]},
+		{"reordered", append(append([][]byte{}, lines[1], lines[0]), lines[2:]...)},
+	}
+	for _, tc := range tamper {
+		_, err := VerifyAuditLog(bytes.NewReader(bytes.Join(tc.log, nil)), tp.policyCert)
+		if err == nil {
+			t.Errorf("%s log verifies", tc.name)
+		}
+	}
+	// Cutting off the end leaves unsigned records.
+	summary, err = VerifyAuditLog(bytes.NewReader(bytes.Join(lines[:2], nil)), tp.policyCert)
+	if err != nil || summary.Unsigned != 2 {
+		t.Error("Truncated log has no unsigned records")
+	}
+	// Another key can't sign checkpoints.
+	other := makeTestPolicy(t, "policyKey2")
+	if _, err := VerifyAuditLog(bytes.NewReader(b), other.policyCert); err == nil {
+		t.Error("Log verifies with another policy cert")
+	}
+}
+
+func TestTransparencyLog(t *testing.T) {
+	fmt.Print("\nTestTransparencyLog\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	name := t.TempDir() + "/transparency.log"
+	transLog, err := OpenTransparencyLog(name, tp.privatePolicyKey)
+	if err != nil {
+		t.Fatalf("OpenTransparencyLog fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		TransparencyLog: transLog,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+
+	var heads []*certprotos.TreeHead
+	for i := 0; i < 3; i++ {
+		response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+		if err != nil || response.GetStatus() != "succeeded" {
+			t.Fatal("Certify fails")
+		}
+		err = certlib.VerifyLogInclusion(response.Artifact, response.TreeHead, response.Inclusion, tp.policyCert)
+		if err != nil {
+			t.Fatalf("Issued cert isn't in the log: %s", err.Error())
+		}
+		if response.Inclusion.GetLeafIndex() != int64(i) {
+			t.Errorf("Cert %d has index %d", i, response.Inclusion.GetLeafIndex())
+		}
+		th, _ := certlib.VerifyTreeHead(response.TreeHead, tp.policyCert)
+		heads = append(heads, th)
+	}
+	// Failed requests issue nothing.
+	cs.Certify(context.Background(), tp.platformOnlyRequest(t, make([]byte, 32)))
+	if cs.Status().GetTransparencyLogSize() != 3 {
+		t.Errorf("Log has %d entries", cs.Status().GetTransparencyLogSize())
+	}
+
+	cp, err := transLog.ConsistencyProof(1, 3)
+	if err != nil || !certlib.VerifyConsistencyProof(1, 3, cp.Path, heads[0].RootHash, heads[2].RootHash) {
+		t.Error("Tree heads aren't consistent")
+	}
+	entries, err := transLog.Entries(0, 10)
+	if err != nil || len(entries) != 3 || entries[1].GetEntryType() != AdmissionCertEntry {
+		t.Error("Wrong log entries")
+	}
+	other := makeTestPolicy(t, "policyKey2")
+	sth, err := transLog.SignedTreeHead()
+	if err != nil {
+		t.Fatalf("SignedTreeHead fails: %s", err.Error())
+	}
+	if _, err := certlib.VerifyTreeHead(sth, other.policyCert); err == nil {
+		t.Error("Tree head verifies with another policy cert")
+	}
+	// Tree heads are signed once per size.
+	again, err := transLog.SignedTreeHead()
+	if err != nil || !bytes.Equal(again.Signature, sth.Signature) {
+		t.Error("Tree head of the same size is signed again")
+	}
+	// A policy key signature on the bare tree head, as on a claim, isn't
+	// a tree head signature.
+	PK := rsa.PublicKey{}
+	pK := rsa.PrivateKey{}
+	if !certlib.GetRsaKeysFromInternal(tp.privatePolicyKey, &pK, &PK) {
+		t.Fatal("Can't get policy key")
+	}
+	bare := &certprotos.SignedTreeHead{
+		SerializedTreeHead: sth.SerializedTreeHead,
+		SigningAlgorithm: sth.SigningAlgorithm,
+		Signature: certlib.RsaSha256Sign(&pK, sth.SerializedTreeHead),
+	}
+	if _, err := certlib.VerifyTreeHead(bare, tp.policyCert); err == nil {
+		t.Error("Tree head without the signing context verifies")
+	}
+	transLog.Close()
+
+	// The log survives a restart.
+	transLog, err = OpenTransparencyLog(name, tp.privatePolicyKey)
+	if err != nil {
+		t.Fatalf("OpenTransparencyLog fails: %s", err.Error())
+	}
+	defer transLog.Close()
+	sth, err = transLog.SignedTreeHead()
+	if err != nil {
+		t.Fatalf("SignedTreeHead fails: %s", err.Error())
+	}
+	th, err := certlib.VerifyTreeHead(sth, tp.policyCert)
+	if err != nil || th.GetTreeSize() != 3 || !bytes.Equal(th.RootHash, heads[2].RootHash) {
+		t.Error("Reopened log has a different tree")
+	}
+}
+
+func TestProofBundle(t *testing.T) {
+	fmt.Print("\nTestProofBundle\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	dir := t.TempDir()
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		ProofBundleDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	certify := func(request *certprotos.TrustRequestMessage) *ProofBundle {
+		response, err := cs.Certify(context.Background(), request)
+		if err != nil || response.GetStatus() != "succeeded" {
+			t.Fatalf("Certify fails: %v %s", err, response.GetErrorDetail())
+		}
+		b, err := ReadProofBundle(ProofBundleName(dir, response.Artifact))
+		if err != nil {
+			t.Fatalf("ReadProofBundle fails: %s", err.Error())
+		}
+		return b
+	}
+	platformRequest := tp.platformOnlyRequest(t, tp.measurement)
+	purpose := "attestation"
+	platformRequest.Purpose = &purpose
+	bundles := []*ProofBundle{
+		certify(tp.platformOnlyRequest(t, tp.measurement)),
+		certify(tp.fullVseRequest(t, tp.measurement)),
+		certify(platformRequest),
+	}
+	for i, b := range bundles {
+		check, err := CheckProofBundle(b, tp.policyCert)
+		if err != nil {
+			t.Errorf("Bundle %d doesn't check: %s", i, err.Error())
+			continue
+		}
+		fmt.Printf("Bundle %d: %+v\n", i, *check)
+	}
+	if bundles[0].ArtifactType != AdmissionCertEntry || bundles[2].ArtifactType != PlatformRuleEntry {
+		t.Error("Wrong artifact types")
+	}
+	if check, _ := CheckProofBundle(bundles[0], tp.policyCert); check == nil || check.PolicyStatements != 2 {
+		t.Error("Policy statements not counted")
+	}
+
+	// Each of these breaks the bundle.
+	tamper := func(f func(b *ProofBundle)) *ProofBundle {
+		var c ProofBundle = *bundles[0]
+		f(&c)
+		return &c
+	}
+	other := makeTestPolicy(t, "otherPolicyKey")
+	proof := &certprotos.Proof{}
+	if proto.Unmarshal(bundles[0].Proof, proof) != nil {
+		t.Fatal("Can't unmarshal proof")
+	}
+	proof.Steps = proof.Steps[:len(proof.Steps) - 1]
+	shortProof, err := proto.Marshal(proof)
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	noMeasurement := tp.makePolicy(t)
+	h := sha256.Sum256(noMeasurement)
+	for name, b := range map[string]*ProofBundle{
+		"another policy's cert": nil,
+		"policy changed": tamper(func(b *ProofBundle) { b.Policy = noMeasurement }),
+		"statement not in the policy": tamper(func(b *ProofBundle) {
+			b.Policy = noMeasurement
+			b.PolicyHash = hex.EncodeToString(h[:])
+		}),
+		"evidence from another request": tamper(func(b *ProofBundle) { b.Evidence = bundles[1].Evidence }),
+		"proof cut short": tamper(func(b *ProofBundle) { b.Proof = shortProof }),
+		"artifact for another key": tamper(func(b *ProofBundle) { b.Artifact = bundles[1].Artifact }),
+		"wrong purpose": tamper(func(b *ProofBundle) { b.Purpose = "attestation" }),
+		"issue time after the artifact expired": tamper(func(b *ProofBundle) {
+			b.IssuedAt = b.IssuedAt.Add(2 * 365 * 24 * time.Hour)
+		}),
+		"issue time before the artifact": tamper(func(b *ProofBundle) {
+			b.IssuedAt = b.IssuedAt.Add(-time.Hour)
+		}),
+	} {
+		policyCert := tp.policyCert
+		if b == nil {
+			b = bundles[0]
+			policyCert = other.policyCert
+		}
+		_, err := CheckProofBundle(b, policyCert)
+		if err == nil {
+			t.Errorf("Bundle with %s checks", name)
+		} else {
+			fmt.Printf("%s: %s\n", name, err.Error())
+		}
+	}
+
+	// A bundle is checked as of when it was issued: evidence that has
+	// expired since still counts.
+	request := tp.platformOnlyRequest(t, tp.measurement)
+	sc := &certprotos.SignedClaimMessage{}
+	cm := &certprotos.ClaimMessage{}
+	if proto.Unmarshal(request.Support.FactAssertion[0].SerializedEvidence, sc) != nil ||
+			proto.Unmarshal(sc.SerializedClaimMessage, cm) != nil {
+		t.Fatal("Can't unmarshal evidence")
+	}
+	tn := certlib.TimePointNow()
+	shortLived := certlib.MakeSignedClaim(certlib.MakeClaim(cm.SerializedClaim, "vse-clause", "short-lived",
+		certlib.TimePointToString(tn), certlib.TimePointToString(certlib.TimePointPlus(tn, 2))),
+		tp.privatePlatformKey)
+	request.Support.FactAssertion[0] = signedClaimEvidence(t, shortLived)
+	b := certify(request)
+	time.Sleep(3 * time.Second)
+	if certlib.CheckSignedClaim(shortLived, tp.privatePlatformKey) == nil {
+		t.Fatal("Evidence hasn't expired")
+	}
+	if _, err := CheckProofBundle(b, tp.policyCert); err != nil {
+		t.Errorf("Bundle with evidence expired since doesn't check: %s", err.Error())
+	}
+	b.IssuedAt = time.Now().UTC()
+	if _, err := CheckProofBundle(b, tp.policyCert); err == nil {
+		t.Error("Bundle checks with expired evidence")
+	}
+
+	// No artifact without its bundle.
+	cs.proofBundleDir = dir + "/missing"
+	response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED ||
+			response.Artifact != nil {
+		t.Errorf("Artifact handed out without a bundle: %v %s", err, response.GetErrorCode())
+	}
+
+	// The bundle is on disk before the artifact is logged, and is
+	// removed if it can't be.
+	dir = t.TempDir()
+	transLog, err := OpenTransparencyLog(dir + "/transparency.log", tp.privatePolicyKey)
+	if err != nil {
+		t.Fatalf("OpenTransparencyLog fails: %s", err.Error())
+	}
+	cs, err = NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		ProofBundleDir: dir + "/bundles",
+		TransparencyLog: transLog,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	if err := os.Mkdir(dir + "/bundles", 0755); err != nil {
+		t.Fatal(err)
+	}
+	transLog.f.Close()
+	response, err = cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil || response.GetErrorCode() != certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED ||
+			response.Artifact != nil {
+		t.Errorf("Artifact handed out without a log entry: %v %s", err, response.GetErrorCode())
+	}
+	if left, _ := os.ReadDir(dir + "/bundles"); len(left) != 0 {
+		t.Errorf("Bundle left for an artifact that wasn't logged: %s", left[0].Name())
+	}
+}
+
+func TestIssuanceDB(t *testing.T) {
+	fmt.Print("\nTestIssuanceDB\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	m2 := make([]byte, 32)
+	m2[0] = 1
+	tp.serializedPolicy = tp.makePolicy(t, tp.measurement, m2)
+	name := t.TempDir() + "/issuances.db"
+	db, err := OpenIssuanceDB(name)
+	if err != nil {
+		t.Fatalf("OpenIssuanceDB fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		IssuanceDB: db,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+
+	before := time.Now().Add(-time.Minute)
+	var serials []string
+	for _, m := range [][]byte{tp.measurement, m2, tp.measurement} {
+		response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, m))
+		if err != nil || response.GetStatus() != "succeeded" {
+			t.Fatal("Certify fails")
+		}
+		cert, err := x509.ParseCertificate(response.Artifact)
+		if err != nil {
+			t.Fatal("Can't parse admission cert")
+		}
+		serials = append(serials, cert.SerialNumber.String())
+	}
+	// Failed requests issue nothing.
+	cs.Certify(context.Background(), tp.platformOnlyRequest(t, make([]byte, 32)))
+
+	platformKey := certlib.KeyFingerprint(certlib.InternalPublicFromPrivateKey(tp.privatePlatformKey))
+	found, err := cs.QueryIssuances(IssuanceQuery{Measurement: hex.EncodeToString(tp.measurement), LiveAt: time.Now()})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("Query by measurement finds %d issuances, %v", len(found), err)
+	}
+	for i, is := range found {
+		if is.Serial != serials[2 * i] || is.Artifact != AdmissionCertEntry || is.PlatformKey != platformKey ||
+				is.EvidenceType != "platform-attestation-only" || is.Purpose != "authentication" ||
+				is.RequestDigest == "" || is.ArtifactDigest == "" || is.SubjectKey == "" {
+			t.Errorf("Wrong issuance %+v", is)
+		}
+	}
+	found, _ = cs.QueryIssuances(IssuanceQuery{Serial: serials[1]})
+	if len(found) != 1 || found[0].Measurement != hex.EncodeToString(m2) {
+		t.Error("Query by serial fails")
+	}
+	found, _ = cs.QueryIssuances(IssuanceQuery{PlatformKey: platformKey, Limit: 2})
+	if len(found) != 2 {
+		t.Errorf("Query by platform key finds %d issuances", len(found))
+	}
+	found, _ = cs.QueryIssuances(IssuanceQuery{IssuedAfter: before, IssuedBefore: time.Now().Add(time.Minute)})
+	if len(found) != 3 {
+		t.Errorf("Query by time finds %d issuances", len(found))
+	}
+	found, _ = cs.QueryIssuances(IssuanceQuery{IssuedBefore: before})
+	if len(found) != 0 {
+		t.Errorf("Query by time finds %d issuances issued before the test", len(found))
+	}
+	found, _ = cs.QueryIssuances(IssuanceQuery{LiveAt: time.Now().Add(2 * 365 * 24 * time.Hour)})
+	if len(found) != 0 {
+		t.Errorf("%d issuances are live after they expire", len(found))
+	}
+
+	// The admin endpoints answer loopback callers.
+	adminGet := func(cs *CertifierService, target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		cs.AdminHandler("").ServeHTTP(w, r)
+		return w
+	}
+	w := adminGet(cs, "/admin/issuances?live=true&measurement=" + hex.EncodeToString(m2))
+	var rep struct {
+		Issuances []*Issuance `json:"issuances"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &rep) != nil || len(rep.Issuances) != 1 ||
+			rep.Issuances[0].Serial != serials[1] {
+		t.Errorf("GET /admin/issuances answers %d, %s", w.Code, w.Body.String())
+	}
+	w = adminGet(cs, "/admin/issuances?issued_after=yesterday")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET /admin/issuances with a bad time answers %d", w.Code)
+	}
+	db.Close()
+
+	// The database survives a restart.
+	db, err = OpenIssuanceDB(name)
+	if err != nil {
+		t.Fatalf("OpenIssuanceDB fails: %s", err.Error())
+	}
+	defer db.Close()
+	found, err = db.Query(IssuanceQuery{})
+	if err != nil || len(found) != 3 || found[2].Serial != serials[2] {
+		t.Error("Reopened database has different issuances")
+	}
+
+	cs = tp.newService(t)
+	w = adminGet(cs, "/admin/issuances")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/issuances without a database answers %d", w.Code)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	fmt.Print("\nTestAdminAuth\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	policyFile := t.TempDir() + "/policy.bin"
+	if err := os.WriteFile(policyFile, tp.serializedPolicy, 0666); err != nil {
+		t.Fatal("Can't write policy file")
+	}
+	serve := func(cs *CertifierService, method string, target string, remote string, auth string) int {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remote
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		cs.AdminHandler(policyFile).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Without a token only loopback callers get in.
+	cs := tp.newService(t)
+	for _, c := range []struct{
+		method string
+		target string
+	} {{"POST", "/admin/reload-policy"}, {"GET", "/admin/policy"}, {"GET", "/admin/issuances"}} {
+		if code := serve(cs, c.method, c.target, "192.0.2.1:1234", ""); code != http.StatusUnauthorized {
+			t.Errorf("%s %s from another host answers %d", c.method, c.target, code)
+		}
+		if code := serve(cs, c.method, c.target, "[::1]:1234", ""); code == http.StatusUnauthorized {
+			t.Errorf("%s %s from loopback answers %d", c.method, c.target, code)
+		}
+	}
+
+	// With one, every caller needs it.
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		AdminToken: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	for _, c := range []struct{
+		remote string
+		auth string
+		want int
+	} {
+		{"127.0.0.1:1234", "", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "Bearer wrong", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "secret", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "Bearer secret", http.StatusOK},
+	} {
+		if code := serve(cs, "POST", "/admin/reload-policy", c.remote, c.auth); code != c.want {
+			t.Errorf("Reload from %s with %q answers %d, want %d", c.remote, c.auth, code, c.want)
+		}
+	}
+
+	// Metrics and health stay open.
+	for _, target := range []string{"/metrics", "/healthz", "/readyz"} {
+		if code := serve(cs, "GET", target, "192.0.2.1:1234", ""); code != http.StatusOK {
+			t.Errorf("GET %s answers %d", target, code)
+		}
+	}
+}
+
+// makeClientCert makes a client cert for name issued under the policy cert.
+func (tp *testPolicy) makeClientCert(t *testing.T, name string) tls.Certificate {
+	ipK := rsa.PrivateKey{}
+	iPK := rsa.PublicKey{}
+	if !certlib.GetRsaKeysFromInternal(tp.privatePolicyKey, &ipK, &iPK) {
+		t.Fatal("Can't get policy key")
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Can't generate client key")
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now(),
+		NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, tp.policyCert, &clientKey.PublicKey,
+		crypto.Signer(&ipK))
+	if err != nil {
+		t.Fatal("Can't create client cert")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: clientKey}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	fmt.Print("\nTestPeerIdentity\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	name := t.TempDir() + "/audit.log"
+	auditLog, err := OpenAuditLog(name, tp.privatePolicyKey, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		AuditLog: auditLog,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	serverConfig, err := cs.ServiceTlsConfig("localhost", "", "")
+	if err != nil {
+		t.Fatalf("ServiceTlsConfig fails: %s", err.Error())
+	}
+	proxies, err := ParseNetworks("127.0.0.1, 10.1.0.0/16")
+	if err != nil || len(proxies) != 2 {
+		t.Fatal("ParseNetworks fails")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Can't listen")
+	}
+	sock := tls.NewListener(cs.ProxyListener(l, proxies, time.Second), serverConfig)
+	served := make(chan error, 1)
+	go func() {
+		served <- cs.Serve(sock)
+	}()
+
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 198, 51, 100, 7, 192, 0, 2, 2, 0x17, 0x70, 0x1f, 0xbb)
+	request, _ := proto.Marshal(tp.platformOnlyRequest(t, tp.measurement))
+	send := func(header []byte, clientCert *tls.Certificate) bool {
+		raw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal("Can't dial")
+		}
+		defer raw.Close()
+		raw.SetDeadline(time.Now().Add(5 * time.Second))
+		raw.Write(header)
+		config := certlib.MakeServiceClientTlsConfig(tp.policyCert, "localhost")
+		if clientCert != nil {
+			config.Certificates = []tls.Certificate{*clientCert}
+		}
+		conn := tls.Client(raw, config)
+		if !certlib.SizedSocketWrite(conn, request) {
+			return false
+		}
+		rb := certlib.SizedSocketRead(conn)
+		response := &certprotos.TrustResponseMessage{}
+		return rb != nil && proto.Unmarshal(rb, response) == nil && response.GetStatus() == "succeeded"
+	}
+	clientCert := tp.makeClientCert(t, "enclave-operator")
+	if !send([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 8123\r\n"), &clientCert) {
+		t.Error("Request through a v1 proxy fails")
+	}
+	if !send(v2, nil) {
+		t.Error("Request through a v2 proxy fails")
+	}
+	if send([]byte("GET / HTTP/1.0\r\n\r\n"), nil) {
+		t.Error("Request from a proxy without a PROXY header succeeds")
+	}
+	sock.Close()
+	if err := <-served; err == nil {
+		t.Error("Serve returns nil")
+	}
+	auditLog.Close()
+
+	var recs []*AuditRecord
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal("Can't open audit log")
+	}
+	defer f.Close()
+	ReadAuditRecords(f, func(rec *AuditRecord) error {
+		if rec.Kind == AuditRequest {
+			recs = append(recs, rec)
+		}
+		return nil
+	})
+	if len(recs) != 2 {
+		t.Fatalf("%d requests audited", len(recs))
+	}
+	if recs[0].Transport != "socket" || recs[0].Peer != "192.0.2.1:5000" ||
+			!strings.HasPrefix(recs[0].Proxy, "127.0.0.1:") || recs[0].ClientCert != "enclave-operator" ||
+			recs[0].ClientCertHash != hashHex(clientCert.Certificate[0]) {
+		t.Errorf("Bad peer for the v1 request: %+v", *recs[0])
+	}
+	if recs[1].Peer != "198.51.100.7:6000" || !strings.HasPrefix(recs[1].Proxy, "127.0.0.1:") ||
+			recs[1].ClientCert != "" {
+		t.Errorf("Bad peer for the v2 request: %+v", *recs[1])
+	}
+
+	// Clients are rate limited by IP address, or by client cert.
+	cs, err = NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		RateLimit: 0.001,
+		RateBurst: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	limited := func(p Peer) bool {
+		_, err := cs.Certify(WithPeer(context.Background(), p), tp.platformOnlyRequest(t, tp.measurement))
+		return err == ErrRateLimited
+	}
+	for i := 0; i < 2; i++ {
+		if limited(Peer{Transport: "socket", Addr: "10.0.0.1:4000"}) {
+			t.Fatal("Client limited within its burst")
+		}
+	}
+	if !limited(Peer{Transport: "http", Addr: "10.0.0.1:4001"}) {
+		t.Error("Client not limited after its burst")
+	}
+	if limited(Peer{Transport: "socket", Addr: "10.0.0.2:4000"}) {
+		t.Error("Another address is limited")
+	}
+	if limited(Peer{Transport: "grpc", Addr: "10.0.0.1:4002", ClientCert: "operator", ClientCertHash: "00"}) {
+		t.Error("Client with a cert is limited by its address")
+	}
+	// Nonces come out of the same bucket.
+	_, err = cs.IssueNonce(WithPeer(context.Background(), Peer{Transport: "grpc", Addr: "10.0.0.1:4003"}))
+	if err != ErrRateLimited {
+		t.Error("Client gets a nonce after its burst")
+	}
+	w := httptest.NewRecorder()
+	cs.AdminHandler("").ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`certifier_request_failures_total{error_code="TRUST_ERROR_RATE_LIMITED"} 1`,
+		`certifier_nonce_requests_total{outcome="rate_limited"} 1`,
+		`certifier_requests_by_peer_total{client_cert="no",proxied="no",transport="socket"} 3`,
+		`certifier_requests_by_peer_total{client_cert="yes",proxied="no",transport="grpc"} 1`,
+		`certifier_rate_limited_clients 3`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Metrics don't have %s", want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	fmt.Print("\nTestMetrics\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	cs := tp.newService(t)
+	untrusted := make([]byte, 32)
+	for _, m := range [][]byte{tp.measurement, tp.measurement, untrusted} {
+		if _, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, m)); err != nil {
+			t.Fatalf("Certify fails: %s", err.Error())
+		}
+	}
+	request := tp.platformOnlyRequest(t, tp.measurement)
+	request.SubmittedEvidenceType = proto.String("made-up-evidence")
+	cs.Certify(context.Background(), request)
+	cs.ReloadPolicy([]byte("not a policy"))
+
+	w := httptest.NewRecorder()
+	cs.AdminHandler("").ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics answers %d", w.Code)
+	}
+	scrape := w.Body.String()
+	for _, want := range []string{
+		`certifier_requests_total{evidence_type="platform-attestation-only",outcome="succeeded",purpose="authentication"} 2`,
+		`certifier_requests_total{evidence_type="platform-attestation-only",outcome="failed",purpose="authentication"} 1`,
+		`certifier_requests_total{evidence_type="other",outcome="failed",purpose="authentication"} 1`,
+		`certifier_request_failures_total{error_code="TRUST_ERROR_UNKNOWN_MEASUREMENT"} 1`,
+		`certifier_stage_duration_seconds_count{stage="init_proved_statements"} 4`,
+		`certifier_stage_duration_seconds_count{stage="add_new_facts"} 3`,
+		`certifier_stage_duration_seconds_count{stage="verify_proof"} 2`,
+		`certifier_stage_duration_seconds_count{stage="sign_artifact"} 2`,
+		`certifier_policy_measurements 1`,
+		`certifier_policy_reloads_total{result="rejected"} 1`,
+		`certifier_policy_last_reload_success 0`,
+		`certifier_last_issued_expiry_timestamp_seconds{artifact="admission-cert"}`,
+	} {
+		if !strings.Contains(scrape, want) {
+			t.Errorf("Metrics don't have %s", want)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	fmt.Print("\nTestTracing\n")
+
+	tp := makeTestPolicy(t, "policyKey")
+	recorder := tracetest.NewSpanRecorder()
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)),
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+
+	b, err := proto.Marshal(tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil {
+		t.Fatal("Can't marshal request")
+	}
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("POST", "/v1/certify", bytes.NewReader(b))
+	r.Header.Set("Content-Type", protoContentType)
+	r.Header.Set("traceparent", "00-" + traceId + "-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	cs.HttpHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /v1/certify answers %d", w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	evidenceItems := 0
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID().String() != traceId {
+			t.Errorf("Span %s isn't in the caller's trace", s.Name())
+		}
+		if s.Name() == "VerifyEvidenceItem" {
+			evidenceItems++
+		}
+		spans[s.Name()] = s
+	}
+	for _, name := range []string{"POST /v1/certify", "ReadRequest", "UnmarshalRequest", "Certify",
+			"InitProvedStatements", "AddPolicyFacts",
+			"ProveRequest", "VerifyProof", "ProduceAdmissionCert"} {
+		if spans[name] == nil {
+			t.Errorf("No %s span", name)
+		}
+	}
+	if evidenceItems != 2 {
+		t.Errorf("%d evidence item spans", evidenceItems)
+	}
+	if s := spans["InitProvedStatements"]; s != nil && s.Parent().SpanID() != spans["Certify"].SpanContext().SpanID() {
+		t.Error("InitProvedStatements isn't under Certify")
+	}
+	if s := spans["Certify"]; s != nil {
+		attrs := map[string]string{}
+		for _, kv := range s.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if attrs["certifier.evidence_type"] != "platform-attestation-only" ||
+				attrs["certifier.measurement"] != hex.EncodeToString(tp.measurement) ||
+				attrs["certifier.decision"] != "succeeded" {
+			t.Errorf("Wrong Certify span attributes %v", attrs)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	fmt.Print("\nTestReplay\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	dropped := make([]byte, 32)
+	dropped[0] = 1
+	added := make([]byte, 32)
+	added[0] = 2
+	tp.serializedPolicy = tp.makePolicy(t, tp.measurement, dropped)
+
+	name := t.TempDir() + "/audit.log"
+	auditLog, err := OpenAuditLog(name, tp.privatePolicyKey, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		AuditLog: auditLog,
+		AuditRequests: true,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	for _, m := range [][]byte{tp.measurement, dropped, added} {
+		if _, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, m)); err != nil {
+			t.Fatalf("Certify fails: %s", err.Error())
+		}
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close fails: %s", err.Error())
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal("Can't open audit log")
+	}
+	requests, skipped, err := ReadAuditRequests(f, "audit.log")
+	f.Close()
+	if err != nil || skipped != 0 || len(requests) != 3 {
+		t.Fatalf("ReadAuditRequests: %d requests, %d skipped, %v", len(requests), skipped, err)
+	}
+
+	// The tool only has the policy cert.
+	publicPolicyKey := certlib.GetSubjectKey(tp.policyCert)
+	current, err := NewPolicy(publicPolicyKey, tp.serializedPolicy)
+	if err != nil {
+		t.Fatalf("NewPolicy fails: %s", err.Error())
+	}
+	candidate, err := NewPolicy(publicPolicyKey, tp.makePolicy(t, tp.measurement, added))
+	if err != nil {
+		t.Fatalf("NewPolicy fails: %s", err.Error())
+	}
+	results := Replay(context.Background(), requests, current, candidate)
+	want := []struct{
+		recorded string
+		current string
+		candidate string
+	}{
+		{"succeeded", "succeeded", "succeeded"},
+		{"succeeded", "succeeded", "failed"},
+		{"failed", "failed", "succeeded"},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Recorded != w.recorded || r.Current.Status != w.current || r.Candidate.Status != w.candidate {
+			t.Errorf("Request %d: recorded %s, current %s, candidate %s", i, r.Recorded,
+				r.Current.Status, r.Candidate.Status)
+		}
+		if r.Changed() != (w.current != w.candidate) {
+			t.Errorf("Request %d: Changed is %v", i, r.Changed())
+		}
+	}
+	if results[1].Candidate.ErrorCode != certprotos.TrustErrorCode_TRUST_ERROR_UNKNOWN_MEASUREMENT.String() {
+		t.Errorf("Dropped measurement fails with %s", results[1].Candidate.ErrorCode)
+	}
+	if results[1].Current.Measurement != hex.EncodeToString(dropped) || results[1].Current.EnclaveKey == "" {
+		t.Errorf("Decision is %+v", results[1].Current)
+	}
+
+	// Request files.
+	b, err := proto.Marshal(tp.platformOnlyRequest(t, dropped))
+	if err != nil {
+		t.Fatal("Marshal fails")
+	}
+	requestFile := t.TempDir() + "/request.bin"
+	if err := os.WriteFile(requestFile, b, 0600); err != nil {
+		t.Fatal("Can't write request file")
+	}
+	request, err := ReadRequestFile(requestFile)
+	if err != nil {
+		t.Fatalf("ReadRequestFile fails: %s", err.Error())
+	}
+	if d := candidate.Decide(context.Background(), request); d.Status != "failed" {
+		t.Errorf("Candidate decides %+v", d)
+	}
+}
+
+func TestExplainProof(t *testing.T) {
+	fmt.Print("\nTestExplainProof\n")
+
+	tp := makeTestPolicy(t, "policyKey1")
+	name := t.TempDir() + "/audit.log"
+	auditLog, err := OpenAuditLog(name, tp.privatePolicyKey, 0, 0)
+	if err != nil {
+		t.Fatalf("OpenAuditLog fails: %s", err.Error())
+	}
+	cs, err := NewCertifierService(Options{
+		PolicyKey: tp.privatePolicyKey,
+		PolicyCert: tp.policyCert,
+		Policy: tp.serializedPolicy,
+		AuditLog: auditLog,
+		AuditProofs: true,
+	})
+	if err != nil {
+		t.Fatalf("NewCertifierService fails: %s", err.Error())
+	}
+	response, err := cs.Certify(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if err != nil || response.GetStatus() != "succeeded" {
+		t.Fatalf("Certify fails: %v", err)
+	}
+	auditLog.Close()
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal("Can't open audit log")
+	}
+	var rec *AuditRecord
+	err = ReadAuditRecords(f, func(r *AuditRecord) error {
+		if r.Kind == AuditRequest {
+			rec = r
+		}
+		return nil
+	})
+	f.Close()
+	if err != nil || rec == nil || rec.Proof == nil {
+		t.Fatalf("No proof in the audit log: %v", err)
+	}
+	pe := rec.Proof
+
+	ids := make(map[string]*certlib.ExplainedClause)
+	sources := make(map[string]int)
+	for _, n := range pe.Nodes {
+		ids[n.Id] = n
+		sources[n.Source]++
+		if n.Source == certlib.SourceEvidence {
+			// The platform key's statement, then the attest key's.
+			want := []string{"platformKey", "attestKey"}[*n.EvidenceIndex]
+			if n.Subject.Name != want || n.EvidenceType != "signed-claim" {
+				t.Errorf("Evidence %d is %s", *n.EvidenceIndex, n.Text)
+			}
+		}
+		if n.Source == certlib.SourcePolicy && n.Subject.Name != "policyKey1" {
+			t.Errorf("Policy statement %s", n.Text)
+		}
+	}
+	if sources[certlib.SourceEvidence] != 2 || sources[certlib.SourcePolicy] != 2 ||
+			sources[certlib.SourcePolicyKey] != 1 {
+		t.Errorf("Sources are %v", sources)
+	}
+	c := ids[pe.Conclusion]
+	if c == nil || c.Verb != "is-trusted-for-authentication" || c.Subject.Fingerprint != rec.EnclaveKey {
+		t.Fatalf("Conclusion is %+v", c)
+	}
+	if len(pe.Steps) == 0 {
+		t.Fatal("No steps")
+	}
+	for _, s := range pe.Steps {
+		if s.Rule <= 0 || ids[s.Conclusion] == nil || ids[s.Premises[0]] == nil || ids[s.Premises[1]] == nil {
+			t.Errorf("Bad step %+v", s)
+		}
+	}
+	found := false
+	for _, n := range pe.Nodes {
+		if n.Object != nil && n.Object.Measurement == hex.EncodeToString(tp.measurement) {
+			found = true
+		}
+		if n.Clause != nil && n.Clause.Object != nil &&
+				n.Clause.Object.Measurement == hex.EncodeToString(tp.measurement) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Measurement not in the proof")
+	}
+
+	dot := pe.DOT()
+	for _, s := range []string{"digraph proof {", "[label=\"rule ", "peripheries=2",
+			"evidence 1 (signed-claim)", pe.Conclusion + " [label="} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT has no %q:\n%s", s, dot)
+		}
+	}
+
+	// The replay tool explains proofs too.
+	d := cs.Policy().Decide(context.Background(), tp.platformOnlyRequest(t, tp.measurement))
+	if d.Proof == nil || len(d.Proof.Steps) != len(pe.Steps) {
+		t.Errorf("Decide explains %+v", d.Proof)
+	}
+}
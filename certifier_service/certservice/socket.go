@@ -0,0 +1,137 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: socket.go
+
+package certservice
+
+import (
+        "context"
+        "errors"
+        "net"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        "go.opentelemetry.io/otel/attribute"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// ServeConn serves one request in the sized socket protocol used by
+// the cc_helpers clients and closes conn.
+// Procedure is:
+//      read a message
+//      evaluate the trust assertion
+//      if it succeeds, sign a cert
+//      record the outcome in the audit log
+func (cs *CertifierService) ServeConn(conn net.Conn) {
+        defer conn.Close()
+        if !cs.begin() {
+                return
+        }
+        defer cs.end()
+        if !cs.addIdleConn(conn) {
+                return
+        }
+        defer cs.forgetConn(conn)
+        ctx, span := cs.startServerSpan(context.Background(), "ServeConn", nil,
+                attribute.String("certifier.transport", "socket"),
+                attribute.String("certifier.peer", conn.RemoteAddr().String()))
+        defer span.End()
+
+        // A client gets IdleTimeout to send its request (including the
+        // TLS handshake) and RequestTimeout to get its answer.
+        conn.SetDeadline(time.Now().Add(cs.idleTimeout))
+        _, readSpan := startSpan(ctx, "ReadRequest")
+	b := certlib.SizedSocketRead(conn)
+	if b == nil {
+                certlib.EndSpan(readSpan, errors.New("can't read request"))
+                cs.logEvent("Can't read request from " + conn.RemoteAddr().String())
+                return
+	}
+        readSpan.End()
+        // The TLS handshake is done, so the client cert is known.
+        p := peerFromConn("socket", conn)
+        if !cs.connBusy(conn) {
+                // Shutdown closed it.
+                return
+        }
+        conn.SetDeadline(time.Now().Add(cs.requestTimeout))
+
+        request:= &certprotos.TrustRequestMessage{}
+        _, unmarshalSpan := startSpan(ctx, "UnmarshalRequest")
+        err := proto.Unmarshal(b, request)
+        certlib.EndSpan(unmarshalSpan, err)
+        if err != nil {
+                cs.log().Debug("ServeConn: can't unmarshal request", "err", err)
+                cs.logEvent("Can't unmarshal request from " + p.Addr)
+                return
+        }
+
+        cs.log().Debug("ServeConn: trust request", "peer", p.Addr,
+                "evidence_type", request.GetSubmittedEvidenceType(), "purpose", request.GetPurpose(),
+                "request", certlib.Sensitive(b))
+
+        // The socket protocol always answers, so requests that can't be
+        // evaluated just fail.
+        response, err := cs.certify(WithPeer(ctx, p), request)
+        if err != nil {
+                cs.log().Debug("ServeConn: request not evaluated", "err", err)
+                response = &certprotos.TrustResponseMessage{
+                        RequestingEnclaveTag: request.RequestingEnclaveTag,
+                        ProvidingEnclaveTag: request.ProvidingEnclaveTag,
+                }
+                setFailure(response, err)
+        }
+
+        cs.log().Debug("ServeConn: sending response", "status", response.GetStatus(),
+                "artifact", certlib.Sensitive(response.Artifact))
+
+        // send response, the audit log has the full failure detail
+        sb, err := proto.Marshal(cs.redactResponse(response, p.ClientCertHash != ""))
+        if err != nil {
+                cs.logEvent("Couldn't marshall response for " + p.Addr)
+                return
+        }
+	if !certlib.SizedSocketWrite(conn, sb) {
+                cs.logEvent("Couldn't send response to " + p.Addr)
+                return
+	}
+}
+
+// Serve accepts sized socket connections on sock and serves each in
+// its own goroutine.  It returns when sock is closed, or ErrShuttingDown
+// after Shutdown.
+func (cs *CertifierService) Serve(sock net.Listener) error {
+        if !cs.trackListener(sock) {
+                sock.Close()
+                return ErrShuttingDown
+        }
+        for {
+                conn, err := sock.Accept()
+                if err != nil {
+                        if errors.Is(err, net.ErrClosed) {
+                                if cs.isShuttingDown() {
+                                        return ErrShuttingDown
+                                }
+                                return err
+                        }
+                        cs.log().Error("Serve: can't accept connection", "err", err)
+                        // Don't spin if we're out of file descriptors.
+                        time.Sleep(10 * time.Millisecond)
+                        continue
+                }
+                go cs.ServeConn(conn)
+        }
+}
@@ -0,0 +1,71 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: tls.go
+
+package certservice
+
+import (
+        "crypto/tls"
+        "crypto/x509"
+        "errors"
+        "fmt"
+
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// ServiceTlsConfig makes the server TLS config.  The service cert must
+// chain to the policy cert, since that is the only root clients have.
+// If certFile and keyFile are empty, a cert for hostName is issued with
+// the policy key.
+func (cs *CertifierService) ServiceTlsConfig(hostName string, certFile string,
+                keyFile string) (*tls.Config, error) {
+        var serviceCert *tls.Certificate = nil
+        if certFile != "" || keyFile != "" {
+                c, err := tls.LoadX509KeyPair(certFile, keyFile)
+                if err != nil {
+                        return nil, fmt.Errorf("can't load service cert and key: %v", err)
+                }
+                leaf, err := x509.ParseCertificate(c.Certificate[0])
+                if err != nil {
+                        return nil, fmt.Errorf("can't parse service cert: %v", err)
+                }
+                if !certlib.VerifyAdmissionCert(cs.policyCert, leaf) {
+                        return nil, errors.New("service cert is not issued under the policy cert")
+                }
+                if len(c.Certificate) == 1 {
+                        c.Certificate = append(c.Certificate, cs.policyCert.Raw)
+                }
+                c.Leaf = leaf
+                serviceCert = &c
+        } else {
+                c, err := certlib.ProduceServiceCert(cs.privatePolicyKey, cs.policyCert, hostName, cs.duration)
+                if err != nil {
+                        return nil, fmt.Errorf("can't produce service cert: %v", err)
+                }
+                serviceCert = c
+        }
+
+        cs.log().Info("Service cert", "subject", serviceCert.Leaf.Subject.CommonName,
+                "issuer", serviceCert.Leaf.Issuer.CommonName, "not_after", serviceCert.Leaf.NotAfter)
+
+        // Clients may present a cert issued under the policy cert, they
+        // get the full reason a request failed.
+        config := certlib.MakeServiceTlsConfig(serviceCert)
+        clientCAs := x509.NewCertPool()
+        clientCAs.AddCert(cs.policyCert)
+        config.ClientCAs = clientCAs
+        config.ClientAuth = tls.VerifyClientCertIfGiven
+        return config, nil
+}
@@ -0,0 +1,156 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: trace.go
+
+package certservice
+
+import (
+        "context"
+        "net/http"
+        "time"
+
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/codes"
+        "go.opentelemetry.io/otel/propagation"
+        "go.opentelemetry.io/otel/trace"
+        "google.golang.org/grpc/metadata"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// OpenTelemetry tracing.  Each request gets a span for its transport,
+// with spans under it for reading and unmarshalling the request,
+// Certify and each stage of evaluating it (see metrics.go); certlib adds
+// a span for each evidence item.  A W3C traceparent from HTTP or gRPC
+// callers makes the request part of the caller's trace.
+
+const tracerName = "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
+
+var stageSpanNames = map[string]string{
+        stageInitProvedStatements: "InitProvedStatements",
+        stageAddNewFacts: "AddNewFacts",
+        stageConstructProof: "ConstructProof",
+        stageVerifyProof: "VerifyProof",
+        stageSignArtifact: "SignArtifact",
+}
+
+var propagator = propagation.TraceContext{}
+
+// metadataCarrier adapts gRPC metadata for the propagator.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+        v := metadata.MD(c).Get(key)
+        if len(v) == 0 {
+                return ""
+        }
+        return v[0]
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+        metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+        keys := make([]string, 0, len(c))
+        for k := range c {
+                keys = append(keys, k)
+        }
+        return keys
+}
+
+// startServerSpan starts the span for a request that came in on a
+// transport.  Its parent is the trace context the caller sent, if any.
+func (cs *CertifierService) startServerSpan(ctx context.Context, name string, carrier propagation.TextMapCarrier,
+                attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+        if carrier != nil {
+                ctx = propagator.Extract(ctx, carrier)
+        }
+        return cs.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+func (cs *CertifierService) startHttpSpan(r *http.Request) (context.Context, trace.Span) {
+        return cs.startServerSpan(r.Context(), r.Method + " " + r.URL.Path, propagation.HeaderCarrier(r.Header),
+                attribute.String("certifier.transport", "http"), attribute.String("certifier.peer", r.RemoteAddr))
+}
+
+func (cs *CertifierService) startGrpcSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+        md, _ := metadata.FromIncomingContext(ctx)
+        return cs.startServerSpan(ctx, "TrustService/" + method, metadataCarrier(md),
+                attribute.String("certifier.transport", "grpc"))
+}
+
+// startSpan starts a span under the one in ctx.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+        return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name)
+}
+
+// stage is one timed and traced stage of evaluating a request.
+type stage struct {
+        ctx context.Context
+        label string
+        start time.Time
+        span trace.Span
+}
+
+// startStage starts the stage label under the span in ctx.  The span
+// can be renamed for the function that does the work.
+func startStage(ctx context.Context, label string) *stage {
+        st := &stage{
+                label: label,
+                start: time.Now(),
+        }
+        st.ctx, st.span = startSpan(ctx, stageSpanNames[label])
+        return st
+}
+
+// end records the stage's time and ends its span.
+func (st *stage) end(err error) {
+        observeStage(st.ctx, st.label, st.start)
+        certlib.EndSpan(st.span, err)
+}
+
+// cancel ends the span of a stage that turned out not to be needed,
+// without recording its time.
+func (st *stage) cancel() {
+        st.span.End()
+}
+
+// traceRequest ends the Certify span with what rec says about the
+// request.
+func traceRequest(span trace.Span, rec *AuditRecord) {
+        span.SetAttributes(attribute.String("certifier.decision", rec.Decision))
+        if rec.Proxy != "" {
+                span.SetAttributes(attribute.String("certifier.client_addr", rec.Peer),
+                        attribute.String("certifier.proxy", rec.Proxy))
+        }
+        if rec.ClientCertHash != "" {
+                span.SetAttributes(attribute.String("certifier.client_cert", rec.ClientCert),
+                        attribute.String("certifier.client_cert_hash", rec.ClientCertHash))
+        }
+        if rec.Measurement != "" {
+                span.SetAttributes(attribute.String("certifier.measurement", rec.Measurement))
+        }
+        if rec.EnclaveKey != "" {
+                span.SetAttributes(attribute.String("certifier.enclave_key", rec.EnclaveKey))
+        }
+        if rec.CertSerial != "" {
+                span.SetAttributes(attribute.String("certifier.cert_serial", rec.CertSerial))
+        }
+        if rec.Decision != "succeeded" {
+                span.SetAttributes(attribute.String("certifier.error_code", rec.ErrorCode))
+                span.SetStatus(codes.Error, rec.Reason)
+        }
+        span.End()
+}
@@ -0,0 +1,293 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: translog.go
+
+package certservice
+
+import (
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "io"
+        "os"
+        "sync"
+        "time"
+
+        "github.com/golang/protobuf/proto"
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+)
+
+// The transparency log holds every admission cert and platform rule the
+// service issues, as leaves of a Merkle tree (see certlib/merkle.go).
+// The trust response carries the tree head, signed by the policy key,
+// and the artifact's inclusion proof, so a relying party can check the
+// artifact was logged.  Auditors fetch tree heads, consistency proofs
+// and the entries to watch what is issued under the policy key.
+//
+// The file is a sequence of log_entry messages, each preceded by its
+// length as a 4 byte big endian number.
+
+// Log entry types.
+const (
+        AdmissionCertEntry = "admission-cert"
+        PlatformRuleEntry = "platform-rule"
+)
+
+const maxLogEntriesPerRequest = 1000
+
+// TransparencyLog is an append only Merkle tree log of issued
+// artifacts.  Its methods may be called concurrently.
+type TransparencyLog struct {
+        mu sync.Mutex
+        f *os.File
+        signingKey *certprotos.KeyMessage
+        tree certlib.MerkleTree
+        entries []*certprotos.LogEntry
+        // head is the signed head of the whole tree, signed again only
+        // when the tree grows.
+        head *certprotos.SignedTreeHead
+        headSize int64
+}
+
+// OpenTransparencyLog opens or creates the log file name; policyKey
+// signs the tree heads.  If name is empty the log is kept in memory.
+func OpenTransparencyLog(name string, policyKey *certprotos.KeyMessage) (*TransparencyLog, error) {
+        if certlib.RsaSigningAlgorithm(policyKey.GetKeyType()) == "" {
+                return nil, errors.New("transparency log needs a private rsa policy key")
+        }
+        l := &TransparencyLog{
+                signingKey: policyKey,
+        }
+        if name == "" {
+                return l, nil
+        }
+        f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+        if err != nil {
+                return nil, err
+        }
+        l.f = f
+        if err := l.load(); err != nil {
+                f.Close()
+                return nil, fmt.Errorf("%s: %v", name, err)
+        }
+        return l, nil
+}
+
+func (l *TransparencyLog) load() error {
+        var size [4]byte
+        for {
+                _, err := io.ReadFull(l.f, size[:])
+                if err == io.EOF {
+                        return nil
+                }
+                if err != nil {
+                        return fmt.Errorf("entry %d: partial entry", len(l.entries))
+                }
+                b := make([]byte, binary.BigEndian.Uint32(size[:]))
+                if _, err := io.ReadFull(l.f, b); err != nil {
+                        return fmt.Errorf("entry %d: partial entry", len(l.entries))
+                }
+                e := &certprotos.LogEntry{}
+                if err := proto.Unmarshal(b, e); err != nil {
+                        return fmt.Errorf("entry %d: %v", len(l.entries), err)
+                }
+                if e.GetIndex() != int64(len(l.entries)) {
+                        return fmt.Errorf("entry %d has index %d", len(l.entries), e.GetIndex())
+                }
+                l.entries = append(l.entries, e)
+                l.tree.AppendLeaf(certlib.MerkleLeafHash(e.Artifact))
+        }
+}
+
+// Size is the number of entries.
+func (l *TransparencyLog) Size() int64 {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return l.tree.Size()
+}
+
+// signedTreeHeadLocked signs the head of the tree of size entries, or
+// returns the head already signed for that size.
+func (l *TransparencyLog) signedTreeHeadLocked(size int64) (*certprotos.SignedTreeHead, error) {
+        if l.head != nil && l.headSize == size {
+                return l.head, nil
+        }
+        root, err := l.tree.Root(size)
+        if err != nil {
+                return nil, err
+        }
+        ts := time.Now().UTC().Format(time.RFC3339)
+        sth := certlib.SignTreeHead(&certprotos.TreeHead{
+                TreeSize: &size,
+                RootHash: root,
+                Timestamp: &ts,
+        }, l.signingKey)
+        if sth == nil {
+                return nil, errors.New("can't sign tree head")
+        }
+        l.head = sth
+        l.headSize = size
+        return sth, nil
+}
+
+// Append logs artifact and returns the signed head of the tree that
+// includes it and its inclusion proof.
+func (l *TransparencyLog) Append(entryType string, artifact []byte) (*certprotos.SignedTreeHead,
+                *certprotos.InclusionProof, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        index := l.tree.Size()
+        ts := time.Now().UTC().Format(time.RFC3339)
+        e := &certprotos.LogEntry{
+                Index: &index,
+                EntryType: &entryType,
+                Artifact: artifact,
+                Timestamp: &ts,
+        }
+        if l.f != nil {
+                b, err := proto.Marshal(e)
+                if err != nil {
+                        return nil, nil, err
+                }
+                rec := make([]byte, 4, 4 + len(b))
+                binary.BigEndian.PutUint32(rec, uint32(len(b)))
+                if _, err := l.f.Write(append(rec, b...)); err != nil {
+                        return nil, nil, err
+                }
+                if err := l.f.Sync(); err != nil {
+                        return nil, nil, err
+                }
+        }
+        l.entries = append(l.entries, e)
+        l.tree.AppendLeaf(certlib.MerkleLeafHash(artifact))
+        size := index + 1
+        sth, err := l.signedTreeHeadLocked(size)
+        if err != nil {
+                return nil, nil, err
+        }
+        path, err := l.tree.InclusionProof(index, size)
+        if err != nil {
+                return nil, nil, err
+        }
+        return sth, &certprotos.InclusionProof{
+                LeafIndex: &index,
+                TreeSize: &size,
+                AuditPath: path,
+        }, nil
+}
+
+// SignedTreeHead is the signed head of the whole log.
+func (l *TransparencyLog) SignedTreeHead() (*certprotos.SignedTreeHead, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return l.signedTreeHeadLocked(l.tree.Size())
+}
+
+// InclusionProof proves entry index is in the tree of size entries,
+// the whole log if size is 0.
+func (l *TransparencyLog) InclusionProof(index int64, size int64) (*certprotos.InclusionProof, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if size == 0 {
+                size = l.tree.Size()
+        }
+        path, err := l.tree.InclusionProof(index, size)
+        if err != nil {
+                return nil, err
+        }
+        return &certprotos.InclusionProof{
+                LeafIndex: &index,
+                TreeSize: &size,
+                AuditPath: path,
+        }, nil
+}
+
+// ConsistencyProof proves the tree of first entries is a prefix of the
+// tree of second entries, the whole log if second is 0.
+func (l *TransparencyLog) ConsistencyProof(first int64, second int64) (*certprotos.ConsistencyProof, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if second == 0 {
+                second = l.tree.Size()
+        }
+        path, err := l.tree.ConsistencyProof(first, second)
+        if err != nil {
+                return nil, err
+        }
+        return &certprotos.ConsistencyProof{
+                FirstSize: &first,
+                SecondSize: &second,
+                Path: path,
+        }, nil
+}
+
+// Entries returns entries [start, end), at most 1000 of them.
+func (l *TransparencyLog) Entries(start int64, end int64) ([]*certprotos.LogEntry, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if end > int64(len(l.entries)) {
+                end = int64(len(l.entries))
+        }
+        if start < 0 || start > end {
+                return nil, errors.New("no such entries")
+        }
+        if end - start > maxLogEntriesPerRequest {
+                end = start + maxLogEntriesPerRequest
+        }
+        return append([]*certprotos.LogEntry(nil), l.entries[start:end]...), nil
+}
+
+// Close closes the log file.
+func (l *TransparencyLog) Close() error {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if l.f == nil {
+                return nil
+        }
+        err := l.f.Close()
+        l.f = nil
+        return err
+}
+
+// ErrNoTransparencyLog is returned by the log queries when the service
+// has no transparency log.
+var ErrNoTransparencyLog = errors.New("no transparency log")
+
+// TransparencyLog is the service's log of issued artifacts, or nil.
+func (cs *CertifierService) TransparencyLog() *TransparencyLog {
+        return cs.transLog
+}
+
+// logIssued adds the artifact in response to the transparency log and
+// the tree head and inclusion proof to response.  An artifact that
+// can't be logged isn't handed out.
+func (cs *CertifierService) logIssued(response *certprotos.TrustResponseMessage, entryType string,
+                rec *AuditRecord) {
+        if cs.transLog == nil {
+                return
+        }
+        sth, ip, err := cs.transLog.Append(entryType, response.Artifact)
+        if err != nil {
+                cs.log().Error("Can't add artifact to the transparency log", "err", err)
+                response.Artifact = nil
+                setFailure(response, certlib.NewTrustError(certprotos.TrustErrorCode_TRUST_ERROR_ARTIFACT_FAILED,
+                        "can't add the artifact to the transparency log: %v", err))
+                return
+        }
+        response.TreeHead = sth
+        response.Inclusion = ip
+        rec.LogIndex = ip.LeafIndex
+}
@@ -0,0 +1,136 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: explainproof.go
+
+// explainproof writes the proof behind a decision as JSON or as a
+// Graphviz graph.  Build it with "go build explainproof.go".  The proof
+// comes from an audit log kept with --auditProofs, found by cert serial
+// or record number, or is found again for a request file named on the
+// command line, with --policyFile.
+package main
+
+import (
+        "context"
+        "crypto/x509"
+        "errors"
+        "flag"
+        "fmt"
+        "os"
+
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+        certservice "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
+)
+
+var auditLogFile = flag.String("auditLogFile", "", "audit log kept with --auditProofs")
+var certSerial = flag.String("certSerial", "", "serial number of the admission cert to explain")
+var seq = flag.Int64("seq", -1, "audit record to explain")
+var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "cert file name, for a request file")
+var policyFile = flag.String("policyFile", "./certlib/policy.bin", "policy to evaluate a request file with")
+var format = flag.String("format", "json", "json or dot")
+
+var errFound = errors.New("found")
+
+func fromAuditLog() (*certlib.ProofExplanation, error) {
+        f, err := os.Open(*auditLogFile)
+        if err != nil {
+                return nil, err
+        }
+        defer f.Close()
+        var found *certservice.AuditRecord
+        err = certservice.ReadAuditRecords(f, func(rec *certservice.AuditRecord) error {
+                if rec.Kind != certservice.AuditRequest {
+                        return nil
+                }
+                if (*certSerial != "" && rec.CertSerial == *certSerial) || int64(rec.Seq) == *seq {
+                        found = rec
+                        return errFound
+                }
+                return nil
+        })
+        if err != nil && err != errFound {
+                return nil, err
+        }
+        if found == nil {
+                return nil, errors.New("no such request in the audit log")
+        }
+        if found.Proof == nil {
+                return nil, fmt.Errorf("record %d has no proof (%s)", found.Seq, found.Decision)
+        }
+        return found.Proof, nil
+}
+
+func fromRequestFile(name string) (*certlib.ProofExplanation, error) {
+        serializedPolicyCert, err := os.ReadFile(*policyCertFile)
+        if err != nil {
+                return nil, err
+        }
+        policyCert, err := x509.ParseCertificate(serializedPolicyCert)
+        if err != nil {
+                return nil, fmt.Errorf("can't parse policy cert: %v", err)
+        }
+        serializedPolicy, err := os.ReadFile(*policyFile)
+        if err != nil {
+                return nil, err
+        }
+        policy, err := certservice.NewPolicy(certlib.GetSubjectKey(policyCert), serializedPolicy)
+        if err != nil {
+                return nil, err
+        }
+        request, err := certservice.ReadRequestFile(name)
+        if err != nil {
+                return nil, err
+        }
+        d := policy.Decide(context.Background(), request)
+        if d.Proof == nil {
+                return nil, fmt.Errorf("no proof: %s, %s", d.ErrorCode, d.Reason)
+        }
+        if d.Status != "succeeded" {
+                fmt.Fprintf(os.Stderr, "explainproof: the proof doesn't check: %s\n", d.Reason)
+        }
+        return d.Proof, nil
+}
+
+func main() {
+        flag.Parse()
+
+        var pe *certlib.ProofExplanation
+        var err error
+        if *auditLogFile != "" && (*certSerial != "" || *seq >= 0) {
+                pe, err = fromAuditLog()
+        } else if flag.NArg() == 1 {
+                pe, err = fromRequestFile(flag.Arg(0))
+        } else {
+                err = errors.New("give --auditLogFile and --certSerial or --seq, or one request file")
+        }
+        if err != nil {
+                fmt.Fprintf(os.Stderr, "explainproof: %s\n", err.Error())
+                os.Exit(1)
+        }
+
+        switch *format {
+        case "json":
+                b, err := pe.JSON()
+                if err != nil {
+                        fmt.Fprintf(os.Stderr, "explainproof: %s\n", err.Error())
+                        os.Exit(1)
+                }
+                fmt.Printf("%s\n", b)
+        case "dot":
+                fmt.Print(pe.DOT())
+        default:
+                fmt.Fprintf(os.Stderr, "explainproof: format must be json or dot\n")
+                os.Exit(2)
+        }
+}
@@ -0,0 +1,74 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: proofcheck.go
+
+// proofcheck checks proof bundles, written by simpleserver with
+// --proofBundleDir, without the server: it verifies the evidence and
+// every proof step again against the policy in the bundle, which must be
+// signed by the policy key.  Build it with "go build proofcheck.go" and
+// name the bundles on the command line.
+package main
+
+import (
+        "crypto/x509"
+        "flag"
+        "fmt"
+        "os"
+
+        certservice "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
+)
+
+var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "cert file name")
+
+func main() {
+        flag.Parse()
+        if flag.NArg() == 0 {
+                fmt.Printf("proofcheck: no bundles named\n")
+                os.Exit(2)
+        }
+
+        serializedPolicyCert, err := os.ReadFile(*policyCertFile)
+        if err != nil {
+                fmt.Printf("proofcheck: can't read policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+        policyCert, err := x509.ParseCertificate(serializedPolicyCert)
+        if err != nil {
+                fmt.Printf("proofcheck: can't parse policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+
+        failed := 0
+        for _, name := range flag.Args() {
+                b, err := certservice.ReadProofBundle(name)
+                if err != nil {
+                        fmt.Printf("proofcheck: %s\n", err.Error())
+                        failed++
+                        continue
+                }
+                check, err := certservice.CheckProofBundle(b, policyCert)
+                if err != nil {
+                        fmt.Printf("proofcheck: %s: FAILED: %s\n", name, err.Error())
+                        failed++
+                        continue
+                }
+                fmt.Printf("proofcheck: %s: %s issued %s for %s, from %d evidence items and %d policy statements in %d steps\n",
+                        name, b.ArtifactType, b.IssuedAt.Format("2006-01-02T15:04:05Z"), check.Conclusion,
+                        check.EvidenceItems, check.PolicyStatements, check.Steps)
+        }
+        if failed > 0 {
+                os.Exit(1)
+        }
+}
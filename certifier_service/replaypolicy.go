@@ -0,0 +1,154 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: replaypolicy.go
+
+// replaypolicy evaluates logged trust requests against the policy in
+// force and a candidate policy and reports the decisions that would
+// change.  Build it with "go build replaypolicy.go".  Request files are
+// named on the command line; audit logs kept with --auditRequests are
+// read with --auditLogFile.
+package main
+
+import (
+        "context"
+        "crypto/x509"
+        "flag"
+        "fmt"
+        "os"
+        "strings"
+
+        certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+        certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
+        certservice "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
+)
+
+var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "cert file name")
+var policyFile = flag.String("policyFile", "./certlib/policy.bin", "policy in force")
+var candidatePolicyFile = flag.String("candidatePolicyFile", "", "policy to compare it with")
+var auditLogFile = flag.String("auditLogFile", "", "audit logs with saved requests, comma separated")
+var all = flag.Bool("all", false, "list every request, not just the ones decided differently")
+
+func readPolicy(publicPolicyKey *certprotos.KeyMessage, name string) *certservice.Policy {
+        b, err := os.ReadFile(name)
+        if err != nil {
+                fmt.Printf("replaypolicy: %s\n", err.Error())
+                os.Exit(2)
+        }
+        p, err := certservice.NewPolicy(publicPolicyKey, b)
+        if err != nil {
+                fmt.Printf("replaypolicy: %s: %s\n", name, err.Error())
+                os.Exit(2)
+        }
+        if p.Rejected() > 0 {
+                fmt.Printf("replaypolicy: %s: %d statements rejected and left out\n", name, p.Rejected())
+        }
+        return p
+}
+
+func describe(d certservice.Decision) string {
+        s := d.Status
+        if d.ErrorCode != "" {
+                s += ", " + d.ErrorCode + ": " + d.Reason
+        }
+        return s
+}
+
+func main() {
+        flag.Parse()
+
+        if *candidatePolicyFile == "" {
+                fmt.Printf("replaypolicy: no --candidatePolicyFile\n")
+                os.Exit(2)
+        }
+        serializedPolicyCert, err := os.ReadFile(*policyCertFile)
+        if err != nil {
+                fmt.Printf("replaypolicy: can't read policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+        policyCert, err := x509.ParseCertificate(serializedPolicyCert)
+        if err != nil {
+                fmt.Printf("replaypolicy: can't parse policy cert: %s\n", err.Error())
+                os.Exit(2)
+        }
+        publicPolicyKey := certlib.GetSubjectKey(policyCert)
+        if publicPolicyKey == nil {
+                fmt.Printf("replaypolicy: can't get the policy key from the policy cert\n")
+                os.Exit(2)
+        }
+        current := readPolicy(publicPolicyKey, *policyFile)
+        candidate := readPolicy(publicPolicyKey, *candidatePolicyFile)
+
+        var requests []certservice.ReplayRequest
+        if *auditLogFile != "" {
+                for _, name := range strings.Split(*auditLogFile, ",") {
+                        f, err := os.Open(name)
+                        if err != nil {
+                                fmt.Printf("replaypolicy: %s\n", err.Error())
+                                os.Exit(2)
+                        }
+                        l, skipped, err := certservice.ReadAuditRequests(f, name)
+                        f.Close()
+                        if err != nil {
+                                fmt.Printf("replaypolicy: %s\n", err.Error())
+                                os.Exit(2)
+                        }
+                        if skipped > 0 {
+                                fmt.Printf("replaypolicy: %s: %d requests weren't saved\n", name, skipped)
+                        }
+                        requests = append(requests, l...)
+                }
+        }
+        for _, name := range flag.Args() {
+                request, err := certservice.ReadRequestFile(name)
+                if err != nil {
+                        fmt.Printf("replaypolicy: %s\n", err.Error())
+                        os.Exit(2)
+                }
+                requests = append(requests, certservice.ReplayRequest{Name: name, Request: request})
+        }
+
+        results := certservice.Replay(context.Background(), requests, current, candidate)
+        changed := 0
+        failing := 0
+        for _, r := range results {
+                if r.Changed() {
+                        changed++
+                        if r.Current.Status == "succeeded" {
+                                failing++
+                        }
+                } else if !*all {
+                        continue
+                }
+                fmt.Printf("%s: %s\n", r.Name, r.Request.GetSubmittedEvidenceType())
+                // A policy that fails the request may not get as far as
+                // the measurement and key.
+                for _, d := range []certservice.Decision{r.Current, r.Candidate} {
+                        if d.Measurement != "" || d.EnclaveKey != "" {
+                                fmt.Printf("    measurement %s, enclave key %s\n", d.Measurement, d.EnclaveKey)
+                                break
+                        }
+                }
+                if r.Recorded != "" && r.Recorded != r.Current.Status {
+                        fmt.Printf("    recorded:  %s\n", r.Recorded)
+                }
+                fmt.Printf("    current:   %s\n", describe(r.Current))
+                fmt.Printf("    candidate: %s\n", describe(r.Candidate))
+        }
+        fmt.Printf("replaypolicy: %d requests, %d decided differently, %d of them would start failing\n",
+                len(results), changed, failing)
+        if changed > 0 {
+                os.Exit(1)
+        }
+}
@@ -17,1435 +17,495 @@
 package main
 
 import (
-        "bytes"
+        "context"
+        "crypto/tls"
         "crypto/x509"
-        //"crypto/rsa"
         "flag"
         "fmt"
-        "encoding/hex"
-        "io/ioutil"
-        "log"
+        "io"
+        "log/slog"
         "net"
+        "net/http"
         "os"
-        "strconv"
+        "os/signal"
+        "strings"
+        "syscall"
         "time"
 
         "github.com/golang/protobuf/proto"
+        "go.opentelemetry.io/otel/attribute"
+        "go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+        "go.opentelemetry.io/otel/sdk/resource"
+        sdktrace "go.opentelemetry.io/otel/sdk/trace"
+        "google.golang.org/grpc"
+        "google.golang.org/grpc/credentials"
+        "google.golang.org/grpc/keepalive"
         certprotos "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certprotos"
         certlib "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certlib"
-        //oeverify "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/oeverify"
+        certservice "github.com/jlmucb/crypto/v2/certifier-framework-for-confidential-computing/certifier_service/certservice"
 )
 
 var serverHost = flag.String("host", "localhost", "address for client/server")
 var serverPort = flag.String("port", "8123", "port for client/server")
+var grpcPort = flag.String("grpcPort", "", "port for the grpc TrustService, disabled if empty")
+var httpPort = flag.String("httpPort", "", "port for the http gateway (POST /v1/certify), disabled if empty")
 
 var policyKeyFile = flag.String("policy_key_file", "policy_key_file.bin", "key file name")
 var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "cert file name")
 var readPolicy = flag.Bool("readPolicy", true, "read policy")
 var policyFile = flag.String("policyFile", "./certlib/policy.bin", "policy file name")
-var loggingSequenceNumber = *flag.Int("loggingSequenceNumber", 1,  "sequence number for logging")
 
-var enableLog = flag.Bool("enableLog", false, "enable logging")
+var enableLog = flag.Bool("enableLog", false, "log to logFile and keep the audit log")
 var logDir = flag.String("logDir", ".", "log directory")
-var logFile = flag.String("logFile", "simpleserver.log", "log file name")
-
-var privatePolicyKey certprotos.KeyMessage
-var publicPolicyKey *certprotos.KeyMessage = nil
-var serializedPolicyCert []byte
-var policyCert *x509.Certificate = nil
-var sn uint64 = uint64(time.Now().UnixNano())
-var duration float64 = 365.0 * 86400
-
-var logging bool = false
-var logger *log.Logger
-var dataPacketFileNum int = loggingSequenceNumber
+var logFile = flag.String("logFile", "simpleserver.log", "log file name, in logDir; the log goes to stdout without enableLog")
+var logLevel = flag.String("logLevel", "info", "least severe log records written: debug, info, warn or error")
+var logFormat = flag.String("logFormat", "text", "log record format: text or json")
+var logSensitive = flag.Bool("logSensitive", false, "log keys, reports and artifacts in full at debug level (insecure)")
+var auditLogFile = flag.String("auditLogFile", "audit.log", "audit log file name, in logDir")
+var auditRequests = flag.Bool("auditRequests", false, "save each request in the audit log, for replaypolicy")
+var auditProofs = flag.Bool("auditProofs", false, "save the proof behind each decision in the audit log, for explainproof")
+var auditCheckpointEvery = flag.Int("auditCheckpointEvery", 100, "audit records between signed checkpoints")
+var transparencyLogFile = flag.String("transparencyLogFile", "", "log of issued certs and platform rules, in logDir, disabled if empty")
+var issuanceDbFile = flag.String("issuanceDbFile", "", "database of issued certs and platform rules, in logDir, disabled if empty")
+var proofBundleDir = flag.String("proofBundleDir", "", "directory for a proof bundle of each issued artifact, for proofcheck, disabled if empty")
+var auditCheckpointInterval = flag.Duration("auditCheckpointInterval", time.Minute, "longest time audit records stay unsigned, 0 to disable")
+
+var plaintext = flag.Bool("plaintext", false, "serve trust requests without TLS (insecure)")
+var serverCertFile = flag.String("server_cert_file", "", "PEM service cert issued under the policy cert, generated if empty")
+var serverKeyFile = flag.String("server_key_file", "", "PEM private key for server_cert_file")
+
+var idleTimeout = flag.Duration("idleTimeout", 30 * time.Second, "time a client has to send its request")
+var requestTimeout = flag.Duration("requestTimeout", 60 * time.Second, "time to evaluate a request and answer")
+var maxConcurrent = flag.Int("maxConcurrent", 16, "requests evaluated at once")
+var maxQueue = flag.Int("maxQueue", 64, "requests waiting to be evaluated before new ones are refused")
+var rateLimit = flag.Float64("rateLimit", 0, "trust requests a second each client (client cert or IP address) may make, 0 for no limit")
+var rateBurst = flag.Int("rateBurst", 10, "trust requests a client may make at once under rateLimit")
+var proxyProtocolFrom = flag.String("proxyProtocolFrom", "", "comma separated networks of proxies whose connections start with a PROXY protocol header")
+var adminHost = flag.String("adminHost", "localhost", "address for the admin endpoints")
+var adminPort = flag.String("adminPort", "", "port for the admin endpoints (policy reload, metrics, issuance queries), disabled if empty")
+// The /admin/ endpoints reload and reveal the policy and the issuances.
+// Without --adminTokenFile they answer only loopback clients and
+// simpleserver won't start with --adminHost set to anything else.
+var adminTokenFile = flag.String("adminTokenFile", "", "file with the bearer token the /admin/ endpoints require, required unless adminHost is loopback")
+var policyPollInterval = flag.Duration("policyPollInterval", 10 * time.Second, "how often to check policyFile for changes, 0 to disable")
+var strictPolicy = flag.Bool("strictPolicy", false, "refuse a policy with any statement that fails verification")
+var failureDetail = flag.String("failureDetail", "code", "why a request failed, as sent to clients without a client cert: none, code or full")
+var requireNonce = flag.Bool("requireNonce", false, "fail requests whose evidence doesn't attest to a nonce from this server")
+var nonceLifetime = flag.Duration("nonceLifetime", 2 * time.Minute, "how long a client may take to use a nonce")
+var traceFile = flag.String("traceFile", "", "file for OpenTelemetry spans as JSON, - for stdout, disabled if empty")
+var drainTimeout = flag.Duration("drainTimeout", 30 * time.Second, "time in-flight requests get to finish on SIGTERM")
+
+var certifierService *certservice.CertifierService = nil
+var auditLog *certservice.AuditLog = nil
+var transparencyLog *certservice.TransparencyLog = nil
+var issuanceDB *certservice.IssuanceDB = nil
+var serviceTlsConfig *tls.Config = nil
+var grpcService *grpc.Server = nil
+var httpService *http.Server = nil
+var adminService *http.Server = nil
+var tracerProvider *sdktrace.TracerProvider = nil
+var logger *slog.Logger = nil
+
+// initLog sets the logger for simpleserver, certservice and certlib.
 func initLog() bool {
-        name := *logDir + "/" + *logFile
-        logFiled, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+        level, err := certlib.ParseLogLevel(*logLevel)
         if err != nil {
-                fmt.Printf("Can't open log file\n")
+                fmt.Printf("simpleserver: bad logLevel %q\n", *logLevel)
                 return false
         }
-        logger = log.New(logFiled, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-        logger.Println("Starting simpleserver")
-        return true
-}
-
-
-var policyInitialized bool = false
-var signedPolicyStatements *certprotos.SignedClaimSequence = nil
-
-// There are really only two kinds of initialzed policy now:
-//      policy-key says Measurement[] is-trusted
-//      policy-key says Key[] is-trusted-for-attestation
-
-type measurementPolicyStatement struct {
-        m []byte
-        sc certprotos.SignedClaimMessage
-}
-type platformPolicyStatement struct {
-        pk  certprotos.KeyMessage
-        sc certprotos.SignedClaimMessage
-}
-
-// These are the policy approved program measurements and platform keys.
-var measurementList []measurementPolicyStatement
-var platformList []platformPolicyStatement
-
-func findPolicyFromMeasurement(m []byte) *certprotos.SignedClaimMessage {
-        for i := 0; i < len(measurementList); i++ {
-                if bytes.Equal(m, measurementList[i].m) {
-                        return &measurementList[i].sc
-                }
+        if *logFormat != "text" && *logFormat != "json" {
+                fmt.Printf("simpleserver: logFormat must be text or json\n")
+                return false
         }
-        return nil
-}
-
-func findPolicyFromKey(k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
-        for i := 0; i < len(platformList); i++ {
-                if certlib.SameKey(k, &platformList[i].pk) {
-                        return &platformList[i].sc
+        var w io.Writer = os.Stdout
+        if *enableLog {
+                f, err := os.OpenFile(*logDir + "/" + *logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+                if err != nil {
+                        fmt.Printf("simpleserver: can't open log file: %s\n", err.Error())
+                        return false
                 }
+                w = f
         }
-        return nil
-}
-
-func initPolicy(thePolicyFile string) bool {
-
-        // Debug
-        fmt.Printf("initPolicy\n")
-
-        policySeq, err := os.ReadFile(thePolicyFile)
-        if err != nil {
-                fmt.Println("can't read policy file, ", err)
-                return false
-        }
-
-        // Debug
-        fmt.Printf("Read %d bytes\n", len(policySeq))
-
-        var  claimBlocks *certprotos.BufferSequence = &certprotos.BufferSequence{}
-        err = proto.Unmarshal(policySeq, claimBlocks)
-        if err != nil {
-                fmt.Println("can't parse policy file, ", err)
-                return false
+        logger = certlib.NewLogger(w, level, *logFormat == "json")
+        certlib.SetLogger(logger)
+        certlib.SetLogSensitive(*logSensitive)
+        if *logSensitive {
+                logger.Warn("Logging keys, reports and artifacts in full")
         }
+        logger.Info("Starting simpleserver")
+        return true
+}
 
-        // Debug
-        fmt.Printf("%d policy statements\n", len (claimBlocks.Block))
-
-        for i := 0; i < len(claimBlocks.Block); i++ {
-                var sc *certprotos.SignedClaimMessage =  &certprotos.SignedClaimMessage{}
-                err = proto.Unmarshal(claimBlocks.Block[i], sc)
+// initTracing exports spans to traceFile.
+func initTracing() bool {
+        var w io.Writer = os.Stdout
+        if *traceFile != "-" {
+                f, err := os.OpenFile(*traceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
                 if err != nil {
-                        fmt.Println("can't recover policy rule, ", err)
+                        logger.Error("Can't open trace file", "err", err)
                         return false
                 }
-                vse := certlib.GetVseFromSignedClaim(sc)
-                if vse == nil {
-                        continue
-                }
-                if vse.Subject == nil || vse.Verb == nil || vse.Clause == nil {
-                        continue
-                }
-                if *vse.Verb != "says" {
-                        continue
-                }
-                if vse.Clause.Subject ==nil || vse.Clause.Verb == nil {
-                        continue
-                }
-
-                if *vse.Clause.Verb == "is-trusted-for-attestation" &&
-                                vse.Clause.Subject.GetEntityType() == "key" {
-                        ps := platformPolicyStatement {
-                                pk: *vse.Clause.Subject.Key,
-                                sc:  *sc,
-                        }
-                        platformList = append(platformList, ps)
-                } else if  *vse.Clause.Verb == "is-trusted" &&
-                        vse.Clause.Subject.GetEntityType() == "measurement" {
-                        ps := measurementPolicyStatement {
-                                m: vse.Clause.Subject.Measurement,
-                                sc:  *sc,
-                        }
-                        measurementList = append(measurementList, ps)
-                } else {
-                        continue
-                }
-        }
-
-        // Debug
-        fmt.Printf("\nMeasurement list, %d entries:\n", len(measurementList))
-        for i := 0; i < len(measurementList); i++ {
-                fmt.Printf("\n")
-                certlib.PrintBytes(measurementList[i].m)
-                fmt.Printf("\n")
-                certlib.PrintSignedClaim(&measurementList[i].sc)
-                fmt.Printf("\n")
+                w = f
         }
-        fmt.Printf("\nPlatform list, %d entries:\n", len(platformList))
-        for i := 0; i < len(platformList); i++ {
-                fmt.Printf("\n")
-                certlib.PrintKey(&platformList[i].pk)
-                fmt.Printf("\n")
-                certlib.PrintSignedClaim(&platformList[i].sc)
-                fmt.Printf("\n")
+        exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+        if err != nil {
+                logger.Error("Can't make trace exporter", "err", err)
+                return false
         }
+        tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter),
+                sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "simpleserver"))))
         return true
 }
 
 // At init, we retrieve the policy key and the rules to evaluate
 func initCertifierService() bool {
-        // Debug
-        fmt.Printf("initCertifierService, Policy key file: %s, Policy cert file: %s\n", *policyKeyFile, *policyCertFile)
-
-        if *enableLog {
-                logging = initLog()
+        logger.Debug("initCertifierService", "policy_key_file", *policyKeyFile, "policy_cert_file", *policyCertFile)
+
+        opts := certservice.Options{
+                IdleTimeout: *idleTimeout,
+                RequestTimeout: *requestTimeout,
+                MaxConcurrent: *maxConcurrent,
+                MaxQueue: *maxQueue,
+                RateLimit: *rateLimit,
+                RateBurst: *rateBurst,
+                StrictPolicy: *strictPolicy,
+                FailureDetail: *failureDetail,
+                RequireNonce: *requireNonce,
+                NonceLifetime: *nonceLifetime,
+        }
+        if *traceFile != "" {
+                if !initTracing() {
+                        return false
+                }
+                opts.TracerProvider = tracerProvider
+        }
+        if *adminTokenFile != "" {
+                token, err := os.ReadFile(*adminTokenFile)
+                if err != nil {
+                        logger.Error("Can't read admin token file", "err", err)
+                        return false
+                }
+                opts.AdminToken = strings.TrimSpace(string(token))
+                if opts.AdminToken == "" {
+                        logger.Error("Admin token file is empty", "file", *adminTokenFile)
+                        return false
+                }
         }
 
         serializedKey, err := os.ReadFile(*policyKeyFile)
         if err != nil {
-                fmt.Println("can't read key file, ", err)
+                logger.Error("Can't read key file", "err", err)
                 return false
         }
 
         serializedPolicyCert, err := os.ReadFile(*policyCertFile)
         if err != nil {
-                fmt.Println("can't certkey file, ", err)
-        }
-        policyCert, err = x509.ParseCertificate(serializedPolicyCert)
-        if err != nil {
-                fmt.Println("Can't Parse policy cert, ", err)
+                logger.Error("Can't read policy cert file", "err", err)
                 return false
         }
-
-        err = proto.Unmarshal(serializedKey, &privatePolicyKey)
+        opts.PolicyCert, err = x509.ParseCertificate(serializedPolicyCert)
         if err != nil {
+                logger.Error("Can't parse policy cert", "err", err)
                 return false
         }
 
-        publicPolicyKey = certlib.InternalPublicFromPrivateKey(&privatePolicyKey)
-        if publicPolicyKey == nil {
+        opts.PolicyKey = &certprotos.KeyMessage{}
+        err = proto.Unmarshal(serializedKey, opts.PolicyKey)
+        if err != nil {
+                logger.Error("Can't parse policy key", "err", err)
                 return false
         }
 
-        if *readPolicy && policyFile != nil {
-                policyInitialized = initPolicy(*policyFile)
-                if !policyInitialized {
-                        fmt.Printf("Error: Couldn't initialize policy\n")
+        if *enableLog {
+                auditLog, err = certservice.OpenAuditLog(*logDir + "/" + *auditLogFile, opts.PolicyKey,
+                        *auditCheckpointEvery, *auditCheckpointInterval)
+                if err != nil {
+                        logger.Error("Can't open audit log", "err", err)
                         return false
                 }
-        } else {
-                fmt.Printf("Error: readPolicy must be true\n")
-                return false
+                opts.AuditLog = auditLog
+                opts.AuditRequests = *auditRequests
+                opts.AuditProofs = *auditProofs
         }
-
-        if !certlib.InitSimulatedEnclave() {
-                return false
-        }
-        return true
-}
-
-func AddFactFromSignedClaim(signedClaim *certprotos.SignedClaimMessage,
-                alreadyProved *certprotos.ProvedStatements) bool {
-
-        k := signedClaim.SigningKey
-        tcl := certprotos.VseClause{}
-        if certlib.VerifySignedAssertion(*signedClaim, k, &tcl) {
-                // make sure the saying key in tcl is the same key that signed it
-                if tcl.GetVerb() == "says" && tcl.GetSubject().GetEntityType() == "key" {
-                        if certlib.SameKey(k, tcl.GetSubject().GetKey()) {
-                                alreadyProved.Proved = append(alreadyProved.Proved, &tcl)
-                        } else {
-                                return false
-                        }
+        if *transparencyLogFile != "" {
+                transparencyLog, err = certservice.OpenTransparencyLog(*logDir + "/" + *transparencyLogFile,
+                        opts.PolicyKey)
+                if err != nil {
+                        logger.Error("Can't open transparency log", "err", err)
+                        return false
                 }
-        } else {
-                return false
-        }
-        return true
-}
-
-func AddNewFactsForOePlatformAttestation(publicPolicyKey *certprotos.KeyMessage, alreadyProved *certprotos.ProvedStatements) bool {
-        // At this point, the already_proved should be
-        //    "policyKey is-trusted"
-	//    "The platform-key says the enclave-key speaks-for the measurement"
-	// Add
-	//    "The policy-key says the measurement is-trusted"
-	//    "The policy-key says the platform-key is-trusted-for-attestation"
-	if len(alreadyProved.Proved) < 2 {
-		fmt.Printf("AddNewFactsForOeEvidence, too few initial facts\n")
-		return false
-	}
-	mc := alreadyProved.Proved[1]
-	if mc.Subject == nil || mc.Verb == nil || mc.Clause == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, bad measurement evidence(1)\n")
-		return false
-	}
-	if mc.Clause.Object == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, bad measurement evidence (2)\n")
-		return false
-	}
-	if mc.Clause.Object.GetEntityType() != "measurement" {
-		fmt.Printf("AddNewFactsForOeEvidence, bad measurement evidence (3)\n")
-		return false
-	}
-	prog_m := mc.Clause.Object.Measurement
-	if prog_m == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, bad measurement\n")
-		return false
-	}
-
-	// Get platformKey from  "The platform-key says the enclave-key speaks-for the measurement"
-	kc := alreadyProved.Proved[1]
-	if kc.Subject == nil || kc.Verb == nil || kc.Clause == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, bad platform evidence(1)\n")
-		return false
-	}
-	if kc.Subject.GetEntityType() != "key" {
-		fmt.Printf("AddNewFactsForOeEvidence, bad platform evidence(2)\n")
-		return false
-	}
-	plat_key := kc.Subject.Key
-	if plat_key == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, bad platform key\n")
-		return false
-	}
-
-	signedPolicyKeySaysMeasurementIsTrusted := findPolicyFromMeasurement(prog_m)
-	if signedPolicyKeySaysMeasurementIsTrusted == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, can't find measurement policy\n")
-		fmt.Printf("    Measurement: ")
-		certlib.PrintBytes(prog_m)
-		fmt.Printf("\n")
-		return false
-	}
-
-	signedPolicyKeySaysPlatformKeyIsTrusted := findPolicyFromKey(plat_key)
-	if signedPolicyKeySaysPlatformKeyIsTrusted == nil {
-		fmt.Printf("AddNewFactsForOeEvidence, can't find platform policy\n")
-		return false
-	}
-
-	if !AddFactFromSignedClaim(signedPolicyKeySaysMeasurementIsTrusted, alreadyProved) {
-		fmt.Printf("AddNewFactsForOeEvidence, Couldn't AddFactFromSignedClaim, Error 1\n")
-		return false
-	}
-
-	if !AddFactFromSignedClaim(signedPolicyKeySaysPlatformKeyIsTrusted, alreadyProved) {
-		fmt.Printf("AddNewFactsForOeEvidence, Couldn't AddFactFromSignedClaim, Error 2\n")
-		return false
-	}
-
-	return true
-}
-
-func AddNewFactsForSevEvidence(publicPolicyKey *certprotos.KeyMessage,
-                alreadyProved *certprotos.ProvedStatements) bool {
-        // At this point, the already_proved should be
-        //    "policyKey is-trusted"
-        //    "The ARK-key says the ARK-key is-trusted-for-attestation"
-        //    "The ARK-key says the ASK-key is-trusted-for-attestation"
-        //    "The ASK-key says the VCEK-key is-trusted-for-attestation"
-        //    "VCEK says the enclave-key speaks-for the measurement"
-        // Add
-        //    "The policy-key says the ARK-key is-trusted-for-attestation"
-        //    "The policy-key says the measurement is-trusted"
-
-        // Get measurement from  "VCEK says the enclave-key speaks-for the measurement"
-	if len(alreadyProved.Proved) < 5 {
-                fmt.Printf("AddNewFactsForSevEvidence, too few initial facts\n")
-                return false
-	}
-        mc := alreadyProved.Proved[4]
-        if mc.Subject == nil || mc.Verb == nil || mc.Clause == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, bad measurement evidence(1)\n")
-                return false
+                opts.TransparencyLog = transparencyLog
         }
-        if mc.Clause.Object == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, bad measurement evidence (2)\n")
-                return false
-        }
-        if mc.Clause.Object.GetEntityType() != "measurement" {
-                fmt.Printf("AddNewFactsForSevEvidence, bad measurement evidence (3)\n")
-                return false
-        }
-        prog_m := mc.Clause.Object.Measurement
-        if prog_m == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, bad measurement\n")
-                return false
+        if *issuanceDbFile != "" {
+                issuanceDB, err = certservice.OpenIssuanceDB(*logDir + "/" + *issuanceDbFile)
+                if err != nil {
+                        logger.Error("Can't open issuance database", "err", err)
+                        return false
+                }
+                opts.IssuanceDB = issuanceDB
         }
+        opts.ProofBundleDir = *proofBundleDir
 
-        // Get platformKey from  "The ARK-key says the ARK-key is-trusted-for-attestation"
-        kc := alreadyProved.Proved[1]
-        if kc.Subject == nil || kc.Verb == nil || kc.Clause == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, bad platform evidence(1)\n")
-                return false
-        }
-        if kc.Subject.GetEntityType() != "key" {
-                fmt.Printf("AddNewFactsForSevEvidence, bad platform evidence(2)\n")
+        if !*readPolicy || policyFile == nil {
+                logger.Error("readPolicy must be true")
                 return false
         }
-        plat_key := kc.Subject.Key
-        if plat_key == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, bad platform key\n")
+        opts.Policy, err = os.ReadFile(*policyFile)
+        if err != nil {
+                logger.Error("Can't read policy file", "err", err)
                 return false
         }
 
-        signedPolicyKeySaysMeasurementIsTrusted := findPolicyFromMeasurement(prog_m)
-        if signedPolicyKeySaysMeasurementIsTrusted == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, can't find measurement policy\n")
+        certifierService, err = certservice.NewCertifierService(opts)
+        if err != nil {
+                logger.Error("Couldn't initialize policy", "err", err)
                 return false
         }
+        logger.Info("Self-test passed")
 
-        signedPolicyKeySaysPlatformKeyIsTrusted := findPolicyFromKey(plat_key)
-        if signedPolicyKeySaysPlatformKeyIsTrusted == nil {
-                fmt.Printf("AddNewFactsForSevEvidence, can't find platform policy\n")
-                return false
-        }
+        certifierService.Policy().LogReport(logger)
 
-        if !AddFactFromSignedClaim(signedPolicyKeySaysPlatformKeyIsTrusted, alreadyProved) {
-                fmt.Printf("Couldn't AddFactFromSignedClaim, Error 2\n")
+        if !certlib.InitSimulatedEnclave() {
                 return false
         }
 
-        if !AddFactFromSignedClaim(signedPolicyKeySaysMeasurementIsTrusted, alreadyProved) {
-                fmt.Printf("Couldn't AddFactFromSignedClaim, Error 1\n")
-                return false
+        if !*plaintext {
+                serviceTlsConfig, err = certifierService.ServiceTlsConfig(*serverHost,
+                        *serverCertFile, *serverKeyFile)
+                if err != nil {
+                        logger.Error("Couldn't initialize TLS", "err", err)
+                        return false
+                }
         }
-
         return true
 }
 
-func AddNewFactsForAbbreviatedPlatformAttestation(publicPolicyKey *certprotos.KeyMessage,
-        alreadyProved *certprotos.ProvedStatements) bool {
-
-        // At this point, already proved should contain
-        //      "policyKey is-trusted"
-        //      "platformKey says attestationKey is-trusted-for-attestation
-        //      "attestKey says enclaveKey speaks-for measurement"
-        // Add
-        //      "policyKey says platformKey is-trusted-for-attestation"
-        //      "policyKey says measurement is-trusted"
-        // Get platform measurement statement and platform statement
-        // Find the corresponding "measurement is-trusted" in measurements
-        //      This is signedPolicyKeySaysMeasurementIsTrusted
-        //      Add it
-        // Find the corresponding "platformKey is-trusted" in platforms 
-        //      This is signedPolicyKeySaysPlatformKeyIsTrusted
-        //      Add it
-        if len(alreadyProved.Proved) != 3 {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, Error 1\n")
-                return false
-        }
-
-        // Get measurement from "attestKey says enclaveKey speaks-for measurement"
-        mc := alreadyProved.Proved[2]
-        if mc.Subject == nil || mc.Verb == nil || mc.Clause == nil {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, bad measurement evidence(1)\n")
-                return false
-        }
-        if mc.Clause.Object == nil {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, bad measurement evidence (2)\n")
-                return false
-        }
-        if mc.Clause.Object.GetEntityType() != "measurement" {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, bad measurement evidence (3)\n")
-                return false
-        }
-        prog_m := mc.Clause.Object.Measurement
-
-        // Get platformKey from "platformKey says attestationKey is-trusted-for-attestation
-        kc := alreadyProved.Proved[1]
-        if kc.Subject == nil || kc.Verb == nil || kc.Clause == nil {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, bad platform evidence(1)\n")
-                return false
-        }
-        if kc.Subject.GetEntityType() != "key" {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, bad platform evidence(2)\n")
-                return false
-        }
-        plat_key := kc.Subject.Key
-
-        signedPolicyKeySaysMeasurementIsTrusted := findPolicyFromMeasurement(prog_m)
-        if signedPolicyKeySaysMeasurementIsTrusted == nil {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, can't find measurement policy\n")
-                return false
-        }
-        signedPolicyKeySaysPlatformKeyIsTrusted := findPolicyFromKey(plat_key)
-        if signedPolicyKeySaysMeasurementIsTrusted == nil {
-                fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation, can't find platform policy\n")
-                return false
-        }
-
-        // Debug
-        fmt.Printf("\nPolicy:\n")
-        certlib.PrintSignedClaim(signedPolicyKeySaysMeasurementIsTrusted)
-        fmt.Printf("\n")
-        certlib.PrintSignedClaim(signedPolicyKeySaysPlatformKeyIsTrusted)
-        fmt.Printf("\n")
-
-        if !AddFactFromSignedClaim(signedPolicyKeySaysPlatformKeyIsTrusted, alreadyProved) {
-                fmt.Printf("Couldn't AddFactFromSignedClaim, Error 2\n")
-                return false
-        }
-
-        if !AddFactFromSignedClaim(signedPolicyKeySaysMeasurementIsTrusted, alreadyProved) {
-                fmt.Printf("Couldn't AddFactFromSignedClaim, Error 1\n")
-                return false
+func grpcServer(sock net.Listener) {
+        logger.Info("grpc TrustService listening", "addr", sock.Addr().String(), "tls", !*plaintext)
+        err := grpcService.Serve(sock)
+        if err != nil {
+                logger.Error("grpc serve error", "err", err)
         }
-
-        return true
 }
 
-func AddNewFactsForAugmentedPlatformAttestation(publicPolicyKey *certprotos.KeyMessage,
-        alreadyProved *certprotos.ProvedStatements) bool {
-
-        // At this point, already proved should contain
-        //      "policyKey is-trusted"
-        //      "policyKey says attestKey is-trusted-for-attestation"
-        //      "attestKey says enclaveKey speaks-for measurement"
-        // Add
-        //      "policyKey says measurement is-trusted"
-        // Get platform measurement statement and platform statement
-        // Find the corresponding "measurement is-trusted" in measurements
-        //      This is signedPolicyKeySaysMeasurementIsTrusted
-        //      Add it
-        if len(alreadyProved.Proved) != 3 {
-                fmt.Printf("AddNewFactsForAugmentedPlatformAttestation, Error 1\n")
-                return false
-        }
-
-        // Get measurement from "attestKey says enclaveKey speaks-for measurement"
-        mc := alreadyProved.Proved[2]
-        if mc.Subject == nil || mc.Verb == nil || mc.Clause == nil {
-                fmt.Printf("AddNewFactsForAugmentedPlatformAttestation, bad measurement evidence(1)\n")
-                return false
-        }
-        if mc.Clause.Object == nil {
-                fmt.Printf("AddNewFactsForAugmentedPlatformAttestation, bad measurement evidence (2)\n")
-                return false
-        }
-        if mc.Clause.Object.GetEntityType() != "measurement" {
-                fmt.Printf("AddNewFactsForAugmentedPlatformAttestation, bad measurement evidence (3)\n")
-                return false
-        }
-        prog_m := mc.Clause.Object.Measurement
-
-        signedPolicyKeySaysMeasurementIsTrusted := findPolicyFromMeasurement(prog_m)
-        if signedPolicyKeySaysMeasurementIsTrusted == nil {
-                fmt.Printf("AddNewFactsForAugmentedPlatformAttestation, can't find measurement policy\n")
-                return false
+func httpServer(sock net.Listener) {
+        var err error
+        if *plaintext {
+                logger.Warn("http gateway listening, TLS is disabled", "addr", sock.Addr().String())
+                err = httpService.Serve(sock)
+        } else {
+                logger.Info("https gateway listening", "addr", sock.Addr().String())
+                err = httpService.ServeTLS(sock, "", "")
         }
-
-        // Debug
-        fmt.Printf("\nPolicy:\n")
-        certlib.PrintSignedClaim(signedPolicyKeySaysMeasurementIsTrusted)
-        fmt.Printf("\n")
-
-        if !AddFactFromSignedClaim(signedPolicyKeySaysMeasurementIsTrusted, alreadyProved) {
-                fmt.Printf("Couldn't AddFactFromSignedClaim, Error 1\n")
-                return false
+        if err != nil && err != http.ErrServerClosed {
+                logger.Error("http serve error", "err", err)
         }
-
-        return true
-}
-
-// Returns toProve and proof steps
-func ConstructProofFromOeEvidence(publicPolicyKey *certprotos.KeyMessage, purpose string, alreadyProved certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
-
-        // At this point, the evidence should be
-        //      "policyKey is-trusted"
-        //      "platform-key says enclaveKey speaks-for measurement
-        //      "policyKey says measurement is-trusted"
-        //      "policyKey says platformKey is-trusted-for-attestation"
-
-	// Debug
-	fmt.Printf("ConstructProofFromOeEvidence, %d statements\n", len(alreadyProved.Proved))
-	for i := 0; i < len(alreadyProved.Proved);  i++ {
-		certlib.PrintVseClause(alreadyProved.Proved[i])
-		fmt.Printf("\n")
-	}
-
-	if len(alreadyProved.Proved) < 4 {
-		fmt.Printf("ConstructProofFromOeEvidence: too few statements\n")
-		return nil, nil
-	}
-	policyKeyIsTrusted :=  alreadyProved.Proved[0]
-	platformSaysEnclaveKeySpeaksForMeasurement :=  alreadyProved.Proved[1]
-	if platformSaysEnclaveKeySpeaksForMeasurement.Clause == nil {
-		fmt.Printf("ConstructProofFromOeEvidence: can't get enclaveKeySpeaksForMeasurement\n")
-		return nil, nil
-	}
-	enclaveKeySpeaksForMeasurement :=  platformSaysEnclaveKeySpeaksForMeasurement.Clause
-	policyKeySaysMeasurementIsTrusted :=  alreadyProved.Proved[2]
-	if policyKeyIsTrusted == nil || enclaveKeySpeaksForMeasurement == nil ||
-			policyKeySaysMeasurementIsTrusted == nil {
-		fmt.Printf("ConstructProofFromOeEvidence: Error 4\n")
-		return nil, nil
-	}
-
-	policyKeySaysPlatformKeyIsTrustedForAttestation := alreadyProved.Proved[3]
-	if policyKeySaysPlatformKeyIsTrustedForAttestation.Clause == nil {
-		fmt.Printf("ConstructProofFromOeEvidence: Can't get platformKeyIsTrustedForAttestation\n")
-		return nil, nil
-	}
-	platformKeyIsTrustedForAttestation := policyKeySaysPlatformKeyIsTrustedForAttestation.Clause
-
-        proof := &certprotos.Proof{}
-        r1 := int32(1)
-        r3 := int32(3)
-        r6 := int32(6)
-        r7 := int32(7)
-
-	enclaveKey := enclaveKeySpeaksForMeasurement.Subject
-	if enclaveKey == nil || enclaveKey.GetEntityType() != "key" {
-		fmt.Printf("ConstructProofFromOeEvidence: Bad enclave key\n")
-		return nil, nil
-	}
-        var toProve *certprotos.VseClause = nil
-	if purpose == "authentication" {
-		verb := "is-trusted-for-authentication"
-		toProve = certlib.MakeUnaryVseClause(enclaveKey, &verb)
-	} else {
-		verb := "is-trusted-for-attestation"
-		toProve = certlib.MakeUnaryVseClause(enclaveKey, &verb)
-	}
-
-	measurementIsTrusted := policyKeySaysMeasurementIsTrusted.Clause
-	if measurementIsTrusted == nil {
-		fmt.Printf("ConstructProofFromOeEvidence: Can't get measurement\n")
-		return nil, nil
-	}
-	ps1 := certprotos.ProofStep {
-		S1: policyKeyIsTrusted,
-		S2: policyKeySaysMeasurementIsTrusted,
-		Conclusion: measurementIsTrusted,
-		RuleApplied: &r3,
-	}
-	proof.Steps = append(proof.Steps, &ps1)
-
-	ps2 := certprotos.ProofStep {
-		S1: policyKeyIsTrusted,
-		S2: policyKeySaysPlatformKeyIsTrustedForAttestation,
-		Conclusion: platformKeyIsTrustedForAttestation,
-		RuleApplied: &r3,
-	}
-	proof.Steps = append(proof.Steps, &ps2)
-
-	ps3 := certprotos.ProofStep {
-		S1: platformKeyIsTrustedForAttestation,
-		S2: platformSaysEnclaveKeySpeaksForMeasurement,
-		Conclusion: enclaveKeySpeaksForMeasurement,
-		RuleApplied: &r6,
-	}
-	proof.Steps = append(proof.Steps, &ps3)
-
-	// measurement is-trusted and enclaveKey speaks-for measurement -->
-	//	enclaveKey is-trusted-for-authentication (r1) or
-	//	enclaveKey is-trusted-for-attestation (r7)
-	if purpose == "authentication" {
-		ps4 := certprotos.ProofStep {
-			S1: measurementIsTrusted,
-			S2: enclaveKeySpeaksForMeasurement,
-			Conclusion: toProve,
-			RuleApplied: &r1,
-		}
-		proof.Steps = append(proof.Steps, &ps4)
-	} else {
-		ps4 := certprotos.ProofStep {
-			S1: measurementIsTrusted,
-			S2: enclaveKeySpeaksForMeasurement,
-			Conclusion: toProve,
-			RuleApplied: &r7,
-		}
-		proof.Steps = append(proof.Steps, &ps4)
-	}
-
-        return toProve, proof
 }
 
-// Returns toProve and proof steps
-func ConstructProofFromFullVseEvidence(publicPolicyKey *certprotos.KeyMessage, purpose string,
-        alreadyProved certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
-
-        // At this point, alreadyProved should be
-        //      "policyKey is-trusted"
-        //      "platformKey says attestationKey is-trusted-for-attestation"
-        //      "attestKey says enclaveKey speaks-for measurement
-        //      "policyKey says platformKey is-trusted-for-attestation"
-        //      "policyKey says measurement is-trusted"
-
-        // Debug
-        fmt.Printf("ConstructProofFromFullVseEvidence entries %d\n", len(alreadyProved.Proved))
-
-        proof := &certprotos.Proof{}
-        r1 := int32(1)
-        r3 := int32(3)
-        r5 := int32(5)
-        r6 := int32(6)
-        r7 := int32(7)
-
-        policyKeyIsTrusted := alreadyProved.Proved[0]
-        policyKeySaysMeasurementIsTrusted := alreadyProved.Proved[4]
-        measurementIsTrusted := policyKeySaysMeasurementIsTrusted.Clause
-        ps1 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysMeasurementIsTrusted,
-                Conclusion: measurementIsTrusted,
-                RuleApplied: &r3,
-        }
-        proof.Steps = append(proof.Steps, &ps1)
-
-        policyKeySaysPlatformKeyIsTrusted := alreadyProved.Proved[3]
-        platformKeyIsTrusted := policyKeySaysPlatformKeyIsTrusted.Clause
-        ps2 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysPlatformKeyIsTrusted,
-                Conclusion: platformKeyIsTrusted,
-                RuleApplied: &r5,
-        }
-        proof.Steps = append(proof.Steps, &ps2)
-
-        platformKeySaysAttestKeyIsTrusted := alreadyProved.Proved[1]
-        attestKeyIsTrusted := platformKeySaysAttestKeyIsTrusted.Clause
-        ps3 := certprotos.ProofStep {
-                S1: platformKeyIsTrusted,
-                S2: platformKeySaysAttestKeyIsTrusted,
-                Conclusion: attestKeyIsTrusted,
-                RuleApplied: &r5,
-        }
-        proof.Steps = append(proof.Steps, &ps3)
-
-        attestKeySaysEnclaveKeySpeaksForMeasurement := alreadyProved.Proved[2]
-        enclaveKeySpeaksForMeasurement := attestKeySaysEnclaveKeySpeaksForMeasurement.Clause
-        ps4 := certprotos.ProofStep {
-        S1: attestKeyIsTrusted,
-        S2: attestKeySaysEnclaveKeySpeaksForMeasurement,
-        Conclusion: enclaveKeySpeaksForMeasurement,
-        RuleApplied: &r6,
-        }
-        proof.Steps = append(proof.Steps, &ps4)
-
-        var toProve *certprotos.VseClause = nil
-        isTrustedForAuth := "is-trusted-for-authentication"
-        isTrustedForAttest:= "is-trusted-for-attestation"
-        if  purpose == "attestation" {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAttest)
-                ps5 := certprotos.ProofStep {
-                S1: measurementIsTrusted,
-                S2: enclaveKeySpeaksForMeasurement,
-                Conclusion: toProve,
-                RuleApplied: &r7,
-                }
-                proof.Steps = append(proof.Steps, &ps5)
+func adminServer(sock net.Listener) {
+        var err error
+        if *plaintext {
+                logger.Warn("admin endpoints listening, TLS is disabled", "addr", sock.Addr().String())
+                err = adminService.Serve(sock)
         } else {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAuth)
-                ps5 := certprotos.ProofStep {
-                S1: measurementIsTrusted,
-                S2: enclaveKeySpeaksForMeasurement,
-                Conclusion: toProve,
-                RuleApplied: &r1,
-                }
-                proof.Steps = append(proof.Steps, &ps5)
+                logger.Info("admin endpoints listening", "addr", sock.Addr().String())
+                err = adminService.ServeTLS(sock, "", "")
         }
-
-        return toProve, proof
-}
-
-// Returns toProve and proof steps
-func ConstructProofFromShortVseEvidence(publicPolicyKey *certprotos.KeyMessage, purpose string,
-        alreadyProved certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
-
-        // At this point, alreadyProved should be
-        //      "policyKey is-trusted"
-        //      "platformKey says attestationKey is-trusted-for-attestation"
-        //      "attestKey says enclaveKey speaks-for measurement
-        //      "policyKey says measurement is-trusted"
-
-        // Debug
-        fmt.Printf("ConstructProofFromFullVseEvidence entries %d\n", len(alreadyProved.Proved))
-
-        proof := &certprotos.Proof{}
-        r1 := int32(1)
-        r3 := int32(3)
-        r5 := int32(5)
-        r6 := int32(6)
-        r7 := int32(7)
-
-        policyKeyIsTrusted := alreadyProved.Proved[0]
-        policyKeySaysMeasurementIsTrusted := alreadyProved.Proved[3]
-        measurementIsTrusted := policyKeySaysMeasurementIsTrusted.Clause
-        ps1 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysMeasurementIsTrusted,
-                Conclusion: measurementIsTrusted,
-                RuleApplied: &r3,
-        }
-        proof.Steps = append(proof.Steps, &ps1)
-
-        policyKeySaysAttestKeyIsTrusted := alreadyProved.Proved[1]
-        attestKeyIsTrusted := policyKeySaysAttestKeyIsTrusted.Clause
-        ps3 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysAttestKeyIsTrusted,
-                Conclusion: attestKeyIsTrusted,
-                RuleApplied: &r5,
-        }
-        proof.Steps = append(proof.Steps, &ps3)
-
-        attestKeySaysEnclaveKeySpeaksForMeasurement := alreadyProved.Proved[2]
-        enclaveKeySpeaksForMeasurement := attestKeySaysEnclaveKeySpeaksForMeasurement.Clause
-        ps4 := certprotos.ProofStep {
-        S1: attestKeyIsTrusted,
-        S2: attestKeySaysEnclaveKeySpeaksForMeasurement,
-        Conclusion: enclaveKeySpeaksForMeasurement,
-        RuleApplied: &r6,
+        if err != nil && err != http.ErrServerClosed {
+                logger.Error("admin serve error", "err", err)
         }
-        proof.Steps = append(proof.Steps, &ps4)
+}
 
-        var toProve *certprotos.VseClause = nil
-        isTrustedForAuth := "is-trusted-for-authentication"
-        isTrustedForAttest:= "is-trusted-for-attestation"
-        if  purpose == "attestation" {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAttest)
-                ps5 := certprotos.ProofStep {
-                S1: measurementIsTrusted,
-                S2: enclaveKeySpeaksForMeasurement,
-                Conclusion: toProve,
-                RuleApplied: &r7,
+func reportReload(err error) {
+        if err != nil {
+                logger.Warn("Policy reload rejected, keeping the old policy", "err", err)
+                if ready := certifierService.Ready(); ready != nil {
+                        logger.Error("Not ready", "err", ready)
                 }
-                proof.Steps = append(proof.Steps, &ps5)
         } else {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAuth)
-                ps5 := certprotos.ProofStep {
-                S1: measurementIsTrusted,
-                S2: enclaveKeySpeaksForMeasurement,
-                Conclusion: toProve,
-                RuleApplied: &r1,
-                }
-                proof.Steps = append(proof.Steps, &ps5)
+                certifierService.Policy().LogReport(logger)
         }
-
-        return toProve, proof
 }
 
-func ConstructProofFromSevEvidence(publicPolicyKey *certprotos.KeyMessage,
-		purpose string, alreadyProved certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
-        // At this point, the already_proved should be
-        //    0 : "policyKey is-trusted"
-        //    1: "The ARK-key says the ARK-key is-trusted-for-attestation"
-        //    2: "The ARK-key says the ASK-key is-trusted-for-attestation"
-        //    3: "The ASK-key says the VCEK-key is-trusted-for-attestation"
-        //    4: "VCEK says the enclave-key speaks-for the measurement
-        //    5: "The policyKey says the ARK-key is-trusted-for-attestation
-        //    6: "policyKey says measurement is-trusted"
-
-        // Proof is:
-        //    "policyKey is-trusted" AND policyKey says measurement is-trusted" -->
-        //        "the measurement is-trusted" (R3)
-        //    "policyKey is-trusted" AND
-        //        "policy-key says the ARK-key is-trusted-for-attestation" -->
-        //        "the ARK-key is-trusted-for-attestation" (R3)
-        //    "the ARK-key is-trusted-for-attestation" AND
-        //        "The ARK-key says the ASK-key is-trusted-for-attestation" -->
-        //        "the ASK-key is-trusted-for-attestation" (R5)
-        //    "the ASK-key is-trusted-for-attestation" AND
-        //        "the ASK-key says the VCEK-key is-trusted-for-attestation" -->
-        //        "the VCEK-key is-trusted-for-attestation" (R5)
-        //    "the VCEK-key is-trusted-for-attestation" AND
-        //        "the VCEK-key says the enclave-key speaks-for the measurement" -->
-        //        "enclave-key speaks-for the measurement"  (R6)
-        //    "enclave-key speaks-for the measurement" AND "the measurement is-trusted" -->
-        //        "the enclave key is-trusted-for-authentication" (R1) OR
-        //        "the enclave key is-trusted-for-attestation" (R7)
-
-        // Debug
-        fmt.Printf("ConstructProofFromSevEvidence entries %d\n", len(alreadyProved.Proved))
-
-        proof := &certprotos.Proof{}
-        r1 := int32(1)
-        r3 := int32(3)
-        r5 := int32(5)
-        r6 := int32(6)
-        r7 := int32(7)
-
-        if len(alreadyProved.Proved) != 7 {
-                fmt.Printf("ConstructProofFromSevEvidence: Wrong number of proved statements\n")
-                return nil, nil
-        }
-        policyKeyIsTrusted := alreadyProved.Proved[0]
-        if policyKeyIsTrusted == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get policyKey is trusted\n")
-                return nil, nil
-        }
-        policyKeySaysMeasurementIsTrusted := alreadyProved.Proved[6]
-        if policyKeySaysMeasurementIsTrusted == nil  || policyKeySaysMeasurementIsTrusted.Clause == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get measurementIsTrusted (1)\n")
-                return nil, nil
-        }
-        measurementIsTrusted := policyKeySaysMeasurementIsTrusted.Clause
-        if measurementIsTrusted == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get measurementIsTrusted (2)\n")
-                return nil, nil
-        }
-        vcertSaysEnclaveKeySpeaksForMeasurement := alreadyProved.Proved[4]
-        if vcertSaysEnclaveKeySpeaksForMeasurement == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get attestation\n")
-                return nil, nil
-        }
-        policyKeySaysArkKeyIsTrustedForAttestation := alreadyProved.Proved[5]
-        if policyKeySaysArkKeyIsTrustedForAttestation == nil  ||
-                        policyKeySaysArkKeyIsTrustedForAttestation.Clause == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get policyKeySaysArkKeyIsTrustedForAttestation\n")
-                return nil, nil
-        }
-        arkIsTrustedForAttestation := policyKeySaysArkKeyIsTrustedForAttestation.Clause
-        arkKeySaysAskKeyIsTrustedForAttestation := alreadyProved.Proved[2]
-        if arkKeySaysAskKeyIsTrustedForAttestation == nil  ||
-                        arkKeySaysAskKeyIsTrustedForAttestation.Clause == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get arkKeySaysAskKeyIsTrustedForAttestation\n")
-                return nil, nil
-        }
-        askKeyIsTrustedForAttestation:= arkKeySaysAskKeyIsTrustedForAttestation.Clause
-        askKeySaysVcertKeyIsTrustedForAttestation := alreadyProved.Proved[3]
-        if askKeySaysVcertKeyIsTrustedForAttestation == nil  || askKeySaysVcertKeyIsTrustedForAttestation.Clause == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get askKeySaysVcertKeyIsTrustedForAttestation\n")
-                return nil, nil
-        }
-        vcertKeyIsTrusted := askKeySaysVcertKeyIsTrustedForAttestation.Clause
-        if vcertKeyIsTrusted == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get vcertKeyIsTrustedForAttestation\n")
-                return nil, nil
-        }
-        enclaveKeySpeaksForMeasurement := vcertSaysEnclaveKeySpeaksForMeasurement.Clause
-        if vcertSaysEnclaveKeySpeaksForMeasurement.Clause == nil {
-                fmt.Printf("ConstructProofFromSevEvidence: Can't get enclaveKeySpeaksForMeasurement\n")
-                return nil, nil
-        }
-
-        //    "policyKey is-trusted" AND policyKey says measurement is-trusted" -->
-        //        "the measurement is-trusted" (R3)
-        ps1 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysMeasurementIsTrusted,
-                Conclusion: measurementIsTrusted,
-                RuleApplied: &r3,
+// reloadOnHangup reloads the policy on SIGHUP.
+func reloadOnHangup() {
+        sigs := make(chan os.Signal, 1)
+        signal.Notify(sigs, syscall.SIGHUP)
+        for range sigs {
+                reportReload(certifierService.ReloadPolicyFile(*policyFile))
         }
-        proof.Steps = append(proof.Steps, &ps1)
+}
 
-        //    "policyKey is-trusted" AND
-        //        "policy-key says the ARK-key is-trusted-for-attestation" -->
-        //        "the ARK-key is-trusted-for-attestation" (R5)
-        ps2 := certprotos.ProofStep {
-                S1: policyKeyIsTrusted,
-                S2: policyKeySaysArkKeyIsTrustedForAttestation,
-                Conclusion: arkIsTrustedForAttestation,
-                RuleApplied: &r5,
+// shutdown waits for SIGTERM or SIGINT, then stops taking requests and
+// gives the ones in flight drainTimeout to finish.
+func shutdown(done chan bool) {
+        sigs := make(chan os.Signal, 1)
+        signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+        sig := <-sigs
+        logger.Info("Draining", "signal", sig.String())
+
+        ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+        defer cancel()
+        if httpService != nil {
+                go httpService.Shutdown(ctx)
+        }
+        if adminService != nil {
+                go adminService.Shutdown(ctx)
+        }
+        if grpcService != nil {
+                go func() {
+                        <-ctx.Done()
+                        grpcService.Stop()
+                }()
+                go grpcService.GracefulStop()
+        }
+        err := certifierService.Shutdown(ctx)
+        if err != nil {
+                logger.Warn("Requests still running", "drain_timeout", drainTimeout.String())
         }
-        proof.Steps = append(proof.Steps, &ps2)
-
-        //    "the ARK-key is-trusted-for-attestation" AND
-        //        "The ARK-key says the ASK-key is-trusted-for-attestation" -->
-        //        "the ASK-key is-trusted-for-attestation" (R5)
-        ps3 := certprotos.ProofStep {
-                S1: arkIsTrustedForAttestation,
-                S2: arkKeySaysAskKeyIsTrustedForAttestation,
-                Conclusion: askKeyIsTrustedForAttestation,
-                RuleApplied: &r5,
+        if transparencyLog != nil {
+                transparencyLog.Close()
         }
-        proof.Steps = append(proof.Steps, &ps3)
-
-        //    "the ASK-key is-trusted-for-attestation" AND
-        //        "the ASK-key says the VCEK-key is-trusted-for-attestation" -->
-        //        "the VCEK-key is-trusted-for-attestation" (R5)
-        ps4 := certprotos.ProofStep {
-                S1: askKeyIsTrustedForAttestation,
-                S2: askKeySaysVcertKeyIsTrustedForAttestation,
-                Conclusion: vcertKeyIsTrusted,
-                RuleApplied: &r5,
+        if issuanceDB != nil {
+                issuanceDB.Close()
         }
-        proof.Steps = append(proof.Steps, &ps4)
-
-        //    "the VCEK-key is-trusted-for-attestation" AND
-        //        "the VCEK-key says the enclave-key speaks-for the measurement" -->
-        //        "enclave-key speaks-for the measurement"  (R6)
-        ps5 := certprotos.ProofStep {
-                S1: vcertKeyIsTrusted,
-                S2: vcertSaysEnclaveKeySpeaksForMeasurement,
-                Conclusion: enclaveKeySpeaksForMeasurement,
-                RuleApplied: &r6,
+        if tracerProvider != nil {
+                tracerProvider.Shutdown(context.Background())
         }
-        proof.Steps = append(proof.Steps, &ps5)
-
-        //    "measurement-is-trusted AND "enclave-key speaks-for the measurement" -->
-        //        "the enclave key is-trusted-for-authentication" (R1) OR
-        //        "the enclave key is-trusted-for-attestation" (R7)
-        var toProve *certprotos.VseClause = nil
-        isTrustedForAuth := "is-trusted-for-authentication"
-        isTrustedForAttest:= "is-trusted-for-attestation"
-        if  purpose == "attestation" {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAttest)
-                ps6 := certprotos.ProofStep {
-                        S1: measurementIsTrusted,
-                        S2: enclaveKeySpeaksForMeasurement,
-                        Conclusion: toProve,
-                        RuleApplied: &r7,
-                }
-                proof.Steps = append(proof.Steps, &ps6)
-        } else {
-                toProve =  certlib.MakeUnaryVseClause(enclaveKeySpeaksForMeasurement.Subject,
-                        &isTrustedForAuth)
-                ps7 := certprotos.ProofStep {
-                        S1: measurementIsTrusted,
-                        S2: enclaveKeySpeaksForMeasurement,
-                        Conclusion: toProve,
-                        RuleApplied: &r1,
+        if auditLog != nil {
+                err = auditLog.Close()
+                if err != nil {
+                        logger.Error("Can't close the audit log", "err", err)
                 }
-                proof.Steps = append(proof.Steps, &ps7)
         }
-
-        return toProve, proof
+        done <- true
 }
 
+func server(serverAddr string, arg string) {
 
-//      ConstructProofFromRequest first checks evidence and make sure each evidence
-//            component is verified and it put in alreadyProved Statements
-//      Next, alreadyProved is augmented to include additional true statements
-//            required for the proof
-//      Finally a proof is constructed
-//
-//      Returns the proof goal (toProve), the proof steps (proof), 
-//            and a list of true statements (alreadyProved)
-func ConstructProofFromRequest(evidenceType string, support *certprotos.EvidencePackage, purpose string) (*certprotos.VseClause, *certprotos.Proof, *certprotos.ProvedStatements) {
-
-        // Debug
-        fmt.Printf("\nConstructProofFromRequest\n")
-        fmt.Printf("Submitted evidence type: %s\n", evidenceType)
-
-        if support == nil {
-                fmt.Printf("Empty support\n")
-                return nil, nil, nil
+        if initCertifierService() != true {
+                logger.Error("Failed to initialize server")
+                os.Exit(1)
         }
 
-        if support.ProverType == nil {
-                fmt.Printf("No prover type\n")
-                return nil, nil, nil
-        }
+        var sock net.Listener
+        var err error
 
-        if support.GetProverType() != "vse-verifier" {
-                fmt.Printf("Only vse verifier supported\n")
-                return nil, nil, nil
+        proxies, err := certservice.ParseNetworks(*proxyProtocolFrom)
+        if err != nil {
+                logger.Error("Bad --proxyProtocolFrom", "err", err)
+                return
         }
-
-        alreadyProved := &certprotos.ProvedStatements{}
-        var toProve *certprotos.VseClause = nil
-        var proof *certprotos.Proof = nil
-
-        // Debug
-        fmt.Printf("%d fact assertions in evidence\n", len(support.FactAssertion))
-        for i := 0; i < len(support.FactAssertion); i++ {
-                fmt.Printf("Type: %s\n",  support.FactAssertion[i].GetEvidenceType())
-                if support.FactAssertion[i].GetEvidenceType() == "signed-claim" {
-                        var sc certprotos.SignedClaimMessage
-                        err := proto.Unmarshal(support.FactAssertion[i].SerializedEvidence, &sc)
-                        if err != nil {
-                                fmt.Printf("Can't unmarshal\n");
-                        } else {
-                        fmt.Printf("Clause: ")
-                        vse:= certlib.GetVseFromSignedClaim(&sc)
-                        certlib.PrintVseClause(vse)
-                        }
-                        fmt.Println("")
-                } else if support.FactAssertion[i].GetEvidenceType() == "signed-vse-attestation-report" {
-                        fmt.Printf("Signed report\n")
-                } else if support.FactAssertion[i].GetEvidenceType() == "cert" {
-                        fmt.Printf("Cert\n")
-                } else if support.FactAssertion[i].GetEvidenceType() == "oe-attestation-report" {
-                        fmt.Printf("oe-attestation-report\n")
-                } else if support.FactAssertion[i].GetEvidenceType() == "sev-attestation" {
-                        fmt.Printf("sev-attestation\n")
-                } else if support.FactAssertion[i].GetEvidenceType() == "pem-cert-chain" {
-                        fmt.Printf("pem-cert-chain\n")
-                } else {
-                        fmt.Printf("Invalid evidence type\n")
-                        return nil, nil, nil
+        // listen listens for clients, behind proxies if there are any.
+        listen := func(addr string) (net.Listener, error) {
+                l, err := net.Listen("tcp", addr)
+                if err != nil || len(proxies) == 0 {
+                        return l, err
                 }
+                return certifierService.ProxyListener(l, proxies, *idleTimeout), nil
         }
 
-        if !certlib.InitProvedStatements(*publicPolicyKey, support.FactAssertion, alreadyProved) {
-                fmt.Printf("certlib.InitProvedStatements failed\n")
-                return nil, nil, nil
-        }
-
-        // Debug
-        fmt.Printf("\nInitial proved statements %d\n", len(alreadyProved.Proved))
-        for i := 0; i < len(alreadyProved.Proved); i++ {
-                certlib.PrintVseClause(alreadyProved.Proved[i])
-                fmt.Println("")
-        }
-        fmt.Println("")
-
-        // evidenceType should be "full-vse-support", "platform-attestation-only" or
-        //      "oe-evidence" or "sev-platform-attestation-only"
-        if evidenceType == "full-vse-support" {
-        } else if evidenceType == "platform-attestation-only" {
-                if !AddNewFactsForAbbreviatedPlatformAttestation(publicPolicyKey, alreadyProved) {
-                        fmt.Printf("AddNewFactsForAbbreviatedPlatformAttestation failed\n")
-                        return nil, nil, nil
-                }
-        } else if evidenceType == "sev-evidence" {
-                if !AddNewFactsForSevEvidence(publicPolicyKey, alreadyProved) {
-                        fmt.Printf("AddNewFactsForSevAttestation failed\n")
-                        return nil, nil, nil
-                }
-        } else if evidenceType == "augmented-platform-attestation-only" {
-                if !AddNewFactsForAugmentedPlatformAttestation(publicPolicyKey, alreadyProved) {
-                        fmt.Printf("AddNewFactsForAugmentedPlatformAttestation failed\n")
-                        return nil, nil, nil
+        if *grpcPort != "" {
+                grpcSock, err := listen(*serverHost + ":" + *grpcPort)
+                if err != nil {
+                        logger.Error("grpc listen error", "err", err)
+                        return
                 }
-        } else if evidenceType == "oe-evidence" {
-                if !AddNewFactsForOePlatformAttestation(publicPolicyKey, alreadyProved) {
-                        fmt.Printf("AddNewFactsForOePlatformAttestation failed\n")
-                        return nil, nil, nil
+                opts := []grpc.ServerOption{
+                        grpc.ConnectionTimeout(*idleTimeout),
+                        grpc.KeepaliveParams(keepalive.ServerParameters{
+                                MaxConnectionIdle: *idleTimeout,
+                        }),
                 }
-        } else if evidenceType == "sev-platform-attestation-only" {
-                if !AddNewFactsForSevEvidence(publicPolicyKey, alreadyProved) {
-                        fmt.Printf("AddNewFactsForSevEvidence failed\n")
-                        return nil, nil, nil
+                if !*plaintext {
+                        opts = append(opts, grpc.Creds(credentials.NewTLS(serviceTlsConfig)))
                 }
-        } else {
-                fmt.Printf("Invalid Evidence type: %s\n", evidenceType)
-                return nil, nil, nil
+                grpcService = grpc.NewServer(opts...)
+                certifierService.RegisterTrustService(grpcService)
+                go grpcServer(grpcSock)
         }
-
-        // Debug
-        fmt.Printf("Augmented proved statements %d\n", len(alreadyProved.Proved))
-        for i := 0; i < len(alreadyProved.Proved); i++ {
-                certlib.PrintVseClause(alreadyProved.Proved[i])
-                fmt.Println("")
-        }
-
-        if evidenceType == "full-vse-support" || evidenceType == "platform-attestation-only" {
-                toProve, proof = ConstructProofFromFullVseEvidence(publicPolicyKey, purpose, *alreadyProved)
-                if toProve == nil {
-                        fmt.Printf("ConstructProofFromFullVseEvidence failed\n")
-                        return nil, nil, nil
-                }
-        } else if evidenceType == "augmented-platform-attestation-only" {
-                toProve, proof = ConstructProofFromShortVseEvidence(publicPolicyKey, purpose, *alreadyProved)
-                if toProve == nil {
-                        fmt.Printf("ConstructProofFromFullVseEvidence failed\n")
-                        return nil, nil, nil
-                }
-        } else if evidenceType == "sev-platform-attestation-only" {
-                toProve, proof = ConstructProofFromSevEvidence(publicPolicyKey, purpose, *alreadyProved)
-                if toProve == nil {
-                        fmt.Printf("ConstructProofFromSevEvidence failed\n")
-                        return nil, nil, nil
+        if *httpPort != "" {
+                httpSock, err := listen(*serverHost + ":" + *httpPort)
+                if err != nil {
+                        logger.Error("http listen error", "err", err)
+                        return
                 }
-        } else if evidenceType == "oe-evidence" {
-                toProve, proof = ConstructProofFromOeEvidence(publicPolicyKey, purpose, *alreadyProved)
-                if toProve == nil {
-                        fmt.Printf("ConstructProofFromOeEvidence failed\n")
-                        return nil, nil, nil
+                httpService = &http.Server{
+                        Handler: certifierService.HttpHandler(),
+                        ConnContext: certifierService.ConnContext,
+                        TLSConfig: serviceTlsConfig,
+                        ReadHeaderTimeout: *idleTimeout,
+                        ReadTimeout: *idleTimeout,
+                        WriteTimeout: *requestTimeout,
+                        IdleTimeout: *idleTimeout,
                 }
-        } else {
-                return nil, nil, nil
-        }
-
-        // Debug
-        if toProve != nil {
-                fmt.Printf("To prove: ")
-                certlib.PrintVseClause(toProve)
-        }
-        fmt.Printf("\n\nProof:\n")
-        for i := 0; i < len(proof.Steps); i++ {
-                certlib.PrintProofStep("    ", proof.Steps[i])
-        }
-        fmt.Println()
-        fmt.Println()
-
-        return toProve, proof, alreadyProved
-}
-
-func getAppMeasurementFromProvedStatements(appKeyEntity *certprotos.EntityMessage,
-                alreadyProved *certprotos.ProvedStatements) []byte {
-
-        for i := 0; i < len(alreadyProved.Proved); i++ {
-                if certlib.SameEntity(alreadyProved.Proved[i].GetSubject(), appKeyEntity) {
-                        if alreadyProved.Proved[i].GetVerb() == "speaks-for" {
-                                if alreadyProved.Proved[i].Object != nil &&
-                                        alreadyProved.Proved[i].Object.GetEntityType() == "measurement" {
-                                        return alreadyProved.Proved[i].Object.Measurement
-                                }
-                        }
-                }
-        }
-        return nil
-}
-
-func logRequest(b []byte) *string {
-        if b == nil {
-                return nil
-        }
-        s := strconv.Itoa(dataPacketFileNum)
-        dataPacketFileNum = dataPacketFileNum + 1
-        fileName := *logDir + "/" + "SSReq" + "-" + s
-        if ioutil.WriteFile(fileName, b, 0666)  != nil {
-                fmt.Printf("Can't write %s\n", fileName)
-                return nil
-        }
-        return &fileName
-}
-
-func logResponse(b []byte) *string {
-        if b == nil {
-                return nil
-        }
-        s := strconv.Itoa(dataPacketFileNum)
-        dataPacketFileNum = dataPacketFileNum + 1
-        fileName := *logDir + "/" + "SSRsp" + "-" + s
-        if ioutil.WriteFile(fileName, b, 0666)  != nil {
-                fmt.Printf("Can't write %s\n", fileName)
-                return nil
-        }
-        return &fileName
-}
-
-// Todo: Consider logging the proof and IP address too.
-func logEvent(msg string, req []byte, resp []byte) {
-        if !logging {
-                return
-        }
-        reqName := logRequest(req)
-        respName := logResponse(resp)
-        logger.Printf("%s, ", msg)
-        if reqName != nil {
-                logger.Printf("%s ,", reqName)
-        } else {
-                logger.Printf("No request,")
-        }
-        if respName != nil {
-                logger.Printf("%s\n", respName)
-        } else {
-                logger.Printf("No response\n")
-        }
-}
-
-// Procedure is:
-//      read a message
-//      evaluate the trust assertion
-//      if it succeeds,
-//            sign a cert
-//            save the proof, action and cert info in the transaction files
-//            save net infor for forensics
-//      if it fails
-//            save net infor for forensics
-//      if logging is enabled, log event, request and response
-func serviceThread(conn net.Conn, client string) {
-
-	b := certlib.SizedSocketRead(conn)
-	if b == nil {
-                logEvent("Can't read request", nil, nil)
-                return
-	}
-
-        request:= &certprotos.TrustRequestMessage{}
-        err := proto.Unmarshal(b, request)
-        if err != nil {
-                fmt.Println("serviceThread: Failed to decode request", err)
-                logEvent("Can't unmarshal request", nil, nil)
-                return
+                go httpServer(httpSock)
         }
 
-        // Debug
-        fmt.Printf("serviceThread: Trust request received:\n")
-        certlib.PrintTrustRequest(request)
-
-        // Prepare response
-        succeeded := "succeeded"
-        failed := "failed"
-
-        response := certprotos.TrustResponseMessage{}
-        response.RequestingEnclaveTag = request.RequestingEnclaveTag
-        response.ProvidingEnclaveTag = request.ProvidingEnclaveTag
-        response.Status = &failed
-
-        // Construct the proof
-        var purpose string
-        if  request.Purpose == nil {
-                purpose =  "authentication"
-        } else {
-                purpose =  *request.Purpose
-        }
-        toProve, proof, alreadyProved := ConstructProofFromRequest(
-                        request.GetSubmittedEvidenceType(), request.GetSupport(),
-                        purpose)
-        if toProve == nil || proof == nil || alreadyProved == nil {
-                // Debug
-                fmt.Printf("Constructing Proof fails\n")
-                logEvent("Can't construct proof from request", b, nil)
-
-                // Debug
-                fmt.Printf("Sending response\n")
-                certlib.PrintTrustReponse(&response)
-
-                // send response
-                rb, err := proto.Marshal(&response)
+        if *adminPort != "" {
+                adminSock, err := net.Listen("tcp", *adminHost + ":" + *adminPort)
                 if err != nil {
-                        logEvent("Couldn't marshall request", b, nil)
+                        logger.Error("admin listen error", "err", err)
                         return
                 }
-		if !certlib.SizedSocketWrite(conn, rb) {
-                        fmt.Printf("SizedSocketWrite failed\n")
+                if addr, ok := adminSock.Addr().(*net.TCPAddr); *adminTokenFile == "" && (!ok || !addr.IP.IsLoopback()) {
+                        adminSock.Close()
+                        logger.Error("admin endpoints not on loopback need --adminTokenFile", "addr",
+                                adminSock.Addr().String())
                         return
-		}
-                if response.Status != nil && *response.Status == "succeeded" {
-                        logEvent("Successful request", b, rb)
-                } else {
-                        logEvent("Failed Request", b, rb)
                 }
-                        return
-        } else {
-                // Debug
-                fmt.Printf("Constructing Proof succeeded\n")
-        }
-        appKeyEntity := toProve.GetSubject()
-
-        // Debug
-        if toProve != nil {
-                fmt.Printf("To prove: ")
-                certlib.PrintVseClause(toProve)
-                fmt.Printf("\n")
+                adminService = &http.Server{
+                        Handler: certifierService.AdminHandler(*policyFile),
+                        TLSConfig: serviceTlsConfig,
+                        ReadHeaderTimeout: *idleTimeout,
+                }
+                go adminServer(adminSock)
         }
-
-        // Verify proof and send response
-        var appOrgName string = "anonymous"
-        if  toProve.Subject.Key != nil && toProve.Subject.Key.KeyName != nil {
-                appOrgName = *toProve.Subject.Key.KeyName
+        go reloadOnHangup()
+        if *policyPollInterval > 0 {
+                go certifierService.WatchPolicyFile(context.Background(), *policyFile,
+                        *policyPollInterval, reportReload)
         }
 
-        // Debug
-        fmt.Printf("Verifying proof %d steps\n", len(proof.Steps))
-
-        // Check proof
-        if proof == nil {
-                response.Status = &failed
-        } else if certlib.VerifyProof(publicPolicyKey, toProve, proof, alreadyProved) {
-                fmt.Printf("Proof verified\n")
-                // Produce Artifact
-                if toProve.Subject == nil && toProve.Subject.Key == nil &&
-                                toProve.Subject.Key.KeyName == nil {
-                        fmt.Printf("toProve check failed\n")
-                        certlib.PrintVseClause(toProve)
-                        fmt.Println()
-                        response.Status = &failed
-                } else {
-                        if purpose == "attestation" {
-                                sr := certlib.ProducePlatformRule(&privatePolicyKey, policyCert,
-                                        toProve.Subject.Key, duration)
-                                if sr == nil {
-                                        response.Status = &succeeded
-                                } else {
-                                        response.Status = &succeeded
-                                        response.Artifact = sr
-                                }
-                        } else {
-                                // find statement appKey speaks-for measurement in alreadyProved and reset appOrgName
-                                m := getAppMeasurementFromProvedStatements(appKeyEntity,  alreadyProved)
-                                if m != nil {
-                                        appOrgName = "Measured-" + hex.EncodeToString(m)
-                                }
-                                sn = sn + 1
-                                org := "CertifierUsers"
-                                cert := certlib.ProduceAdmissionCert(&privatePolicyKey, policyCert,
-                                        toProve.Subject.Key, org,
-                                        appOrgName, sn, duration)
-                                if cert == nil {
-                                        fmt.Printf("certlib.ProduceAdmissionCert returned nil\n")
-                                        response.Status = &failed
-                                } else {
-                                        response.Status = &succeeded
-                                        response.Artifact = cert.Raw
-                                }
-                        }
-                }
+        // Listen for clients.
+        if *plaintext {
+                logger.Warn("Listening, TLS is disabled", "addr", serverAddr)
+                sock, err = listen(serverAddr)
         } else {
-                fmt.Printf("Verifying proof failed\n")
-                response.Status = &failed
+                logger.Info("Listening (TLS)", "addr", serverAddr)
+                sock, err = listen(serverAddr)
+                if err == nil {
+                        sock = tls.NewListener(sock, serviceTlsConfig)
+                }
         }
-
-        // Debug
-        fmt.Printf("Sending response\n")
-        certlib.PrintTrustReponse(&response)
-
-        // send response
-        rb, err := proto.Marshal(&response)
         if err != nil {
-                logEvent("Couldn't marshall request", b, nil)
+                logger.Error("listen error", "err", err)
                 return
         }
-	if !certlib.SizedSocketWrite(conn, rb) {
-                fmt.Printf("SizedSocketWrite failed (2)\n")
-                return
-	}
-        if response.Status != nil && *response.Status == "succeeded" {
-                logEvent("Successful request", b, rb)
-        } else {
-                logEvent("Failed Request", b, rb)
-        }
-        return
-}
-
-
-func server(serverAddr string, arg string) {
-
-        if initCertifierService() != true {
-                fmt.Println("Server: failed to initialize server")
-                os.Exit(1)
-        }
-
-        var sock net.Listener
-        var err error
-        var conn net.Conn
 
-        // Listen for clients.
-        fmt.Printf("simpleserver: Listening\n")
-        sock, err = net.Listen("tcp", serverAddr)
-        if err != nil {
-                fmt.Printf("simpleserver, listen error: ", err, "\n")
-                return
-        }
+        done := make(chan bool, 1)
+        go shutdown(done)
 
         // Service client connections.
-        for {
-                fmt.Printf("server: at accept\n")
-                conn, err = sock.Accept()
-                if err != nil {
-                        fmt.Printf("simpleserver: can't accept connection: %s\n", err.Error())
-                        continue
-                }
-                // Todo: maybe get client name and client IP for logging.
-                var clientName string = "blah"
-                go serviceThread(conn, clientName)
+        err = certifierService.Serve(sock)
+        if err == certservice.ErrShuttingDown {
+                <-done
+        } else if err != nil {
+                logger.Error("Serve error", "err", err)
         }
 }
 
 func main() {
 
         flag.Parse()
+        if !initLog() {
+                os.Exit(1)
+        }
 
         var serverAddr string
         serverAddr = *serverHost + ":" + *serverPort
         var arg string = "something"
 
-        // later this may turn into a TLS connection, we'll see
         server(serverAddr, arg)
-        fmt.Printf("simpleserver: done\n")
+        logger.Info("Done")
 }
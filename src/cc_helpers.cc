@@ -716,6 +716,47 @@ bool cc_trust_data::GetPlatformSaysAttestClaim(signed_claim_message* scm) {
   return false;
 }
 
+// Ask the Certifier Service for a nonce to put in the attestation
+// user data.  Services that don't issue nonces fail the request;
+// then there is no nonce and the evidence is sent without one.
+static bool get_certifier_nonce(const string& host_name, int port, string* nonce) {
+  trust_request_message request;
+  trust_response_message response;
+
+  request.set_requesting_enclave_tag("requesting-enclave");
+  request.set_providing_enclave_tag("providing-enclave");
+  request.mutable_nonce_request();
+  string serialized_request;
+  if (!request.SerializeToString(&serialized_request)) {
+    return false;
+  }
+
+  int sock = -1;
+  if (!open_client_socket(host_name, port, &sock)) {
+    return false;
+  }
+  if (sized_socket_write(sock, serialized_request.size(), (byte*)serialized_request.data()) <
+        (int)serialized_request.size()) {
+    close(sock);
+    return false;
+  }
+  string serialized_response;
+  int resp_size = sized_socket_read(sock, &serialized_response);
+  close(sock);
+  if (resp_size < 0) {
+    return false;
+  }
+  if (!response.ParseFromString(serialized_response)) {
+    return false;
+  }
+  if (response.status() != "succeeded" || !response.has_nonce() ||
+        !response.nonce().has_nonce()) {
+    return false;
+  }
+  nonce->assign(response.nonce().nonce());
+  return true;
+}
+
 bool cc_trust_data::certify_me(const string& host_name, int port) {
 
   if (!cc_all_initialized()) {
@@ -814,6 +855,12 @@ bool cc_trust_data::certify_me(const string& host_name, int port) {
     printf("cc_trust_data::certify_me: neither attestation or authorization\n");
     return false;
   }
+  string nonce;
+  if (get_certifier_nonce(host_name, port, &nonce)) {
+    ud.set_nonce(nonce);
+  } else {
+    printf("cc_trust_data::certify_me: no nonce from the certifier service, continuing without one\n");
+  }
   string serialized_ud;
   if (!ud.SerializeToString(&serialized_ud)) {
     printf("cc_trust_data::certify_me: Can't serialize user data\n");
@@ -989,6 +989,17 @@ void print_trust_response_message(trust_response_message& m) {
     print_bytes((int)m.artifact().size(), (byte*)m.artifact().data());
     printf("\n");
   }
+  if (m.has_error_code()) {
+    printf("Error code             :  %s\n", trust_error_code_Name(m.error_code()).c_str());
+  }
+  if (m.has_error_detail()) {
+    printf("Error detail           :  %s\n", m.error_detail().c_str());
+  }
+  if (m.has_nonce()) {
+    printf("Nonce                  : ");
+    print_bytes((int)m.nonce().nonce().size(), (byte*)m.nonce().nonce().data());
+    printf(", use by %s\n", m.nonce().not_after().c_str());
+  }
 }
 
 void print_proof_step(const proof_step& ps) {